@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"github.com/0226zy/myredis/pkg/config"
+	"github.com/0226zy/myredis/pkg/constant"
 	"github.com/0226zy/myredis/pkg/log"
 	"github.com/0226zy/myredis/pkg/server"
 )
@@ -21,10 +22,11 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Usage: ./redis-server [path]/to/redis.conf\n")
 		os.Exit(1)
 	} else {
-		fmt.Printf("Warning: no config file specified,using the default config. In order to specify a config file use 'redis-server /path/to/redis.con'")
+		fmt.Printf("Warning: no config file specified,using the default config. In order to specify a config file use 'redis-server /path/to/redis.con'\n")
+		redisConfig = config.Unmarshal(nil)
 	}
 
-	version := "0.0.1"
+	version := constant.REDIS_VERSION
 	fmt.Printf("Server started,Myredis versin %s\n", version)
 	log.RedisLog(log.REDIS_NOTICE, "Server started, Myredis version %s", version)
 	//TODO: daemonize
@@ -49,6 +49,7 @@ type RedisConfig struct {
 	// save ht db on disk
 	Saves          []SaveConf `conf:"save"`
 	RDBCompression bool       `conf:"rdbcompression"`
+	RDBVersion     int        `conf:"rdb-version"`
 	DBFileName     string     `conf:"dbfilename"`
 	Dir            string     `conf:"dir"`
 
@@ -57,15 +58,21 @@ type RedisConfig struct {
 	MasterAuth string `conf:"masterauth"`
 
 	// security
-	RequirePass string `conf:"foobared"`
+	RequirePass         string `conf:"requirepass"`
+	EnableAdminCommands string `conf:"enable-admin-commands"`
 
 	// limits
-	MaxClients int   `conf:"maxclients"`
-	MaxMemory  int64 `conf:"maxmemory"`
+	MaxClients      int    `conf:"maxclients"`
+	MaxMemory       int64  `conf:"maxmemory"`
+	MaxMemoryPolicy string `conf:"maxmemory-policy"`
+	LfuLogFactor    int    `conf:"lfu-log-factor"`
+	LfuDecayTime    int    `conf:"lfu-decay-time"`
 
 	// append only mode
-	AppendOnly bool   `conf:"appendonly"`
-	AppendSync string `conf:"appendfsync"`
+	AppendOnly       bool   `conf:"appendonly"`
+	AppendFilename   string `conf:"appendfilename"`
+	AppendSync       string `conf:"appendfsync"`
+	AofLoadTruncated bool   `conf:"aof-load-truncated"`
 	// virtual memory
 
 	VmEnabled    bool   `conf:"vm-enabled"`
@@ -76,13 +83,20 @@ type RedisConfig struct {
 	VmMaxThreads int    `conf:"vm-max-threads"`
 
 	// advanced config
-	GlueOutPutBuf        bool `conf:"glueoutputbuf"`
-	ShareObjects         bool `conf:"shareobjects"`
-	ShareObjectsPoolSize int  `conf:"shareobjectspoolsize"`
-	HashMaxZipMapEntries int  `conf:"hash-max-zipmap-entries"`
-	HashMaxZipMapValue   int  `conf:"hash-max-zipmap-value"`
-	interconf            string
-	DBNum                int
+	GlueOutPutBuf         bool `conf:"glueoutputbuf"`
+	ShareObjects          bool `conf:"shareobjects"`
+	ShareObjectsPoolSize  int  `conf:"shareobjectspoolsize"`
+	HashMaxZipMapEntries  int  `conf:"hash-max-zipmap-entries"`
+	HashMaxZipMapValue    int  `conf:"hash-max-zipmap-value"`
+	ListMaxZipListEntries int  `conf:"list-max-ziplist-entries"`
+	ListMaxZipListValue   int  `conf:"list-max-ziplist-value"`
+	SetMaxIntsetEntries   int  `conf:"set-max-intset-entries"`
+	ZsetMaxZipListEntries int  `conf:"zset-max-ziplist-entries"`
+	ZsetMaxZipListValue   int  `conf:"zset-max-ziplist-value"`
+	HllSparseMaxBytes     int  `conf:"hll-sparse-max-bytes"`
+	ActiveRehashing       bool `conf:"activerehashing"`
+	interconf             string
+	DBNum                 int
 }
 
 // SaveConf 触发备份的配置
@@ -96,6 +110,32 @@ func newRedisConfig() *RedisConfig {
 	return &RedisConfig{
 		DBNum: constant.REDIS_DEFAULT_DBNUM,
 		Bind:  "127.0.0.1",
+		Port:  constant.REDIS_SERVERPORT,
+
+		HashMaxZipMapEntries:  constant.REDIS_HASH_MAX_ZIPMAP_ENTRIES,
+		HashMaxZipMapValue:    constant.REDIS_HASH_MAX_ZIPMAP_VALUE,
+		ListMaxZipListEntries: constant.REDIS_LIST_MAX_ZIPLIST_ENTRIES,
+		ListMaxZipListValue:   constant.REDIS_LIST_MAX_ZIPLIST_VALUE,
+		SetMaxIntsetEntries:   constant.REDIS_SET_MAX_INTSET_ENTRIES,
+		ZsetMaxZipListEntries: constant.REDIS_ZSET_MAX_ZIPLIST_ENTRIES,
+		ZsetMaxZipListValue:   constant.REDIS_ZSET_MAX_ZIPLIST_VALUE,
+		HllSparseMaxBytes:     constant.REDIS_HLL_SPARSE_MAX_BYTES,
+		ActiveRehashing:       true,
+
+		RDBCompression: true,
+		RDBVersion:     constant.REDIS_DEFAULT_RDB_VERSION,
+		DBFileName:     constant.REDIS_DEFAULT_DBFILENAME,
+		Dir:            "./",
+
+		EnableAdminCommands: constant.ADMIN_COMMANDS_YES,
+
+		AppendFilename:   constant.REDIS_DEFAULT_AOF_FILENAME,
+		AppendSync:       constant.AOF_FSYNC_EVERYSEC,
+		AofLoadTruncated: true,
+
+		MaxMemoryPolicy: constant.REDIS_DEFAULT_MAXMEMORY_POLICY,
+		LfuLogFactor:    constant.REDIS_LFU_LOG_FACTOR,
+		LfuDecayTime:    constant.REDIS_LFU_DECAY_TIME,
 	}
 }
 
@@ -161,6 +201,40 @@ func Unmarshal(data []byte) *RedisConfig {
 			loaderr(lineNum, line, err)
 		}
 
+		if parts[0] == "databases" {
+			if redisConfig.DataBases < 1 {
+				loaderr(lineNum, line, errors.New("Invalid number of databases"))
+			}
+			redisConfig.DBNum = redisConfig.DataBases
+		}
+		if parts[0] == "rdb-version" {
+			if redisConfig.RDBVersion < constant.REDIS_RDB_MIN_SAVE_VERSION || redisConfig.RDBVersion > constant.REDIS_RDB_VERSION {
+				loaderr(lineNum, line, fmt.Errorf("rdb-version must be between %d and %d",
+					constant.REDIS_RDB_MIN_SAVE_VERSION, constant.REDIS_RDB_VERSION))
+			}
+		}
+		if parts[0] == "enable-admin-commands" {
+			switch redisConfig.EnableAdminCommands {
+			case constant.ADMIN_COMMANDS_YES, constant.ADMIN_COMMANDS_LOCAL, constant.ADMIN_COMMANDS_NO:
+			default:
+				loaderr(lineNum, line, errors.New("argument must be 'yes', 'local' or 'no'"))
+			}
+		}
+		if parts[0] == "appendfsync" {
+			switch redisConfig.AppendSync {
+			case constant.AOF_FSYNC_NO, constant.AOF_FSYNC_ALWAYS, constant.AOF_FSYNC_EVERYSEC:
+			default:
+				loaderr(lineNum, line, errors.New("argument must be 'no', 'always' or 'everysec'"))
+			}
+		}
+		if parts[0] == "maxmemory-policy" {
+			switch redisConfig.MaxMemoryPolicy {
+			case "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+				"allkeys-lru", "allkeys-lfu", "allkeys-random", "noeviction":
+			default:
+				loaderr(lineNum, line, errors.New("Invalid maxmemory policy"))
+			}
+		}
 	}
 	return redisConfig
 }
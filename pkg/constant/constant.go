@@ -1,5 +1,8 @@
 package constant
 
+// REDIS_VERSION version of the server, also stored in the RDB files
+const REDIS_VERSION string = "0.0.1"
+
 const REDIS_DEFAULT_DBNUM int = 16
 const REDIS_SERVERPORT int = 6379
 
@@ -15,6 +18,217 @@ const REDIS_CONFIGLINE_MAX int = 1024
 const REDIS_OBJFREELIST_MAX int = 1000000
 const REDIS_MAX_SYNC_TIME int = 60
 
+// REDIS_INLINE_MAX_SIZE max size of inline reads
+const REDIS_INLINE_MAX_SIZE int = 1024 * 64
+
+// REDIS_MULTIBULK_MAX_LEN max number of arguments in a multibulk request
+const REDIS_MULTIBULK_MAX_LEN int64 = 1024 * 1024
+
+// REDIS_PROTO_MAX_BULK_LEN max size of a single bulk argument
+const REDIS_PROTO_MAX_BULK_LEN int64 = 512 * 1024 * 1024
+
+// object types
+const REDIS_STRING int = 0
+const REDIS_LIST int = 1
+const REDIS_SET int = 2
+const REDIS_ZSET int = 3
+const REDIS_HASH int = 4
+const REDIS_STREAM int = 6
+
+// object encodings, some kind of objects like strings and hashes can be
+// internally represented in multiple ways
+const REDIS_ENCODING_RAW int = 0        // raw representation
+const REDIS_ENCODING_INT int = 1        // encoded as integer
+const REDIS_ENCODING_HT int = 2         // encoded as hash table
+const REDIS_ENCODING_ZIPMAP int = 3     // encoded as zipmap
+const REDIS_ENCODING_LINKEDLIST int = 4 // encoded as regular linked list
+const REDIS_ENCODING_ZIPLIST int = 5    // encoded as ziplist
+const REDIS_ENCODING_INTSET int = 6     // encoded as intset
+const REDIS_ENCODING_SKIPLIST int = 7   // encoded as skiplist
+const REDIS_ENCODING_EMBSTR int = 8     // embedded sds string encoding
+const REDIS_ENCODING_QUICKLIST int = 9  // encoded as linked list of listpacks
+const REDIS_ENCODING_STREAM int = 10    // encoded as a stream
+const REDIS_ENCODING_LISTPACK int = 11  // encoded as a listpack
+
+// hash encoding defaults: hashes are stored as a zipmap until one of
+// these limits is exceeded
+const REDIS_HASH_MAX_ZIPMAP_ENTRIES int = 64
+const REDIS_HASH_MAX_ZIPMAP_VALUE int = 512
+
+// REDIS_SET_MAX_INTSET_ENTRIES sets of integers are stored as an intset
+// up to this number of members
+const REDIS_SET_MAX_INTSET_ENTRIES int = 512
+
+// list encoding defaults: lists are stored as a single listpack until one
+// of these limits is exceeded
+const REDIS_LIST_MAX_ZIPLIST_ENTRIES int = 128
+const REDIS_LIST_MAX_ZIPLIST_VALUE int = 64
+
+// sorted set encoding defaults: sorted sets are stored as a single
+// listpack until one of these limits is exceeded
+const REDIS_ZSET_MAX_ZIPLIST_ENTRIES int = 128
+const REDIS_ZSET_MAX_ZIPLIST_VALUE int = 64
+
+// REDIS_HLL_SPARSE_MAX_BYTES sparse HyperLogLogs bigger than this are
+// converted to the dense representation
+const REDIS_HLL_SPARSE_MAX_BYTES int = 3000
+
+// REDIS_DEFAULT_MAXMEMORY_POLICY the keys to evict when maxmemory is reached
+const REDIS_DEFAULT_MAXMEMORY_POLICY string = "noeviction"
+
+// LFU defaults: the access frequency counter of a key grows
+// logarithmically with the accesses and is decremented by one every
+// decay time minutes the key is not accessed
+const REDIS_LFU_LOG_FACTOR int = 10
+const REDIS_LFU_DECAY_TIME int = 1
+
+// REDIS_LFU_INIT_VAL counter of new keys, so they are not evicted before
+// they have a chance to accumulate accesses
+const REDIS_LFU_INIT_VAL uint8 = 5
+
+// REDIS_SHARED_INTEGERS integers in [0, REDIS_SHARED_INTEGERS) are shared objects
+const REDIS_SHARED_INTEGERS int64 = 10000
+
+// REDIS_SHARED_REFCOUNT refcount of shared objects, they are never modified in place
+const REDIS_SHARED_REFCOUNT int = 1<<31 - 1
+
+// command flags
+const REDIS_CMD_WRITE int = 1 << 0   // the command may modify the dataset
+const REDIS_CMD_DENYOOM int = 1 << 1 // the command may increase memory usage
+const REDIS_CMD_ADMIN int = 1 << 2   // administrative command, see enable-admin-commands
+const REDIS_CMD_NOAUTH int = 1 << 3  // the command can run before AUTH
+
+// enable-admin-commands values
+const (
+	ADMIN_COMMANDS_YES   string = "yes"   // accepted from every client
+	ADMIN_COMMANDS_LOCAL string = "local" // accepted from the loopback and unix socket clients
+	ADMIN_COMMANDS_NO    string = "no"    // refused
+)
+
+// client flags
+const REDIS_BLOCKED int = 1 << 5           // the client is waiting in a blocking operation
+const REDIS_CLOSE_AFTER_REPLY int = 1 << 7 // close after writing entire reply
+const REDIS_PREVENT_PROP int = 1 << 8      // the command propagated its effects itself
+
+// REDIS_MAX_WRITE_PER_EVENT max bytes written to one client per writable event,
+// so a slow reader with a big reply can't starve the other clients
+const REDIS_MAX_WRITE_PER_EVENT int = 1024 * 64
+
+// REDIS_REPLY_CHUNK_BYTES with glueoutputbuf small replies are coalesced
+// into chunks up to this size
+const REDIS_REPLY_CHUNK_BYTES int = 16 * 1024
+
+// client request types
+const REDIS_REQ_INLINE int = 1
+const REDIS_REQ_MULTIBULK int = 2
+
+// REDIS_DEFAULT_HZ serverCron calls per second
+const REDIS_DEFAULT_HZ int = 10
+
+// active expire
+const ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP int = 20 // keys for each DB loop
+const ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC int = 25   // CPU max % for keys collection
+
+// CRON_DBS_PER_CALL max number of dbs shrunk or rehashed per cron call
+const CRON_DBS_PER_CALL int = 16
+
+// REDIS_HT_MINFILL dicts filled less than this percentage are shrunk
+const REDIS_HT_MINFILL int = 10
+
+// RDB persistence
+const REDIS_DEFAULT_DBFILENAME string = "dump.rdb"
+
+// REDIS_RDB_VERSION the most recent RDB version, the files up to this
+// version can be loaded
+const REDIS_RDB_VERSION int = 11
+
+// REDIS_RDB_MIN_SAVE_VERSION the oldest version rdb-version can select,
+// the first with the IDLE and FREQ opcodes and the streams
+const REDIS_RDB_MIN_SAVE_VERSION int = 9
+
+// REDIS_DEFAULT_RDB_VERSION version of the RDB files written by default,
+// the one of Redis 7.0 that refuses the version 11 files
+const REDIS_DEFAULT_RDB_VERSION int = 10
+
+// REDIS_BGSAVE_RETRY_DELAY seconds to wait before retrying a failed BGSAVE
+const REDIS_BGSAVE_RETRY_DELAY int64 = 5
+
+// AOF persistence
+const REDIS_DEFAULT_AOF_FILENAME string = "appendonly.aof"
+
+// appendfsync policies
+const (
+	AOF_FSYNC_NO       string = "no"       // let the OS flush the data
+	AOF_FSYNC_ALWAYS   string = "always"   // fsync before replying to the clients
+	AOF_FSYNC_EVERYSEC string = "everysec" // fsync once per second in the background
+)
+
+// REDIS_AOF_MAX_POSTPONE seconds a write to the AOF can be delayed while
+// the background fsync is in progress
+const REDIS_AOF_MAX_POSTPONE int64 = 2
+
+// REDIS_AOF_BUF_REUSE_SIZE the AOF buffer is reused after a write unless
+// its capacity grew over this size
+const REDIS_AOF_BUF_REUSE_SIZE int = 4000
+
+// RDB lengths are encoded in the two most significant bits of the first
+// byte: 00 six bits, 01 fourteen bits, 10 a 32 or 64 bit big endian
+// length follows, 11 the object is a string in a special encoding
+const REDIS_RDB_6BITLEN byte = 0
+const REDIS_RDB_14BITLEN byte = 1
+const REDIS_RDB_32BITLEN byte = 0x80
+const REDIS_RDB_64BITLEN byte = 0x81
+const REDIS_RDB_ENCVAL byte = 3
+
+// special string encodings, in the six bits following REDIS_RDB_ENCVAL
+const REDIS_RDB_ENC_INT8 int = 0  // 8 bit signed integer
+const REDIS_RDB_ENC_INT16 int = 1 // 16 bit signed integer
+const REDIS_RDB_ENC_INT32 int = 2 // 32 bit signed integer
+const REDIS_RDB_ENC_LZF int = 3   // string compressed with LZF
+
+// RDB object types
+const REDIS_RDB_TYPE_STRING byte = 0
+const REDIS_RDB_TYPE_LIST byte = 1
+const REDIS_RDB_TYPE_SET byte = 2
+const REDIS_RDB_TYPE_ZSET byte = 3
+const REDIS_RDB_TYPE_HASH byte = 4
+const REDIS_RDB_TYPE_ZSET_2 byte = 5 // zset with binary scores
+const REDIS_RDB_TYPE_MODULE_PRE_GA byte = 6
+const REDIS_RDB_TYPE_MODULE_2 byte = 7
+
+// RDB object types of the compact encodings, the value is saved as a
+// single string holding the serialized structure
+const REDIS_RDB_TYPE_HASH_ZIPMAP byte = 9
+const REDIS_RDB_TYPE_LIST_ZIPLIST byte = 10
+const REDIS_RDB_TYPE_SET_INTSET byte = 11
+const REDIS_RDB_TYPE_ZSET_ZIPLIST byte = 12
+const REDIS_RDB_TYPE_HASH_ZIPLIST byte = 13
+const REDIS_RDB_TYPE_LIST_QUICKLIST byte = 14
+const REDIS_RDB_TYPE_STREAM_LISTPACKS byte = 15
+const REDIS_RDB_TYPE_HASH_LISTPACK byte = 16
+const REDIS_RDB_TYPE_ZSET_LISTPACK byte = 17
+const REDIS_RDB_TYPE_LIST_QUICKLIST_2 byte = 18
+const REDIS_RDB_TYPE_STREAM_LISTPACKS_2 byte = 19
+const REDIS_RDB_TYPE_SET_LISTPACK byte = 20
+const REDIS_RDB_TYPE_STREAM_LISTPACKS_3 byte = 21
+
+// containers of the nodes of REDIS_RDB_TYPE_LIST_QUICKLIST_2
+const REDIS_QUICKLIST_NODE_CONTAINER_PLAIN uint64 = 1  // a single big element
+const REDIS_QUICKLIST_NODE_CONTAINER_PACKED uint64 = 2 // a listpack
+
+// RDB opcodes, they share the byte of the object types
+const REDIS_RDB_OPCODE_FUNCTION2 byte = 245       // function library
+const REDIS_RDB_OPCODE_FUNCTION_PRE_GA byte = 246 // old function library
+const REDIS_RDB_OPCODE_MODULE_AUX byte = 247      // module auxiliary data
+const REDIS_RDB_OPCODE_IDLE byte = 248            // LRU idle time
+const REDIS_RDB_OPCODE_FREQ byte = 249            // LFU frequency
+const REDIS_RDB_OPCODE_AUX byte = 250             // RDB aux field
+const REDIS_RDB_OPCODE_RESIZEDB byte = 251        // hash table resize hint
+const REDIS_RDB_OPCODE_EXPIRETIME_MS byte = 252   // expire time in milliseconds
+const REDIS_RDB_OPCODE_EXPIRETIME byte = 253      // old expire time in seconds
+const REDIS_RDB_OPCODE_SELECTDB byte = 254        // DB number of the following keys
+const REDIS_RDB_OPCODE_EOF byte = 255             // end of the RDB file
+
 // event
 const AE_SETSIZE int = 1024 * 10
 
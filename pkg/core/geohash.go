@@ -0,0 +1,426 @@
+package core
+
+import "math"
+
+// Geohashes interleave the bits of the latitude (even bits) and of the
+// longitude (odd bits), each one being the position of the coordinate in
+// its range at a given precision (the step). With the maximum step of 26
+// a hash takes 52 bits, so it is stored exactly as a sorted set score and
+// close points have close scores.
+
+// the limits of EPSG:900913 / EPSG:3785 / OSGEO:41001
+const (
+	GEO_LAT_MIN  float64 = -85.05112878
+	GEO_LAT_MAX  float64 = 85.05112878
+	GEO_LONG_MIN float64 = -180
+	GEO_LONG_MAX float64 = 180
+)
+
+// GEO_STEP_MAX 26*2 = 52 bits
+const GEO_STEP_MAX uint8 = 26
+
+const (
+	degToRad            = 0.017453292519943295769236907684886
+	earthRadiusInMeters = 6372797.560856
+	mercatorMax         = 20037726.37
+)
+
+// GeoHashRange the range of a coordinate
+type GeoHashRange struct {
+	Min, Max float64
+}
+
+// GeoHashBits a geohash of 2*Step bits
+type GeoHashBits struct {
+	Bits uint64
+	Step uint8
+}
+
+// IsZero true for the empty hash marking an excluded neighbor
+func (hash GeoHashBits) IsZero() bool {
+	return hash.Bits == 0 && hash.Step == 0
+}
+
+// Align52Bits the hash shifted to 52 bits, the sorted set score
+func (hash GeoHashBits) Align52Bits() uint64 {
+	return hash.Bits << (52 - uint(hash.Step)*2)
+}
+
+// GeoHashArea the box a hash stands for
+type GeoHashArea struct {
+	Hash      GeoHashBits
+	Longitude GeoHashRange
+	Latitude  GeoHashRange
+}
+
+// GeoHashNeighbors the eight boxes around a hash
+type GeoHashNeighbors struct {
+	North, East, West, South                   GeoHashBits
+	NorthEast, SouthEast, NorthWest, SouthWest GeoHashBits
+}
+
+// GeoHashRadius the box of the center of a search and its neighbors
+type GeoHashRadius struct {
+	Hash      GeoHashBits
+	Area      GeoHashArea
+	Neighbors GeoHashNeighbors
+}
+
+// WGS84 coordinate ranges used to index the points
+var geoLongRange = GeoHashRange{Min: GEO_LONG_MIN, Max: GEO_LONG_MAX}
+var geoLatRange = GeoHashRange{Min: GEO_LAT_MIN, Max: GEO_LAT_MAX}
+
+// interleave64 interleave the lower 32 bits of x and y, the bits of x
+// go in the even positions and the bits of y in the odd ones
+func interleave64(xlo, ylo uint32) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F,
+		0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	S := [...]uint{1, 2, 4, 8, 16}
+	x, y := uint64(xlo), uint64(ylo)
+
+	x = (x | (x << S[4])) & B[4]
+	y = (y | (y << S[4])) & B[4]
+	x = (x | (x << S[3])) & B[3]
+	y = (y | (y << S[3])) & B[3]
+	x = (x | (x << S[2])) & B[2]
+	y = (y | (y << S[2])) & B[2]
+	x = (x | (x << S[1])) & B[1]
+	y = (y | (y << S[1])) & B[1]
+	x = (x | (x << S[0])) & B[0]
+	y = (y | (y << S[0])) & B[0]
+	return x | (y << 1)
+}
+
+// deinterleave64 reverse interleave64: the even bits go to the lower 32
+// bits of the result, the odd bits to the upper 32 bits
+func deinterleave64(interleaved uint64) uint64 {
+	B := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F,
+		0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	S := [...]uint{0, 1, 2, 4, 8, 16}
+	x := interleaved
+	y := interleaved >> 1
+
+	x = (x | (x >> S[0])) & B[0]
+	y = (y | (y >> S[0])) & B[0]
+	x = (x | (x >> S[1])) & B[1]
+	y = (y | (y >> S[1])) & B[1]
+	x = (x | (x >> S[2])) & B[2]
+	y = (y | (y >> S[2])) & B[2]
+	x = (x | (x >> S[3])) & B[3]
+	y = (y | (y >> S[3])) & B[3]
+	x = (x | (x >> S[4])) & B[4]
+	y = (y | (y >> S[4])) & B[4]
+	x = (x | (x >> S[5])) & B[5]
+	y = (y | (y >> S[5])) & B[5]
+	return x | (y << 32)
+}
+
+// GeohashEncode encode a point with the given ranges and step, false when
+// the point is out of the ranges or of the indexable area
+func GeohashEncode(longRange, latRange GeoHashRange, longitude, latitude float64, step uint8) (GeoHashBits, bool) {
+	if step > 32 || step == 0 || latRange.Max-latRange.Min == 0 || longRange.Max-longRange.Min == 0 {
+		return GeoHashBits{}, false
+	}
+	if longitude > GEO_LONG_MAX || longitude < GEO_LONG_MIN ||
+		latitude > GEO_LAT_MAX || latitude < GEO_LAT_MIN {
+		return GeoHashBits{}, false
+	}
+	if latitude < latRange.Min || latitude > latRange.Max ||
+		longitude < longRange.Min || longitude > longRange.Max {
+		return GeoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.Min) / (latRange.Max - latRange.Min)
+	longOffset := (longitude - longRange.Min) / (longRange.Max - longRange.Min)
+	// convert to fixed point based on the step size
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return GeoHashBits{Bits: interleave64(uint32(latOffset), uint32(longOffset)), Step: step}, true
+}
+
+// GeohashEncodeWGS84 encode a point with the WGS84 ranges
+func GeohashEncodeWGS84(longitude, latitude float64, step uint8) (GeoHashBits, bool) {
+	return GeohashEncode(geoLongRange, geoLatRange, longitude, latitude, step)
+}
+
+// GeohashDecode return the box a hash stands for
+func GeohashDecode(longRange, latRange GeoHashRange, hash GeoHashBits) (GeoHashArea, bool) {
+	if hash.IsZero() || latRange.Max-latRange.Min == 0 || longRange.Max-longRange.Min == 0 {
+		return GeoHashArea{}, false
+	}
+	area := GeoHashArea{Hash: hash}
+	step := hash.Step
+	sep := deinterleave64(hash.Bits) // [LAT][LONG]
+	latScale := latRange.Max - latRange.Min
+	longScale := longRange.Max - longRange.Min
+	ilato := uint32(sep)
+	ilono := uint32(sep >> 32)
+	div := float64(uint64(1) << step)
+
+	area.Latitude.Min = latRange.Min + (float64(ilato)/div)*latScale
+	area.Latitude.Max = latRange.Min + ((float64(ilato)+1)/div)*latScale
+	area.Longitude.Min = longRange.Min + (float64(ilono)/div)*longScale
+	area.Longitude.Max = longRange.Min + ((float64(ilono)+1)/div)*longScale
+	return area, true
+}
+
+// GeohashDecodeWGS84 return the box of a hash encoded with the WGS84 ranges
+func GeohashDecodeWGS84(hash GeoHashBits) (GeoHashArea, bool) {
+	return GeohashDecode(geoLongRange, geoLatRange, hash)
+}
+
+// Center return the longitude and latitude of the center of the area
+func (area GeoHashArea) Center() (float64, float64) {
+	longitude := (area.Longitude.Min + area.Longitude.Max) / 2
+	longitude = math.Max(GEO_LONG_MIN, math.Min(GEO_LONG_MAX, longitude))
+	latitude := (area.Latitude.Min + area.Latitude.Max) / 2
+	latitude = math.Max(GEO_LAT_MIN, math.Min(GEO_LAT_MAX, latitude))
+	return longitude, latitude
+}
+
+// GeohashDecodeToLongLatWGS84 return the center of the box of a hash
+func GeohashDecodeToLongLatWGS84(hash GeoHashBits) (float64, float64, bool) {
+	area, ok := GeohashDecodeWGS84(hash)
+	if !ok {
+		return 0, 0, false
+	}
+	longitude, latitude := area.Center()
+	return longitude, latitude, true
+}
+
+// geohashMoveX move the hash one box east (d > 0) or west (d < 0)
+func geohashMoveX(hash *GeoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - uint(hash.Step)*2)
+	if d > 0 {
+		x = x + (zz + 1)
+	} else {
+		x = x | zz
+		x = x - (zz + 1)
+	}
+	x &= uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.Step)*2)
+	hash.Bits = x | y
+}
+
+// geohashMoveY move the hash one box north (d > 0) or south (d < 0)
+func geohashMoveY(hash *GeoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.Bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.Bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - uint(hash.Step)*2)
+	if d > 0 {
+		y = y + (zz + 1)
+	} else {
+		y = y | zz
+		y = y - (zz + 1)
+	}
+	y &= uint64(0x5555555555555555) >> (64 - uint(hash.Step)*2)
+	hash.Bits = x | y
+}
+
+// GeohashNeighbors return the eight boxes around hash
+func GeohashNeighbors(hash GeoHashBits) GeoHashNeighbors {
+	move := func(dx, dy int) GeoHashBits {
+		h := hash
+		geohashMoveX(&h, dx)
+		geohashMoveY(&h, dy)
+		return h
+	}
+	return GeoHashNeighbors{
+		East:      move(1, 0),
+		West:      move(-1, 0),
+		South:     move(0, -1),
+		North:     move(0, 1),
+		NorthWest: move(-1, 1),
+		SouthWest: move(-1, -1),
+		NorthEast: move(1, 1),
+		SouthEast: move(1, -1),
+	}
+}
+
+func degRad(ang float64) float64 { return ang * degToRad }
+func radDeg(ang float64) float64 { return ang / degToRad }
+
+// geohashEstimateStepsByRadius the step whose boxes are large enough to
+// cover a search of the given radius with the box of the center and its
+// neighbors
+func geohashEstimateStepsByRadius(rangeMeters, lat float64) uint8 {
+	if rangeMeters == 0 {
+		return 26
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	// make sure range is included in most of the base cases
+	step -= 2
+
+	// wider range towards the poles, an approximation good enough
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > 26 {
+		step = 26
+	}
+	return uint8(step)
+}
+
+// GeoShape the area of a search: a circle of Radius or a box of Width
+// and Height, in the unit given by Conversion (meters per unit), centered
+// on Longitude, Latitude
+type GeoShape struct {
+	Longitude, Latitude float64
+	IsBox               bool
+	Radius              float64
+	Width, Height       float64
+	Conversion          float64
+}
+
+// boundingBox return min longitude, min latitude, max longitude, max
+// latitude of the shape
+func (shape *GeoShape) boundingBox() [4]float64 {
+	longitude, latitude := shape.Longitude, shape.Latitude
+	height, width := shape.Radius, shape.Radius
+	if shape.IsBox {
+		height, width = shape.Height/2, shape.Width/2
+	}
+	height *= shape.Conversion
+	width *= shape.Conversion
+
+	latDelta := radDeg(height / earthRadiusInMeters)
+	longDeltaTop := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusInMeters / math.Cos(degRad(latitude-latDelta)))
+	// the directions of the northern and southern hemispheres are
+	// opposite, so different points are the min/max longitude
+	var bounds [4]float64
+	if latitude < 0 {
+		bounds[0] = longitude - longDeltaBottom
+		bounds[2] = longitude + longDeltaBottom
+	} else {
+		bounds[0] = longitude - longDeltaTop
+		bounds[2] = longitude + longDeltaTop
+	}
+	bounds[1] = latitude - latDelta
+	bounds[3] = latitude + latDelta
+	return bounds
+}
+
+// GeohashCalculateAreasByShapeWGS84 the box containing the center of the
+// shape and its neighbors, at a step such that together they cover the
+// shape. Neighbors out of the bounding box of the shape are zeroed.
+func GeohashCalculateAreasByShapeWGS84(shape *GeoShape) GeoHashRadius {
+	bounds := shape.boundingBox()
+	minLon, minLat, maxLon, maxLat := bounds[0], bounds[1], bounds[2], bounds[3]
+
+	longitude, latitude := shape.Longitude, shape.Latitude
+	// a box is covered by the circle through its corners
+	radiusMeters := shape.Radius
+	if shape.IsBox {
+		radiusMeters = math.Sqrt((shape.Width/2)*(shape.Width/2) + (shape.Height/2)*(shape.Height/2))
+	}
+	radiusMeters *= shape.Conversion
+
+	steps := geohashEstimateStepsByRadius(radiusMeters, latitude)
+	hash, _ := GeohashEncodeWGS84(longitude, latitude, steps)
+	neighbors := GeohashNeighbors(hash)
+	area, _ := GeohashDecodeWGS84(hash)
+
+	// near the edges of the covered area the estimated step may be too
+	// large: a neighbor box too close to the center can't cover the shape
+	decreaseStep := false
+	north, _ := GeohashDecodeWGS84(neighbors.North)
+	south, _ := GeohashDecodeWGS84(neighbors.South)
+	east, _ := GeohashDecodeWGS84(neighbors.East)
+	west, _ := GeohashDecodeWGS84(neighbors.West)
+	if north.Latitude.Max < maxLat || south.Latitude.Min > minLat ||
+		east.Longitude.Max < maxLon || west.Longitude.Min > minLon {
+		decreaseStep = true
+	}
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = GeohashEncodeWGS84(longitude, latitude, steps)
+		neighbors = GeohashNeighbors(hash)
+		area, _ = GeohashDecodeWGS84(hash)
+	}
+
+	// exclude the search areas that are useless
+	if steps >= 2 {
+		if area.Latitude.Min < minLat {
+			neighbors.South = GeoHashBits{}
+			neighbors.SouthWest = GeoHashBits{}
+			neighbors.SouthEast = GeoHashBits{}
+		}
+		if area.Latitude.Max > maxLat {
+			neighbors.North = GeoHashBits{}
+			neighbors.NorthEast = GeoHashBits{}
+			neighbors.NorthWest = GeoHashBits{}
+		}
+		if area.Longitude.Min < minLon {
+			neighbors.West = GeoHashBits{}
+			neighbors.SouthWest = GeoHashBits{}
+			neighbors.NorthWest = GeoHashBits{}
+		}
+		if area.Longitude.Max > maxLon {
+			neighbors.East = GeoHashBits{}
+			neighbors.SouthEast = GeoHashBits{}
+			neighbors.NorthEast = GeoHashBits{}
+		}
+	}
+	return GeoHashRadius{Hash: hash, Area: area, Neighbors: neighbors}
+}
+
+// geohashGetLatDistance the distance between two latitudes on the same
+// meridian, the haversine formula simplifies to the angle difference
+func geohashGetLatDistance(lat1d, lat2d float64) float64 {
+	return earthRadiusInMeters * math.Abs(degRad(lat2d)-degRad(lat1d))
+}
+
+// GeohashGetDistance the distance in meters between two points, using
+// the haversine great circle distance formula
+func GeohashGetDistance(lon1d, lat1d, lon2d, lat2d float64) float64 {
+	lon1r := degRad(lon1d)
+	lon2r := degRad(lon2d)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// same longitude, avoid the expensive math
+	if v == 0.0 {
+		return geohashGetLatDistance(lat1d, lat2d)
+	}
+	lat1r := degRad(lat1d)
+	lat2r := degRad(lat2d)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusInMeters * math.Asin(math.Sqrt(a))
+}
+
+// Contains return the distance in meters of the point from the center of
+// the shape, false when the point is out of the shape
+func (shape *GeoShape) Contains(longitude, latitude float64) (float64, bool) {
+	if !shape.IsBox {
+		distance := GeohashGetDistance(shape.Longitude, shape.Latitude, longitude, latitude)
+		return distance, distance <= shape.Radius*shape.Conversion
+	}
+	// the point is in the box when its distance from the center along the
+	// meridian and along the parallel are within the half sizes. The
+	// latitude distance is cheaper so it is checked first.
+	widthM, heightM := shape.Width*shape.Conversion, shape.Height*shape.Conversion
+	if geohashGetLatDistance(latitude, shape.Latitude) > heightM/2 {
+		return 0, false
+	}
+	if GeohashGetDistance(longitude, latitude, shape.Longitude, latitude) > widthM/2 {
+		return 0, false
+	}
+	return GeohashGetDistance(shape.Longitude, shape.Latitude, longitude, latitude), true
+}
@@ -0,0 +1,592 @@
+package core
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// HyperLogLog a cardinality estimator serialized in a single buffer, with
+// the same byte layout used by redis:
+//
+//	+------+---+-----+----------+
+//	| HYLL | E | N/U | Cardin.  |
+//	+------+---+-----+----------+
+//
+// "HYLL" is the magic, E the encoding (dense or sparse), N/U three unused
+// bytes and Cardin. the last computed cardinality as a 64 bit little
+// endian integer, whose most significant bit set means the cached value
+// is stale. The header is followed by the 16384 registers of 6 bits.
+//
+// The dense encoding packs the registers, least significant bits first.
+// The sparse encoding is a run length encoding made of three opcodes:
+//
+//	ZERO:  00xxxxxx          xxxxxx+1 (1-64) registers set to 0
+//	XZERO: 01xxxxxx yyyyyyyy xxxxxxyyyyyyyy+1 (1-16384) registers set to 0
+//	VAL:   1vvvvvxx          xx+1 (1-4) registers set to vvvvv+1 (1-32)
+//
+// Sparse HLLs are turned into dense ones when a register exceeds 32 or the
+// encoding grows too big.
+type HyperLogLog struct {
+	buf []byte
+}
+
+// HLL_P the greater is P, the smaller the error
+const HLL_P int = 14
+
+// HLL_Q the number of bits of the hash value used for determining the
+// number of leading zeros
+const HLL_Q int = 64 - HLL_P
+
+// HLL_REGISTERS number of registers, 16384
+const HLL_REGISTERS int = 1 << HLL_P
+
+// HLL_P_MASK mask to index register
+const HLL_P_MASK uint64 = uint64(HLL_REGISTERS - 1)
+
+// HLL_BITS enough to count up to 63 leading zeroes
+const HLL_BITS int = 6
+
+// HLL_REGISTER_MAX max value of a register
+const HLL_REGISTER_MAX int = (1 << HLL_BITS) - 1
+
+// HLL_HDR_SIZE size of the header
+const HLL_HDR_SIZE int = 16
+
+// HLL_DENSE_SIZE size of a dense HLL
+const HLL_DENSE_SIZE int = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8
+
+// HLL encodings
+const HLL_DENSE byte = 0
+const HLL_SPARSE byte = 1
+
+// HLL_SPARSE_VAL_MAX_VALUE max register value of the sparse encoding
+const HLL_SPARSE_VAL_MAX_VALUE int = 32
+
+const hllSparseValMaxLen = 4
+const hllSparseZeroMaxLen = 64
+const hllSparseXZeroMaxLen = 16384
+
+const hllAlphaInf = 0.721347520444481703680 // constant for 0.5/ln(2)
+
+// NewHyperLogLog create an empty HLL, with the sparse encoding
+func NewHyperLogLog() *HyperLogLog {
+	regs := make([]uint8, HLL_REGISTERS)
+	buf, _ := hllSparseEncode(regs)
+	return &HyperLogLog{buf: buf}
+}
+
+// NewHyperLogLogFromBytes wrap a serialized HLL, buf is not copied
+func NewHyperLogLogFromBytes(buf []byte) *HyperLogLog {
+	return &HyperLogLog{buf: buf}
+}
+
+// Bytes the serialized HLL, valid until the next modification
+func (h *HyperLogLog) Bytes() []byte {
+	return h.buf
+}
+
+// IsValid check the header of the HLL
+func (h *HyperLogLog) IsValid() bool {
+	if len(h.buf) < HLL_HDR_SIZE || string(h.buf[:4]) != "HYLL" {
+		return false
+	}
+	switch h.buf[4] {
+	case HLL_DENSE:
+		// dense representation must have the exact length
+		return len(h.buf) == HLL_DENSE_SIZE
+	case HLL_SPARSE:
+		return true
+	}
+	return false
+}
+
+// IsSparse check the encoding
+func (h *HyperLogLog) IsSparse() bool {
+	return h.buf[4] == HLL_SPARSE
+}
+
+// CachedCard the cached cardinality, false when stale
+func (h *HyperLogLog) CachedCard() (uint64, bool) {
+	if h.buf[15]&(1<<7) != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(h.buf[8:16]), true
+}
+
+// SetCachedCard store the cardinality in the header
+func (h *HyperLogLog) SetCachedCard(card uint64) {
+	binary.LittleEndian.PutUint64(h.buf[8:16], card)
+}
+
+// InvalidateCache mark the cached cardinality as stale
+func (h *HyperLogLog) InvalidateCache() {
+	h.buf[15] |= 1 << 7
+}
+
+// hllDenseGetRegister the register at regnum of a dense HLL
+func hllDenseGetRegister(regs []byte, regnum int) uint8 {
+	b := regnum * HLL_BITS / 8
+	fb := uint(regnum*HLL_BITS) & 7
+	fb8 := 8 - fb
+	b0 := uint(regs[b])
+	var b1 uint
+	if b+1 < len(regs) {
+		b1 = uint(regs[b+1])
+	}
+	return uint8((b0>>fb | b1<<fb8) & uint(HLL_REGISTER_MAX))
+}
+
+// hllDenseSetRegister set the register at regnum of a dense HLL
+func hllDenseSetRegister(regs []byte, regnum int, val uint8) {
+	b := regnum * HLL_BITS / 8
+	fb := uint(regnum*HLL_BITS) & 7
+	fb8 := 8 - fb
+	v := uint(val)
+	regs[b] &^= byte(uint(HLL_REGISTER_MAX) << fb)
+	regs[b] |= byte(v << fb)
+	if b+1 < len(regs) {
+		regs[b+1] &^= byte(uint(HLL_REGISTER_MAX) >> fb8)
+		regs[b+1] |= byte(v >> fb8)
+	}
+}
+
+// MurmurHash64A 64 bit version of MurmurHash2 by Austin Appleby, with the
+// little endian read used by redis on every platform
+func MurmurHash64A(key []byte, seed uint64) uint64 {
+	const m uint64 = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+
+	i := 0
+	for ; i+8 <= len(key); i += 8 {
+		k := binary.LittleEndian.Uint64(key[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	tail := key[i:]
+	switch len(tail) {
+	case 7:
+		h ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(tail[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// HllPatLen hash ele and return the register index and the length of the
+// pattern 000..1 of the hash, the value to store in the register
+func HllPatLen(ele []byte) (int, uint8) {
+	hash := MurmurHash64A(ele, 0xadc83b19)
+	index := int(hash & HLL_P_MASK)
+	// remove the bits used for the index, and set the bit HLL_Q so the
+	// loop terminates when the remaining bits are all zero
+	hash >>= uint(HLL_P)
+	hash |= uint64(1) << uint(HLL_Q)
+	bit := uint64(1)
+	count := uint8(1)
+	for hash&bit == 0 {
+		count++
+		bit <<= 1
+	}
+	return index, count
+}
+
+// Registers decode the registers, one byte per register. Return false
+// when the sparse encoding is corrupted.
+func (h *HyperLogLog) Registers() ([]uint8, bool) {
+	regs := make([]uint8, HLL_REGISTERS)
+	if !h.MergeInto(regs) {
+		return nil, false
+	}
+	return regs, true
+}
+
+// MergeInto set every register of max to the max between its value and
+// the one of the HLL. Return false when the sparse encoding is corrupted.
+func (h *HyperLogLog) MergeInto(max []uint8) bool {
+	if h.buf[4] == HLL_DENSE {
+		regs := h.buf[HLL_HDR_SIZE:]
+		for i := 0; i < HLL_REGISTERS; i++ {
+			if val := hllDenseGetRegister(regs, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return true
+	}
+
+	idx := 0
+	p := h.buf[HLL_HDR_SIZE:]
+	for i := 0; i < len(p); {
+		var runlen int
+		var val uint8
+		switch op := p[i]; {
+		case op&0xc0 == 0x00: // ZERO
+			runlen = int(op&0x3f) + 1
+			i++
+		case op&0xc0 == 0x40: // XZERO
+			if i+1 >= len(p) {
+				return false
+			}
+			runlen = (int(op&0x3f)<<8 | int(p[i+1])) + 1
+			i += 2
+		default: // VAL
+			runlen = int(op&0x3) + 1
+			val = (op>>2)&0x1f + 1
+			i++
+		}
+		if idx+runlen > HLL_REGISTERS {
+			return false
+		}
+		if val != 0 {
+			for j := idx; j < idx+runlen; j++ {
+				if val > max[j] {
+					max[j] = val
+				}
+			}
+		}
+		idx += runlen
+	}
+	return idx == HLL_REGISTERS
+}
+
+// Add add the elements, return true when at least one register changed.
+// A sparse HLL is converted to dense when a register exceeds the sparse
+// limit or its size would exceed sparseMaxBytes. Return false as second
+// value when the sparse encoding is corrupted.
+func (h *HyperLogLog) Add(elements [][]byte, sparseMaxBytes int) (bool, bool) {
+	updated := false
+	for _, ele := range elements {
+		index, count := HllPatLen(ele)
+		var changed bool
+		if h.buf[4] == HLL_DENSE {
+			changed = h.denseSet(index, count)
+		} else {
+			var ok bool
+			if changed, ok = h.sparseSet(index, count, sparseMaxBytes); !ok {
+				return false, false
+			}
+		}
+		updated = updated || changed
+	}
+	return updated, true
+}
+
+// denseSet set the register at index of a dense HLL to count if count is
+// greater than its current value
+func (h *HyperLogLog) denseSet(index int, count uint8) bool {
+	regs := h.buf[HLL_HDR_SIZE:]
+	if count > hllDenseGetRegister(regs, index) {
+		hllDenseSetRegister(regs, index, count)
+		return true
+	}
+	return false
+}
+
+// sparseSet set the register at index of a sparse HLL to count if count is
+// greater than its current value. The opcode covering the register is
+// replaced in place by at most three opcodes, only the bytes after it move:
+//
+//	ZERO/XZERO of n registers -> zeros before, VAL of count, zeros after
+//	VAL of n registers        -> VAL before, VAL of count, VAL after
+//
+// The HLL is promoted to dense when count exceeds the sparse limit or the
+// encoding would grow over sparseMaxBytes. Return false as second value
+// when the sparse encoding is corrupted.
+func (h *HyperLogLog) sparseSet(index int, count uint8, sparseMaxBytes int) (bool, bool) {
+	if int(count) > HLL_SPARSE_VAL_MAX_VALUE {
+		return h.promoteAndSet(index, count)
+	}
+
+	// find the opcode covering index: pos is its offset, first the first
+	// register it covers and prev the offset of the previous opcode
+	p := h.buf
+	pos, prev, first := HLL_HDR_SIZE, -1, 0
+	var oplen, runlen int
+	for {
+		if pos >= len(p) {
+			return false, false
+		}
+		op := p[pos]
+		oplen = 1
+		switch {
+		case op&0xc0 == 0x00: // ZERO
+			runlen = int(op&0x3f) + 1
+		case op&0xc0 == 0x40: // XZERO
+			if pos+1 >= len(p) {
+				return false, false
+			}
+			runlen = (int(op&0x3f)<<8 | int(p[pos+1])) + 1
+			oplen = 2
+		default: // VAL
+			runlen = int(op&0x3) + 1
+		}
+		if index < first+runlen {
+			break
+		}
+		prev = pos
+		pos += oplen
+		first += runlen
+	}
+	var oldval uint8
+	if op := p[pos]; op&0x80 != 0 {
+		oldval = (op>>2)&0x1f + 1
+		if oldval >= count {
+			return false, true
+		}
+		if runlen == 1 {
+			p[pos] = hllSparseVal(count, 1)
+			h.sparseMerge(prev)
+			return true, true
+		}
+	}
+
+	var seq [5]byte
+	n := 0
+	last := first + runlen - 1
+	if index > first {
+		n += hllSparseRun(seq[n:], oldval, index-first)
+	}
+	seq[n] = hllSparseVal(count, 1)
+	n++
+	if last > index {
+		n += hllSparseRun(seq[n:], oldval, last-index)
+	}
+
+	delta := n - oplen
+	if delta > 0 && len(p)+delta > sparseMaxBytes {
+		return h.promoteAndSet(index, count)
+	}
+	tail := len(p)
+	if delta > 0 {
+		// grow the buffer, the new bytes are overwritten below
+		p = append(p, seq[:delta]...)
+	}
+	copy(p[pos+n:], p[pos+oplen:tail])
+	p = p[:tail+delta]
+	copy(p[pos:], seq[:n])
+	h.buf = p
+	h.sparseMerge(prev)
+	return true, true
+}
+
+// promoteAndSet convert a sparse HLL to dense and set the register
+func (h *HyperLogLog) promoteAndSet(index int, count uint8) (bool, bool) {
+	regs, ok := h.Registers()
+	if !ok {
+		return false, false
+	}
+	buf := hllDenseEncode(regs)
+	copy(buf[5:HLL_HDR_SIZE], h.buf[5:HLL_HDR_SIZE])
+	h.buf = buf
+	return h.denseSet(index, count), true
+}
+
+// sparseMerge merge the adjacent VAL opcodes with the same value, among
+// the five opcodes from start, the ones a sparseSet may have touched. A
+// negative start is the first opcode.
+func (h *HyperLogLog) sparseMerge(start int) {
+	if start < 0 {
+		start = HLL_HDR_SIZE
+	}
+	p := h.buf
+	for i, scan := start, 5; i < len(p) && scan > 0; scan-- {
+		op := p[i]
+		if op&0xc0 == 0x40 { // XZERO
+			i += 2
+			continue
+		}
+		if op&0x80 == 0 { // ZERO
+			i++
+			continue
+		}
+		if i+1 < len(p) && p[i+1]&0x80 != 0 {
+			next := p[i+1]
+			len1, len2 := int(op&0x3)+1, int(next&0x3)+1
+			if op>>2 == next>>2 && len1+len2 <= hllSparseValMaxLen {
+				p[i] = op&^0x3 | byte(len1+len2-1)
+				copy(p[i+1:], p[i+2:])
+				p = p[:len(p)-1]
+				// the merged opcode may merge with the next one too
+				scan++
+				continue
+			}
+		}
+		i++
+	}
+	h.buf = p
+}
+
+// hllSparseVal the VAL opcode of runlen (1-4) registers set to val (1-32)
+func hllSparseVal(val uint8, runlen int) byte {
+	return 0x80 | (val-1)<<2 | byte(runlen-1)
+}
+
+// hllSparseRun write in buf the opcode of runlen registers set to val,
+// ZERO or XZERO when val is 0, runlen is at most 4 for VAL. Return the
+// number of bytes written.
+func hllSparseRun(buf []byte, val uint8, runlen int) int {
+	if val != 0 {
+		buf[0] = hllSparseVal(val, runlen)
+		return 1
+	}
+	if runlen > hllSparseZeroMaxLen {
+		buf[0] = 0x40 | byte((runlen-1)>>8)
+		buf[1] = byte(runlen - 1)
+		return 2
+	}
+	buf[0] = byte(runlen - 1)
+	return 1
+}
+
+// SetRegisters replace every register. Sparse HLLs stay sparse when the
+// registers fit the encoding and sparseMaxBytes, dense HLLs stay dense.
+// The cached cardinality is invalidated.
+func (h *HyperLogLog) SetRegisters(regs []uint8, sparseMaxBytes int) {
+	if h.buf[4] == HLL_SPARSE {
+		if buf, ok := hllSparseEncode(regs); ok && len(buf) <= sparseMaxBytes {
+			h.buf = buf
+			h.InvalidateCache()
+			return
+		}
+	}
+	h.buf = hllDenseEncode(regs)
+	h.InvalidateCache()
+}
+
+// hllDenseEncode encode the registers with the dense encoding
+func hllDenseEncode(regs []uint8) []byte {
+	buf := make([]byte, HLL_DENSE_SIZE)
+	copy(buf, "HYLL")
+	buf[4] = HLL_DENSE
+	for i, val := range regs {
+		hllDenseSetRegister(buf[HLL_HDR_SIZE:], i, val)
+	}
+	return buf
+}
+
+// hllSparseEncode encode the registers with the sparse encoding, return
+// false when a register is too big for it
+func hllSparseEncode(regs []uint8) ([]byte, bool) {
+	buf := make([]byte, HLL_HDR_SIZE, HLL_HDR_SIZE+64)
+	copy(buf, "HYLL")
+	buf[4] = HLL_SPARSE
+
+	for i := 0; i < len(regs); {
+		val := regs[i]
+		runlen := 1
+		for i+runlen < len(regs) && regs[i+runlen] == val {
+			runlen++
+		}
+		i += runlen
+
+		if val == 0 {
+			for runlen > 0 {
+				if runlen > hllSparseZeroMaxLen {
+					n := runlen
+					if n > hllSparseXZeroMaxLen {
+						n = hllSparseXZeroMaxLen
+					}
+					buf = append(buf, 0x40|byte((n-1)>>8), byte(n-1))
+					runlen -= n
+				} else {
+					buf = append(buf, byte(runlen-1))
+					runlen = 0
+				}
+			}
+			continue
+		}
+		if int(val) > HLL_SPARSE_VAL_MAX_VALUE {
+			return nil, false
+		}
+		for runlen > 0 {
+			n := runlen
+			if n > hllSparseValMaxLen {
+				n = hllSparseValMaxLen
+			}
+			buf = append(buf, hllSparseVal(val, n))
+			runlen -= n
+		}
+	}
+	return buf, true
+}
+
+// hllSigma helper function sigma as defined in "New cardinality
+// estimation algorithms for HyperLogLog sketches", Otmar Ertl
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+// hllTau helper function tau as defined in "New cardinality estimation
+// algorithms for HyperLogLog sketches", Otmar Ertl
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// HllCount estimate the cardinality from the registers, using the
+// improved estimator by Otmar Ertl
+func HllCount(regs []uint8) uint64 {
+	m := float64(HLL_REGISTERS)
+	var reghisto [64]int
+	for _, val := range regs {
+		reghisto[val]++
+	}
+
+	z := m * hllTau((m-float64(reghisto[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
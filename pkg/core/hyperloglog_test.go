@@ -0,0 +1,139 @@
+package core
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// checkSparse check every opcode of a sparse HLL is well formed, the runs
+// cover all the registers and no two adjacent VAL opcodes could be merged
+func checkSparse(t *testing.T, h *HyperLogLog) {
+	t.Helper()
+	p := h.Bytes()[HLL_HDR_SIZE:]
+	idx := 0
+	for i := 0; i < len(p); {
+		op := p[i]
+		switch {
+		case op&0xc0 == 0x00:
+			idx += int(op&0x3f) + 1
+			i++
+		case op&0xc0 == 0x40:
+			idx += (int(op&0x3f)<<8 | int(p[i+1])) + 1
+			i += 2
+		default:
+			if i+1 < len(p) && p[i+1]&0x80 != 0 && op>>2 == p[i+1]>>2 &&
+				int(op&0x3)+int(p[i+1]&0x3)+2 <= hllSparseValMaxLen {
+				t.Fatalf("mergeable VAL opcodes %#x %#x at %d", op, p[i+1], i)
+			}
+			idx += int(op&0x3) + 1
+			i++
+		}
+	}
+	if idx != HLL_REGISTERS {
+		t.Fatalf("sparse runs cover %d registers, want %d", idx, HLL_REGISTERS)
+	}
+}
+
+func TestHllSparseAdd(t *testing.T) {
+	const sparseMaxBytes = 3000
+	h := NewHyperLogLog()
+	want := make([]uint8, HLL_REGISTERS)
+	for i := 0; ; i++ {
+		ele := []byte("ele:" + strconv.Itoa(i))
+		index, count := HllPatLen(ele)
+		changed, ok := h.Add([][]byte{ele}, sparseMaxBytes)
+		if !ok {
+			t.Fatalf("Add(%q): corrupted", ele)
+		}
+		if wantChanged := count > want[index]; changed != wantChanged {
+			t.Fatalf("Add(%q) = %v, want %v", ele, changed, wantChanged)
+		}
+		if count > want[index] {
+			want[index] = count
+		}
+		if !h.IsSparse() {
+			break
+		}
+		checkSparse(t, h)
+		if len(h.Bytes()) > sparseMaxBytes {
+			t.Fatalf("sparse HLL of %d bytes, over %d", len(h.Bytes()), sparseMaxBytes)
+		}
+		if i%100 == 0 {
+			regs, _ := h.Registers()
+			if !bytes.Equal(regs, want) {
+				t.Fatalf("registers differ after %d elements", i+1)
+			}
+		}
+	}
+	if len(h.Bytes()) != HLL_DENSE_SIZE {
+		t.Fatalf("promoted HLL of %d bytes, want %d", len(h.Bytes()), HLL_DENSE_SIZE)
+	}
+	regs, _ := h.Registers()
+	if !bytes.Equal(regs, want) {
+		t.Fatalf("registers differ after the promotion")
+	}
+}
+
+func TestHllSparseSet(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	h := NewHyperLogLog()
+	want := make([]uint8, HLL_REGISTERS)
+	for i := 0; i < 2000; i++ {
+		// clustered registers to split and merge the runs of every opcode
+		index := rnd.Intn(64) * 256
+		if rnd.Intn(2) == 0 {
+			index += rnd.Intn(8)
+		} else {
+			index += rnd.Intn(256)
+		}
+		count := uint8(rnd.Intn(4) + 1)
+		changed, ok := h.sparseSet(index, count, 1<<20)
+		if !ok {
+			t.Fatalf("sparseSet(%d, %d): corrupted", index, count)
+		}
+		if changed != (count > want[index]) {
+			t.Fatalf("sparseSet(%d, %d) = %v with register %d", index, count, changed, want[index])
+		}
+		if changed {
+			want[index] = count
+		}
+		checkSparse(t, h)
+	}
+	regs, _ := h.Registers()
+	if !bytes.Equal(regs, want) {
+		t.Fatalf("registers differ")
+	}
+
+	// a value over the sparse limit promotes to dense
+	if changed, ok := h.sparseSet(5, uint8(HLL_SPARSE_VAL_MAX_VALUE+1), 1<<20); !changed || !ok || h.IsSparse() {
+		t.Fatalf("sparseSet over the sparse limit = %v, %v, sparse %v", changed, ok, h.IsSparse())
+	}
+	want[5] = uint8(HLL_SPARSE_VAL_MAX_VALUE + 1)
+	regs, _ = h.Registers()
+	if !bytes.Equal(regs, want) {
+		t.Fatalf("registers differ after the promotion")
+	}
+
+	// a corrupted encoding is reported
+	bad := NewHyperLogLog()
+	bad.buf = bad.buf[:HLL_HDR_SIZE+1]
+	if _, ok := bad.sparseSet(HLL_REGISTERS-1, 1, 1<<20); ok {
+		t.Fatalf("sparseSet on a truncated HLL succeeded")
+	}
+}
+
+func BenchmarkHllSparseAdd(b *testing.B) {
+	elements := make([][]byte, 1000)
+	for i := range elements {
+		elements[i] = []byte("ele:" + strconv.Itoa(i))
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h := NewHyperLogLog()
+		for _, ele := range elements {
+			h.Add([][]byte{ele}, 3000)
+		}
+	}
+}
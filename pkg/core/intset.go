@@ -0,0 +1,234 @@
+package core
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// Intset a sorted set of integers serialized in a single buffer, with the
+// same byte layout used by redis:
+//
+//	<encoding uint32><length uint32><contents>
+//
+// contents holds length little endian integers of encoding bytes each, in
+// ascending order and without duplicates. The encoding is the smallest of
+// 2, 4 or 8 bytes that can represent every member, adding a bigger value
+// upgrades the whole set.
+type Intset struct {
+	buf []byte
+}
+
+// intset encodings, the size in bytes of every member
+const INTSET_ENC_INT16 int = 2
+const INTSET_ENC_INT32 int = 4
+const INTSET_ENC_INT64 int = 8
+
+const intsetHdrSize = 8
+
+// NewIntset create an empty intset
+func NewIntset() *Intset {
+	is := &Intset{buf: make([]byte, intsetHdrSize)}
+	is.setEncoding(INTSET_ENC_INT16)
+	return is
+}
+
+// NewIntsetFromBytes wrap a serialized intset, buf is not copied
+func NewIntsetFromBytes(buf []byte) *Intset {
+	return &Intset{buf: buf}
+}
+
+// IntsetValidateIntegrity check that buf is a well formed intset: a known
+// encoding, a length matching the size of the buffer and members sorted
+// without duplicates
+func IntsetValidateIntegrity(buf []byte) bool {
+	if len(buf) < intsetHdrSize {
+		return false
+	}
+	is := NewIntsetFromBytes(buf)
+	enc := is.encoding()
+	if enc != INTSET_ENC_INT16 && enc != INTSET_ENC_INT32 && enc != INTSET_ENC_INT64 {
+		return false
+	}
+	n := uint64(binary.LittleEndian.Uint32(buf[4:8]))
+	if uint64(len(buf)) != uint64(intsetHdrSize)+n*uint64(enc) {
+		return false
+	}
+	for i := 1; i < int(n); i++ {
+		if is.Get(i-1) >= is.Get(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// Bytes the serialized intset, valid until the next modification
+func (is *Intset) Bytes() []byte {
+	return is.buf
+}
+
+// Dup duplicate the intset
+func (is *Intset) Dup() *Intset {
+	return &Intset{buf: append([]byte(nil), is.buf...)}
+}
+
+func (is *Intset) encoding() int {
+	return int(binary.LittleEndian.Uint32(is.buf[0:4]))
+}
+
+func (is *Intset) setEncoding(enc int) {
+	binary.LittleEndian.PutUint32(is.buf[0:4], uint32(enc))
+}
+
+// Len number of members
+func (is *Intset) Len() int {
+	return int(binary.LittleEndian.Uint32(is.buf[4:8]))
+}
+
+func (is *Intset) setLen(n int) {
+	binary.LittleEndian.PutUint32(is.buf[4:8], uint32(n))
+}
+
+// intsetValueEncoding the smallest encoding able to represent v
+func intsetValueEncoding(v int64) int {
+	if v < math.MinInt32 || v > math.MaxInt32 {
+		return INTSET_ENC_INT64
+	}
+	if v < math.MinInt16 || v > math.MaxInt16 {
+		return INTSET_ENC_INT32
+	}
+	return INTSET_ENC_INT16
+}
+
+// Get the member at pos, members are sorted in ascending order
+func (is *Intset) Get(pos int) int64 {
+	return is.getEncoded(pos, is.encoding())
+}
+
+func (is *Intset) getEncoded(pos int, enc int) int64 {
+	p := intsetHdrSize + pos*enc
+	switch enc {
+	case INTSET_ENC_INT64:
+		return int64(binary.LittleEndian.Uint64(is.buf[p:]))
+	case INTSET_ENC_INT32:
+		return int64(int32(binary.LittleEndian.Uint32(is.buf[p:])))
+	}
+	return int64(int16(binary.LittleEndian.Uint16(is.buf[p:])))
+}
+
+func (is *Intset) set(pos int, v int64) {
+	enc := is.encoding()
+	p := intsetHdrSize + pos*enc
+	switch enc {
+	case INTSET_ENC_INT64:
+		binary.LittleEndian.PutUint64(is.buf[p:], uint64(v))
+	case INTSET_ENC_INT32:
+		binary.LittleEndian.PutUint32(is.buf[p:], uint32(v))
+	default:
+		binary.LittleEndian.PutUint16(is.buf[p:], uint16(v))
+	}
+}
+
+// search binary search v, return its position or the position where it
+// should be inserted
+func (is *Intset) search(v int64) (int, bool) {
+	min, max := 0, is.Len()-1
+	if is.Len() == 0 {
+		return 0, false
+	}
+	// check for the case where we know we cannot find the value, but do
+	// know the insert position
+	if v > is.Get(max) {
+		return is.Len(), false
+	} else if v < is.Get(0) {
+		return 0, false
+	}
+	for max >= min {
+		mid := int(uint(min+max) >> 1)
+		cur := is.Get(mid)
+		if v > cur {
+			min = mid + 1
+		} else if v < cur {
+			max = mid - 1
+		} else {
+			return mid, true
+		}
+	}
+	return min, false
+}
+
+// Find check if v is a member
+func (is *Intset) Find(v int64) bool {
+	if intsetValueEncoding(v) > is.encoding() {
+		return false
+	}
+	_, found := is.search(v)
+	return found
+}
+
+// Add insert v, return false when it is already a member
+func (is *Intset) Add(v int64) bool {
+	enc := is.encoding()
+	if intsetValueEncoding(v) > enc {
+		// v is bigger or smaller than every member
+		is.upgradeAndAdd(v)
+		return true
+	}
+	pos, found := is.search(v)
+	if found {
+		return false
+	}
+	length := is.Len()
+	p := intsetHdrSize + pos*enc
+	buf := make([]byte, len(is.buf)+enc)
+	copy(buf, is.buf[:p])
+	copy(buf[p+enc:], is.buf[p:])
+	is.buf = buf
+	is.set(pos, v)
+	is.setLen(length + 1)
+	return true
+}
+
+// upgradeAndAdd upgrade the encoding to the one required by v and add it.
+// v needs a bigger encoding so it is either the new min or the new max.
+func (is *Intset) upgradeAndAdd(v int64) {
+	oldEnc := is.encoding()
+	newEnc := intsetValueEncoding(v)
+	length := is.Len()
+	prepend := 0
+	if v < 0 {
+		prepend = 1
+	}
+
+	old := is.buf
+	is.buf = make([]byte, intsetHdrSize+(length+1)*newEnc)
+	is.setEncoding(newEnc)
+	is.setLen(length + 1)
+	for i := length - 1; i >= 0; i-- {
+		is.set(i+prepend, (&Intset{buf: old}).getEncoded(i, oldEnc))
+	}
+	if prepend == 1 {
+		is.set(0, v)
+	} else {
+		is.set(length, v)
+	}
+}
+
+// Remove delete v, return false when it is not a member
+func (is *Intset) Remove(v int64) bool {
+	if intsetValueEncoding(v) > is.encoding() {
+		return false
+	}
+	pos, found := is.search(v)
+	if !found {
+		return false
+	}
+	enc := is.encoding()
+	p := intsetHdrSize + pos*enc
+	length := is.Len()
+	buf := make([]byte, len(is.buf)-enc)
+	copy(buf, is.buf[:p])
+	copy(buf[p:], is.buf[p+enc:])
+	is.buf = buf
+	is.setLen(length - 1)
+	return true
+}
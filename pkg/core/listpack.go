@@ -0,0 +1,492 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+)
+
+// Listpack a list of strings and integers serialized in a single contiguous
+// buffer, with the same byte layout used by redis:
+//
+//	<total-bytes uint32><num-elements uint16><entry>...<entry><0xFF>
+//
+// Every entry is <encoding><data><backlen>, where backlen is the length of
+// encoding+data stored so that the list can be walked from the tail.
+// Entries are addressed by their byte offset inside the buffer, offsets are
+// invalidated by any modification of the listpack.
+type Listpack struct {
+	buf []byte
+}
+
+// LP_HDR_SIZE size of the listpack header: total bytes + number of elements
+const LP_HDR_SIZE int = 6
+
+// LP_HDR_NUMELE_UNKNOWN the element count doesn't fit the header and must
+// be computed walking the whole listpack
+const LP_HDR_NUMELE_UNKNOWN int = 65535
+
+// LP_EOF terminator byte
+const LP_EOF byte = 0xFF
+
+// entry encodings
+const (
+	lpEncoding7BitUint     byte = 0x00
+	lpEncoding7BitUintMask byte = 0x80
+	lpEncoding6BitStr      byte = 0x80
+	lpEncoding6BitStrMask  byte = 0xC0
+	lpEncoding13BitInt     byte = 0xC0
+	lpEncoding13BitIntMask byte = 0xE0
+	lpEncoding12BitStr     byte = 0xE0
+	lpEncoding12BitStrMask byte = 0xF0
+	lpEncoding16BitInt     byte = 0xF1
+	lpEncoding24BitInt     byte = 0xF2
+	lpEncoding32BitInt     byte = 0xF3
+	lpEncoding64BitInt     byte = 0xF4
+	lpEncoding32BitStr     byte = 0xF0
+)
+
+// ListpackValidateIntegrity check that buf is a well formed listpack: the
+// header must match the size of the buffer and every entry must fit in it
+// with a consistent backlen. Listpacks coming from the outside, like the
+// ones of an RDB file, must be validated before being accessed.
+func ListpackValidateIntegrity(buf []byte) bool {
+	if len(buf) < LP_HDR_SIZE+1 || int(binary.LittleEndian.Uint32(buf)) != len(buf) ||
+		buf[len(buf)-1] != LP_EOF {
+		return false
+	}
+	end := len(buf) - 1
+	count := 0
+	for p := LP_HDR_SIZE; p < end; count++ {
+		// make sure the length of the entry can be read
+		b := buf[p]
+		lenbytes := 1
+		switch {
+		case b == lpEncoding32BitStr:
+			lenbytes = 5
+		case b&lpEncoding12BitStrMask == lpEncoding12BitStr:
+			lenbytes = 2
+		case b > lpEncoding64BitInt:
+			return false
+		}
+		if p+lenbytes > end {
+			return false
+		}
+		l := lpEncodedSize(buf, p)
+		backlen := lpEncodeBacklen(l)
+		if l > end-p-len(backlen) || !bytes.Equal(buf[p+l:p+l+len(backlen)], backlen) {
+			return false
+		}
+		p += l + len(backlen)
+	}
+	num := int(binary.LittleEndian.Uint16(buf[4:]))
+	return num == LP_HDR_NUMELE_UNKNOWN || num == count
+}
+
+// NewListpack create an empty listpack
+func NewListpack() *Listpack {
+	buf := make([]byte, LP_HDR_SIZE+1)
+	buf[LP_HDR_SIZE] = LP_EOF
+	lp := &Listpack{buf: buf}
+	lp.setTotalBytes(len(buf))
+	lp.setNumElements(0)
+	return lp
+}
+
+// NewListpackFromBytes wrap a serialized listpack, buf is not copied
+func NewListpackFromBytes(buf []byte) *Listpack {
+	return &Listpack{buf: buf}
+}
+
+// Bytes the serialized listpack, valid until the next modification
+func (lp *Listpack) Bytes() []byte {
+	return lp.buf
+}
+
+// Dup duplicate the listpack
+func (lp *Listpack) Dup() *Listpack {
+	return &Listpack{buf: append([]byte(nil), lp.buf...)}
+}
+
+// TotalBytes size of the serialized listpack
+func (lp *Listpack) TotalBytes() int {
+	return int(binary.LittleEndian.Uint32(lp.buf[0:4]))
+}
+
+func (lp *Listpack) setTotalBytes(n int) {
+	binary.LittleEndian.PutUint32(lp.buf[0:4], uint32(n))
+}
+
+func (lp *Listpack) numElements() int {
+	return int(binary.LittleEndian.Uint16(lp.buf[4:6]))
+}
+
+func (lp *Listpack) setNumElements(n int) {
+	binary.LittleEndian.PutUint16(lp.buf[4:6], uint16(n))
+}
+
+// Len number of elements. When the count doesn't fit the header it is
+// computed walking the listpack, and cached if it fits again.
+func (lp *Listpack) Len() int {
+	num := lp.numElements()
+	if num != LP_HDR_NUMELE_UNKNOWN {
+		return num
+	}
+	num = 0
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		num++
+	}
+	if num < LP_HDR_NUMELE_UNKNOWN {
+		lp.setNumElements(num)
+	}
+	return num
+}
+
+// First offset of the first element, -1 if the listpack is empty
+func (lp *Listpack) First() int {
+	if lp.buf[LP_HDR_SIZE] == LP_EOF {
+		return -1
+	}
+	return LP_HDR_SIZE
+}
+
+// Last offset of the last element, -1 if the listpack is empty
+func (lp *Listpack) Last() int {
+	return lp.Prev(len(lp.buf) - 1)
+}
+
+// Next offset of the element after p, -1 if p is the last one
+func (lp *Listpack) Next(p int) int {
+	q := p + lp.entrySize(p)
+	if lp.buf[q] == LP_EOF {
+		return -1
+	}
+	return q
+}
+
+// Prev offset of the element before p, -1 if p is the first one.
+// p can be the offset of the terminator.
+func (lp *Listpack) Prev(p int) int {
+	if p <= LP_HDR_SIZE {
+		return -1
+	}
+	encodedLen, backlenSize := lpDecodeBacklen(lp.buf, p-1)
+	return p - backlenSize - encodedLen
+}
+
+// Seek offset of the element at index, negative indexes count from the
+// tail (-1 is the last element). Return -1 when out of range.
+func (lp *Listpack) Seek(index int) int {
+	num := lp.Len()
+	if index < 0 {
+		index = num + index
+	}
+	if index < 0 || index >= num {
+		return -1
+	}
+	if index > num/2 {
+		// closer to the tail
+		p := lp.Last()
+		for i := num - 1; i > index; i-- {
+			p = lp.Prev(p)
+		}
+		return p
+	}
+	p := lp.First()
+	for i := 0; i < index; i++ {
+		p = lp.Next(p)
+	}
+	return p
+}
+
+// Get decode the element at p. Integer encoded elements return isInt true
+// and their value, string elements return a slice of the listpack buffer
+// that is valid until the next modification.
+func (lp *Listpack) Get(p int) (str []byte, value int64, isInt bool) {
+	buf := lp.buf
+	b := buf[p]
+	switch {
+	case b&lpEncoding7BitUintMask == lpEncoding7BitUint:
+		return nil, int64(b & 0x7F), true
+	case b&lpEncoding6BitStrMask == lpEncoding6BitStr:
+		l := int(b & 0x3F)
+		return buf[p+1 : p+1+l], 0, false
+	case b&lpEncoding13BitIntMask == lpEncoding13BitInt:
+		uv := uint64(b&0x1F)<<8 | uint64(buf[p+1])
+		return nil, lpSignExtend(uv, 13), true
+	case b&lpEncoding12BitStrMask == lpEncoding12BitStr:
+		l := int(b&0x0F)<<8 | int(buf[p+1])
+		return buf[p+2 : p+2+l], 0, false
+	case b == lpEncoding16BitInt:
+		uv := uint64(binary.LittleEndian.Uint16(buf[p+1:]))
+		return nil, lpSignExtend(uv, 16), true
+	case b == lpEncoding24BitInt:
+		uv := uint64(buf[p+1]) | uint64(buf[p+2])<<8 | uint64(buf[p+3])<<16
+		return nil, lpSignExtend(uv, 24), true
+	case b == lpEncoding32BitInt:
+		uv := uint64(binary.LittleEndian.Uint32(buf[p+1:]))
+		return nil, lpSignExtend(uv, 32), true
+	case b == lpEncoding64BitInt:
+		return nil, int64(binary.LittleEndian.Uint64(buf[p+1:])), true
+	case b == lpEncoding32BitStr:
+		l := int(binary.LittleEndian.Uint32(buf[p+1:]))
+		return buf[p+5 : p+5+l], 0, false
+	}
+	panic("listpack: invalid entry encoding")
+}
+
+// GetValue a copy of the element at p, integers are returned in their
+// decimal representation
+func (lp *Listpack) GetValue(p int) []byte {
+	str, value, isInt := lp.Get(p)
+	if isInt {
+		return strconv.AppendInt(nil, value, 10)
+	}
+	out := make([]byte, len(str))
+	copy(out, str)
+	return out
+}
+
+// Compare check if the element at p is equal to s
+func (lp *Listpack) Compare(p int, s []byte) bool {
+	str, value, isInt := lp.Get(p)
+	if !isInt {
+		return bytes.Equal(str, s)
+	}
+	if len(s) > 20 {
+		return false
+	}
+	v, ok := String2ll(s)
+	return ok && v == value
+}
+
+// Append add ele at the tail, return its offset
+func (lp *Listpack) Append(ele []byte) int {
+	return lp.insertAt(len(lp.buf)-1, lpEncodeEntry(ele))
+}
+
+// Prepend add ele at the head, return its offset
+func (lp *Listpack) Prepend(ele []byte) int {
+	return lp.insertAt(LP_HDR_SIZE, lpEncodeEntry(ele))
+}
+
+// Insert add ele before or after the element at p, return its offset
+func (lp *Listpack) Insert(ele []byte, p int, after bool) int {
+	if after {
+		p += lp.entrySize(p)
+	}
+	return lp.insertAt(p, lpEncodeEntry(ele))
+}
+
+// Replace overwrite the element at p with ele, return its offset
+// (always p)
+func (lp *Listpack) Replace(p int, ele []byte) int {
+	entry := lpEncodeEntry(ele)
+	oldSize := lp.entrySize(p)
+	buf := make([]byte, 0, len(lp.buf)-oldSize+len(entry))
+	buf = append(buf, lp.buf[:p]...)
+	buf = append(buf, entry...)
+	buf = append(buf, lp.buf[p+oldSize:]...)
+	lp.buf = buf
+	lp.setTotalBytes(len(buf))
+	return p
+}
+
+// Delete remove the element at p, return the offset of the element that
+// followed it (now at p) or -1 if p was the last one
+func (lp *Listpack) Delete(p int) int {
+	lp.deleteBytes(p, lp.entrySize(p), 1)
+	if lp.buf[p] == LP_EOF {
+		return -1
+	}
+	return p
+}
+
+// DeleteRange remove num elements starting at index
+func (lp *Listpack) DeleteRange(index, num int) {
+	p := lp.Seek(index)
+	if p == -1 || num <= 0 {
+		return
+	}
+	q := p
+	deleted := 0
+	for deleted < num && lp.buf[q] != LP_EOF {
+		q += lp.entrySize(q)
+		deleted++
+	}
+	lp.deleteBytes(p, q-p, deleted)
+}
+
+func (lp *Listpack) insertAt(p int, entry []byte) int {
+	buf := make([]byte, 0, len(lp.buf)+len(entry))
+	buf = append(buf, lp.buf[:p]...)
+	buf = append(buf, entry...)
+	buf = append(buf, lp.buf[p:]...)
+	lp.buf = buf
+	lp.setTotalBytes(len(buf))
+	if num := lp.numElements(); num != LP_HDR_NUMELE_UNKNOWN {
+		if num+1 < LP_HDR_NUMELE_UNKNOWN {
+			lp.setNumElements(num + 1)
+		} else {
+			lp.setNumElements(LP_HDR_NUMELE_UNKNOWN)
+		}
+	}
+	return p
+}
+
+func (lp *Listpack) deleteBytes(p, size, deleted int) {
+	buf := make([]byte, 0, len(lp.buf)-size)
+	buf = append(buf, lp.buf[:p]...)
+	buf = append(buf, lp.buf[p+size:]...)
+	lp.buf = buf
+	lp.setTotalBytes(len(buf))
+	if num := lp.numElements(); num != LP_HDR_NUMELE_UNKNOWN {
+		lp.setNumElements(num - deleted)
+	}
+}
+
+// entrySize total size of the entry at p, backlen included
+func (lp *Listpack) entrySize(p int) int {
+	l := lpEncodedSize(lp.buf, p)
+	return l + lpBacklenSize(l)
+}
+
+// lpEncodedSize size of encoding+data of the entry at p
+func lpEncodedSize(buf []byte, p int) int {
+	b := buf[p]
+	switch {
+	case b&lpEncoding7BitUintMask == lpEncoding7BitUint:
+		return 1
+	case b&lpEncoding6BitStrMask == lpEncoding6BitStr:
+		return 1 + int(b&0x3F)
+	case b&lpEncoding13BitIntMask == lpEncoding13BitInt:
+		return 2
+	case b&lpEncoding12BitStrMask == lpEncoding12BitStr:
+		return 2 + (int(b&0x0F)<<8 | int(buf[p+1]))
+	case b == lpEncoding16BitInt:
+		return 3
+	case b == lpEncoding24BitInt:
+		return 4
+	case b == lpEncoding32BitInt:
+		return 5
+	case b == lpEncoding64BitInt:
+		return 9
+	case b == lpEncoding32BitStr:
+		return 5 + int(binary.LittleEndian.Uint32(buf[p+1:]))
+	}
+	panic("listpack: invalid entry encoding")
+}
+
+// lpEncodeEntry serialize ele with its backlen. Strings that can be
+// represented as a 64 bit integer are stored with an integer encoding.
+func lpEncodeEntry(ele []byte) []byte {
+	var entry []byte
+	if v, ok := String2ll(ele); ok && len(ele) <= 20 {
+		entry = lpEncodeInt(v)
+	} else {
+		entry = lpEncodeString(ele)
+	}
+	return append(entry, lpEncodeBacklen(len(entry))...)
+}
+
+func lpEncodeInt(v int64) []byte {
+	switch {
+	case v >= 0 && v <= 127:
+		return []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		uv := uint64(v) & (1<<13 - 1)
+		return []byte{byte(uv>>8) | lpEncoding13BitInt, byte(uv)}
+	case v >= -32768 && v <= 32767:
+		uv := uint64(v)
+		return []byte{lpEncoding16BitInt, byte(uv), byte(uv >> 8)}
+	case v >= -8388608 && v <= 8388607:
+		uv := uint64(v)
+		return []byte{lpEncoding24BitInt, byte(uv), byte(uv >> 8), byte(uv >> 16)}
+	case v >= -2147483648 && v <= 2147483647:
+		buf := make([]byte, 5)
+		buf[0] = lpEncoding32BitInt
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		return buf
+	}
+	buf := make([]byte, 9)
+	buf[0] = lpEncoding64BitInt
+	binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+	return buf
+}
+
+func lpEncodeString(s []byte) []byte {
+	l := len(s)
+	var buf []byte
+	switch {
+	case l < 64:
+		buf = make([]byte, 0, 1+l)
+		buf = append(buf, lpEncoding6BitStr|byte(l))
+	case l < 4096:
+		buf = make([]byte, 0, 2+l)
+		buf = append(buf, lpEncoding12BitStr|byte(l>>8), byte(l))
+	default:
+		buf = make([]byte, 5, 5+l)
+		buf[0] = lpEncoding32BitStr
+		binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	}
+	return append(buf, s...)
+}
+
+// lpSignExtend interpret the low bits of uv as a two's complement integer
+func lpSignExtend(uv uint64, bits uint) int64 {
+	if uv >= 1<<(bits-1) {
+		return int64(uv) - int64(1)<<bits
+	}
+	return int64(uv)
+}
+
+// lpEncodeBacklen encode l using 7 bits per byte, the byte closest to the
+// next entry holds the least significant bits and every byte but the
+// first one has the high bit set
+func lpEncodeBacklen(l int) []byte {
+	switch {
+	case l <= 127:
+		return []byte{byte(l)}
+	case l < 16383:
+		return []byte{byte(l >> 7), byte(l&127) | 128}
+	case l < 2097151:
+		return []byte{byte(l >> 14), byte((l>>7)&127) | 128, byte(l&127) | 128}
+	case l < 268435455:
+		return []byte{byte(l >> 21), byte((l>>14)&127) | 128, byte((l>>7)&127) | 128, byte(l&127) | 128}
+	}
+	return []byte{byte(l >> 28), byte((l>>21)&127) | 128, byte((l>>14)&127) | 128,
+		byte((l>>7)&127) | 128, byte(l&127) | 128}
+}
+
+func lpBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// lpDecodeBacklen decode the backlen whose last byte is at q, return the
+// encoded length of the entry and the size of the backlen itself
+func lpDecodeBacklen(buf []byte, q int) (int, int) {
+	val := 0
+	shift := 0
+	n := 0
+	for {
+		b := buf[q]
+		val |= int(b&127) << shift
+		n++
+		if b&128 == 0 {
+			break
+		}
+		shift += 7
+		q--
+	}
+	return val, n
+}
@@ -0,0 +1,411 @@
+package core
+
+// QUICKLIST_HEAD / QUICKLIST_TAIL end of the list used by push, pop and
+// the direction of iterators (from head to tail or from tail to head)
+const QUICKLIST_HEAD int = 0
+const QUICKLIST_TAIL int = -1
+
+// quicklistNode a listpack holding a chunk of the list
+type quicklistNode struct {
+	prev *quicklistNode
+	next *quicklistNode
+	lp   *Listpack
+}
+
+// Quicklist a doubly linked list of listpacks. Every node holds at max
+// fill elements, so pushes and pops at both ends are cheap while the
+// memory overhead of a linked list is paid once per node and not once
+// per element.
+type Quicklist struct {
+	head  *quicklistNode
+	tail  *quicklistNode
+	count int // total number of elements in all the listpacks
+	len   int // number of nodes
+	fill  int // max number of elements per node
+}
+
+// QuicklistEntry an element returned by the iterator or by Index
+type QuicklistEntry struct {
+	node   *quicklistNode
+	offset int
+	Value  []byte // copy of the element
+}
+
+// QuicklistIter iterate the elements of a quicklist in a given direction
+type QuicklistIter struct {
+	ql        *Quicklist
+	current   *quicklistNode
+	offset    int // offset of the next element in current, -1 to start from the node edge
+	direction int
+}
+
+// NewQuicklist create an empty quicklist whose nodes hold at max fill
+// elements
+func NewQuicklist(fill int) *Quicklist {
+	if fill < 1 {
+		fill = 1
+	}
+	return &Quicklist{fill: fill}
+}
+
+// Count number of elements
+func (ql *Quicklist) Count() int {
+	return ql.count
+}
+
+// Len number of nodes
+func (ql *Quicklist) Len() int {
+	return ql.len
+}
+
+// Dup duplicate the quicklist, every node gets a copy of its listpack
+func (ql *Quicklist) Dup() *Quicklist {
+	dup := NewQuicklist(ql.fill)
+	for node := ql.head; node != nil; node = node.next {
+		dup.AppendListpack(node.lp.Dup())
+	}
+	return dup
+}
+
+// AppendListpack add lp as a new node at the tail, used when the list is
+// converted from a single listpack
+func (ql *Quicklist) AppendListpack(lp *Listpack) {
+	num := lp.Len()
+	if num == 0 {
+		return
+	}
+	ql.insertNode(&quicklistNode{lp: lp}, ql.tail, true)
+	ql.count += num
+}
+
+// Push add value at the head or at the tail
+func (ql *Quicklist) Push(value []byte, where int) {
+	if where == QUICKLIST_HEAD {
+		if ql.head != nil && ql.head.lp.Len() < ql.fill {
+			ql.head.lp.Prepend(value)
+		} else {
+			node := &quicklistNode{lp: NewListpack()}
+			node.lp.Prepend(value)
+			ql.insertNode(node, ql.head, false)
+		}
+	} else {
+		if ql.tail != nil && ql.tail.lp.Len() < ql.fill {
+			ql.tail.lp.Append(value)
+		} else {
+			node := &quicklistNode{lp: NewListpack()}
+			node.lp.Append(value)
+			ql.insertNode(node, ql.tail, true)
+		}
+	}
+	ql.count++
+}
+
+// Pop remove and return the element at the head or at the tail
+func (ql *Quicklist) Pop(where int) ([]byte, bool) {
+	node := ql.head
+	if where != QUICKLIST_HEAD {
+		node = ql.tail
+	}
+	if node == nil {
+		return nil, false
+	}
+	var p int
+	if where == QUICKLIST_HEAD {
+		p = node.lp.First()
+	} else {
+		p = node.lp.Last()
+	}
+	value := node.lp.GetValue(p)
+	ql.delIndex(node, p)
+	return value, true
+}
+
+// Index return the element at index, negative indexes count from the tail
+func (ql *Quicklist) Index(index int) (*QuicklistEntry, bool) {
+	node, offset := ql.seek(index)
+	if node == nil {
+		return nil, false
+	}
+	return &QuicklistEntry{node: node, offset: offset, Value: node.lp.GetValue(offset)}, true
+}
+
+// ReplaceAtIndex overwrite the element at index, return false when index
+// is out of range
+func (ql *Quicklist) ReplaceAtIndex(index int, value []byte) bool {
+	entry, ok := ql.Index(index)
+	if !ok {
+		return false
+	}
+	ql.ReplaceEntry(entry, value)
+	return true
+}
+
+// ReplaceEntry overwrite the element referenced by entry
+func (ql *Quicklist) ReplaceEntry(entry *QuicklistEntry, value []byte) {
+	entry.node.lp.Replace(entry.offset, value)
+}
+
+// InsertBefore add value before the element referenced by entry
+func (ql *Quicklist) InsertBefore(entry *QuicklistEntry, value []byte) {
+	ql.insert(entry, value, false)
+}
+
+// InsertAfter add value after the element referenced by entry
+func (ql *Quicklist) InsertAfter(entry *QuicklistEntry, value []byte) {
+	ql.insert(entry, value, true)
+}
+
+func (ql *Quicklist) insert(entry *QuicklistEntry, value []byte, after bool) {
+	node := entry.node
+	lp := node.lp
+	ql.count++
+	if lp.Len() < ql.fill {
+		lp.Insert(value, entry.offset, after)
+		return
+	}
+
+	// the node is full: use the neighbour when inserting at the node edge,
+	// otherwise split the node at the insertion point
+	atTail := after && lp.Next(entry.offset) == -1
+	atHead := !after && entry.offset == lp.First()
+	if atTail {
+		if node.next != nil && node.next.lp.Len() < ql.fill {
+			node.next.lp.Prepend(value)
+		} else {
+			n := &quicklistNode{lp: NewListpack()}
+			n.lp.Append(value)
+			ql.insertNode(n, node, true)
+		}
+		return
+	}
+	if atHead {
+		if node.prev != nil && node.prev.lp.Len() < ql.fill {
+			node.prev.lp.Append(value)
+		} else {
+			n := &quicklistNode{lp: NewListpack()}
+			n.lp.Append(value)
+			ql.insertNode(n, node, false)
+		}
+		return
+	}
+
+	// count the elements that stay in node
+	keep := 0
+	for p := lp.First(); p != entry.offset; p = lp.Next(p) {
+		keep++
+	}
+	if after {
+		keep++
+	}
+	ql.splitNode(node, keep)
+	node.lp.Append(value)
+}
+
+// splitNode move the elements of node from index keep on into a new node
+// inserted after it
+func (ql *Quicklist) splitNode(node *quicklistNode, keep int) {
+	n := &quicklistNode{lp: NewListpack()}
+	for p := node.lp.Seek(keep); p != -1; p = node.lp.Next(p) {
+		n.lp.Append(node.lp.GetValue(p))
+	}
+	node.lp.DeleteRange(keep, node.lp.Len()-keep)
+	ql.insertNode(n, node, true)
+}
+
+// DelRange remove count elements starting at index start, negative start
+// counts from the tail. Return the number of deleted elements.
+func (ql *Quicklist) DelRange(start, count int) int {
+	if start < 0 {
+		start = ql.count + start
+	}
+	if start < 0 || start >= ql.count || count <= 0 {
+		return 0
+	}
+	if count > ql.count-start {
+		count = ql.count - start
+	}
+
+	node := ql.head
+	for node != nil && start >= node.lp.Len() {
+		start -= node.lp.Len()
+		node = node.next
+	}
+
+	deleted := 0
+	for node != nil && deleted < count {
+		next := node.next
+		num := node.lp.Len()
+		del := num - start
+		if del > count-deleted {
+			del = count - deleted
+		}
+		if start == 0 && del == num {
+			ql.delNode(node)
+		} else {
+			node.lp.DeleteRange(start, del)
+		}
+		ql.count -= del
+		deleted += del
+		start = 0
+		node = next
+	}
+	return deleted
+}
+
+// GetIterator iterate the whole list starting from the head or the tail
+func (ql *Quicklist) GetIterator(direction int) *QuicklistIter {
+	it := &QuicklistIter{ql: ql, offset: -1, direction: direction}
+	if direction == QUICKLIST_HEAD {
+		it.current = ql.head
+	} else {
+		it.current = ql.tail
+	}
+	return it
+}
+
+// GetIteratorAtIdx iterate starting from the element at index, the
+// iterator is exhausted at once if index is out of range
+func (ql *Quicklist) GetIteratorAtIdx(direction int, index int) *QuicklistIter {
+	it := &QuicklistIter{ql: ql, offset: -1, direction: direction}
+	it.current, it.offset = ql.seek(index)
+	return it
+}
+
+// Next return the next element, false when the iteration is done
+func (it *QuicklistIter) Next() (*QuicklistEntry, bool) {
+	for it.current != nil {
+		lp := it.current.lp
+		if it.offset == -1 {
+			if it.direction == QUICKLIST_HEAD {
+				it.offset = lp.First()
+			} else {
+				it.offset = lp.Last()
+			}
+		}
+		entry := &QuicklistEntry{node: it.current, offset: it.offset, Value: lp.GetValue(it.offset)}
+		if it.direction == QUICKLIST_HEAD {
+			it.offset = lp.Next(it.offset)
+		} else {
+			it.offset = lp.Prev(it.offset)
+		}
+		if it.offset == -1 {
+			it.advanceNode()
+		}
+		return entry, true
+	}
+	return nil, false
+}
+
+func (it *QuicklistIter) advanceNode() {
+	if it.direction == QUICKLIST_HEAD {
+		it.current = it.current.next
+	} else {
+		it.current = it.current.prev
+	}
+	it.offset = -1
+}
+
+// DelEntry remove the element returned by the last call to it.Next, the
+// iterator stays valid and continues with the following element
+func (ql *Quicklist) DelEntry(it *QuicklistIter, entry *QuicklistEntry) {
+	node := entry.node
+	next := node.lp.Delete(entry.offset)
+	ql.count--
+	if node.lp.Len() == 0 {
+		if it.current == node {
+			it.advanceNode()
+		}
+		ql.delNode(node)
+		return
+	}
+	// iterating towards the tail the following element moved to the
+	// offset of the deleted one, towards the head nothing moved
+	if it.direction == QUICKLIST_HEAD && it.current == node {
+		it.offset = next
+		if next == -1 {
+			it.advanceNode()
+		}
+	}
+}
+
+// seek find the node and the offset of the element at index
+func (ql *Quicklist) seek(index int) (*quicklistNode, int) {
+	forward := index >= 0
+	if !forward {
+		index = -index - 1
+	}
+	if index >= ql.count {
+		return nil, -1
+	}
+	if forward {
+		for node := ql.head; node != nil; node = node.next {
+			if index < node.lp.Len() {
+				return node, node.lp.Seek(index)
+			}
+			index -= node.lp.Len()
+		}
+	} else {
+		for node := ql.tail; node != nil; node = node.prev {
+			if index < node.lp.Len() {
+				return node, node.lp.Seek(-index - 1)
+			}
+			index -= node.lp.Len()
+		}
+	}
+	return nil, -1
+}
+
+// delIndex remove the element at offset p of node, dropping the node when
+// it becomes empty
+func (ql *Quicklist) delIndex(node *quicklistNode, p int) {
+	node.lp.Delete(p)
+	ql.count--
+	if node.lp.Len() == 0 {
+		ql.delNode(node)
+	}
+}
+
+// insertNode link node after (or before) oldNode, oldNode nil means the
+// list is empty
+func (ql *Quicklist) insertNode(node, oldNode *quicklistNode, after bool) {
+	if oldNode == nil {
+		ql.head = node
+		ql.tail = node
+	} else if after {
+		node.prev = oldNode
+		node.next = oldNode.next
+		if oldNode.next != nil {
+			oldNode.next.prev = node
+		} else {
+			ql.tail = node
+		}
+		oldNode.next = node
+	} else {
+		node.next = oldNode
+		node.prev = oldNode.prev
+		if oldNode.prev != nil {
+			oldNode.prev.next = node
+		} else {
+			ql.head = node
+		}
+		oldNode.prev = node
+	}
+	ql.len++
+}
+
+// delNode unlink node, its elements must already be accounted in count
+func (ql *Quicklist) delNode(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	node.prev = nil
+	node.next = nil
+	ql.len--
+}
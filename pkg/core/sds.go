@@ -1,7 +1,446 @@
 package core
 
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// SDS_MAX_PREALLOC growing a string doubles its allocation until it reaches
+// this size, after that only SDS_MAX_PREALLOC bytes are added each time
+const SDS_MAX_PREALLOC int64 = 1024 * 1024
+
+// SdsHdr binary safe dynamic string.
+// Buf holds Len bytes of content followed by Free bytes of spare room,
+// so appends don't reallocate until the spare room is used.
 type SdsHdr struct {
 	Len  int64
 	Free int64
 	Buf  []byte
 }
+
+// SdsNewLen create a new sds string with the content of init
+func SdsNewLen(init []byte) *SdsHdr {
+	buf := make([]byte, len(init))
+	copy(buf, init)
+	return &SdsHdr{Len: int64(len(init)), Free: 0, Buf: buf}
+}
+
+// SdsNew create a new sds string from a go string
+func SdsNew(init string) *SdsHdr {
+	return &SdsHdr{Len: int64(len(init)), Free: 0, Buf: []byte(init)}
+}
+
+// SdsEmpty create an empty (zero length) sds string
+func SdsEmpty() *SdsHdr {
+	return &SdsHdr{Len: 0, Free: 0, Buf: []byte{}}
+}
+
+// SdsFromLongLong create a sds string with the decimal representation of value
+func SdsFromLongLong(value int64) *SdsHdr {
+	buf := strconv.AppendInt(make([]byte, 0, 20), value, 10)
+	return &SdsHdr{Len: int64(len(buf)), Free: int64(cap(buf) - len(buf)), Buf: buf[:cap(buf)]}
+}
+
+// Dup duplicate the sds string
+func (s *SdsHdr) Dup() *SdsHdr {
+	return SdsNewLen(s.Bytes())
+}
+
+// Bytes the content of the string, valid until the next modification
+func (s *SdsHdr) Bytes() []byte {
+	return s.Buf[:s.Len]
+}
+
+func (s *SdsHdr) String() string {
+	return string(s.Buf[:s.Len])
+}
+
+// Avail free space at the end of the string
+func (s *SdsHdr) Avail() int64 {
+	return s.Free
+}
+
+// AllocSize total size of the allocation
+func (s *SdsHdr) AllocSize() int64 {
+	return s.Len + s.Free
+}
+
+// MakeRoomFor enlarge the free space at the end of the string so that the
+// caller is sure that after calling this function can write addlen bytes
+// after the end of the string. The content and Len are not changed.
+//
+// The allocation is doubled while smaller than SDS_MAX_PREALLOC, so a
+// sequence of appends takes amortized linear time.
+func (s *SdsHdr) MakeRoomFor(addlen int64) {
+	if s.Free >= addlen {
+		return
+	}
+	newlen := s.Len + addlen
+	if newlen < SDS_MAX_PREALLOC {
+		newlen *= 2
+	} else {
+		newlen += SDS_MAX_PREALLOC
+	}
+	buf := make([]byte, newlen)
+	copy(buf, s.Buf[:s.Len])
+	s.Buf = buf
+	s.Free = newlen - s.Len
+}
+
+// RemoveFreeSpace reallocate the string so that it has no free space at the end
+func (s *SdsHdr) RemoveFreeSpace() {
+	if s.Free == 0 {
+		return
+	}
+	buf := make([]byte, s.Len)
+	copy(buf, s.Buf[:s.Len])
+	s.Buf = buf
+	s.Free = 0
+}
+
+// IncrLen increment the length after the caller wrote incr bytes in the
+// free space, as returned by MakeRoomFor. A negative incr right trims the string.
+func (s *SdsHdr) IncrLen(incr int64) {
+	if incr > s.Free || -incr > s.Len {
+		panic("sds: IncrLen out of range")
+	}
+	s.Len += incr
+	s.Free -= incr
+}
+
+// GrowZero grow the string to have the specified length, the added bytes
+// are set to zero. Nothing is done if the string is already longer.
+func (s *SdsHdr) GrowZero(length int64) {
+	if length <= s.Len {
+		return
+	}
+	curlen := s.Len
+	s.MakeRoomFor(length - curlen)
+	for i := curlen; i < length; i++ {
+		s.Buf[i] = 0
+	}
+	s.IncrLen(length - curlen)
+}
+
+// CatLen append the binary safe data to the string
+func (s *SdsHdr) CatLen(data []byte) *SdsHdr {
+	s.MakeRoomFor(int64(len(data)))
+	copy(s.Buf[s.Len:], data)
+	s.IncrLen(int64(len(data)))
+	return s
+}
+
+// Cat append a go string
+func (s *SdsHdr) Cat(str string) *SdsHdr {
+	s.MakeRoomFor(int64(len(str)))
+	copy(s.Buf[s.Len:], str)
+	s.IncrLen(int64(len(str)))
+	return s
+}
+
+// CatSds append another sds string
+func (s *SdsHdr) CatSds(t *SdsHdr) *SdsHdr {
+	return s.CatLen(t.Bytes())
+}
+
+// CatPrintf append a string obtained using a printf-alike format specifier
+func (s *SdsHdr) CatPrintf(format string, args ...interface{}) *SdsHdr {
+	return s.Cat(fmt.Sprintf(format, args...))
+}
+
+// Cpy replace the content of the string with data, reusing the allocation
+// when it is large enough
+func (s *SdsHdr) Cpy(data []byte) *SdsHdr {
+	total := s.Len + s.Free
+	if int64(len(data)) > total {
+		s.Len = 0
+		s.Free = total
+		s.MakeRoomFor(int64(len(data)))
+		total = s.Len + s.Free
+	}
+	copy(s.Buf, data)
+	s.Len = int64(len(data))
+	s.Free = total - s.Len
+	return s
+}
+
+// Clear make the string empty keeping the allocation
+func (s *SdsHdr) Clear() {
+	s.Free += s.Len
+	s.Len = 0
+}
+
+// Range turn the string into a smaller (or equal) string containing only
+// the substring specified by the start and end indexes, both inclusive.
+// Negative indexes count from the end: -1 is the last character.
+func (s *SdsHdr) Range(start, end int64) {
+	length := s.Len
+	if length == 0 {
+		return
+	}
+	if start < 0 {
+		start = length + start
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end < 0 {
+		end = length + end
+		if end < 0 {
+			end = 0
+		}
+	}
+	newlen := int64(0)
+	if start <= end {
+		newlen = end - start + 1
+	}
+	if newlen != 0 {
+		if start >= length {
+			newlen = 0
+		} else if end >= length {
+			end = length - 1
+			newlen = end - start + 1
+		}
+	}
+	if start != 0 && newlen != 0 {
+		copy(s.Buf, s.Buf[start:start+newlen])
+	}
+	s.Free += s.Len - newlen
+	s.Len = newlen
+}
+
+// Trim remove from both ends of the string all the characters in cset
+func (s *SdsHdr) Trim(cset string) {
+	b := bytes.Trim(s.Bytes(), cset)
+	if len(b) == 0 {
+		s.Clear()
+		return
+	}
+	start := int64(len(s.Bytes()) - len(bytes.TrimLeft(s.Bytes(), cset)))
+	s.Range(start, start+int64(len(b))-1)
+}
+
+// ToLower apply tolower() to every character of the string
+func (s *SdsHdr) ToLower() {
+	for i := int64(0); i < s.Len; i++ {
+		if c := s.Buf[i]; c >= 'A' && c <= 'Z' {
+			s.Buf[i] = c + ('a' - 'A')
+		}
+	}
+}
+
+// ToUpper apply toupper() to every character of the string
+func (s *SdsHdr) ToUpper() {
+	for i := int64(0); i < s.Len; i++ {
+		if c := s.Buf[i]; c >= 'a' && c <= 'z' {
+			s.Buf[i] = c - ('a' - 'A')
+		}
+	}
+}
+
+// ToLongLong parse the string as int64, see String2ll
+func (s *SdsHdr) ToLongLong() (int64, bool) {
+	return String2ll(s.Bytes())
+}
+
+// SdsCmp compare two sds strings with memcmp semantic: negative if a < b,
+// positive if a > b, zero if equal. A prefix is smaller than the longer string.
+func SdsCmp(a, b *SdsHdr) int {
+	return bytes.Compare(a.Bytes(), b.Bytes())
+}
+
+// SdsSplitLen split s with the separator sep, returning the tokens.
+// Zero length s or sep return an empty result.
+func SdsSplitLen(s []byte, sep []byte) []*SdsHdr {
+	tokens := []*SdsHdr{}
+	if len(s) == 0 || len(sep) == 0 {
+		return tokens
+	}
+	start := 0
+	for j := 0; j <= len(s)-len(sep); j++ {
+		if bytes.Equal(s[j:j+len(sep)], sep) {
+			tokens = append(tokens, SdsNewLen(s[start:j]))
+			start = j + len(sep)
+			j = j + len(sep) - 1 // skip the separator
+		}
+	}
+	// add the final element
+	tokens = append(tokens, SdsNewLen(s[start:]))
+	return tokens
+}
+
+// SdsSplitArgs split a line into arguments, where every argument can be in
+// the following programming-language REPL-alike form:
+//
+// foo bar "newline are supported\n" and "\xff\x00otherstuff"
+//
+// Double quoted arguments support the escapes \n \r \t \b \a \\ \" and
+// \xHH, single quoted arguments only \'. An error is returned when the
+// quotes are unbalanced or a closing quote is not followed by a space.
+func SdsSplitArgs(line []byte) ([]*SdsHdr, error) {
+	argv := []*SdsHdr{}
+	p := 0
+	for {
+		// skip blanks
+		for p < len(line) && isSpace(line[p]) {
+			p++
+		}
+		if p == len(line) {
+			return argv, nil
+		}
+
+		inq := false  // set to true if we are in "quotes"
+		insq := false // set to true if we are in 'single quotes'
+		done := false
+		current := SdsEmpty()
+		for !done {
+			if inq {
+				if p == len(line) {
+					// unterminated quotes
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[p] == '\\' && p+3 < len(line) && line[p+1] == 'x' &&
+					isHexDigit(line[p+2]) && isHexDigit(line[p+3]) {
+					current.CatLen([]byte{hexDigitToInt(line[p+2])*16 + hexDigitToInt(line[p+3])})
+					p += 3
+				} else if line[p] == '\\' && p+1 < len(line) {
+					p++
+					c := line[p]
+					switch c {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					}
+					current.CatLen([]byte{c})
+				} else if line[p] == '"' {
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					current.CatLen(line[p : p+1])
+				}
+			} else if insq {
+				if p == len(line) {
+					// unterminated quotes
+					return nil, errors.New("unbalanced quotes")
+				}
+				if line[p] == '\\' && p+1 < len(line) && line[p+1] == '\'' {
+					p++
+					current.CatLen([]byte{'\''})
+				} else if line[p] == '\'' {
+					// closing quote must be followed by a space or nothing at all
+					if p+1 < len(line) && !isSpace(line[p+1]) {
+						return nil, errors.New("unbalanced quotes")
+					}
+					done = true
+				} else {
+					current.CatLen(line[p : p+1])
+				}
+			} else {
+				if p == len(line) {
+					break
+				}
+				switch line[p] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inq = true
+				case '\'':
+					insq = true
+				default:
+					current.CatLen(line[p : p+1])
+				}
+			}
+			if p < len(line) {
+				p++
+			}
+		}
+		argv = append(argv, current)
+	}
+}
+
+// String2ll convert a string into a int64 only if the string is the exact
+// representation of the number: no spaces, no '+' and no leading zeroes.
+func String2ll(s []byte) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	// special case: first and only digit is 0
+	if len(s) == 1 && s[0] == '0' {
+		return 0, true
+	}
+
+	p := 0
+	negative := false
+	if s[0] == '-' {
+		negative = true
+		p++
+		if p == len(s) {
+			return 0, false
+		}
+	}
+
+	// first digit should be 1-9, otherwise the string should just be 0
+	if s[p] < '1' || s[p] > '9' {
+		return 0, false
+	}
+	var v uint64
+	for ; p < len(s); p++ {
+		if s[p] < '0' || s[p] > '9' {
+			return 0, false
+		}
+		if v > (^uint64(0))/10 { // overflow
+			return 0, false
+		}
+		v *= 10
+		d := uint64(s[p] - '0')
+		if v > (^uint64(0))-d { // overflow
+			return 0, false
+		}
+		v += d
+	}
+
+	// convert to negative if needed, and do the final overflow check when
+	// converting from unsigned to signed
+	if negative {
+		if v > uint64(1)<<63 {
+			return 0, false
+		}
+		return -int64(v), true
+	}
+	if v > uint64(1)<<63-1 {
+		return 0, false
+	}
+	return int64(v), true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexDigitToInt(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
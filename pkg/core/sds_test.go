@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestSdsRange(t *testing.T) {
+	tests := []struct {
+		start, end int64
+		want       string
+	}{
+		{0, -1, "hello world"},
+		{1, 1, "e"},
+		{0, 4, "hello"},
+		{-5, -1, "world"},
+		{-100, 4, "hello"}, // start before the beginning is clamped to 0
+		{6, 100, "world"},  // end after the end is clamped to the last byte
+		{-3, -100, ""},     // end before the beginning
+		{5, 2, ""},         // start after end
+		{11, 20, ""},       // start past the end
+		{100, -1, ""},      // start far past the end
+		{-1, -1, "d"},      // last byte
+		{-11, -11, "h"},    // first byte with a negative index
+		{-12, 0, "h"},      // one before the first byte is clamped
+		{0, math.MaxInt64, "hello world"},
+	}
+	for _, tt := range tests {
+		s := SdsNew("hello world")
+		alloc := s.AllocSize()
+		s.Range(tt.start, tt.end)
+		if got := s.String(); got != tt.want {
+			t.Errorf("Range(%d, %d) = %q, want %q", tt.start, tt.end, got, tt.want)
+		}
+		// the allocation is kept, the removed bytes become free space
+		if s.AllocSize() != alloc {
+			t.Errorf("Range(%d, %d) changed the allocation from %d to %d", tt.start, tt.end, alloc, s.AllocSize())
+		}
+	}
+
+	s := SdsEmpty()
+	s.Range(0, -1)
+	if s.Len != 0 {
+		t.Errorf("Range on an empty string = %q", s.String())
+	}
+}
+
+func TestSdsSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"   ", []string{}},
+		{"set foo bar", []string{"set", "foo", "bar"}},
+		{"  set\tfoo \r\n bar  ", []string{"set", "foo", "bar"}},
+		{`set "foo bar" baz`, []string{"set", "foo bar", "baz"}},
+		{`set 'foo bar' baz`, []string{"set", "foo bar", "baz"}},
+		{`"" ''`, []string{"", ""}},
+		{`"\n\r\t\b\a\\\""`, []string{"\n\r\t\b\a\\\""}},
+		{`"\x41\x4a\x7e\x00z"`, []string{"AJ~\x00z"}},
+		{`"\x4"`, []string{"x4"}}, // not a hex escape, the backslash escapes the x
+		{`"\xzz"`, []string{"xzz"}},
+		{`'it\'s'`, []string{"it's"}},
+		{`'a\nb'`, []string{`a\nb`}},     // no escapes in single quotes but \'
+		{`foo"bar"`, []string{"foobar"}}, // a quote inside a token starts quoting, as in redis
+	}
+	for _, tt := range tests {
+		argv, err := SdsSplitArgs([]byte(tt.line))
+		if err != nil {
+			t.Errorf("SdsSplitArgs(%q) error: %v", tt.line, err)
+			continue
+		}
+		got := make([]string, len(argv))
+		for i, arg := range argv {
+			got[i] = arg.String()
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("SdsSplitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("SdsSplitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+				break
+			}
+		}
+	}
+
+	unbalanced := []string{
+		`"foo`,
+		`'foo`,
+		`set "foo bar`,
+		`"foo"bar`, // closing quote not followed by a space
+		`'foo'bar`,
+		`"foo\"`,
+		`'foo\'`,
+	}
+	for _, line := range unbalanced {
+		if argv, err := SdsSplitArgs([]byte(line)); err == nil {
+			t.Errorf("SdsSplitArgs(%q) = %d args, want unbalanced quotes error", line, len(argv))
+		}
+	}
+}
+
+func TestString2ll(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1", 1, true},
+		{"-1", -1, true},
+		{"1234567890", 1234567890, true},
+		{"9223372036854775807", math.MaxInt64, true},
+		{"-9223372036854775808", math.MinInt64, true},
+		{"9223372036854775808", 0, false},   // overflow
+		{"-9223372036854775809", 0, false},  // overflow
+		{"18446744073709551615", 0, false},  // fits uint64 only
+		{"18446744073709551616", 0, false},  // overflows uint64
+		{"99999999999999999999", 0, false},  // 20 digits
+		{"123456789012345678901", 0, false}, // too long
+		{"", 0, false},
+		{"-", 0, false},
+		{"+1", 0, false},
+		{"-0", 0, false},
+		{"00", 0, false},
+		{"01", 0, false},
+		{"-01", 0, false},
+		{" 1", 0, false},
+		{"1 ", 0, false},
+		{"1a", 0, false},
+		{"0x10", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := String2ll([]byte(tt.s))
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("String2ll(%q) = %d, %v, want %d, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSdsMakeRoomFor(t *testing.T) {
+	s := SdsNew("abc")
+	s.MakeRoomFor(10)
+	if s.Avail() < 10 || s.String() != "abc" {
+		t.Fatalf("MakeRoomFor(10) = %q with %d free", s.String(), s.Avail())
+	}
+	// under SDS_MAX_PREALLOC the allocation is doubled
+	if s.AllocSize() != 26 {
+		t.Errorf("AllocSize() = %d, want 26", s.AllocSize())
+	}
+	// enough room, nothing changes
+	alloc := s.AllocSize()
+	s.MakeRoomFor(5)
+	if s.AllocSize() != alloc {
+		t.Errorf("MakeRoomFor with enough free space reallocated")
+	}
+
+	// over SDS_MAX_PREALLOC only SDS_MAX_PREALLOC is added
+	big := SdsEmpty()
+	big.MakeRoomFor(SDS_MAX_PREALLOC)
+	if big.AllocSize() != 2*SDS_MAX_PREALLOC {
+		t.Errorf("AllocSize() = %d, want %d", big.AllocSize(), 2*SDS_MAX_PREALLOC)
+	}
+
+	var want []byte
+	c := SdsEmpty()
+	for i := 0; i < 1000; i++ {
+		chunk := []byte(strconv.Itoa(i))
+		c.CatLen(chunk)
+		want = append(want, chunk...)
+	}
+	if !bytes.Equal(c.Bytes(), want) {
+		t.Errorf("CatLen content mismatch")
+	}
+}
+
+// The benchmarks compare the sds growth with appending to a []byte. The
+// append builtin already grows geometrically, appendExact is the naive
+// strategy of allocating just the needed size at every append.
+
+var benchChunk = []byte("*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n")
+
+const benchAppends = 10000
+
+func BenchmarkSdsCatLen(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := SdsEmpty()
+		for j := 0; j < benchAppends; j++ {
+			s.CatLen(benchChunk)
+		}
+	}
+}
+
+func BenchmarkSdsCat(b *testing.B) {
+	chunk := string(benchChunk)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := SdsEmpty()
+		for j := 0; j < benchAppends; j++ {
+			s.Cat(chunk)
+		}
+	}
+}
+
+func BenchmarkAppend(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var s []byte
+		for j := 0; j < benchAppends; j++ {
+			s = append(s, benchChunk...)
+		}
+	}
+}
+
+func appendExact(s, data []byte) []byte {
+	buf := make([]byte, len(s)+len(data))
+	copy(buf, s)
+	copy(buf[len(s):], data)
+	return buf
+}
+
+func BenchmarkAppendExact(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var s []byte
+		for j := 0; j < benchAppends; j++ {
+			s = appendExact(s, benchChunk)
+		}
+	}
+}
+
+// BenchmarkSdsMakeRoomForRead the query buffer pattern: room for a read
+// is made in place, the read fills it and IncrLen commits it
+func BenchmarkSdsMakeRoomForRead(b *testing.B) {
+	const readLen = 16 * 1024
+	src := bytes.Repeat(benchChunk, readLen/len(benchChunk)+1)[:readLen]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		s := SdsEmpty()
+		for j := 0; j < 64; j++ {
+			s.MakeRoomFor(readLen)
+			n := copy(s.Buf[s.Len:s.Len+readLen], src)
+			s.IncrLen(int64(n))
+		}
+	}
+}
+
+// BenchmarkAppendRead the same pattern with append, the read goes to a
+// temporary buffer that is then appended
+func BenchmarkAppendRead(b *testing.B) {
+	const readLen = 16 * 1024
+	src := bytes.Repeat(benchChunk, readLen/len(benchChunk)+1)[:readLen]
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var s []byte
+		tmp := make([]byte, readLen)
+		for j := 0; j < 64; j++ {
+			n := copy(tmp, src)
+			s = append(s, tmp[:n]...)
+		}
+	}
+}
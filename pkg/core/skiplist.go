@@ -0,0 +1,474 @@
+package core
+
+import "math/rand"
+
+// ZSKIPLIST_MAXLEVEL should be enough for 2^64 elements
+const ZSKIPLIST_MAXLEVEL int = 32
+
+// ZSKIPLIST_P skiplist P = 1/4
+const ZSKIPLIST_P float64 = 0.25
+
+// ZskiplistNode an element of the skiplist
+type ZskiplistNode struct {
+	Ele      string
+	Score    float64
+	backward *ZskiplistNode
+	level    []zskiplistLevel
+}
+
+type zskiplistLevel struct {
+	forward *ZskiplistNode
+	span    int // number of nodes between this node and forward
+}
+
+// Zskiplist a skiplist ordered by score, then by element, as described
+// in William Pugh's paper with two changes: repeated scores are allowed
+// and every link stores its span, so the rank of an element is computed
+// while searching it in O(log N).
+type Zskiplist struct {
+	header *ZskiplistNode
+	tail   *ZskiplistNode
+	length int
+	level  int
+}
+
+// ZRangeSpec a score range, Minex and Maxex make the bounds exclusive
+type ZRangeSpec struct {
+	Min, Max     float64
+	Minex, Maxex bool
+}
+
+// kinds of lex range bounds
+const (
+	ZLEX_BOUND_STRING = iota // Value, inclusive or exclusive
+	ZLEX_BOUND_MIN           // "-", smaller than any string
+	ZLEX_BOUND_MAX           // "+", greater than any string
+)
+
+// ZLexBound a bound of a lex range
+type ZLexBound struct {
+	Kind      int
+	Value     string
+	Exclusive bool
+}
+
+// ZLexRangeSpec a lexicographic range
+type ZLexRangeSpec struct {
+	Min, Max ZLexBound
+}
+
+func zslCreateNode(level int, score float64, ele string) *ZskiplistNode {
+	return &ZskiplistNode{Ele: ele, Score: score, level: make([]zskiplistLevel, level)}
+}
+
+// NewZskiplist create an empty skiplist
+func NewZskiplist() *Zskiplist {
+	return &Zskiplist{
+		header: zslCreateNode(ZSKIPLIST_MAXLEVEL, 0, ""),
+		level:  1,
+	}
+}
+
+// Len number of elements
+func (zsl *Zskiplist) Len() int {
+	return zsl.length
+}
+
+// First the element with the lowest score, nil when empty
+func (zsl *Zskiplist) First() *ZskiplistNode {
+	return zsl.header.level[0].forward
+}
+
+// Last the element with the highest score, nil when empty
+func (zsl *Zskiplist) Last() *ZskiplistNode {
+	return zsl.tail
+}
+
+// Next the following element in ascending order
+func (node *ZskiplistNode) Next() *ZskiplistNode {
+	return node.level[0].forward
+}
+
+// Prev the previous element in ascending order
+func (node *ZskiplistNode) Prev() *ZskiplistNode {
+	return node.backward
+}
+
+// zslRandomLevel returns a random level for the new node, the return value
+// is between 1 and ZSKIPLIST_MAXLEVEL with a powerlaw-alike distribution
+// where higher levels are less likely to be returned
+func zslRandomLevel() int {
+	level := 1
+	for level < ZSKIPLIST_MAXLEVEL && rand.Float64() < ZSKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// zslLess compare (score, ele) pairs
+func zslLess(score float64, ele string, node *ZskiplistNode) bool {
+	return node.Score < score || (node.Score == score && node.Ele < ele)
+}
+
+// Insert add a new element, the caller must make sure it is not already
+// in the skiplist
+func (zsl *Zskiplist) Insert(score float64, ele string) *ZskiplistNode {
+	var update [ZSKIPLIST_MAXLEVEL]*ZskiplistNode
+	var rank [ZSKIPLIST_MAXLEVEL]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// store rank that is crossed to reach the insert position
+		if i != zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && zslLess(score, ele, x.level[i].forward) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := zslRandomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = zslCreateNode(level, score, ele)
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+
+		// update span covered by update[i] as x is inserted here
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = (rank[0] - rank[i]) + 1
+	}
+
+	// increment span for untouched levels
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// deleteNode unlink x, update holds the last node before x at every level
+func (zsl *Zskiplist) deleteNode(x *ZskiplistNode, update []*ZskiplistNode) {
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+}
+
+// findUpdate the last node before (score, ele) at every level
+func (zsl *Zskiplist) findUpdate(score float64, ele string) []*ZskiplistNode {
+	update := make([]*ZskiplistNode, ZSKIPLIST_MAXLEVEL)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && zslLess(score, ele, x.level[i].forward) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	return update
+}
+
+// Delete remove the element with matching score and ele, return false
+// when not found
+func (zsl *Zskiplist) Delete(score float64, ele string) bool {
+	update := zsl.findUpdate(score, ele)
+	// we may have multiple elements with the same score, what we need is
+	// to find the element with both the right score and object
+	x := update[0].level[0].forward
+	if x != nil && score == x.Score && x.Ele == ele {
+		zsl.deleteNode(x, update)
+		return true
+	}
+	return false
+}
+
+// UpdateScore change the score of an element, the element must exist with
+// curscore. When the node stays in the same position it is updated in
+// place, otherwise it is removed and inserted again.
+func (zsl *Zskiplist) UpdateScore(curscore float64, ele string, newscore float64) *ZskiplistNode {
+	update := zsl.findUpdate(curscore, ele)
+	x := update[0].level[0].forward
+
+	// if the node, after the score update, would be still exactly at the
+	// same position, we can just update the score without actually
+	// removing and re-inserting the element in the skiplist
+	if (x.backward == nil || x.backward.Score < newscore) &&
+		(x.level[0].forward == nil || x.level[0].forward.Score > newscore) {
+		x.Score = newscore
+		return x
+	}
+	zsl.deleteNode(x, update)
+	return zsl.Insert(newscore, ele)
+}
+
+// ValueGteMin check value against the min of the range
+func (r *ZRangeSpec) ValueGteMin(value float64) bool {
+	if r.Minex {
+		return value > r.Min
+	}
+	return value >= r.Min
+}
+
+// ValueLteMax check value against the max of the range
+func (r *ZRangeSpec) ValueLteMax(value float64) bool {
+	if r.Maxex {
+		return value < r.Max
+	}
+	return value <= r.Max
+}
+
+// isInRange check if a part of the skiplist is in range
+func (zsl *Zskiplist) isInRange(r *ZRangeSpec) bool {
+	// test for ranges that will always be empty
+	if r.Min > r.Max || (r.Min == r.Max && (r.Minex || r.Maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !r.ValueGteMin(x.Score) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !r.ValueLteMax(x.Score) {
+		return false
+	}
+	return true
+}
+
+// FirstInRange the first node that is contained in the range, nil when no
+// element is contained in the range
+func (zsl *Zskiplist) FirstInRange(r *ZRangeSpec) *ZskiplistNode {
+	if !zsl.isInRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// go forward while *out* of range
+		for x.level[i].forward != nil && !r.ValueGteMin(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+	// this is an inner range, so the next node cannot be nil
+	x = x.level[0].forward
+	if !r.ValueLteMax(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// LastInRange the last node that is contained in the range, nil when no
+// element is contained in the range
+func (zsl *Zskiplist) LastInRange(r *ZRangeSpec) *ZskiplistNode {
+	if !zsl.isInRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		// go forward while *in* range
+		for x.level[i].forward != nil && r.ValueLteMax(x.level[i].forward.Score) {
+			x = x.level[i].forward
+		}
+	}
+	// this is an inner range, so this node cannot be nil
+	if !r.ValueGteMin(x.Score) {
+		return nil
+	}
+	return x
+}
+
+// ZslLexCompare compare ele with a lex bound
+func ZslLexCompare(ele string, bound *ZLexBound) int {
+	switch bound.Kind {
+	case ZLEX_BOUND_MIN:
+		return 1
+	case ZLEX_BOUND_MAX:
+		return -1
+	}
+	if ele < bound.Value {
+		return -1
+	} else if ele > bound.Value {
+		return 1
+	}
+	return 0
+}
+
+// ValueGteMin check ele against the min of the range
+func (r *ZLexRangeSpec) ValueGteMin(ele string) bool {
+	cmp := ZslLexCompare(ele, &r.Min)
+	if r.Min.Exclusive {
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// ValueLteMax check ele against the max of the range
+func (r *ZLexRangeSpec) ValueLteMax(ele string) bool {
+	cmp := ZslLexCompare(ele, &r.Max)
+	if r.Max.Exclusive {
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+// IsEmpty check for ranges that will always be empty
+func (r *ZLexRangeSpec) IsEmpty() bool {
+	min, max := &r.Min, &r.Max
+	if min.Kind == ZLEX_BOUND_MAX || max.Kind == ZLEX_BOUND_MIN {
+		return true
+	}
+	if min.Kind == ZLEX_BOUND_STRING && max.Kind == ZLEX_BOUND_STRING {
+		if min.Value > max.Value {
+			return true
+		}
+		if min.Value == max.Value && (min.Exclusive || max.Exclusive) {
+			return true
+		}
+	}
+	return false
+}
+
+func (zsl *Zskiplist) isInLexRange(r *ZLexRangeSpec) bool {
+	if r.IsEmpty() {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !r.ValueGteMin(x.Ele) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !r.ValueLteMax(x.Ele) {
+		return false
+	}
+	return true
+}
+
+// FirstInLexRange the first node that is contained in the lex range, the
+// elements must all have the same score
+func (zsl *Zskiplist) FirstInLexRange(r *ZLexRangeSpec) *ZskiplistNode {
+	if !zsl.isInLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.ValueGteMin(x.level[i].forward.Ele) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.ValueLteMax(x.Ele) {
+		return nil
+	}
+	return x
+}
+
+// LastInLexRange the last node that is contained in the lex range, the
+// elements must all have the same score
+func (zsl *Zskiplist) LastInLexRange(r *ZLexRangeSpec) *ZskiplistNode {
+	if !zsl.isInLexRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.ValueLteMax(x.level[i].forward.Ele) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.ValueGteMin(x.Ele) {
+		return nil
+	}
+	return x
+}
+
+// DeleteRangeByRank delete all the elements with rank between start and
+// end from the skiplist, start and end are inclusive and start at 1.
+// Return the deleted nodes.
+func (zsl *Zskiplist) DeleteRangeByRank(start, end int) []*ZskiplistNode {
+	update := make([]*ZskiplistNode, ZSKIPLIST_MAXLEVEL)
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span < start {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	traversed++
+	x = x.level[0].forward
+	var removed []*ZskiplistNode
+	for x != nil && traversed <= end {
+		next := x.level[0].forward
+		zsl.deleteNode(x, update)
+		removed = append(removed, x)
+		traversed++
+		x = next
+	}
+	return removed
+}
+
+// GetRank find the rank of the element by both score and ele, return 0
+// when the element cannot be found, rank 1 is the first element
+func (zsl *Zskiplist) GetRank(score float64, ele string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.Score < score ||
+				(x.level[i].forward.Score == score && x.level[i].forward.Ele <= ele)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		// x might be equal to header, so test that it's not the header
+		if x != zsl.header && x.Ele == ele {
+			return rank
+		}
+	}
+	return 0
+}
+
+// GetElementByRank find the element with the given rank, rank starts at 1
+func (zsl *Zskiplist) GetElementByRank(rank int) *ZskiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
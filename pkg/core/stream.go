@@ -0,0 +1,314 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// StreamID the ID of a stream entry: the unix time in ms the entry was
+// created at, and a sequence number for the entries created in the same ms
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// StreamIDMin the smallest possible ID
+var StreamIDMin = StreamID{Ms: 0, Seq: 0}
+
+// StreamIDMax the greatest possible ID
+var StreamIDMax = StreamID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// Compare return -1, 0 or 1 if id is smaller, equal or greater than other
+func (id StreamID) Compare(other StreamID) int {
+	switch {
+	case id.Ms > other.Ms:
+		return 1
+	case id.Ms < other.Ms:
+		return -1
+	case id.Seq > other.Seq:
+		return 1
+	case id.Seq < other.Seq:
+		return -1
+	}
+	return 0
+}
+
+// IsZero true for the 0-0 ID
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Incr return the ID following id, false when id is the greatest ID
+func (id StreamID) Incr() (StreamID, bool) {
+	if id.Seq == math.MaxUint64 {
+		if id.Ms == math.MaxUint64 {
+			return id, false
+		}
+		return StreamID{Ms: id.Ms + 1, Seq: 0}, true
+	}
+	return StreamID{Ms: id.Ms, Seq: id.Seq + 1}, true
+}
+
+// Decr return the ID preceding id, false when id is the smallest ID
+func (id StreamID) Decr() (StreamID, bool) {
+	if id.Seq == 0 {
+		if id.Ms == 0 {
+			return id, false
+		}
+		return StreamID{Ms: id.Ms - 1, Seq: math.MaxUint64}, true
+	}
+	return StreamID{Ms: id.Ms, Seq: id.Seq - 1}, true
+}
+
+// String format the ID as <ms>-<seq>
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// ParseStreamID parse an ID in the <ms>-<seq> or <ms> form, the latter
+// gets missingSeq as sequence. The <ms>-* form is accepted only when
+// allowAutoSeq is set, seqGiven is false in that case.
+func ParseStreamID(b []byte, missingSeq uint64, allowAutoSeq bool) (id StreamID, seqGiven bool, ok bool) {
+	if len(b) == 0 || len(b) > 127 {
+		return id, false, false
+	}
+	msPart, seqPart := b, []byte(nil)
+	for i, c := range b {
+		if c == '-' {
+			msPart, seqPart = b[:i], b[i+1:]
+			break
+		}
+	}
+	ms, ok := parseUint64(msPart)
+	if !ok {
+		return id, false, false
+	}
+	if seqPart == nil {
+		return StreamID{Ms: ms, Seq: missingSeq}, true, true
+	}
+	if allowAutoSeq && len(seqPart) == 1 && seqPart[0] == '*' {
+		return StreamID{Ms: ms}, false, true
+	}
+	seq, ok := parseUint64(seqPart)
+	if !ok {
+		return id, false, false
+	}
+	return StreamID{Ms: ms, Seq: seq}, true, true
+}
+
+// parseUint64 parse a decimal unsigned number without sign or spaces
+func parseUint64(b []byte) (uint64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	v, err := strconv.ParseUint(string(b), 10, 64)
+	return v, err == nil
+}
+
+// StreamEntry an entry of a stream, Fields holds the field value pairs
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// Stream an append only log of entries ordered by ID.
+//
+// Every new entry gets an ID greater than all the others, so the entries
+// are kept in a slice: appending is O(1), lookups are binary searches and
+// trimming the oldest entries reslices the head. Only XDEL in the middle
+// of the stream costs a copy.
+type Stream struct {
+	entries []*StreamEntry
+
+	LastID            StreamID // ID of the last added entry, may be deleted
+	FirstID           StreamID // ID of the first entry, 0-0 when empty
+	MaxDeletedEntryID StreamID // greatest ID removed by XDEL
+	EntriesAdded      uint64   // number of entries ever added
+}
+
+func NewStream() *Stream {
+	return &Stream{}
+}
+
+// Len return the number of entries
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// Dup duplicate the stream. Entries are never modified once added, so
+// the copy shares them and only owns the slice.
+func (s *Stream) Dup() *Stream {
+	dup := *s
+	dup.entries = append([]*StreamEntry(nil), s.entries...)
+	return &dup
+}
+
+// Entry return the entry with index i, 0 is the oldest
+func (s *Stream) Entry(i int) *StreamEntry {
+	return s.entries[i]
+}
+
+// First return the oldest entry or nil
+func (s *Stream) First() *StreamEntry {
+	if len(s.entries) == 0 {
+		return nil
+	}
+	return s.entries[0]
+}
+
+// Last return the newest entry or nil
+func (s *Stream) Last() *StreamEntry {
+	if len(s.entries) == 0 {
+		return nil
+	}
+	return s.entries[len(s.entries)-1]
+}
+
+// Append add an entry, id must be greater than LastID
+func (s *Stream) Append(id StreamID, fields [][]byte) *StreamEntry {
+	e := &StreamEntry{ID: id, Fields: fields}
+	s.entries = append(s.entries, e)
+	if len(s.entries) == 1 {
+		s.FirstID = id
+	}
+	s.LastID = id
+	s.EntriesAdded++
+	return e
+}
+
+// Seek return the index of the first entry with ID >= id, Len() if none
+func (s *Stream) Seek(id StreamID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return s.entries[i].ID.Compare(id) >= 0
+	})
+}
+
+// Lookup return the entry with the given ID or nil
+func (s *Stream) Lookup(id StreamID) *StreamEntry {
+	i := s.Seek(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i]
+	}
+	return nil
+}
+
+// Delete remove the entry with the given ID, return false if missing
+func (s *Stream) Delete(id StreamID) bool {
+	i := s.Seek(id)
+	if i == len(s.entries) || s.entries[i].ID != id {
+		return false
+	}
+	copy(s.entries[i:], s.entries[i+1:])
+	s.entries[len(s.entries)-1] = nil
+	s.entries = s.entries[:len(s.entries)-1]
+	if id.Compare(s.MaxDeletedEntryID) > 0 {
+		s.MaxDeletedEntryID = id
+	}
+	if i == 0 {
+		s.updateFirstID()
+	}
+	return true
+}
+
+// TrimByLen remove the oldest entries until at most maxlen are left.
+// limit bounds the number of removed entries, 0 means no bound.
+// Return the number of removed entries.
+func (s *Stream) TrimByLen(maxlen int64, limit int64) int64 {
+	n := int64(len(s.entries)) - maxlen
+	if n <= 0 {
+		return 0
+	}
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	s.removeHead(int(n))
+	return n
+}
+
+// TrimByMinID remove the entries with an ID smaller than minid. limit
+// bounds the number of removed entries, 0 means no bound.
+// Return the number of removed entries.
+func (s *Stream) TrimByMinID(minid StreamID, limit int64) int64 {
+	n := int64(s.Seek(minid))
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	if n == 0 {
+		return 0
+	}
+	s.removeHead(int(n))
+	return n
+}
+
+// removeHead remove the n oldest entries. The slice is resliced, its
+// backing array is reclaimed once append needs to grow it.
+func (s *Stream) removeHead(n int) {
+	for i := 0; i < n; i++ {
+		s.entries[i] = nil
+	}
+	s.entries = s.entries[n:]
+	s.updateFirstID()
+}
+
+func (s *Stream) updateFirstID() {
+	if len(s.entries) == 0 {
+		s.FirstID = StreamIDMin
+	} else {
+		s.FirstID = s.entries[0].ID
+	}
+}
+
+// RangeHasTombstones true when entries between start and end (inclusive,
+// nil for no bound) may have been deleted with XDEL
+func (s *Stream) RangeHasTombstones(start, end *StreamID) bool {
+	if len(s.entries) == 0 || s.MaxDeletedEntryID.IsZero() {
+		return false
+	}
+	startID, endID := StreamIDMin, StreamIDMax
+	if start != nil {
+		startID = *start
+	}
+	if end != nil {
+		endID = *end
+	}
+	return startID.Compare(s.MaxDeletedEntryID) <= 0 && endID.Compare(s.MaxDeletedEntryID) >= 0
+}
+
+// EstimateDistanceFromFirstEverEntry return the logical position of id
+// counting every entry ever added, that is the number of entries a reader
+// has consumed when it reaches id. Return false when the position can't
+// be known because of deletions or because id is in the future.
+func (s *Stream) EstimateDistanceFromFirstEverEntry(id StreamID) (int64, bool) {
+	// the counter of any ID in an empty, never used stream is 0
+	if s.EntriesAdded == 0 {
+		return 0, true
+	}
+	// in an empty stream every ID up to the last one is fully consumed
+	if len(s.entries) == 0 && id.Compare(s.LastID) < 1 {
+		return int64(s.EntriesAdded), true
+	}
+	cmpLast := id.Compare(s.LastID)
+	if cmpLast == 0 {
+		return int64(s.EntriesAdded), true
+	} else if cmpLast > 0 {
+		return 0, false
+	}
+
+	cmpFirst := id.Compare(s.FirstID)
+	if s.MaxDeletedEntryID.IsZero() || s.MaxDeletedEntryID.Compare(s.FirstID) < 0 {
+		// no fragmentation ahead
+		if cmpFirst < 0 {
+			return int64(s.EntriesAdded) - int64(len(s.entries)), true
+		} else if cmpFirst == 0 {
+			return int64(s.EntriesAdded) - int64(len(s.entries)) + 1, true
+		}
+	}
+	// id is before a deleted entry, or is an arbitrary ID
+	return 0, false
+}
@@ -0,0 +1,149 @@
+package core
+
+// StringMatchLen glob-style pattern matching, a port of stringmatchlen.
+// '*' matches any sequence of characters, the empty one included, '?'
+// any single character. [abc] matches one of the characters in the
+// brackets, [a-z] a range and [^abc] any character but the ones in the
+// brackets. A backslash matches the next character literally, even when
+// it is a special character.
+func StringMatchLen(pattern, str []byte, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchLenImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+// byteAt the byte at index i, or 0 past the end: the C implementation
+// relies on the null terminator of the pattern
+func byteAt(b []byte, i int) byte {
+	if i >= 0 && i < len(b) {
+		return b[i]
+	}
+	return 0
+}
+
+// toLower the glibc tolower of a char, signed like on x86: negative
+// chars but EOF (-1) are mapped to their unsigned value
+func toLower(c int) int {
+	if c < -1 {
+		return c + 256
+	}
+	if c >= 'A' && c <= 'Z' {
+		return c + ('a' - 'A')
+	}
+	return c
+}
+
+func stringMatchLenImpl(pattern, str []byte, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// protection against abusive patterns
+	if nesting > 1000 {
+		return false
+	}
+
+	p, s := 0, 0
+	for p < len(pattern) && s < len(str) {
+		switch pattern[p] {
+		case '*':
+			for p < len(pattern) && byteAt(pattern, p+1) == '*' {
+				p++
+			}
+			if p == len(pattern)-1 {
+				return true // match
+			}
+			for s < len(str) {
+				if stringMatchLenImpl(pattern[p+1:], str[s:], nocase, skipLongerMatches, nesting+1) {
+					return true // match
+				}
+				if *skipLongerMatches {
+					return false // no match
+				}
+				s++
+			}
+			// there was no match for the rest of the pattern starting
+			// from anywhere in the rest of the string. If there were any
+			// '*' earlier in the pattern, we can terminate the search
+			// early without trying to match them to longer substrings:
+			// a longer match for the earlier part of the pattern would
+			// require the rest of the pattern to match starting later
+			// in the string, and we just determined it doesn't.
+			*skipLongerMatches = true
+			return false // no match
+		case '?':
+			s++
+		case '[':
+			p++
+			not := byteAt(pattern, p) == '^'
+			if not {
+				p++
+			}
+			match := false
+			for {
+				if byteAt(pattern, p) == '\\' && len(pattern)-p >= 2 {
+					p++
+					if pattern[p] == str[s] {
+						match = true
+					}
+				} else if byteAt(pattern, p) == ']' {
+					break
+				} else if p == len(pattern) {
+					// unterminated class: stay on the last character,
+					// the pattern is consumed right after the loop
+					p--
+					break
+				} else if len(pattern)-p >= 3 && pattern[p+1] == '-' {
+					start := int(int8(pattern[p]))
+					end := int(int8(pattern[p+2]))
+					c := int(int8(str[s]))
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start = toLower(start)
+						end = toLower(end)
+						c = toLower(c)
+					}
+					p += 2
+					if c >= start && c <= end {
+						match = true
+					}
+				} else {
+					if !nocase {
+						if pattern[p] == str[s] {
+							match = true
+						}
+					} else if toLower(int(int8(pattern[p]))) == toLower(int(int8(str[s]))) {
+						match = true
+					}
+				}
+				p++
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false // no match
+			}
+			s++
+		case '\\':
+			if len(pattern)-p >= 2 {
+				p++
+			}
+			fallthrough
+		default:
+			if !nocase {
+				if pattern[p] != str[s] {
+					return false // no match
+				}
+			} else if toLower(int(int8(pattern[p]))) != toLower(int(int8(str[s]))) {
+				return false // no match
+			}
+			s++
+		}
+		p++
+		if s == len(str) {
+			for byteAt(pattern, p) == '*' {
+				p++
+			}
+			break
+		}
+	}
+	return p == len(pattern) && s == len(str)
+}
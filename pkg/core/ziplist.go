@@ -0,0 +1,151 @@
+package core
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// The ziplist is the compact list encoding used by redis before the
+// listpack. It is never created here, but RDB files written by older
+// versions store small lists, hashes and sorted sets as ziplists:
+//
+//	<zlbytes uint32><zltail uint32><zllen uint16><entry>...<entry><0xFF>
+//
+// Every entry is <prevlen><encoding><data>. prevlen is the size of the
+// previous entry: one byte for 0..253, otherwise the byte 254 followed by
+// a 4 bytes little endian length. The header fields are little endian.
+
+const ziplistHeaderSize int = 10
+
+// ZIPLIST_END terminator byte
+const ZIPLIST_END byte = 0xFF
+
+const ziplistBigPrevlen byte = 254
+
+// ziplist entry encodings
+const (
+	zipStrMask byte = 0xC0
+	zipStr06B  byte = 0 << 6
+	zipStr14B  byte = 1 << 6
+	zipStr32B  byte = 2 << 6
+	zipInt16B  byte = 0xC0 | 0<<4
+	zipInt32B  byte = 0xC0 | 1<<4
+	zipInt64B  byte = 0xC0 | 2<<4
+	zipInt24B  byte = 0xC0 | 3<<4
+	zipInt8B   byte = 0xFE
+	// 4 bit immediate integers: 1111xxxx with xxxx between 0001 and 1101,
+	// the value is xxxx - 1
+	zipIntImmMin byte = 0xF1
+	zipIntImmMax byte = 0xFD
+)
+
+// ZiplistEntries validate a ziplist and return its elements, integers in
+// their decimal representation. ok is false when zl is not a well formed
+// ziplist.
+func ZiplistEntries(zl []byte) (entries [][]byte, ok bool) {
+	if len(zl) < ziplistHeaderSize+1 || int(binary.LittleEndian.Uint32(zl)) != len(zl) ||
+		zl[len(zl)-1] != ZIPLIST_END {
+		return nil, false
+	}
+	tail := int(binary.LittleEndian.Uint32(zl[4:]))
+	count := int(binary.LittleEndian.Uint16(zl[8:]))
+
+	end := len(zl) - 1
+	p, prev, prevlen := ziplistHeaderSize, ziplistHeaderSize, 0
+	for p < end {
+		start := p
+		// prevlen must be the size of the previous entry
+		var l int
+		if zl[p] < ziplistBigPrevlen {
+			l = int(zl[p])
+			p++
+		} else {
+			if zl[p] != ziplistBigPrevlen || p+5 > end {
+				return nil, false
+			}
+			l = int(binary.LittleEndian.Uint32(zl[p+1:]))
+			p += 5
+		}
+		if l != prevlen || p >= end {
+			return nil, false
+		}
+
+		enc := zl[p]
+		var value []byte
+		if enc&zipStrMask != zipStrMask {
+			// string
+			var slen int
+			switch enc & zipStrMask {
+			case zipStr06B:
+				slen = int(enc & 0x3F)
+				p++
+			case zipStr14B:
+				if p+2 > end {
+					return nil, false
+				}
+				slen = int(enc&0x3F)<<8 | int(zl[p+1])
+				p += 2
+			default:
+				if enc != zipStr32B || p+5 > end {
+					return nil, false
+				}
+				slen = int(binary.BigEndian.Uint32(zl[p+1:]))
+				p += 5
+			}
+			if slen > end-p {
+				return nil, false
+			}
+			value = append([]byte(nil), zl[p:p+slen]...)
+			p += slen
+		} else {
+			// integer
+			var size int
+			switch {
+			case enc == zipInt8B:
+				size = 1
+			case enc == zipInt16B:
+				size = 2
+			case enc == zipInt24B:
+				size = 3
+			case enc == zipInt32B:
+				size = 4
+			case enc == zipInt64B:
+				size = 8
+			case enc >= zipIntImmMin && enc <= zipIntImmMax:
+				size = 0
+			default:
+				return nil, false
+			}
+			p++
+			if size > end-p {
+				return nil, false
+			}
+			var v int64
+			switch size {
+			case 0:
+				v = int64(enc&0x0F) - 1
+			case 1:
+				v = int64(int8(zl[p]))
+			case 2:
+				v = int64(int16(binary.LittleEndian.Uint16(zl[p:])))
+			case 3:
+				v = lpSignExtend(uint64(zl[p])|uint64(zl[p+1])<<8|uint64(zl[p+2])<<16, 24)
+			case 4:
+				v = int64(int32(binary.LittleEndian.Uint32(zl[p:])))
+			case 8:
+				v = int64(binary.LittleEndian.Uint64(zl[p:]))
+			}
+			value = strconv.AppendInt(nil, v, 10)
+			p += size
+		}
+		entries = append(entries, value)
+		prev, prevlen = start, p-start
+	}
+
+	// zltail is the offset of the last entry, zllen the number of entries
+	// unless it doesn't fit 16 bits
+	if tail != prev || (count != 0xFFFF && count != len(entries)) {
+		return nil, false
+	}
+	return entries, true
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Zipmap a string -> string map serialized in a single buffer, with the
+// same byte layout used by redis 2.x:
+//
+//	<zmlen><len>"foo"<len><free>"bar"<len>"hello"<len><free>"world"<end>
+//
+// zmlen is one byte holding the number of pairs, when it is >= 254 the
+// length must be computed walking the map. len is the length of the
+// following string: one byte for 0..253, otherwise the byte 254 followed
+// by a 4 bytes little endian length. free is the number of unused bytes
+// after the value, left there by updates with a shorter value. end is 255.
+//
+// Lookups are O(N), zipmaps are only used for small hashes.
+type Zipmap struct {
+	buf []byte
+}
+
+// ZIPMAP_BIGLEN marks a 4 bytes length, and an unknown zmlen
+const ZIPMAP_BIGLEN byte = 254
+
+// ZIPMAP_END terminator byte
+const ZIPMAP_END byte = 255
+
+// ZIPMAP_VALUE_MAX_FREE updates leaving more unused bytes than this
+// rewrite the entry to reclaim the space
+const ZIPMAP_VALUE_MAX_FREE int = 4
+
+// NewZipmap create an empty zipmap
+func NewZipmap() *Zipmap {
+	return &Zipmap{buf: []byte{0, ZIPMAP_END}}
+}
+
+// NewZipmapFromBytes wrap a serialized zipmap, buf is not copied
+func NewZipmapFromBytes(buf []byte) *Zipmap {
+	return &Zipmap{buf: buf}
+}
+
+// ZipmapValidateIntegrity check that buf is a well formed zipmap: every
+// length fits in the buffer, the keys are unique and the terminator is the
+// last byte
+func ZipmapValidateIntegrity(buf []byte) bool {
+	// readLength decode the length at p checking the buffer bounds
+	readLength := func(p int) (int, int, bool) {
+		if p >= len(buf) || buf[p] == ZIPMAP_END {
+			return 0, 0, false
+		}
+		if buf[p] < ZIPMAP_BIGLEN {
+			return int(buf[p]), 1, true
+		}
+		if p+5 > len(buf) {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint32(buf[p+1:])), 5, true
+	}
+
+	if len(buf) < 2 {
+		return false
+	}
+	keys := map[string]struct{}{}
+	p := 1
+	for p < len(buf) && buf[p] != ZIPMAP_END {
+		klen, ksize, ok := readLength(p)
+		if !ok || klen > len(buf)-p-ksize {
+			return false
+		}
+		p += ksize
+		key := string(buf[p : p+klen])
+		p += klen
+		vlen, vsize, ok := readLength(p)
+		if !ok || p+vsize >= len(buf) {
+			return false
+		}
+		p += vsize
+		free := int(buf[p])
+		p++
+		if vlen+free > len(buf)-p {
+			return false
+		}
+		p += vlen + free
+		if _, dup := keys[key]; dup {
+			return false
+		}
+		keys[key] = struct{}{}
+	}
+	if p != len(buf)-1 {
+		return false
+	}
+	// a zmlen below ZIPMAP_BIGLEN is the exact number of pairs
+	return buf[0] >= ZIPMAP_BIGLEN || int(buf[0]) == len(keys)
+}
+
+// Bytes the serialized zipmap, valid until the next modification
+func (zm *Zipmap) Bytes() []byte {
+	return zm.buf
+}
+
+// Dup duplicate the zipmap
+func (zm *Zipmap) Dup() *Zipmap {
+	return &Zipmap{buf: append([]byte(nil), zm.buf...)}
+}
+
+// zipmapDecodeLength decode the length at p, return it with the number of
+// bytes used to encode it
+func zipmapDecodeLength(buf []byte, p int) (int, int) {
+	if buf[p] < ZIPMAP_BIGLEN {
+		return int(buf[p]), 1
+	}
+	return int(binary.LittleEndian.Uint32(buf[p+1:])), 5
+}
+
+func zipmapEncodeLength(l int) []byte {
+	if l < int(ZIPMAP_BIGLEN) {
+		return []byte{byte(l)}
+	}
+	buf := make([]byte, 5)
+	buf[0] = ZIPMAP_BIGLEN
+	binary.LittleEndian.PutUint32(buf[1:], uint32(l))
+	return buf
+}
+
+// Rewind offset of the first entry, to be passed to Next
+func (zm *Zipmap) Rewind() int {
+	return 1
+}
+
+// Next return the key and the value of the entry at p and the offset of
+// the following entry. ok is false when p is the end of the zipmap.
+// key and value are slices of the zipmap buffer.
+func (zm *Zipmap) Next(p int) (next int, key, value []byte, ok bool) {
+	buf := zm.buf
+	if buf[p] == ZIPMAP_END {
+		return p, nil, nil, false
+	}
+	klen, ksize := zipmapDecodeLength(buf, p)
+	p += ksize
+	key = buf[p : p+klen]
+	p += klen
+	vlen, vsize := zipmapDecodeLength(buf, p)
+	p += vsize
+	free := int(buf[p])
+	p++
+	value = buf[p : p+vlen]
+	p += vlen + free
+	return p, key, value, true
+}
+
+// lookup find the entry of key, return its offset and total size
+func (zm *Zipmap) lookup(key []byte) (int, int, bool) {
+	p := zm.Rewind()
+	for {
+		next, k, _, ok := zm.Next(p)
+		if !ok {
+			return 0, 0, false
+		}
+		if bytes.Equal(k, key) {
+			return p, next - p, true
+		}
+		p = next
+	}
+}
+
+// Get the value of key, a slice of the zipmap buffer
+func (zm *Zipmap) Get(key []byte) ([]byte, bool) {
+	p, _, ok := zm.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	_, _, value, _ := zm.Next(p)
+	return value, true
+}
+
+// Exists check if key is in the zipmap
+func (zm *Zipmap) Exists(key []byte) bool {
+	_, _, ok := zm.lookup(key)
+	return ok
+}
+
+// Set the value of key, return true if the key already existed and its
+// value was updated
+func (zm *Zipmap) Set(key, value []byte) bool {
+	entry := make([]byte, 0, len(key)+len(value)+11)
+	entry = append(entry, zipmapEncodeLength(len(key))...)
+	entry = append(entry, key...)
+	entry = append(entry, zipmapEncodeLength(len(value))...)
+	entry = append(entry, 0) // no free space
+	entry = append(entry, value...)
+
+	p, size, update := zm.lookup(key)
+	if !update {
+		// append before the terminator
+		p = len(zm.buf) - 1
+		size = 0
+	} else if size >= len(entry) && size-len(entry) <= ZIPMAP_VALUE_MAX_FREE {
+		// the new value fits the old entry, keep the unused bytes as free
+		// space so the following entries don't move
+		entry[len(entry)-len(value)-1] = byte(size - len(entry))
+		copy(zm.buf[p:], entry)
+		return true
+	}
+
+	buf := make([]byte, 0, len(zm.buf)-size+len(entry))
+	buf = append(buf, zm.buf[:p]...)
+	buf = append(buf, entry...)
+	buf = append(buf, zm.buf[p+size:]...)
+	zm.buf = buf
+	if !update && zm.buf[0] < ZIPMAP_BIGLEN {
+		zm.buf[0]++
+	}
+	return update
+}
+
+// Del remove key, return false if it was not in the zipmap
+func (zm *Zipmap) Del(key []byte) bool {
+	p, size, ok := zm.lookup(key)
+	if !ok {
+		return false
+	}
+	buf := make([]byte, 0, len(zm.buf)-size)
+	buf = append(buf, zm.buf[:p]...)
+	buf = append(buf, zm.buf[p+size:]...)
+	zm.buf = buf
+	if zm.buf[0] < ZIPMAP_BIGLEN {
+		zm.buf[0]--
+	}
+	return true
+}
+
+// Len number of pairs. When the count doesn't fit zmlen it is computed
+// walking the zipmap, and cached if it fits again.
+func (zm *Zipmap) Len() int {
+	if zm.buf[0] < ZIPMAP_BIGLEN {
+		return int(zm.buf[0])
+	}
+	num := 0
+	p := zm.Rewind()
+	for {
+		next, _, _, ok := zm.Next(p)
+		if !ok {
+			break
+		}
+		num++
+		p = next
+	}
+	if num < int(ZIPMAP_BIGLEN) {
+		zm.buf[0] = byte(num)
+	}
+	return num
+}
@@ -0,0 +1,26 @@
+// Package crc64 the 64 bit CRC used by Redis to checksum the RDB files:
+// the Jones polynomial (0xad93d23594c935a9), reflected input and output,
+// initial value 0 and no final xor.
+//
+// The check value, the CRC of "123456789", is 0xe9c6d914c4b8d9ca.
+package crc64
+
+import "hash/crc64"
+
+// jones the polynomial in the reversed notation of hash/crc64
+const jones = 0x95ac9329ac4bc9b5
+
+var table = crc64.MakeTable(jones)
+
+// Update return the result of adding the bytes in p to the crc
+func Update(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = table[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// Checksum the CRC of data
+func Checksum(data []byte) uint64 {
+	return Update(0, data)
+}
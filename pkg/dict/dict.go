@@ -0,0 +1,716 @@
+// Package dict a hash table with incremental rehashing, a port of the
+// Redis dict.
+//
+// The dict uses two tables: when the first one needs to grow a bigger
+// table is allocated and the entries are moved a few buckets at a time,
+// on every lookup and update, so there is never a long pause to rehash
+// a big table. While rehashing, lookups search both tables and new
+// entries go to the new one.
+package dict
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand"
+	"time"
+)
+
+// DICT_HT_INITIAL_SIZE the size of the first table
+const DICT_HT_INITIAL_SIZE int = 4
+
+// GETFAIR_NUM_ENTRIES number of entries sampled by GetFairRandomKey
+const GETFAIR_NUM_ENTRIES int = 15
+
+// hashSeed random seed of the hash functions, so that the distribution of
+// the keys in the buckets can't be predicted by the clients
+var hashSeed = maphash.MakeSeed()
+
+// GenHashFunction the default hash function, seeded at startup
+func GenHashFunction(key string) uint64 {
+	return maphash.String(hashSeed, key)
+}
+
+// GenCaseHashFunction a case insensitive hash function, for ASCII keys
+func GenCaseHashFunction(key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(hashSeed)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		h.WriteByte(c)
+	}
+	return h.Sum64()
+}
+
+// DictType the functions a dict uses to handle its keys. A nil
+// KeyCompare compares the keys byte by byte.
+type DictType struct {
+	HashFunction func(key string) uint64
+	KeyCompare   func(key1, key2 string) bool
+}
+
+// DefaultType binary safe keys hashed with GenHashFunction
+var DefaultType = &DictType{HashFunction: GenHashFunction}
+
+// Entry a key value pair of the dict. Key must not be modified.
+type Entry struct {
+	Key  string
+	Val  interface{}
+	next *Entry
+}
+
+// dictht a hash table with chaining, the size is a power of two
+type dictht struct {
+	table []*Entry
+	used  int
+}
+
+func (ht *dictht) size() int {
+	return len(ht.table)
+}
+
+func (ht *dictht) mask() uint64 {
+	return uint64(len(ht.table) - 1)
+}
+
+// Dict a hash table from string keys to values
+type Dict struct {
+	dtype       *DictType
+	ht          [2]dictht
+	rehashidx   int // bucket of ht[0] to rehash next, -1 when not rehashing
+	pauserehash int // rehashing is paused while > 0, by safe iterators and scans
+}
+
+// New create an empty dict, the table is allocated on the first insert
+func New(dtype *DictType) *Dict {
+	return &Dict{dtype: dtype, rehashidx: -1}
+}
+
+func (d *Dict) hashKey(key string) uint64 {
+	return d.dtype.HashFunction(key)
+}
+
+func (d *Dict) compareKeys(key1, key2 string) bool {
+	if d.dtype.KeyCompare == nil {
+		return key1 == key2
+	}
+	return d.dtype.KeyCompare(key1, key2)
+}
+
+// Len number of entries
+func (d *Dict) Len() int {
+	return d.ht[0].used + d.ht[1].used
+}
+
+// Slots number of buckets in both tables
+func (d *Dict) Slots() int {
+	return d.ht[0].size() + d.ht[1].size()
+}
+
+// IsRehashing true while entries are moved from the first table to the
+// second one
+func (d *Dict) IsRehashing() bool {
+	return d.rehashidx != -1
+}
+
+// PauseRehashing stop the lookups from moving entries, e.g. while the dict
+// is read by another goroutine. Each call must be paired with a
+// ResumeRehashing.
+func (d *Dict) PauseRehashing() {
+	d.pauserehash++
+}
+
+// ResumeRehashing undo a PauseRehashing
+func (d *Dict) ResumeRehashing() {
+	d.pauserehash--
+}
+
+// nextPower the smallest power of two >= size
+func nextPower(size int) int {
+	if size <= DICT_HT_INITIAL_SIZE {
+		return DICT_HT_INITIAL_SIZE
+	}
+	return 1 << bits.Len(uint(size-1))
+}
+
+// Expand create a table able to hold size entries, the entries are then
+// incrementally moved to it. Return false when rehashing or when size is
+// not valid.
+func (d *Dict) Expand(size int) bool {
+	// the size is invalid if it is smaller than the number of elements
+	// already inside the hash table
+	if d.IsRehashing() || d.ht[0].used > size {
+		return false
+	}
+	realsize := nextPower(size)
+	// rehashing to the same table size is not useful
+	if realsize == d.ht[0].size() {
+		return false
+	}
+	n := dictht{table: make([]*Entry, realsize)}
+
+	// is this the first initialization? If so it's not really a
+	// rehashing, we just set the first hash table so that it can accept
+	// keys
+	if d.ht[0].table == nil {
+		d.ht[0] = n
+		return true
+	}
+	// prepare a second hash table for incremental rehashing
+	d.ht[1] = n
+	d.rehashidx = 0
+	return true
+}
+
+// Resize shrink the table to the minimal size containing all the
+// entries, keeping the used/buckets ratio near 1
+func (d *Dict) Resize() bool {
+	if d.IsRehashing() {
+		return false
+	}
+	minimal := d.ht[0].used
+	if minimal < DICT_HT_INITIAL_SIZE {
+		minimal = DICT_HT_INITIAL_SIZE
+	}
+	return d.Expand(minimal)
+}
+
+// expandIfNeeded grow the table when it holds as many entries as buckets
+func (d *Dict) expandIfNeeded() {
+	// incremental rehashing already in progress
+	if d.IsRehashing() {
+		return
+	}
+	// if the hash table is empty expand it to the initial size
+	if d.ht[0].size() == 0 {
+		d.Expand(DICT_HT_INITIAL_SIZE)
+		return
+	}
+	// if we reached the 1:1 ratio we double the table
+	if d.ht[0].used >= d.ht[0].size() {
+		d.Expand(d.ht[0].used + 1)
+	}
+}
+
+// Rehash perform n steps of incremental rehashing, a step moves all the
+// entries of a bucket. Return true if there are still keys to move.
+//
+// Since part of the table may be composed of empty buckets, at max n*10
+// empty buckets are visited, otherwise the amount of work could be
+// unbounded.
+func (d *Dict) Rehash(n int) bool {
+	emptyVisits := n * 10
+	if !d.IsRehashing() {
+		return false
+	}
+
+	for ; n > 0 && d.ht[0].used != 0; n-- {
+		for d.ht[0].table[d.rehashidx] == nil {
+			d.rehashidx++
+			emptyVisits--
+			if emptyVisits == 0 {
+				return true
+			}
+		}
+		// move all the keys in this bucket from the old to the new table
+		de := d.ht[0].table[d.rehashidx]
+		for de != nil {
+			nextde := de.next
+			h := d.hashKey(de.Key) & d.ht[1].mask()
+			de.next = d.ht[1].table[h]
+			d.ht[1].table[h] = de
+			d.ht[0].used--
+			d.ht[1].used++
+			de = nextde
+		}
+		d.ht[0].table[d.rehashidx] = nil
+		d.rehashidx++
+	}
+
+	// check if we already rehashed the whole table
+	if d.ht[0].used == 0 {
+		d.ht[0] = d.ht[1]
+		d.ht[1] = dictht{}
+		d.rehashidx = -1
+		return false
+	}
+	return true
+}
+
+// RehashMilliseconds rehash in batches of 100 buckets for about ms
+// milliseconds, return the number of rehashed buckets. Used by the cron
+// to make progress on dicts nobody is accessing.
+func (d *Dict) RehashMilliseconds(ms int) int {
+	if d.pauserehash > 0 {
+		return 0
+	}
+	start := time.Now()
+	rehashes := 0
+	for d.Rehash(100) {
+		rehashes += 100
+		if time.Since(start) > time.Duration(ms)*time.Millisecond {
+			break
+		}
+	}
+	return rehashes
+}
+
+// rehashStep perform a single step of rehashing, unless it is paused.
+// Called by lookups and updates so that the table migrates while used.
+func (d *Dict) rehashStep() {
+	if d.pauserehash == 0 {
+		d.Rehash(1)
+	}
+}
+
+// Find return the entry of key or nil
+func (d *Dict) Find(key string) *Entry {
+	if d.Len() == 0 {
+		return nil
+	}
+	if d.IsRehashing() {
+		d.rehashStep()
+	}
+	h := d.hashKey(key)
+	for table := 0; table <= 1; table++ {
+		he := d.ht[table].table[h&d.ht[table].mask()]
+		for he != nil {
+			if d.compareKeys(he.Key, key) {
+				return he
+			}
+			he = he.next
+		}
+		if !d.IsRehashing() {
+			return nil
+		}
+	}
+	return nil
+}
+
+// FetchValue return the value of key, false if missing
+func (d *Dict) FetchValue(key string) (interface{}, bool) {
+	he := d.Find(key)
+	if he == nil {
+		return nil, false
+	}
+	return he.Val, true
+}
+
+// AddRaw add key with a nil value and return its entry. When the key
+// already exists nil is returned with the existing entry.
+func (d *Dict) AddRaw(key string) (entry *Entry, existing *Entry) {
+	if d.IsRehashing() {
+		d.rehashStep()
+	}
+	d.expandIfNeeded()
+
+	h := d.hashKey(key)
+	for table := 0; table <= 1; table++ {
+		he := d.ht[table].table[h&d.ht[table].mask()]
+		for he != nil {
+			if d.compareKeys(he.Key, key) {
+				return nil, he
+			}
+			he = he.next
+		}
+		if !d.IsRehashing() {
+			break
+		}
+	}
+
+	// insert the element at the head of the bucket, assuming that in a
+	// database system it is more likely that recently added entries are
+	// accessed more frequently. During rehashing new entries go to the
+	// new table.
+	ht := &d.ht[0]
+	if d.IsRehashing() {
+		ht = &d.ht[1]
+	}
+	idx := h & ht.mask()
+	entry = &Entry{Key: key, next: ht.table[idx]}
+	ht.table[idx] = entry
+	ht.used++
+	return entry, nil
+}
+
+// Add add key, return false if the key already exists
+func (d *Dict) Add(key string, val interface{}) bool {
+	entry, _ := d.AddRaw(key)
+	if entry == nil {
+		return false
+	}
+	entry.Val = val
+	return true
+}
+
+// Replace add or overwrite key. Return true if the key was added, false
+// if its value was updated.
+func (d *Dict) Replace(key string, val interface{}) bool {
+	entry, existing := d.AddRaw(key)
+	if entry != nil {
+		entry.Val = val
+		return true
+	}
+	existing.Val = val
+	return false
+}
+
+// Delete remove key, return false if it was missing
+func (d *Dict) Delete(key string) bool {
+	if d.Len() == 0 {
+		return false
+	}
+	if d.IsRehashing() {
+		d.rehashStep()
+	}
+	h := d.hashKey(key)
+	for table := 0; table <= 1; table++ {
+		idx := h & d.ht[table].mask()
+		var prev *Entry
+		he := d.ht[table].table[idx]
+		for he != nil {
+			if d.compareKeys(he.Key, key) {
+				if prev != nil {
+					prev.next = he.next
+				} else {
+					d.ht[table].table[idx] = he.next
+				}
+				d.ht[table].used--
+				return true
+			}
+			prev = he
+			he = he.next
+		}
+		if !d.IsRehashing() {
+			break
+		}
+	}
+	return false
+}
+
+// Empty remove every entry and release the tables
+func (d *Dict) Empty() {
+	d.ht[0] = dictht{}
+	d.ht[1] = dictht{}
+	d.rehashidx = -1
+}
+
+// GetRandomKey return a random entry, nil when the dict is empty. Keys
+// in long chains are less likely to be returned.
+func (d *Dict) GetRandomKey() *Entry {
+	if d.Len() == 0 {
+		return nil
+	}
+	if d.IsRehashing() {
+		d.rehashStep()
+	}
+	var he *Entry
+	if d.IsRehashing() {
+		s0 := d.ht[0].size()
+		for he == nil {
+			// we are sure there are no elements in indexes from 0 to
+			// rehashidx-1
+			h := d.rehashidx + rand.Intn(d.Slots()-d.rehashidx)
+			if h >= s0 {
+				he = d.ht[1].table[h-s0]
+			} else {
+				he = d.ht[0].table[h]
+			}
+		}
+	} else {
+		m := d.ht[0].mask()
+		for he == nil {
+			he = d.ht[0].table[rand.Uint64()&m]
+		}
+	}
+
+	// now we found a non empty bucket, but it is a linked list and we
+	// need to get a random element from the list
+	listlen := 0
+	for e := he; e != nil; e = e.next {
+		listlen++
+	}
+	for listele := rand.Intn(listlen); listele > 0; listele-- {
+		he = he.next
+	}
+	return he
+}
+
+// GetSomeKeys sample up to count entries from random locations. The
+// entries are not guaranteed to be distinct nor count of them are
+// returned, but it is much faster than calling GetRandomKey count times.
+//
+// A random bucket is picked and the consecutive buckets are collected,
+// jumping to another random bucket after too many empty ones.
+func (d *Dict) GetSomeKeys(count int) []*Entry {
+	if d.Len() < count {
+		count = d.Len()
+	}
+	if count == 0 {
+		return nil
+	}
+	maxsteps := count * 10
+
+	// try to do a rehashing work proportional to count
+	for j := 0; j < count && d.IsRehashing(); j++ {
+		d.rehashStep()
+	}
+
+	tables := 1
+	if d.IsRehashing() {
+		tables = 2
+	}
+	maxsizemask := d.ht[0].mask()
+	if tables > 1 && maxsizemask < d.ht[1].mask() {
+		maxsizemask = d.ht[1].mask()
+	}
+
+	// pick a random point inside the larger table
+	des := make([]*Entry, 0, count)
+	i := rand.Uint64() & maxsizemask
+	emptylen := 0 // continuous empty entries so far
+	for ; len(des) < count && maxsteps > 0; maxsteps-- {
+		for j := 0; j < tables; j++ {
+			// invariant of the rehashing: up to the indexes already
+			// visited in ht[0] during the rehashing there are no
+			// populated buckets, so we can skip ht[0] for indexes
+			// between 0 and rehashidx-1
+			if tables == 2 && j == 0 && i < uint64(d.rehashidx) {
+				// moreover, if we are currently out of range in the
+				// second table, there will be no elements in both tables
+				// up to the current rehashing index, so we jump if
+				// possible (this happens when going from big to small
+				// table)
+				if i >= uint64(d.ht[1].size()) {
+					i = uint64(d.rehashidx)
+				} else {
+					continue
+				}
+			}
+			if i >= uint64(d.ht[j].size()) {
+				continue // out of range for this table
+			}
+			he := d.ht[j].table[i]
+
+			// count contiguous empty buckets, and jump to other locations
+			// if they reach count (with a minimum of 5)
+			if he == nil {
+				emptylen++
+				if emptylen >= 5 && emptylen > count {
+					i = rand.Uint64() & maxsizemask
+					emptylen = 0
+				}
+				continue
+			}
+			emptylen = 0
+			// collect all the elements of the buckets found non empty
+			// while iterating
+			for ; he != nil; he = he.next {
+				des = append(des, he)
+				if len(des) == count {
+					return des
+				}
+			}
+		}
+		i = (i + 1) & maxsizemask
+	}
+	return des
+}
+
+// GetFairRandomKey like GetRandomKey but the entries in long chains are
+// not penalized: a few entries are sampled and one of them is returned
+func (d *Dict) GetFairRandomKey() *Entry {
+	entries := d.GetSomeKeys(GETFAIR_NUM_ENTRIES)
+	// GetSomeKeys may return zero elements in an unlucky run even if
+	// there are actually elements inside the hash table, so fall back to
+	// GetRandomKey that always yields an element if there is one
+	if len(entries) == 0 {
+		return d.GetRandomKey()
+	}
+	return entries[rand.Intn(len(entries))]
+}
+
+// Iterator iterate the entries of a dict.
+//
+// A safe iterator pauses rehashing, so the dict can be modified while
+// iterating. Any other iterator is unsafe: only Next can be called until
+// Release, which panics if the dict was modified in the meantime.
+type Iterator struct {
+	d           *Dict
+	table       int
+	index       int
+	safe        bool
+	entry       *Entry
+	nextEntry   *Entry
+	fingerprint uint64 // unsafe iterators: detects misuse
+}
+
+// GetIterator return an unsafe iterator, Release must be called when done
+func (d *Dict) GetIterator() *Iterator {
+	return &Iterator{d: d, index: -1}
+}
+
+// GetSafeIterator return an iterator allowing to modify the dict, Release
+// must be called when done
+func (d *Dict) GetSafeIterator() *Iterator {
+	it := d.GetIterator()
+	it.safe = true
+	return it
+}
+
+// Next return the next entry, nil at the end
+func (it *Iterator) Next() *Entry {
+	for {
+		if it.entry == nil {
+			if it.index == -1 && it.table == 0 {
+				if it.safe {
+					it.d.PauseRehashing()
+				} else {
+					it.fingerprint = it.d.fingerprint()
+				}
+			}
+			it.index++
+			if it.index >= it.d.ht[it.table].size() {
+				if it.d.IsRehashing() && it.table == 0 {
+					it.table++
+					it.index = 0
+				} else {
+					return nil
+				}
+			}
+			it.entry = it.d.ht[it.table].table[it.index]
+		} else {
+			it.entry = it.nextEntry
+		}
+		if it.entry != nil {
+			// we need to save the next here, the iterator user may
+			// delete the entry we are returning
+			it.nextEntry = it.entry.next
+			return it.entry
+		}
+	}
+}
+
+// Release end the iteration: rehashing is resumed for safe iterators,
+// unsafe ones check the dict was not modified
+func (it *Iterator) Release() {
+	if !(it.index == -1 && it.table == 0) {
+		if it.safe {
+			it.d.ResumeRehashing()
+		} else if it.fingerprint != it.d.fingerprint() {
+			panic("dict modified during an unsafe iteration")
+		}
+	}
+	it.d = nil
+}
+
+// fingerprint a 64 bit number representing the state of the dict at a
+// given time. If a different fingerprint is computed later the dict was
+// modified, even if the number of entries is the same. Pausing the
+// rehashing is not a modification: the fingerprint is only computed from
+// fields written when the entries move.
+func (d *Dict) fingerprint() uint64 {
+	integers := [5]uint64{
+		uint64(d.ht[0].size()), uint64(d.ht[0].used), uint64(d.rehashidx),
+		uint64(d.ht[1].size()), uint64(d.ht[1].used),
+	}
+	// we hash N integers by summing every successive integer with the
+	// integer hashing of the previous sum (Tomas Wang's 64 bit integer
+	// hash), so that the same set of integers in a different order will
+	// (likely) hash to a different number
+	var hash uint64
+	for _, n := range integers {
+		hash += n
+		hash = (^hash) + (hash << 21) // hash = (hash << 21) - hash - 1
+		hash = hash ^ (hash >> 24)
+		hash = (hash + (hash << 3)) + (hash << 8) // hash * 265
+		hash = hash ^ (hash >> 14)
+		hash = (hash + (hash << 2)) + (hash << 4) // hash * 21
+		hash = hash ^ (hash >> 28)
+		hash = hash + (hash << 31)
+	}
+	return hash
+}
+
+// Scan iterate the dict incrementally. Start with cursor 0, call fn on
+// the entries of the visited buckets and pass the returned cursor to the
+// next call, until 0 is returned.
+//
+// Every element present in the dict for the whole iteration is returned
+// at least once, even if the table grows or shrinks in the meantime.
+// Elements may be returned more than once.
+//
+// The cursor is incremented in its high bits: it is reversed, incremented
+// and reversed again. Buckets of a table of size 2^N map to the buckets
+// of a table of size 2^M sharing the same N low bits, so once the bucket
+// 0b110 of a table of 8 buckets is visited, the buckets xx0b110 of a
+// bigger table and 0b10 of a smaller one are all already visited or
+// still to be visited as a whole. While rehashing both tables are
+// scanned: the bucket of the smaller one, then all its expansions in the
+// bigger one.
+func (d *Dict) Scan(cursor uint64, fn func(de *Entry)) uint64 {
+	if d.Len() == 0 {
+		return 0
+	}
+
+	// this is needed in case the scan callback tries to do Find or similar
+	d.PauseRehashing()
+	defer d.ResumeRehashing()
+
+	v := cursor
+	if !d.IsRehashing() {
+		t0 := &d.ht[0]
+		m0 := t0.mask()
+
+		// emit entries at cursor
+		scanBucket(t0.table[v&m0], fn)
+
+		// set unmasked bits so incrementing the reversed cursor operates
+		// on the masked bits
+		v |= ^m0
+
+		// increment the reverse cursor
+		v = bits.Reverse64(v)
+		v++
+		v = bits.Reverse64(v)
+		return v
+	}
+
+	t0, t1 := &d.ht[0], &d.ht[1]
+	// make sure t0 is the smaller and t1 is the bigger table
+	if t0.size() > t1.size() {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := t0.mask(), t1.mask()
+
+	// emit entries at cursor
+	scanBucket(t0.table[v&m0], fn)
+
+	// iterate over indices in the larger table that are the expansion of
+	// the index pointed to by the cursor in the smaller table
+	for {
+		scanBucket(t1.table[v&m1], fn)
+
+		// increment the reverse cursor not covered by the smaller mask
+		v |= ^m1
+		v = bits.Reverse64(v)
+		v++
+		v = bits.Reverse64(v)
+
+		// continue while bits covered by mask difference is non-zero
+		if v&(m0^m1) == 0 {
+			break
+		}
+	}
+	return v
+}
+
+func scanBucket(de *Entry, fn func(de *Entry)) {
+	for de != nil {
+		next := de.next
+		fn(de)
+		de = next
+	}
+}
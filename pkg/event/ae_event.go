@@ -77,12 +77,12 @@ func NewAeEventLoop() *AeEventLoop {
 
 // Stop 关闭事件循环
 func (eventLoop *AeEventLoop) Stop() {
-	eventLoop.stop = 0
+	eventLoop.stop = 1
 }
 
 // CreateFileEvent	create file event and add to epoll
 func (eventLoop *AeEventLoop) CreateFileEvent(fd, mask int, proc AeFileProc, clientData interface{}) error {
-	if fd > constant.AE_SETSIZE {
+	if fd >= constant.AE_SETSIZE {
 		return errors.New("invalid fd")
 	}
 
@@ -94,7 +94,6 @@ func (eventLoop *AeEventLoop) CreateFileEvent(fd, mask int, proc AeFileProc, cli
 	if err := eventLoop.epollLoop.Add(eventLoop, fd, mask); err != nil {
 		return err
 	}
-	fmt.Printf("create fd:%d after add\n", fd)
 
 	fe.Mask |= mask
 	if (mask & constant.AE_READABLE) > 0 {
@@ -112,11 +111,12 @@ func (eventLoop *AeEventLoop) CreateFileEvent(fd, mask int, proc AeFileProc, cli
 	return nil
 }
 
-// CreateTimeEvent create time event and add to epoll
+// CreateTimeEvent create time event fired after ms milliseconds,
+// return the id of the event
 func (eventLoop *AeEventLoop) CreateTimeEvent(ms int64,
 	proc AeTimeProc,
 	finProc AeEventFinalizerProc,
-	clientData interface{}) {
+	clientData interface{}) int64 {
 
 	id := eventLoop.timeEventNextId
 	eventLoop.timeEventNextId += 1
@@ -129,17 +129,62 @@ func (eventLoop *AeEventLoop) CreateTimeEvent(ms int64,
 		WhenMs:        time.Now().UnixNano()/1e6 + ms,
 	}
 	eventLoop.timeEventHead = te
-
+	return id
 }
 
 // CreateFiredEvent  create fired event and add to epoll
 func (eventLoop *AeEventLoop) CreateFiredEvent() {}
 
 // DelFileEvent del file event
-func (eventLoop *AeEventLoop) DelFileEvent() {}
+func (eventLoop *AeEventLoop) DelFileEvent(fd, mask int) {
+	if fd < 0 || fd >= constant.AE_SETSIZE {
+		return
+	}
+	fe := eventLoop.fileEvents[fd]
+	if fe.Mask == constant.AE_NONE {
+		return
+	}
+	if err := eventLoop.epollLoop.Del(eventLoop, fd, mask); err != nil {
+		fmt.Printf("del file event fd:%d failed:%v\n", fd, err)
+	}
+	fe.Mask = fe.Mask & (^mask)
+	if fe.Mask == constant.AE_NONE {
+		fe.RFileProc = nil
+		fe.WFileProc = nil
+		fe.ClientData = nil
+	}
+	if fd == eventLoop.maxFd && fe.Mask == constant.AE_NONE {
+		// update the max fd
+		j := eventLoop.maxFd - 1
+		for ; j >= 0; j-- {
+			if eventLoop.fileEvents[j].Mask != constant.AE_NONE {
+				break
+			}
+		}
+		eventLoop.maxFd = j
+	}
+}
 
 // DelTimeEvent del time event
-func (eventLoop *AeEventLoop) DelTimeEvent(id int64) {}
+func (eventLoop *AeEventLoop) DelTimeEvent(id int64) {
+	var prev *AeTimeEvent
+	te := eventLoop.timeEventHead
+	for te != nil {
+		if te.Id == id {
+			if prev == nil {
+				eventLoop.timeEventHead = te.Next
+			} else {
+				prev.Next = te.Next
+			}
+			if te.FinalizerProc != nil {
+				te.FinalizerProc(eventLoop, te.ClientData)
+			}
+			return
+		}
+		prev = te
+		te = te.Next
+	}
+}
 
 // DelFiredEvent del fired event
 func (eventLoop *AeEventLoop) DelFiredEvent() {}
@@ -160,7 +205,9 @@ func (eventLoop *AeEventLoop) Main() {
 func (eventLoop *AeEventLoop) Wait(fd, mask int, milliseconds int64) {}
 
 // SetBeforeSleepProc set proc before enter event loop
-func (eventLoop *AeEventLoop) SetBeforeSleepProc(proc AeBeForeSleepProc) {}
+func (eventLoop *AeEventLoop) SetBeforeSleepProc(proc AeBeForeSleepProc) {
+	eventLoop.beforeSleepProc = proc
+}
 
 // ========== interal func ==================
 /* Process every pending time event, then every pending file event
@@ -182,13 +229,17 @@ func (eventLoop *AeEventLoop) processEvents(flags int) int {
 	}
 	timeout := int64(-1)
 	if shortest != nil {
+		// wait until the nearest timer, without blocking when it is already due
 		nowMs := time.Now().UnixNano() / 1e6
 		timeout = shortest.WhenMs - nowMs
 		if timeout < 0 {
-			timeout = -1
+			timeout = 0
 		}
-	} else {
+	} else if (flags & constant.AE_DONT_WAIT) > 0 {
 		timeout = 0
+	} else {
+		// no timers, block until a file event fires
+		timeout = -1
 	}
 
 	//fmt.Printf("processEvents timeout:%d\n", timeout)
@@ -226,7 +277,8 @@ func (eventLoop *AeEventLoop) processEvents(flags int) int {
 func (eventLoop *AeEventLoop) processTimeEvents() int {
 	processed := 0
 	te := eventLoop.timeEventHead
-	maxId := eventLoop.timeEventNextId
+	// events created by the handlers are processed in the next iteration
+	maxId := eventLoop.timeEventNextId - 1
 	for te != nil {
 		if te.Id > maxId {
 			te = te.Next
@@ -234,7 +286,7 @@ func (eventLoop *AeEventLoop) processTimeEvents() int {
 		}
 		nowMs := time.Now().UnixNano() / 1e6
 		id := te.Id
-		if nowMs > te.WhenMs {
+		if nowMs >= te.WhenMs {
 			ret := te.TimeProc(eventLoop, te.Id, te.ClientData)
 			processed += 1
 			if ret != int64(constant.AE_NOMORE) {
@@ -242,7 +294,9 @@ func (eventLoop *AeEventLoop) processTimeEvents() int {
 			} else {
 				eventLoop.DelTimeEvent(id)
 			}
-
+			// the handler may have added or deleted events, restart
+			// from the head of the list
+			te = eventLoop.timeEventHead
 		} else {
 			te = te.Next
 		}
@@ -12,62 +12,67 @@ import (
 )
 
 type Epoll struct {
-	fd int
-	ts syscall.Timespec
-	mu *sync.RWMutex
+	fd     int
+	ts     syscall.Timespec
+	mu     *sync.RWMutex
+	events []syscall.EpollEvent
 }
 
 func NewEpoll() (IEpoll, error) {
-	var err error
-	efd, err = syscall.EpollCreate1(0)
+	efd, err := syscall.EpollCreate1(0)
 	if err != nil {
-		fmt.Printf("create epoll failed:\n", err)
+		fmt.Printf("create epoll failed:%v\n", err)
 		return nil, err
 	}
 	ret := &Epoll{
-		fd: efd,
-		mu: &sync.RWMutex{},
-		ts: syscall.NsecToTimespec(1e9),
+		fd:     efd,
+		mu:     &sync.RWMutex{},
+		ts:     syscall.NsecToTimespec(1e9),
+		events: make([]syscall.EpollEvent, constant.AE_SETSIZE),
 	}
-	return ret
+	return ret, nil
 }
 
 func (e *Epoll) Remove(fd int) error {
-
+	if err := syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, fd, &syscall.EpollEvent{}); err != nil {
+		fmt.Printf("remove event from epoll failed:%v\n", err)
+		return err
+	}
+	return nil
 }
 
 func (e *Epoll) Add(eventLoop *AeEventLoop, fd, mask int) error {
 
-	op = syscall.EPOLL_CTL_MOD
+	// If the fd was already monitored for some event, we need a MOD
+	// operation. Otherwise we need an ADD operation.
+	op := syscall.EPOLL_CTL_MOD
 	if eventLoop.fileEvents[fd].Mask == constant.AE_NONE {
 		op = syscall.EPOLL_CTL_ADD
 	}
-	ev := syscall.EpollEvent{
-		Fd:     int32(fd),
-		Events: 0,
-	}
 	mask |= eventLoop.fileEvents[fd].Mask
-	if (mask & constant.AE_READABLE) > 0 {
-		ev.Events |= syscall.EPOLLIN
+	ev := e.maskToEvent(fd, mask)
+	if err := syscall.EpollCtl(e.fd, op, fd, &ev); err != nil {
+		fmt.Printf("add event to epoll failed:%v\n", err)
+		return err
 	}
-	if (mask & constant.AE_WRITABLE) > 0 {
-		ev.Events |= syscall.EPOLLOUT
+	return nil
+}
+
+func (e *Epoll) Del(eventLoop *AeEventLoop, fd, delmask int) error {
+	mask := eventLoop.fileEvents[fd].Mask & (^delmask)
+	if mask == constant.AE_NONE {
+		return e.Remove(fd)
 	}
-	err = syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, int(fd), &ev)
-	if err != nil {
-		fmt.Printf("add event to event failed:%v\n", err)
+	ev := e.maskToEvent(fd, mask)
+	if err := syscall.EpollCtl(e.fd, syscall.EPOLL_CTL_MOD, fd, &ev); err != nil {
+		fmt.Printf("mod event in epoll failed:%v\n", err)
 		return err
 	}
+	return nil
 }
 
 func (e *Epoll) Wait(eventLoop *AeEventLoop, timeout int64) (int, error) {
-	e.mu.RLock()
-	changes := e.changes
-	e.mu.RUnlock()
-	ret := []int{}
-
-	events := make([]syscall.EpollEvent, constant.AE_SETSIZE)
-	n, err := syscall.EpollWait(e.fd, events, timeout)
+	n, err := syscall.EpollWait(e.fd, e.events, int(timeout))
 	if err != nil {
 		if err == syscall.EINTR {
 			return 0, nil
@@ -75,18 +80,20 @@ func (e *Epoll) Wait(eventLoop *AeEventLoop, timeout int64) (int, error) {
 		return 0, err
 	}
 
-	e.mu.RLock()
-	defer e.mu.RUnlock()
 	for i := 0; i < n; i++ {
 		mask := 0
-		if (events[i].events & syscall.EPOLLIN) > 0 {
+		ev := e.events[i]
+		if (ev.Events & syscall.EPOLLIN) > 0 {
 			mask |= constant.AE_READABLE
 		}
-		if (events[i].events & syscall.EPOLLOUT) > 0 {
+		if (ev.Events & syscall.EPOLLOUT) > 0 {
 			mask |= constant.AE_WRITABLE
 		}
-		eventLoop.fired[i].Fd = events[i].Fd
-		eventLoop.fired[i].Mask = mask
+		if (ev.Events & (syscall.EPOLLERR | syscall.EPOLLHUP)) > 0 {
+			mask |= constant.AE_READABLE | constant.AE_WRITABLE
+		}
+		eventLoop.firedEvents[i].Fd = int(ev.Fd)
+		eventLoop.firedEvents[i].Mask = mask
 	}
 	return n, nil
 }
@@ -111,6 +118,19 @@ func (e *Epoll) WaitWithChan() <-chan []int {
 func (e *Epoll) Close() error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	e.changes = nil
 	return syscall.Close(e.fd)
 }
+
+func (e *Epoll) maskToEvent(fd, mask int) syscall.EpollEvent {
+	ev := syscall.EpollEvent{
+		Fd:     int32(fd),
+		Events: 0,
+	}
+	if (mask & constant.AE_READABLE) > 0 {
+		ev.Events |= syscall.EPOLLIN
+	}
+	if (mask & constant.AE_WRITABLE) > 0 {
+		ev.Events |= syscall.EPOLLOUT
+	}
+	return ev
+}
@@ -57,11 +57,53 @@ func (e *Kqueue) Add(eventLoop *AeEventLoop, fd, mask int) error {
 
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	e.changes = append(e.changes, syscall.Kevent_t{
-		Ident:  uint64(fd),
-		Flags:  syscall.EV_ADD | syscall.EV_EOF,
-		Filter: syscall.EVFILT_READ,
-	})
+	if (mask & constant.AE_READABLE) > 0 {
+		e.changes = append(e.changes, syscall.Kevent_t{
+			Ident:  uint64(fd),
+			Flags:  syscall.EV_ADD | syscall.EV_EOF,
+			Filter: syscall.EVFILT_READ,
+		})
+	}
+	if (mask & constant.AE_WRITABLE) > 0 {
+		e.changes = append(e.changes, syscall.Kevent_t{
+			Ident:  uint64(fd),
+			Flags:  syscall.EV_ADD | syscall.EV_EOF,
+			Filter: syscall.EVFILT_WRITE,
+		})
+	}
+	return nil
+}
+
+func (e *Kqueue) Del(eventLoop *AeEventLoop, fd, delmask int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	ident := uint64(fd)
+	changes := make([]syscall.Kevent_t, 0, len(e.changes))
+	for _, ke := range e.changes {
+		if ke.Ident == ident {
+			if (delmask&constant.AE_READABLE) > 0 && ke.Filter == syscall.EVFILT_READ {
+				continue
+			}
+			if (delmask&constant.AE_WRITABLE) > 0 && ke.Filter == syscall.EVFILT_WRITE {
+				continue
+			}
+		}
+		changes = append(changes, ke)
+	}
+	e.changes = changes
+
+	// the registered filters stay in the kernel queue until explicitly deleted
+	dels := []syscall.Kevent_t{}
+	if (delmask & constant.AE_READABLE) > 0 {
+		dels = append(dels, syscall.Kevent_t{Ident: ident, Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_READ})
+	}
+	if (delmask & constant.AE_WRITABLE) > 0 {
+		dels = append(dels, syscall.Kevent_t{Ident: ident, Flags: syscall.EV_DELETE, Filter: syscall.EVFILT_WRITE})
+	}
+	for i := range dels {
+		syscall.Kevent(e.fd, dels[i:i+1], nil, nil)
+	}
 	return nil
 }
 
@@ -0,0 +1,205 @@
+package lzf
+
+import (
+	"math"
+	"sync"
+)
+
+// The compressor is a port of lzf_c.c with the settings used by Redis:
+// HLOG 16 and VERY_FAST, so the output is the same byte for byte. The hash
+// table always starts empty, as liblzf does with INIT_HTAB, to keep the
+// output deterministic.
+
+const (
+	hlog  = 16
+	hsize = 1 << hlog
+
+	maxLit = 1 << 5
+	maxOff = 1 << 13
+	maxRef = (1 << 8) + (1 << 3)
+)
+
+// htable the hash table of the compressor. Clearing its 256KB costs more
+// than compressing a short string, so the entries store the offsets plus
+// base instead: base moves past the offsets of the previous calls and the
+// entries below it read as a negative offset, that is never referenced.
+type htable struct {
+	slots [hsize]uint32
+	base  uint32
+}
+
+// reset empty the table for an input of n bytes
+func (t *htable) reset(n int) {
+	if uint64(t.base)+uint64(n) >= math.MaxUint32 {
+		t.slots = [hsize]uint32{}
+		t.base = 0
+	}
+}
+
+// htabPool reuse the hash tables between the calls
+var htabPool = sync.Pool{
+	New: func() interface{} { return new(htable) },
+}
+
+// first the hash of the first two bytes at p
+func first(in []byte, p int) uint32 {
+	return uint32(in[p])<<8 | uint32(in[p+1])
+}
+
+// next roll the third byte at p into the hash
+func next(v uint32, in []byte, p int) uint32 {
+	return v<<8 | uint32(in[p+2])
+}
+
+func idx(h uint32) uint32 {
+	return ((h >> (3*8 - hlog)) - h*5) & (hsize - 1)
+}
+
+// Compress compress in into out, return the number of bytes written or 0
+// when the compressed data doesn't fit out. Pass an out shorter than in to
+// only get a result when the compression saves space. Inputs of less than
+// 4 bytes can't be compressed.
+func Compress(in, out []byte) int {
+	if len(in) == 0 || len(out) == 0 {
+		return 0
+	}
+
+	htab := htabPool.Get().(*htable)
+	defer htabPool.Put(htab)
+	// the table stores the offsets of the last 3 bytes sequences with
+	// each hash, 0 is never referenced so an empty table has no entry
+	htab.reset(len(in))
+	base := htab.base
+	htab.base += uint32(len(in))
+
+	inEnd, outEnd := len(in), len(out)
+	ip, op := 0, 0
+	lit := 0
+	op++ // start run
+
+	var hval uint32
+	if inEnd > 2 {
+		hval = first(in, ip)
+	}
+	for ip < inEnd-2 {
+		hval = next(hval, in, ip)
+		slot := idx(hval)
+		ref := int(htab.slots[slot]) - int(base)
+		htab.slots[slot] = base + uint32(ip)
+
+		off := ip - ref - 1
+		if ref < ip && off < maxOff && ref > 0 &&
+			in[ref+2] == in[ip+2] && in[ref] == in[ip] && in[ref+1] == in[ip+1] {
+			// match found at ref
+			l := 2
+			maxlen := inEnd - ip - l
+			if maxlen > maxRef {
+				maxlen = maxRef
+			}
+
+			if op+3+1 >= outEnd {
+				// the exact test, lit == 0 frees the run byte
+				if op-b2i(lit == 0)+3+1 >= outEnd {
+					return 0
+				}
+			}
+
+			out[op-lit-1] = byte(lit - 1) // stop run
+			op -= b2i(lit == 0)           // undo run if length is zero
+
+			// liblzf unrolls the first 16 comparisons without checking
+			// maxlen, the match can be up to 2 bytes longer than maxlen
+			matched := false
+			if maxlen > 16 {
+				for i := 0; i < 16; i++ {
+					l++
+					if in[ref+l] != in[ip+l] {
+						matched = true
+						break
+					}
+				}
+			}
+			if !matched {
+				for {
+					l++
+					if l >= maxlen || in[ref+l] != in[ip+l] {
+						break
+					}
+				}
+			}
+
+			l -= 2 // l is now the number of bytes - 1
+			ip++
+
+			if l < 7 {
+				out[op] = byte(off>>8 + l<<5)
+				op++
+			} else {
+				out[op] = byte(off>>8 + 7<<5)
+				out[op+1] = byte(l - 7)
+				op += 2
+			}
+			out[op] = byte(off)
+			op++
+
+			lit = 0
+			op++ // start run
+
+			ip += l + 1
+			if ip >= inEnd-2 {
+				break
+			}
+
+			// hash the last two bytes of the match
+			ip -= 2
+			hval = first(in, ip)
+			hval = next(hval, in, ip)
+			htab.slots[idx(hval)] = base + uint32(ip)
+			ip++
+			hval = next(hval, in, ip)
+			htab.slots[idx(hval)] = base + uint32(ip)
+			ip++
+		} else {
+			// one more literal byte we must copy
+			if op >= outEnd {
+				return 0
+			}
+			lit++
+			out[op] = in[ip]
+			op++
+			ip++
+			if lit == maxLit {
+				out[op-lit-1] = byte(lit - 1) // stop run
+				lit = 0
+				op++ // start run
+			}
+		}
+	}
+
+	// at most 3 bytes can be missing here
+	if op+3 > outEnd {
+		return 0
+	}
+	for ip < inEnd {
+		lit++
+		out[op] = in[ip]
+		op++
+		ip++
+		if lit == maxLit {
+			out[op-lit-1] = byte(lit - 1) // stop run
+			lit = 0
+			op++ // start run
+		}
+	}
+
+	out[op-lit-1] = byte(lit - 1) // end run
+	op -= b2i(lit == 0)           // undo run if length is zero
+	return op
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
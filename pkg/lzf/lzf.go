@@ -0,0 +1,78 @@
+// Package lzf the LZF compression format of liblzf, used by Redis for the
+// strings of the RDB files. Compress and Decompress don't depend on the
+// RDB code and produce the same bytes as liblzf.
+//
+// The compressed data is a sequence of chunks, each starting with a
+// control byte:
+//
+//	000LLLLL                    literal run of L+1 bytes following the control byte
+//	LLLooooo oooooooo           back reference of L+2 bytes, at offset o+1
+//	111ooooo LLLLLLLL oooooooo  back reference of L+9 bytes, at offset o+1
+//
+// The offsets count backwards from the current end of the output.
+package lzf
+
+import "errors"
+
+var (
+	// ErrInsufficientBuffer the output buffer can't hold the decompressed data
+	ErrInsufficientBuffer = errors.New("lzf: output buffer too small")
+	// ErrCorrupt the compressed data is invalid
+	ErrCorrupt = errors.New("lzf: invalid compressed data")
+)
+
+// Decompress decompress in into out, return the number of bytes written.
+// out must be large enough to hold the whole decompressed data, its
+// length is usually stored along with the compressed data.
+func Decompress(in, out []byte) (int, error) {
+	ip, op := 0, 0
+	for ip < len(in) {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// literal run
+			ctrl++
+			if op+ctrl > len(out) {
+				return 0, ErrInsufficientBuffer
+			}
+			if ip+ctrl > len(in) {
+				return 0, ErrCorrupt
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			ip += ctrl
+			op += ctrl
+			continue
+		}
+
+		// back reference
+		l := ctrl >> 5
+		ref := op - (ctrl&0x1F)<<8 - 1
+		if ip >= len(in) {
+			return 0, ErrCorrupt
+		}
+		if l == 7 {
+			l += int(in[ip])
+			ip++
+			if ip >= len(in) {
+				return 0, ErrCorrupt
+			}
+		}
+		ref -= int(in[ip])
+		ip++
+		l += 2
+		if op+l > len(out) {
+			return 0, ErrInsufficientBuffer
+		}
+		if ref < 0 {
+			return 0, ErrCorrupt
+		}
+		// the reference can overlap the bytes being written: copy one
+		// byte at a time
+		for i := 0; i < l; i++ {
+			out[op+i] = out[ref+i]
+		}
+		op += l
+	}
+	return op, nil
+}
@@ -0,0 +1,218 @@
+package lzf
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// maxCompressed an out buffer always large enough: a control byte every 32
+// literals, plus the 3 bytes the compressor wants free before copying the
+// last literals
+func maxCompressed(n int) int {
+	return n + n/32 + 1 + 3
+}
+
+func compressible(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		buf.WriteString("user:")
+		buf.WriteByte(byte('0' + i%10))
+		buf.WriteString(":name=redis,value=")
+		buf.WriteByte(byte('a' + i%26))
+		buf.WriteString("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa;")
+	}
+	return buf.Bytes()[:n]
+}
+
+func incompressible(n int) []byte {
+	buf := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(buf)
+	return buf
+}
+
+// checkRoundTrip compress in with the out buffer sizes the callers use and
+// check the data comes back unchanged
+func checkRoundTrip(t *testing.T, in []byte) {
+	out := make([]byte, maxCompressed(len(in)))
+	n := Compress(in, out)
+	if n == 0 {
+		if len(in) >= 4 {
+			t.Fatalf("Compress(%d bytes) failed with a worst case buffer", len(in))
+		}
+		return
+	}
+	if n > len(out) {
+		t.Fatalf("Compress(%d bytes) = %d, more than the %d bytes buffer", len(in), n, len(out))
+	}
+	comp := out[:n]
+
+	dec := make([]byte, len(in))
+	m, err := Decompress(comp, dec)
+	if err != nil {
+		t.Fatalf("Decompress: %v", err)
+	}
+	if m != len(in) || !bytes.Equal(dec[:m], in) {
+		t.Fatalf("round trip mismatch: %d bytes in, %d bytes out", len(in), m)
+	}
+
+	// a shorter output buffer is an error, never a partial result
+	if len(in) > 0 {
+		if _, err := Decompress(comp, dec[:len(in)-1]); err != ErrInsufficientBuffer {
+			t.Fatalf("Decompress with a short buffer = %v, want %v", err, ErrInsufficientBuffer)
+		}
+	}
+
+	// a compression that doesn't fit returns 0, as liblzf the check of the
+	// tail is conservative and can also give 0 with a buffer of n bytes
+	for _, size := range []int{n - 1, n / 2, len(in) - 1, 1} {
+		if size <= 0 || size > len(out) {
+			continue
+		}
+		small := make([]byte, size)
+		got := Compress(in, small)
+		if size < n && got != 0 {
+			t.Fatalf("Compress into %d bytes = %d, the data needs %d", size, got, n)
+		}
+		if got != 0 && !bytes.Equal(small[:got], comp) {
+			t.Fatalf("Compress into %d bytes differs from the large buffer", size)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abc"),
+		[]byte("abcd"),
+		[]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"),
+		bytes.Repeat([]byte{0}, 100000), // references longer than maxRef
+		compressible(20),
+		compressible(100000), // offsets up to maxOff
+		incompressible(31),
+		incompressible(33), // more than one literal run
+		incompressible(100000),
+	}
+	for _, in := range inputs {
+		checkRoundTrip(t, in)
+	}
+}
+
+func TestIncompressible(t *testing.T) {
+	// the literal runs make random data larger, it never fits in a buffer
+	// shorter than the input
+	for _, n := range []int{4, 100, 4096, 100000} {
+		in := incompressible(n)
+		if got := Compress(in, make([]byte, n-1)); got != 0 {
+			t.Errorf("Compress(%d random bytes) = %d, want 0", n, got)
+		}
+	}
+	in := compressible(4096)
+	if got := Compress(in, make([]byte, len(in)-1)); got == 0 || got >= len(in)/2 {
+		t.Errorf("Compress(%d compressible bytes) = %d", len(in), got)
+	}
+}
+
+func TestCompressDeterministic(t *testing.T) {
+	inputs := [][]byte{compressible(1000), incompressible(1000), compressible(50), []byte("abcdabcdabcd")}
+	want := make([][]byte, len(inputs))
+	for i, in := range inputs {
+		out := make([]byte, maxCompressed(len(in)))
+		want[i] = out[:Compress(in, out)]
+	}
+	// the entries left by the previous calls are never referenced
+	for round := 0; round < 3; round++ {
+		for i, in := range inputs {
+			out := make([]byte, maxCompressed(len(in)))
+			if got := out[:Compress(in, out)]; !bytes.Equal(got, want[i]) {
+				t.Fatalf("round %d: Compress(input %d) differs from the first call", round, i)
+			}
+		}
+	}
+
+	// a table whose base would overflow is cleared
+	htab := htabPool.Get().(*htable)
+	htab.base = math.MaxUint32 - 10
+	htabPool.Put(htab)
+	for i, in := range inputs {
+		out := make([]byte, maxCompressed(len(in)))
+		if got := out[:Compress(in, out)]; !bytes.Equal(got, want[i]) {
+			t.Fatalf("Compress(input %d) after the base wrapped differs from the first call", i)
+		}
+	}
+}
+
+func TestDecompressCorrupt(t *testing.T) {
+	tests := [][]byte{
+		{0x05, 'a', 'b'},  // literal run past the end of the input
+		{0x20, 0x00},      // back reference before the start of the output
+		{0x00, 'a', 0x20}, // back reference without its offset byte
+		{0x00, 'a', 0xe0}, // long back reference without its length byte
+		{0x00, 'a', 0xe0, 0x00},
+		{0x00, 'a', 0x3f, 0xff}, // offset past the start of the output
+	}
+	out := make([]byte, 1024)
+	for _, in := range tests {
+		if _, err := Decompress(in, out); err != ErrCorrupt {
+			t.Errorf("Decompress(%x) = %v, want %v", in, err, ErrCorrupt)
+		}
+	}
+}
+
+func FuzzCompressDecompress(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add([]byte("abcd"))
+	f.Add([]byte("hello hello hello hello"))
+	f.Add(bytes.Repeat([]byte{0}, 1000))
+	f.Add(compressible(300))
+	f.Add(incompressible(300))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		checkRoundTrip(t, in)
+
+		// arbitrary data as compressed input must fail cleanly
+		out := make([]byte, 4*len(in))
+		if n, err := Decompress(in, out); err == nil && n > len(out) {
+			t.Fatalf("Decompress = %d, more than the %d bytes buffer", n, len(out))
+		}
+	})
+}
+
+func benchmarkCompress(b *testing.B, in []byte) {
+	out := make([]byte, maxCompressed(len(in)))
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if Compress(in, out) == 0 {
+			b.Fatal("Compress failed")
+		}
+	}
+}
+
+func benchmarkDecompress(b *testing.B, in []byte) {
+	comp := make([]byte, maxCompressed(len(in)))
+	comp = comp[:Compress(in, comp)]
+	out := make([]byte, len(in))
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decompress(comp, out); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCompress(b *testing.B) {
+	b.Run("text-1KB", func(b *testing.B) { benchmarkCompress(b, compressible(1024)) })
+	b.Run("text-64KB", func(b *testing.B) { benchmarkCompress(b, compressible(64*1024)) })
+	b.Run("random-64KB", func(b *testing.B) { benchmarkCompress(b, incompressible(64*1024)) })
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	b.Run("text-1KB", func(b *testing.B) { benchmarkDecompress(b, compressible(1024)) })
+	b.Run("text-64KB", func(b *testing.B) { benchmarkDecompress(b, compressible(64*1024)) })
+	b.Run("random-64KB", func(b *testing.B) { benchmarkDecompress(b, incompressible(64*1024)) })
+}
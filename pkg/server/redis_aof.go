@@ -0,0 +1,450 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/log"
+)
+
+// Append only file
+//
+// Every command changing the dataset is appended to the AOF in the RESP
+// format of the requests. The commands accumulate in aofBuf while the
+// clients are served and are written in beforeSleep, before any reply is
+// sent: a client never gets the acknowledge of a write missing from the
+// AOF. Then the file is fsynced as configured by appendfsync: after every
+// write (always), once per second by a background goroutine (everysec) or
+// never, leaving it to the OS (no).
+//
+// At startup the AOF is replayed with a client without connection before
+// the event loop starts. The commands whose effects depend on the time or
+// on random choices are propagated in a deterministic form, e.g. EXPIRE
+// becomes PEXPIREAT and SPOP becomes SREM, and keys don't expire while
+// loading: the DEL of the keys that expired is in the file.
+
+// aofFsyncer fsync the AOF in its own goroutine for appendfsync everysec,
+// an fsync may take seconds on a busy disk and the event loop must not
+// wait for it
+type aofFsyncer struct {
+	jobs       chan *os.File
+	inProgress atomic.Bool
+
+	mu      sync.Mutex
+	lastErr error // error of the last fsync, nil when it succeeded
+}
+
+func newAofFsyncer() *aofFsyncer {
+	f := &aofFsyncer{jobs: make(chan *os.File, 1)}
+	go f.run()
+	return f
+}
+
+func (f *aofFsyncer) run() {
+	for file := range f.jobs {
+		err := file.Sync()
+		if err != nil {
+			log.RedisLog(log.REDIS_WARNING, "Error syncing the AOF file in the background: %v", err)
+		}
+		f.mu.Lock()
+		f.lastErr = err
+		f.mu.Unlock()
+		f.inProgress.Store(false)
+	}
+}
+
+// fsync start an fsync of file, the previous one must be completed
+func (f *aofFsyncer) fsync(file *os.File) {
+	f.inProgress.Store(true)
+	f.jobs <- file
+}
+
+func (f *aofFsyncer) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastErr
+}
+
+func (svr *RedisServer) aofFilename() string {
+	return filepath.Join(svr.conf.Dir, svr.conf.AppendFilename)
+}
+
+// ======================= propagation ===========================
+
+// propagate the effects of a command executed in db dbid
+func (svr *RedisServer) propagate(dbid int, argv [][]byte) {
+	svr.feedAppendOnlyFile(dbid, argv)
+}
+
+// catAppendOnlyGenericCommand append argv to buf as a RESP multibulk
+func catAppendOnlyGenericCommand(buf []byte, argv [][]byte) []byte {
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(argv)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range argv {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// feedAppendOnlyFile queue argv to be written to the AOF, preceded by a
+// SELECT when the command runs in another db than the previous one
+func (svr *RedisServer) feedAppendOnlyFile(dbid int, argv [][]byte) {
+	if svr.aofFile == nil {
+		return
+	}
+	if dbid != svr.aofSelectedDb {
+		svr.aofBuf = catAppendOnlyGenericCommand(svr.aofBuf,
+			[][]byte{[]byte("SELECT"), []byte(strconv.Itoa(dbid))})
+		svr.aofSelectedDb = dbid
+	}
+	svr.aofBuf = catAppendOnlyGenericCommand(svr.aofBuf, argv)
+}
+
+// ======================= write and fsync ===========================
+
+// flushAppendOnlyFile write the AOF buffer to the file and fsync it as
+// configured by appendfsync. With everysec the write is postponed while a
+// background fsync is in progress, as the write would block on most
+// kernels, but for at most REDIS_AOF_MAX_POSTPONE seconds.
+func (svr *RedisServer) flushAppendOnlyFile() {
+	if svr.aofFile == nil {
+		return
+	}
+	now := time.Now().Unix()
+	everysec := svr.conf.AppendSync == constant.AOF_FSYNC_EVERYSEC
+
+	if len(svr.aofBuf) == 0 {
+		// nothing to write, but the data written in the last second
+		// may still need its fsync, or a failed fsync its retry
+		if everysec && (svr.aofFsyncOffset != svr.aofCurrentSize || svr.aofFsyncer.err() != nil) {
+			svr.aofBackgroundFsync(now)
+		}
+		return
+	}
+
+	if everysec && svr.aofFsyncer.inProgress.Load() {
+		if svr.aofFlushPostponedStart == 0 {
+			// no previous write postponing, remember that we are
+			// postponing the flush and return
+			svr.aofFlushPostponedStart = now
+			return
+		} else if now-svr.aofFlushPostponedStart < constant.REDIS_AOF_MAX_POSTPONE {
+			// we were already waiting for fsync to finish, but for
+			// less than two seconds this is still ok
+			return
+		}
+		// otherwise fall through and go write since we can't wait over
+		// two seconds
+		svr.aofDelayedFsync++
+		log.RedisLog(log.REDIS_NOTICE, "Asynchronous AOF fsync is taking too long (disk is busy?). "+
+			"Writing the AOF buffer without waiting for fsync to complete, this may slow down Redis.")
+	}
+	svr.aofFlushPostponedStart = 0
+
+	n, err := svr.aofFile.Write(svr.aofBuf)
+	if err != nil {
+		if n > 0 {
+			// remove the partial command, so the AOF still ends with
+			// a complete one
+			if terr := svr.aofFile.Truncate(svr.aofCurrentSize); terr != nil {
+				log.RedisLog(log.REDIS_WARNING, "Could not remove short write from the append-only file. "+
+					"Redis may refuse to load the AOF the next time it starts. ftruncate: %v", terr)
+				// the partial command stays in the file, only the
+				// rest of the buffer can be written again
+				svr.aofCurrentSize += int64(n)
+				svr.aofBuf = svr.aofBuf[n:]
+			}
+		}
+		if svr.conf.AppendSync == constant.AOF_FSYNC_ALWAYS {
+			// the commands are already executed and the clients
+			// expect them to be durable, we can't recover
+			log.RedisLog(log.REDIS_WARNING, "Can't recover from AOF write error when the AOF fsync policy is 'always': %v. Exiting...", err)
+			os.Exit(1)
+		}
+		// keep the buffer and try again later, meanwhile the write
+		// commands are refused
+		if svr.aofLastWriteErr == nil {
+			log.RedisLog(log.REDIS_WARNING, "Error writing to the AOF file: %v", err)
+		}
+		svr.aofLastWriteErr = err
+		return
+	}
+	svr.aofCurrentSize += int64(n)
+	if svr.aofLastWriteErr != nil {
+		log.RedisLog(log.REDIS_WARNING, "AOF write error looks solved, Redis can write again.")
+		svr.aofLastWriteErr = nil
+	}
+
+	// reuse the buffer unless it grew large
+	if cap(svr.aofBuf) < constant.REDIS_AOF_BUF_REUSE_SIZE {
+		svr.aofBuf = svr.aofBuf[:0]
+	} else {
+		svr.aofBuf = nil
+	}
+
+	switch svr.conf.AppendSync {
+	case constant.AOF_FSYNC_ALWAYS:
+		if err := svr.aofFile.Sync(); err != nil {
+			log.RedisLog(log.REDIS_WARNING, "Can't persist AOF for fsync error when the AOF fsync policy is 'always': %v. Exiting...", err)
+			os.Exit(1)
+		}
+		svr.aofFsyncOffset = svr.aofCurrentSize
+		svr.aofLastFsync = now
+	case constant.AOF_FSYNC_EVERYSEC:
+		svr.aofBackgroundFsync(now)
+	}
+}
+
+// aofBackgroundFsync start the fsync of everysec, at most one per second
+// and never while the previous one is in progress
+func (svr *RedisServer) aofBackgroundFsync(now int64) {
+	if now <= svr.aofLastFsync || svr.aofFsyncer.inProgress.Load() {
+		return
+	}
+	svr.aofFsyncer.fsync(svr.aofFile)
+	svr.aofFsyncOffset = svr.aofCurrentSize
+	svr.aofLastFsync = now
+}
+
+// aofWriteError the error that makes the AOF unable to persist the
+// writes, nil when it works
+func (svr *RedisServer) aofWriteError() error {
+	if svr.aofLastWriteErr != nil {
+		return svr.aofLastWriteErr
+	}
+	if svr.aofFsyncer != nil {
+		return svr.aofFsyncer.err()
+	}
+	return nil
+}
+
+// aofWritePending true when replies must wait for the AOF buffer to be
+// written, see sendReplyToClient. A postponed write or a write error
+// don't hold the replies back.
+func (svr *RedisServer) aofWritePending() bool {
+	return len(svr.aofBuf) > 0 && svr.aofLastWriteErr == nil && svr.aofFlushPostponedStart == 0
+}
+
+// ======================= open ===========================
+
+// openAppendOnlyFile open the AOF for appending. When there is no AOF yet,
+// e.g. appendonly was just enabled, the dataset loaded from the RDB
+// becomes the RDB preamble of the new AOF, so it is not lost at the next
+// restart.
+func (svr *RedisServer) openAppendOnlyFile() {
+	filename := svr.aofFilename()
+	if _, err := os.Stat(filename); os.IsNotExist(err) && !svr.datasetIsEmpty() {
+		log.RedisLog(log.REDIS_NOTICE, "Creating AOF base file %s from the dataset in memory", filename)
+		snapshot := svr.snapshotDataset(false)
+		snapshot.aofBase = true
+		tmpfile := filepath.Join(svr.conf.Dir, fmt.Sprintf("temp-aof-%d.aof", os.Getpid()))
+		if err := rdbSaveSnapshot(filename, tmpfile, snapshot, nil); err != nil {
+			log.RedisLog(log.REDIS_WARNING, "Can't create the append-only file: %v. Exiting.", err)
+			fmt.Fprintf(os.Stderr, "Can't create the append-only file %s: %v. Exiting.\n", filename, err)
+			os.Exit(1)
+		}
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil {
+			svr.aofCurrentSize = fi.Size()
+		}
+	}
+	if err != nil {
+		log.RedisLog(log.REDIS_WARNING, "Can't open the append-only file: %v. Exiting.", err)
+		fmt.Fprintf(os.Stderr, "Can't open the append-only file %s: %v. Exiting.\n", filename, err)
+		os.Exit(1)
+	}
+	svr.aofFile = f
+	svr.aofFsyncOffset = svr.aofCurrentSize
+	svr.aofLastFsync = time.Now().Unix()
+	svr.aofSelectedDb = -1
+	if svr.conf.AppendSync == constant.AOF_FSYNC_EVERYSEC {
+		svr.aofFsyncer = newAofFsyncer()
+	}
+}
+
+// datasetIsEmpty true when no db holds keys
+func (svr *RedisServer) datasetIsEmpty() bool {
+	for _, db := range svr.dbs {
+		if db.dbSize() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ======================= load ===========================
+
+// countingReader count the bytes read, to know the offset in the AOF of
+// the commands parsed through the bufio.Reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// loadAppendOnlyFile replay the AOF. A missing file is reported with an
+// error satisfying os.IsNotExist, an empty one is an empty dataset. A file
+// ending in the middle of a command, as left by a crash during a write, is
+// truncated to the last complete command when aof-load-truncated is
+// enabled.
+func (svr *RedisServer) loadAppendOnlyFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		return nil
+	}
+
+	svr.loading = true
+	defer func() { svr.loading = false }()
+
+	cr := &countingReader{r: f}
+	br := bufio.NewReaderSize(cr, 64*1024)
+	// offset of the first byte not parsed yet
+	offset := func() int64 { return cr.n - int64(br.Buffered()) }
+
+	// the AOF may start with the dataset in RDB format
+	if magic, _ := br.Peek(5); bytes.Equal(magic, []byte("REDIS")) {
+		log.RedisLog(log.REDIS_NOTICE, "Reading RDB preamble from AOF file...")
+		if err := svr.rdbLoadRio(br, fi.Size(), true); err != nil {
+			return fmt.Errorf("error reading the RDB preamble of the AOF file: %v", err)
+		}
+		log.RedisLog(log.REDIS_NOTICE, "Reading the remaining AOF tail...")
+	}
+
+	client := NewRedisClient(svr, nil, nil)
+	client.selectDb(0)
+	client.authenticated = true
+	valid := offset() // end of the last complete command
+	for {
+		argv, err := aofReadCommand(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return svr.aofLoadTruncated(filename, valid)
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file at offset %d: %v", valid, err)
+		}
+
+		cmd := svr.lookupCommand(argv[0])
+		if cmd == nil {
+			return fmt.Errorf("unknown command '%s' reading the append only file at offset %d", argv[0], valid)
+		}
+		if (cmd.Arity > 0 && cmd.Arity != len(argv)) || len(argv) < -cmd.Arity {
+			return fmt.Errorf("wrong number of arguments for '%s' reading the append only file at offset %d", cmd.Name, valid)
+		}
+		// the replies are discarded, the client has no connection
+		client.argv = argv
+		svr.call(client, cmd)
+		client.reset()
+		valid = offset()
+	}
+}
+
+// aofLoadTruncated handle an AOF ending in the middle of a command, valid
+// is the offset after the last complete one
+func (svr *RedisServer) aofLoadTruncated(filename string, valid int64) error {
+	if !svr.conf.AofLoadTruncated {
+		return fmt.Errorf("unexpected end of file reading the append only file. "+
+			"Make a backup of your AOF file, then truncate it to %d bytes, "+
+			"or set 'aof-load-truncated yes' to do it at startup", valid)
+	}
+	log.RedisLog(log.REDIS_WARNING, "!!! Warning: short read while loading the AOF file %s!!!", filename)
+	log.RedisLog(log.REDIS_WARNING, "!!! Truncating the AOF at offset %d !!!", valid)
+	if err := os.Truncate(filename, valid); err != nil {
+		return fmt.Errorf("error truncating the AOF file: %v", err)
+	}
+	log.RedisLog(log.REDIS_WARNING, "AOF loaded anyway because aof-load-truncated is enabled")
+	return nil
+}
+
+// aofReadCommand read a command in RESP multibulk format. io.EOF is the
+// clean end of the file, io.ErrUnexpectedEOF a file ending in the middle
+// of a command.
+func aofReadCommand(br *bufio.Reader) ([][]byte, error) {
+	argc, err := aofReadCount(br, '*', constant.REDIS_MULTIBULK_MAX_LEN)
+	if err != nil {
+		return nil, err
+	}
+	if argc < 1 {
+		return nil, errors.New("invalid multibulk length")
+	}
+	argv := make([][]byte, argc)
+	for i := range argv {
+		l, err := aofReadCount(br, '$', constant.REDIS_PROTO_MAX_BULK_LEN)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, l+2)
+		if _, err := io.ReadFull(br, arg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if arg[l] != '\r' || arg[l+1] != '\n' {
+			return nil, errors.New("bulk string not terminated by CRLF")
+		}
+		argv[i] = arg[:l]
+	}
+	return argv, nil
+}
+
+// aofReadCount read a "<prefix><count>\r\n" line, count must be in
+// [0, max]
+func aofReadCount(br *bufio.Reader, prefix byte, max int64) (int64, error) {
+	line, err := br.ReadSlice('\n')
+	if err == io.EOF && len(line) > 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err == bufio.ErrBufferFull {
+		return 0, fmt.Errorf("expected '%c', got a too long line", prefix)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 4 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, fmt.Errorf("expected '%c', got '%c'", prefix, line[0])
+	}
+	n, ok := core.String2ll(line[1 : len(line)-2])
+	if !ok || n < 0 || n > max {
+		return 0, fmt.Errorf("invalid length after '%c'", prefix)
+	}
+	return n, nil
+}
@@ -0,0 +1,800 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// Bitmaps are not a type of their own: the bit commands operate directly
+// on the bytes of string values. Bit 0 is the most significant bit of the
+// first byte, strings are zero padded when a bit past the end is set.
+
+// ======================= helpers ===========================
+
+// redisPopcount count the number of set bits in s, a 64 bit word at a time
+func redisPopcount(s []byte) int64 {
+	var count int
+	i := 0
+	for ; i+32 <= len(s); i += 32 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(s[i:]))
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(s[i+8:]))
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(s[i+16:]))
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(s[i+24:]))
+	}
+	for ; i+8 <= len(s); i += 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(s[i:]))
+	}
+	for ; i < len(s); i++ {
+		count += bits.OnesCount8(s[i])
+	}
+	return int64(count)
+}
+
+// redisBitpos the position of the first bit set to one or zero (according
+// to bit) in s. When looking for a zero bit in a string of ones, the
+// position of the first bit past the string is returned, as if the string
+// was padded with zeros. When looking for a one bit in a string of zeros
+// -1 is returned.
+func redisBitpos(s []byte, bit int) int64 {
+	var skipword uint64
+	var skipbyte byte
+	if bit == 0 {
+		skipword = math.MaxUint64
+		skipbyte = 0xFF
+	}
+
+	// skip words made only of the bit we are not looking for
+	i := 0
+	for ; i+8 <= len(s); i += 8 {
+		if binary.LittleEndian.Uint64(s[i:]) != skipword {
+			break
+		}
+	}
+	for ; i < len(s); i++ {
+		if s[i] != skipbyte {
+			b := s[i]
+			if bit == 0 {
+				b = ^b
+			}
+			return int64(i)<<3 + int64(bits.LeadingZeros8(b))
+		}
+	}
+	if bit == 1 {
+		return -1
+	}
+	return int64(len(s)) << 3
+}
+
+// getBit the bit at offset, bits past the end of s are zero
+func getBit(s []byte, offset uint64) int {
+	byteIdx := offset >> 3
+	if byteIdx >= uint64(len(s)) {
+		return 0
+	}
+	return int(s[byteIdx]>>(7-offset&7)) & 1
+}
+
+// setBit set the bit at offset, s must be long enough
+func setBit(s []byte, offset uint64, value int) {
+	byteIdx := offset >> 3
+	mask := byte(1) << (7 - offset&7)
+	if value != 0 {
+		s[byteIdx] |= mask
+	} else {
+		s[byteIdx] &^= mask
+	}
+}
+
+// bitposRange the position of the first bit set to bit between the bit
+// offsets start and end, inclusive. Return -1 when not found.
+func bitposRange(s []byte, start, end int64, bit int) int64 {
+	pos := start
+	// leading bits of a partial byte
+	for ; pos <= end && pos&7 != 0; pos++ {
+		if getBit(s, uint64(pos)) == bit {
+			return pos
+		}
+	}
+	// whole bytes
+	if full := (end + 1 - pos) >> 3; full > 0 {
+		first := pos >> 3
+		if p := redisBitpos(s[first:first+full], bit); p != -1 && p < full<<3 {
+			return pos + p
+		}
+		pos += full << 3
+	}
+	// trailing bits of a partial byte
+	for ; pos <= end; pos++ {
+		if getBit(s, uint64(pos)) == bit {
+			return pos
+		}
+	}
+	return -1
+}
+
+// getBitOffsetFromArgument parse a bit offset. When hash is set the offset
+// can be given as "#<n>", meaning n*bits.
+func getBitOffsetFromArgument(client *RedisClient, arg []byte, hash bool, bits int) (uint64, bool) {
+	const errmsg = "bit offset is not an integer or out of range"
+	usehash := hash && len(arg) > 1 && arg[0] == '#'
+	if usehash {
+		arg = arg[1:]
+	}
+	loffset, ok := core.String2ll(arg)
+	if ok && usehash {
+		if loffset > math.MaxInt64/int64(bits) {
+			ok = false
+		}
+		loffset *= int64(bits)
+	}
+	// limit offset to proto-max-bulk-len
+	if !ok || loffset < 0 || loffset>>3 >= constant.REDIS_PROTO_MAX_BULK_LEN {
+		client.addReplyError(errmsg)
+		return 0, false
+	}
+	return uint64(loffset), true
+}
+
+// lookupStringForBitCommand lookup or create the string at the key of the
+// command and make it long enough to hold maxbit. The returned object can
+// be modified in place.
+func lookupStringForBitCommand(client *RedisClient, maxbit uint64) *RedisObject {
+	db := client.db
+	key := client.argv[1]
+	byteLen := int64(maxbit>>3) + 1
+
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		o = createObject(constant.REDIS_STRING, core.SdsEmpty())
+		db.dbAdd(key, o)
+	} else {
+		if !client.checkType(o, constant.REDIS_STRING) {
+			return nil
+		}
+		o = db.dbUnshareStringValue(key, o)
+	}
+	o.Ptr.(*core.SdsHdr).GrowZero(byteLen)
+	return o
+}
+
+// ======================= commands ===========================
+
+// setbitCommand SETBIT key offset bitvalue
+func setbitCommand(client *RedisClient) {
+	bitoffset, ok := getBitOffsetFromArgument(client, client.argv[2], false, 0)
+	if !ok {
+		return
+	}
+	on, ok := client.getLongLongOrReply(client.argv[3], "bit is not an integer or out of range")
+	if !ok {
+		return
+	}
+	// bits can only be set or cleared...
+	if on & ^1 != 0 {
+		client.addReplyError("bit is not an integer or out of range")
+		return
+	}
+
+	o := lookupStringForBitCommand(client, bitoffset)
+	if o == nil {
+		return
+	}
+	s := o.Ptr.(*core.SdsHdr).Bytes()
+	bitval := getBit(s, bitoffset)
+	setBit(s, bitoffset, int(on))
+	client.svr.dirty++
+	client.addReplyLongLong(int64(bitval))
+}
+
+// getbitCommand GETBIT key offset
+func getbitCommand(client *RedisClient) {
+	bitoffset, ok := getBitOffsetFromArgument(client, client.argv[2], false, 0)
+	if !ok {
+		return
+	}
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	client.addReplyLongLong(int64(getBit(stringObjectBytes(o), bitoffset)))
+}
+
+// parseBitRangeUnit parse the BYTE or BIT unit of BITCOUNT and BITPOS,
+// return true for BIT
+func parseBitRangeUnit(client *RedisClient, arg []byte) (bool, bool) {
+	switch strings.ToLower(string(arg)) {
+	case "bit":
+		return true, true
+	case "byte":
+		return false, true
+	}
+	client.addReplyError(shared.syntaxerr)
+	return false, false
+}
+
+// bitcountCommand BITCOUNT key [start end [BYTE|BIT]]
+func bitcountCommand(client *RedisClient) {
+	argc := len(client.argv)
+	var start, end int64
+	isbit := false
+	var ok bool
+
+	// parse start/end range if any
+	if argc == 4 || argc == 5 {
+		if start, ok = client.getLongLongOrReply(client.argv[2], ""); !ok {
+			return
+		}
+		if end, ok = client.getLongLongOrReply(client.argv[3], ""); !ok {
+			return
+		}
+		if argc == 5 {
+			if isbit, ok = parseBitRangeUnit(client, client.argv[4]); !ok {
+				return
+			}
+		}
+	} else if argc != 2 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	s := stringObjectBytes(o)
+	strlen := int64(len(s))
+
+	var firstByteNegMask, lastByteNegMask byte
+	if argc == 2 {
+		start, end = 0, strlen-1
+	} else {
+		// convert negative indexes
+		if start < 0 && end < 0 && start > end {
+			client.addReply(shared.czero)
+			return
+		}
+		totlen := strlen
+		if isbit {
+			totlen <<= 3
+		}
+		if start < 0 {
+			start = totlen + start
+		}
+		if end < 0 {
+			end = totlen + end
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end < 0 {
+			end = 0
+		}
+		if end >= totlen {
+			end = totlen - 1
+		}
+		if isbit && start <= end {
+			// before converting bit offset to byte offset, create
+			// negative masks for the edges
+			firstByteNegMask = ^byte((1 << (8 - start&7)) - 1)
+			lastByteNegMask = byte((1 << (7 - end&7)) - 1)
+			start >>= 3
+			end >>= 3
+		}
+	}
+
+	// precondition: end >= 0 && end < strlen, so the only condition where
+	// zero can be returned is: start > end
+	if start > end {
+		client.addReply(shared.czero)
+		return
+	}
+	count := redisPopcount(s[start : end+1])
+	if firstByteNegMask != 0 || lastByteNegMask != 0 {
+		count -= int64(bits.OnesCount8(s[start] & firstByteNegMask))
+		count -= int64(bits.OnesCount8(s[end] & lastByteNegMask))
+	}
+	client.addReplyLongLong(count)
+}
+
+// bitposCommand BITPOS key bit [start [end [BYTE|BIT]]]
+func bitposCommand(client *RedisClient) {
+	argc := len(client.argv)
+	bit, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	if bit != 0 && bit != 1 {
+		client.addReplyError("The bit argument must be 1 or 0.")
+		return
+	}
+
+	var start, end int64
+	endGiven := false
+	isbit := false
+	if argc > 6 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+	if argc >= 4 {
+		if start, ok = client.getLongLongOrReply(client.argv[3], ""); !ok {
+			return
+		}
+	}
+	if argc >= 5 {
+		if end, ok = client.getLongLongOrReply(client.argv[4], ""); !ok {
+			return
+		}
+		endGiven = true
+	}
+	if argc == 6 {
+		if isbit, ok = parseBitRangeUnit(client, client.argv[5]); !ok {
+			return
+		}
+	}
+
+	// if the key does not exist, from our point of view it is an infinite
+	// array of 0 bits. If the user is looking for the first clear bit
+	// return 0, if the user is looking for the first set bit, return -1
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		if bit == 1 {
+			client.addReplyLongLong(-1)
+		} else {
+			client.addReply(shared.czero)
+		}
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	s := stringObjectBytes(o)
+	totlen := int64(len(s))
+	if isbit {
+		totlen <<= 3
+	}
+	if !endGiven {
+		end = totlen - 1
+	}
+
+	// convert negative indexes
+	if start < 0 {
+		start = totlen + start
+	}
+	if end < 0 {
+		end = totlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+
+	// for empty ranges (start > end) we return -1 as an empty range does
+	// not contain a 0 nor a 1
+	if start > end {
+		client.addReplyLongLong(-1)
+		return
+	}
+
+	// the range is searched in bits
+	if !isbit {
+		start <<= 3
+		end = end<<3 + 7
+	}
+	pos := bitposRange(s, start, end, int(bit))
+
+	// if we are looking for clear bits and the user did not specify an
+	// exact range, the right of the string is considered zero padded
+	if pos == -1 && bit == 0 && !endGiven {
+		pos = end + 1
+	}
+	client.addReplyLongLong(pos)
+}
+
+// bitopCommand BITOP op_name target_key src_key1 src_key2 src_key3 ... src_keyN
+func bitopCommand(client *RedisClient) {
+	db := client.db
+	opname := strings.ToLower(string(client.argv[1]))
+	targetkey := client.argv[2]
+	srckeys := client.argv[3:]
+
+	switch opname {
+	case "and", "or", "xor", "not":
+	default:
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	// sanity check: NOT accepts only a single key argument
+	if opname == "not" && len(srckeys) != 1 {
+		client.addReplyError("BITOP NOT must be called with a single source key.")
+		return
+	}
+
+	// lookup keys, and store pointers to the string objects, missing keys
+	// are empty strings
+	srcs := make([][]byte, len(srckeys))
+	maxlen := 0
+	for j, key := range srckeys {
+		o := db.lookupKeyRead(key)
+		if o == nil {
+			continue
+		}
+		if !client.checkType(o, constant.REDIS_STRING) {
+			return
+		}
+		srcs[j] = stringObjectBytes(o)
+		if len(srcs[j]) > maxlen {
+			maxlen = len(srcs[j])
+		}
+	}
+
+	// compute the bit operation, if at least one string is not empty.
+	// Strings shorter than maxlen are zero padded.
+	res := make([]byte, maxlen)
+	if maxlen > 0 {
+		switch opname {
+		case "not":
+			for i, b := range srcs[0] {
+				res[i] = ^b
+			}
+		case "and":
+			copy(res, srcs[0])
+			for _, src := range srcs[1:] {
+				for i := range res {
+					if i < len(src) {
+						res[i] &= src[i]
+					} else {
+						res[i] = 0
+					}
+				}
+			}
+		case "or", "xor":
+			copy(res, srcs[0])
+			for _, src := range srcs[1:] {
+				for i, b := range src {
+					if opname == "or" {
+						res[i] |= b
+					} else {
+						res[i] ^= b
+					}
+				}
+			}
+		}
+	}
+
+	// store the computed value into the target key
+	if maxlen > 0 {
+		db.setKey(targetkey, createStringObject(res), false)
+	} else {
+		db.dbDelete(targetkey)
+	}
+	client.svr.dirty++
+	client.addReplyLongLong(int64(maxlen))
+}
+
+// ======================= BITFIELD ===========================
+
+// overflow behaviors of BITFIELD
+const (
+	bfOverflowWrap = iota
+	bfOverflowSat
+	bfOverflowFail
+)
+
+// BITFIELD subcommands
+const (
+	bitfieldOpGet = iota
+	bitfieldOpSet
+	bitfieldOpIncrby
+)
+
+// bitfieldOp a parsed BITFIELD subcommand
+type bitfieldOp struct {
+	offset uint64 // bitfield offset
+	i64    int64  // increment amount (INCRBY) or SET value
+	opcode int
+	owtype int // overflow type
+	bits   int // integer bitfield bits width
+	signed bool
+}
+
+// getUnsignedBitfield read an unsigned integer of bits width at offset,
+// bits past the end of s are zero
+func getUnsignedBitfield(s []byte, offset uint64, bits int) uint64 {
+	var value uint64
+	for j := 0; j < bits; j++ {
+		value = value<<1 | uint64(getBit(s, offset))
+		offset++
+	}
+	return value
+}
+
+// getSignedBitfield read a two's complement integer of bits width
+func getSignedBitfield(s []byte, offset uint64, bits int) int64 {
+	value := getUnsignedBitfield(s, offset, bits)
+	// if the top significant bit is 1, propagate it to all the higher
+	// bits for two's complement representation of signed integers
+	if bits < 64 && value&(uint64(1)<<(bits-1)) != 0 {
+		value |= math.MaxUint64 << bits
+	}
+	return int64(value)
+}
+
+// setUnsignedBitfield write the bits low bits of value at offset, s must
+// be long enough
+func setUnsignedBitfield(s []byte, offset uint64, bits int, value uint64) {
+	for j := 0; j < bits; j++ {
+		bitval := int(value>>(bits-1-j)) & 1
+		setBit(s, offset, bitval)
+		offset++
+	}
+}
+
+// checkUnsignedBitfieldOverflow check if value+incr overflows an unsigned
+// integer of bits width. Return 1 on overflow, -1 on underflow and 0
+// otherwise, along with the value to store according to owtype.
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, bits int, owtype int) (int, uint64) {
+	max := uint64(math.MaxUint64)
+	if bits < 64 {
+		max = uint64(1)<<bits - 1
+	}
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+
+	wrap := func() uint64 {
+		mask := uint64(math.MaxUint64) << bits
+		return (value + uint64(incr)) &^ mask
+	}
+	if value > max || (incr > 0 && incr > maxincr) {
+		if owtype == bfOverflowWrap {
+			return 1, wrap()
+		}
+		return 1, max
+	} else if incr < 0 && incr < minincr {
+		if owtype == bfOverflowWrap {
+			return -1, wrap()
+		}
+		return -1, 0
+	}
+	return 0, value + uint64(incr)
+}
+
+// checkSignedBitfieldOverflow like checkUnsignedBitfieldOverflow for
+// signed integers
+func checkSignedBitfieldOverflow(value, incr int64, bits int, owtype int) (int, int64) {
+	max := int64(math.MaxInt64)
+	if bits < 64 {
+		max = int64(1)<<(bits-1) - 1
+	}
+	min := -max - 1
+
+	// maxincr and minincr could overflow, but they are only used after
+	// checking the range of value, when no overflow happens
+	maxincr := int64(uint64(max) - uint64(value))
+	minincr := min - value
+
+	wrap := func() int64 {
+		msb := uint64(1) << (bits - 1)
+		c := uint64(value) + uint64(incr)
+		// if the sign bit is set, propagate to all the higher order bits,
+		// to cap the negative value. If it's clear, mask to the positive
+		// integer limit.
+		if bits < 64 {
+			mask := uint64(math.MaxUint64) << bits
+			if c&msb != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c)
+	}
+	overflow := value > max
+	underflow := value < min
+	if !overflow && !underflow {
+		overflow = (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr)
+		underflow = (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr)
+	}
+	if overflow {
+		if owtype == bfOverflowWrap {
+			return 1, wrap()
+		}
+		return 1, max
+	} else if underflow {
+		if owtype == bfOverflowWrap {
+			return -1, wrap()
+		}
+		return -1, min
+	}
+	return 0, value + incr
+}
+
+// getBitfieldTypeFromArgument parse a bitfield type: "i" or "u" followed
+// by the width in bits, i64 and u63 at most
+func getBitfieldTypeFromArgument(client *RedisClient, arg []byte) (bool, int, bool) {
+	const errmsg = "Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u') {
+		client.addReplyError(errmsg)
+		return false, 0, false
+	}
+	signed := arg[0] == 'i'
+	bits, err := strconv.Atoi(string(arg[1:]))
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		client.addReplyError(errmsg)
+		return false, 0, false
+	}
+	return signed, bits, true
+}
+
+// bitfieldGeneric BITFIELD key [GET type offset] [SET type offset value]
+// [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]
+//
+// The subcommands are parsed first and executed in order only when they
+// are all valid. BITFIELD_RO accepts only GET.
+func bitfieldGeneric(client *RedisClient, readonly bool) {
+	argv := client.argv
+	owtype := bfOverflowWrap
+	var ops []bitfieldOp
+	changes := false
+	var maxbit uint64
+
+	for j := 2; j < len(argv); j++ {
+		remargs := len(argv) - j - 1
+		subcmd := strings.ToLower(string(argv[j]))
+		var opcode int
+		switch {
+		case subcmd == "get" && remargs >= 2:
+			opcode = bitfieldOpGet
+		case subcmd == "set" && remargs >= 3:
+			opcode = bitfieldOpSet
+		case subcmd == "incrby" && remargs >= 3:
+			opcode = bitfieldOpIncrby
+		case subcmd == "overflow" && remargs >= 1:
+			j++
+			switch strings.ToLower(string(argv[j])) {
+			case "wrap":
+				owtype = bfOverflowWrap
+			case "sat":
+				owtype = bfOverflowSat
+			case "fail":
+				owtype = bfOverflowFail
+			default:
+				client.addReplyError("Invalid OVERFLOW type specified")
+				return
+			}
+			continue
+		default:
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+
+		// get the type and offset arguments, common to all the ops
+		signed, bits, ok := getBitfieldTypeFromArgument(client, argv[j+1])
+		if !ok {
+			return
+		}
+		bitoffset, ok := getBitOffsetFromArgument(client, argv[j+2], true, bits)
+		if !ok {
+			return
+		}
+		op := bitfieldOp{offset: bitoffset, opcode: opcode, owtype: owtype, bits: bits, signed: signed}
+		if opcode != bitfieldOpGet {
+			// SET and INCRBY need another argument
+			if op.i64, ok = client.getLongLongOrReply(argv[j+3], ""); !ok {
+				return
+			}
+			j++
+			changes = true
+			if last := bitoffset + uint64(bits) - 1; last > maxbit {
+				maxbit = last
+			}
+		}
+		j += 2
+		ops = append(ops, op)
+	}
+
+	if readonly && changes {
+		client.addReplyError("BITFIELD_RO only supports the GET subcommand")
+		return
+	}
+
+	var s []byte
+	if changes {
+		// lookup by making room up to the farthest bit reached by SET and
+		// INCRBY operations
+		o := lookupStringForBitCommand(client, maxbit)
+		if o == nil {
+			return
+		}
+		s = o.Ptr.(*core.SdsHdr).Bytes()
+	} else {
+		// lookup for read is ok if key doesn't exist, but errors if it's
+		// not a string
+		o := client.db.lookupKeyRead(argv[1])
+		if o != nil {
+			if !client.checkType(o, constant.REDIS_STRING) {
+				return
+			}
+			s = stringObjectBytes(o)
+		}
+	}
+
+	client.addReplyMultiBulkLen(len(ops))
+	dirty := false
+	for _, op := range ops {
+		switch op.opcode {
+		case bitfieldOpGet:
+			if op.signed {
+				client.addReplyLongLong(getSignedBitfield(s, op.offset, op.bits))
+			} else {
+				client.addReplyLongLong(int64(getUnsignedBitfield(s, op.offset, op.bits)))
+			}
+			continue
+		}
+
+		// SET and INCRBY: compute the new value, a SET is handled as an
+		// increment of zero on the new value
+		var oldval, newval uint64
+		var overflow int
+		if op.signed {
+			old := getSignedBitfield(s, op.offset, op.bits)
+			var wrapped int64
+			if op.opcode == bitfieldOpIncrby {
+				overflow, wrapped = checkSignedBitfieldOverflow(old, op.i64, op.bits, op.owtype)
+			} else {
+				overflow, wrapped = checkSignedBitfieldOverflow(op.i64, 0, op.bits, op.owtype)
+			}
+			oldval, newval = uint64(old), uint64(wrapped)
+		} else {
+			oldval = getUnsignedBitfield(s, op.offset, op.bits)
+			if op.opcode == bitfieldOpIncrby {
+				overflow, newval = checkUnsignedBitfieldOverflow(oldval, op.i64, op.bits, op.owtype)
+			} else {
+				overflow, newval = checkUnsignedBitfieldOverflow(uint64(op.i64), 0, op.bits, op.owtype)
+			}
+		}
+
+		// on overflow with FAIL, the operation is not performed
+		if overflow != 0 && op.owtype == bfOverflowFail {
+			client.addReply(shared.nullbulk)
+			continue
+		}
+		setUnsignedBitfield(s, op.offset, op.bits, newval)
+		dirty = true
+		if op.opcode == bitfieldOpSet {
+			client.addReplyLongLong(int64(oldval))
+		} else {
+			client.addReplyLongLong(int64(newval))
+		}
+	}
+	if dirty {
+		client.svr.dirty++
+	}
+}
+
+func bitfieldCommand(client *RedisClient) {
+	bitfieldGeneric(client, false)
+}
+
+func bitfieldroCommand(client *RedisClient) {
+	bitfieldGeneric(client, true)
+}
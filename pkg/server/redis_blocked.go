@@ -0,0 +1,374 @@
+package server
+
+import (
+	"math"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/event"
+)
+
+// Blocking operations (BLPOP, BZPOPMIN, XREAD and friends) park the client instead of
+// replying: the client gets the REDIS_BLOCKED flag and is appended to the
+// waiting list of every key it waits for (db.blockingKeys).
+//
+// When a key with waiting clients is added to the keyspace it is
+// signaled as ready. After every command the ready keys are served,
+// waking up the blocked clients in FIFO order while the key has data.
+//
+// Timeouts are time events of the event loop, so blocked clients cost
+// nothing while they wait. Requests a blocked client sends are kept in its
+// query buffer and processed in beforeSleep once it is unblocked.
+
+// blockingState what a blocked client is waiting for
+type blockingState struct {
+	db        *redisDb
+	btype     int      // type of the value the client waits for
+	keys      [][]byte // keys the client is waiting for
+	timeout   int64    // unix time in ms, 0 to block forever
+	timerID   int64    // time event firing the timeout, -1 when none
+	target    []byte   // destination key of BLMOVE and BRPOPLPUSH
+	wherefrom int
+	whereto   int
+
+	// XREAD and XREADGROUP
+	streamIDs     map[string]core.StreamID // serve the entries after these IDs
+	xreadCount    int64
+	xreadGroup    []byte // nil for XREAD
+	xreadConsumer []byte
+	xreadNoAck    bool
+}
+
+// readyKey a key that received data while clients are blocked on it
+type readyKey struct {
+	db  *redisDb
+	key string
+}
+
+// getTimeoutOrReply parse the timeout of a blocking command, in seconds
+// with decimals. Return the absolute unix time in ms, 0 to block forever.
+func getTimeoutOrReply(client *RedisClient, arg []byte) (int64, bool) {
+	ftval, ok := getDoubleFromBytes(arg)
+	if !ok || math.IsInf(ftval, 0) {
+		client.addReplyError("timeout is not a float or out of range")
+		return 0, false
+	}
+	if ftval < 0 {
+		client.addReplyError("timeout is negative")
+		return 0, false
+	}
+	ftval *= 1000
+	if ftval > math.MaxInt64/2 {
+		client.addReplyError("timeout is out of range")
+		return 0, false
+	}
+	tval := int64(math.Ceil(ftval))
+	if tval > 0 {
+		tval += time.Now().UnixMilli()
+	}
+	return tval, true
+}
+
+// getTimeoutMsOrReply parse the timeout of a blocking command given as an
+// integer number of ms. Return the absolute unix time in ms, 0 to block
+// forever.
+func getTimeoutMsOrReply(client *RedisClient, arg []byte) (int64, bool) {
+	tval, ok := core.String2ll(arg)
+	if !ok {
+		client.addReplyError("timeout is not an integer or out of range")
+		return 0, false
+	}
+	if tval < 0 {
+		client.addReplyError("timeout is negative")
+		return 0, false
+	}
+	if tval > 0 {
+		if tval > math.MaxInt64/2 {
+			client.addReplyError("timeout is out of range")
+			return 0, false
+		}
+		tval += time.Now().UnixMilli()
+	}
+	return tval, true
+}
+
+// blockForKeys block the client on keys until one of them receives data
+// of type btype or the timeout is reached
+func (client *RedisClient) blockForKeys(btype int, keys [][]byte, timeout int64, target []byte, wherefrom, whereto int) {
+	svr := client.svr
+	db := client.db
+	client.bpop = blockingState{
+		db:        db,
+		btype:     btype,
+		timeout:   timeout,
+		timerID:   -1,
+		target:    target,
+		wherefrom: wherefrom,
+		whereto:   whereto,
+	}
+	for _, key := range keys {
+		// the same key may be passed many times
+		duplicated := false
+		for _, k := range client.bpop.keys {
+			if string(k) == string(key) {
+				duplicated = true
+				break
+			}
+		}
+		if duplicated {
+			continue
+		}
+		client.bpop.keys = append(client.bpop.keys, key)
+		db.blockingKeys[string(key)] = append(db.blockingKeys[string(key)], client)
+	}
+
+	if timeout > 0 {
+		ms := timeout - time.Now().UnixMilli()
+		if ms < 0 {
+			ms = 0
+		}
+		client.bpop.timerID = svr.eventLoop.CreateTimeEvent(ms, svr.blockedClientTimeout, nil, client)
+	}
+	client.flags |= constant.REDIS_BLOCKED
+	svr.blockedClients++
+}
+
+// unblockClient remove the client from the waiting lists and cancel its
+// timeout. The requests it queued meanwhile are processed in beforeSleep.
+func (svr *RedisServer) unblockClient(client *RedisClient) {
+	db := client.bpop.db
+	for _, key := range client.bpop.keys {
+		clients := db.blockingKeys[string(key)]
+		for i, c := range clients {
+			if c == client {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(db.blockingKeys, string(key))
+		} else {
+			db.blockingKeys[string(key)] = clients
+		}
+	}
+	if client.bpop.timerID != -1 {
+		svr.eventLoop.DelTimeEvent(client.bpop.timerID)
+	}
+	client.bpop = blockingState{}
+	client.flags &^= constant.REDIS_BLOCKED
+	svr.blockedClients--
+	svr.unblockedClients = append(svr.unblockedClients, client)
+}
+
+// blockedClientTimeout time event proc: the client waited too long
+func (svr *RedisServer) blockedClientTimeout(eventLoop *event.AeEventLoop, id int64, clientData interface{}) int64 {
+	client := clientData.(*RedisClient)
+	// the event loop deletes the event itself
+	client.bpop.timerID = -1
+	client.addReply(shared.nullmultibulk)
+	svr.unblockClient(client)
+	return int64(constant.AE_NOMORE)
+}
+
+// processUnblockedClients process the requests accumulated by the clients
+// while they were blocked
+func (svr *RedisServer) processUnblockedClients() {
+	for len(svr.unblockedClients) > 0 {
+		client := svr.unblockedClients[0]
+		svr.unblockedClients = svr.unblockedClients[1:]
+		if client.querybuf.Len > 0 {
+			client.processInputBufferOrClose()
+		}
+	}
+}
+
+// signalKeyAsReady called when key is added to the keyspace, if clients
+// are waiting for it the key is queued to be served after the command
+func (db *redisDb) signalKeyAsReady(key []byte) {
+	if _, ok := db.blockingKeys[string(key)]; !ok {
+		return
+	}
+	if _, ok := db.readyKeys[string(key)]; ok {
+		return
+	}
+	db.readyKeys[string(key)] = struct{}{}
+	db.svr.readyKeys = append(db.svr.readyKeys, readyKey{db: db, key: string(key)})
+}
+
+// scanDatabaseForReadyKeys signal every blocked key that exists, used when
+// the whole dataset of the db changes
+func (db *redisDb) scanDatabaseForReadyKeys() {
+	for key := range db.blockingKeys {
+		if db.dict.Find(key) != nil {
+			db.signalKeyAsReady([]byte(key))
+		}
+	}
+}
+
+// handleClientsBlockedOnKeys serve the clients blocked on the ready keys.
+// Serving a client may push data to other keys (BLMOVE), so the loop
+// continues until no key is ready.
+func (svr *RedisServer) handleClientsBlockedOnKeys() {
+	for len(svr.readyKeys) > 0 {
+		readyKeys := svr.readyKeys
+		svr.readyKeys = nil
+		for _, rk := range readyKeys {
+			delete(rk.db.readyKeys, rk.key)
+			rk.db.serveClientsBlockedOnKey([]byte(rk.key))
+		}
+	}
+}
+
+// serveClientsBlockedOnKey wake up the clients waiting for key, in the
+// order they blocked, while the value can satisfy them
+func (db *redisDb) serveClientsBlockedOnKey(key []byte) {
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		return
+	}
+	// serving clients changes the waiting list
+	clients := append([]*RedisClient(nil), db.blockingKeys[string(key)]...)
+	for _, receiver := range clients {
+		if receiver.bpop.btype != o.Type {
+			continue
+		}
+		switch o.Type {
+		case constant.REDIS_LIST:
+			if listTypeLength(o) > 0 {
+				serveClientBlockedOnList(receiver, key, o)
+			}
+		case constant.REDIS_ZSET:
+			if zsetLength(o) > 0 {
+				serveClientBlockedOnSortedSet(receiver, key, o)
+			}
+		case constant.REDIS_STREAM:
+			serveClientBlockedOnStream(receiver, key, o)
+		}
+	}
+
+	empty := (o.Type == constant.REDIS_LIST && listTypeLength(o) == 0) ||
+		(o.Type == constant.REDIS_ZSET && zsetLength(o) == 0)
+	if empty && db.lookupKey(key) == o {
+		db.dbDelete(key)
+	}
+}
+
+// serveClientBlockedOnList pop an element for a client blocked in BLPOP,
+// BRPOP, BLMOVE or BRPOPLPUSH and unblock it
+func serveClientBlockedOnList(receiver *RedisClient, key []byte, o *RedisObject) {
+	bpop := &receiver.bpop
+	svr := receiver.svr
+	if bpop.target == nil {
+		value := listTypePop(o, bpop.wherefrom)
+		receiver.addReplyMultiBulkLen(2)
+		receiver.addReplyBulk(key)
+		receiver.addReplyBulk(value)
+		svr.propagate(receiver.db.id, [][]byte{listPopCommandName(bpop.wherefrom), key})
+		svr.dirty++
+	} else {
+		// the destination type is checked again, it may have changed
+		// while the client was blocked
+		dstobj := receiver.db.lookupKeyWrite(bpop.target)
+		if dstobj == nil || receiver.checkType(dstobj, constant.REDIS_LIST) {
+			value := listTypePop(o, bpop.wherefrom)
+			lmoveHandlePush(receiver, bpop.target, dstobj, value, bpop.whereto)
+			svr.propagate(receiver.db.id, [][]byte{[]byte("LMOVE"), key, bpop.target,
+				listPositionName(bpop.wherefrom), listPositionName(bpop.whereto)})
+			svr.dirty++
+		}
+	}
+	svr.unblockClient(receiver)
+}
+
+// ======================= commands ===========================
+
+// blockingPopGenericCommand BLPOP/BRPOP key [key ...] timeout
+// Pop from the first non empty list, or block until one of the keys
+// receives data
+func blockingPopGenericCommand(client *RedisClient, where int) {
+	last := len(client.argv) - 1
+	timeout, ok := getTimeoutOrReply(client, client.argv[last])
+	if !ok {
+		return
+	}
+
+	db := client.db
+	keys := client.argv[1:last]
+	for _, key := range keys {
+		o := db.lookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if !client.checkType(o, constant.REDIS_LIST) {
+			return
+		}
+		if listTypeLength(o) == 0 {
+			continue
+		}
+		// non empty list, this is like a normal [LR]POP
+		value := listTypePop(o, where)
+		client.addReplyMultiBulkLen(2)
+		client.addReplyBulk(key)
+		client.addReplyBulk(value)
+		if listTypeLength(o) == 0 {
+			db.dbDelete(key)
+		}
+		client.svr.dirty++
+		// replaying the blocking pop could block the loading
+		client.rewriteCommandVector(listPopCommandName(where), key)
+		return
+	}
+
+	// if the keys are all empty we need to block
+	client.blockForKeys(constant.REDIS_LIST, keys, timeout, nil, where, 0)
+}
+
+func blpopCommand(client *RedisClient) {
+	blockingPopGenericCommand(client, core.QUICKLIST_HEAD)
+}
+
+func brpopCommand(client *RedisClient) {
+	blockingPopGenericCommand(client, core.QUICKLIST_TAIL)
+}
+
+// blmoveGenericCommand like LMOVE but block when the source is empty
+func blmoveGenericCommand(client *RedisClient, wherefrom, whereto int, timeoutArg []byte) {
+	timeout, ok := getTimeoutOrReply(client, timeoutArg)
+	if !ok {
+		return
+	}
+	key := client.argv[1]
+	o := client.db.lookupKeyWrite(key)
+	if o != nil {
+		if !client.checkType(o, constant.REDIS_LIST) {
+			return
+		}
+		if listTypeLength(o) > 0 {
+			// the list exists and has elements, so the regular lmove
+			// command is executed
+			lmoveGenericCommand(client, wherefrom, whereto)
+			client.rewriteCommandVector([]byte("LMOVE"), key, client.argv[2],
+				listPositionName(wherefrom), listPositionName(whereto))
+			return
+		}
+	}
+	// the list is empty, the client has to block
+	client.blockForKeys(constant.REDIS_LIST, [][]byte{key}, timeout, client.argv[2], wherefrom, whereto)
+}
+
+func blmoveCommand(client *RedisClient) {
+	wherefrom, ok := getListPositionOrReply(client, client.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionOrReply(client, client.argv[4])
+	if !ok {
+		return
+	}
+	blmoveGenericCommand(client, wherefrom, whereto, client.argv[5])
+}
+
+func brpoplpushCommand(client *RedisClient) {
+	blmoveGenericCommand(client, core.QUICKLIST_TAIL, core.QUICKLIST_HEAD, client.argv[3])
+}
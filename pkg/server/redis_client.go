@@ -1,58 +1,285 @@
 package server
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"strconv"
 	"syscall"
 
 	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
 	"github.com/0226zy/myredis/pkg/event"
 )
 
 type RedisClient struct {
+	svr   *RedisServer
 	conn  net.Conn
+	file  *os.File
 	flags int
+	db    *redisDb
+
+	// query buffer and parser state
+	querybuf     *core.SdsHdr
+	qbPos        int64 // offset in querybuf of the first byte not parsed yet
+	reqtype      int
+	multibulklen int64
+	bulklen      int64
+	argv         [][]byte
+	cmd          *RedisCommand
+
+	// reply list, sentlen is the number of bytes of reply[0] already sent
+	reply   []*core.SdsHdr
+	sentlen int
+
+	authenticated bool
+
+	// state of BLPOP and friends while REDIS_BLOCKED is set
+	bpop blockingState
 }
 
-func NewRedisClient(conn net.Conn) *RedisClient {
-	return &RedisClient{conn: conn}
+func NewRedisClient(svr *RedisServer, conn net.Conn, file *os.File) *RedisClient {
+	return &RedisClient{svr: svr, conn: conn, file: file, bulklen: -1, querybuf: core.SdsEmpty()}
 }
 
 func (client *RedisClient) onRead(eventLoop *event.AeEventLoop, fd int, clientData interface{}, mask int) error {
-	buf := make([]byte, constant.REDIS_IOBUF_LEN)
-
-	n, err := client.conn.Read(buf)
+	// read straight into the free space of the query buffer
+	querybuf := client.querybuf
+	querybuf.MakeRoomFor(int64(constant.REDIS_IOBUF_LEN))
+	n, err := client.conn.Read(querybuf.Buf[querybuf.Len : querybuf.Len+int64(constant.REDIS_IOBUF_LEN)])
 	if err != nil {
 		if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK {
 			n = 0
 		} else if err == io.EOF {
 			fmt.Printf("client close connection\n")
-			// TODO freeclient
+			client.svr.freeClient(client)
 			return nil
 		} else {
 			fmt.Printf("Error reading from client:%v\n", err)
+			client.svr.freeClient(client)
 			return err
 		}
 	}
 
-	//if (client.flags & constant.REDIS_BLOCKED) == 0 {
 	if n > 0 {
-		client.processInputData(buf)
+		querybuf.IncrLen(int64(n))
+		// a blocked client keeps accumulating requests in the query
+		// buffer, they are processed once it is unblocked
+		if (client.flags & constant.REDIS_BLOCKED) == 0 {
+			return client.processInputBufferOrClose()
+		}
 	}
-	//}
 	return nil
 }
 
-func (client *RedisClient) processInputData(data []byte) {
-	fmt.Printf("read from client:%s\n", string(data))
+// processInputBufferOrClose process the query buffer, on protocol errors
+// the error is sent and the client is closed
+func (client *RedisClient) processInputBufferOrClose() error {
+	if err := client.processInputBuffer(); err != nil {
+		client.addReplyError(err.Error())
+		client.flags |= constant.REDIS_CLOSE_AFTER_REPLY
+		return err
+	}
+	return nil
 }
 
-func (client *RedisClient) fd() int {
-	f, err := client.conn.(*net.TCPConn).File()
+// processInputBuffer process every complete request in the query buffer.
+// Incomplete requests are kept in the query buffer until more data arrives.
+// The parsers only move qbPos forward, the parsed requests are removed at
+// the end with a single copy, so a deep pipeline is not copied again for
+// every request.
+func (client *RedisClient) processInputBuffer() error {
+	defer client.trimQueryBuf()
+	for client.qbPos < client.querybuf.Len {
+		// once a client is about to be closed no more requests are served
+		if (client.flags & constant.REDIS_CLOSE_AFTER_REPLY) > 0 {
+			break
+		}
+		// a blocked client waits before serving the next request
+		if (client.flags & constant.REDIS_BLOCKED) > 0 {
+			break
+		}
+
+		// determine request type when unknown
+		if client.reqtype == 0 {
+			if client.querybuf.Buf[client.qbPos] == '*' {
+				client.reqtype = constant.REDIS_REQ_MULTIBULK
+			} else {
+				client.reqtype = constant.REDIS_REQ_INLINE
+			}
+		}
+
+		var done bool
+		var err error
+		if client.reqtype == constant.REDIS_REQ_INLINE {
+			done, err = client.processInlineBuffer()
+		} else {
+			done, err = client.processMultibulkBuffer()
+		}
+		if err != nil {
+			return err
+		}
+		if !done {
+			break
+		}
+
+		// multibulk processing could see a <= 0 length
+		if len(client.argv) > 0 {
+			client.svr.processCommand(client)
+		}
+		client.reset()
+	}
+	return nil
+}
+
+// processInlineBuffer parse a inline command like "SET foo bar\r\n".
+// Return true when a full request is in argv
+func (client *RedisClient) processInlineBuffer() (bool, error) {
+	querybuf := client.querybuf.Bytes()[client.qbPos:]
+	newline := bytes.IndexByte(querybuf, '\n')
+	if newline == -1 {
+		if len(querybuf) > constant.REDIS_INLINE_MAX_SIZE {
+			return false, errors.New("Protocol error: too big inline request")
+		}
+		return false, nil
+	}
+
+	line := querybuf[:newline]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	argv, err := core.SdsSplitArgs(line)
 	if err != nil {
-		fmt.Printf("Get net.Conn File failed:%v\n", err)
-		return -1
+		return false, errors.New("Protocol error: unbalanced quotes in request")
+	}
+	client.consumeQueryBuf(newline + 1)
+	client.argv = make([][]byte, len(argv))
+	for i, arg := range argv {
+		client.argv[i] = arg.Bytes()
+	}
+	return true, nil
+}
+
+// processMultibulkBuffer parse a multibulk request like
+// "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n". The parser state is kept
+// in the client so a request can be split in any number of reads.
+// Return true when a full request is in argv
+func (client *RedisClient) processMultibulkBuffer() (bool, error) {
+	querybuf := client.querybuf.Bytes()[client.qbPos:]
+	pos := 0
+
+	if client.multibulklen == 0 {
+		newline := bytes.IndexByte(querybuf, '\r')
+		if newline == -1 {
+			if len(querybuf) > constant.REDIS_INLINE_MAX_SIZE {
+				return false, errors.New("Protocol error: too big mbulk count string")
+			}
+			return false, nil
+		}
+		// buffer should also contain \n
+		if newline > len(querybuf)-2 {
+			return false, nil
+		}
+
+		ll, err := strconv.ParseInt(string(querybuf[1:newline]), 10, 64)
+		if err != nil || ll > constant.REDIS_MULTIBULK_MAX_LEN {
+			return false, errors.New("Protocol error: invalid multibulk length")
+		}
+
+		pos = newline + 2
+		if ll <= 0 {
+			client.consumeQueryBuf(pos)
+			return true, nil
+		}
+		client.multibulklen = ll
+		client.argv = make([][]byte, 0, ll)
+	}
+
+	for client.multibulklen > 0 {
+		// read bulk length if unknown
+		if client.bulklen == -1 {
+			newline := bytes.IndexByte(querybuf[pos:], '\r')
+			if newline == -1 {
+				if len(querybuf)-pos > constant.REDIS_INLINE_MAX_SIZE {
+					return false, errors.New("Protocol error: too big bulk count string")
+				}
+				break
+			}
+			newline += pos
+			// buffer should also contain \n
+			if newline > len(querybuf)-2 {
+				break
+			}
+
+			if querybuf[pos] != '$' {
+				return false, fmt.Errorf("Protocol error: expected '$', got '%c'", querybuf[pos])
+			}
+
+			ll, err := strconv.ParseInt(string(querybuf[pos+1:newline]), 10, 64)
+			if err != nil || ll < 0 || ll > constant.REDIS_PROTO_MAX_BULK_LEN {
+				return false, errors.New("Protocol error: invalid bulk length")
+			}
+			pos = newline + 2
+			client.bulklen = ll
+		}
+
+		// read bulk argument
+		if int64(len(querybuf)-pos) < client.bulklen+2 {
+			// not enough data (+2 == trailing \r\n)
+			break
+		}
+		arg := make([]byte, client.bulklen)
+		copy(arg, querybuf[pos:pos+int(client.bulklen)])
+		client.argv = append(client.argv, arg)
+		pos += int(client.bulklen) + 2
+		client.bulklen = -1
+		client.multibulklen--
+	}
+
+	client.consumeQueryBuf(pos)
+	return client.multibulklen == 0, nil
+}
+
+// consumeQueryBuf mark the next n bytes of the query buffer as parsed
+func (client *RedisClient) consumeQueryBuf(n int) {
+	client.qbPos += int64(n)
+}
+
+// trimQueryBuf drop the parsed part of the query buffer
+func (client *RedisClient) trimQueryBuf() {
+	if client.qbPos == 0 || client.querybuf == nil {
+		return
+	}
+	client.querybuf.Range(client.qbPos, -1)
+	client.qbPos = 0
+}
+
+// rewriteCommandVector replace the arguments of the command being
+// executed, so it is propagated to the AOF in a different form
+func (client *RedisClient) rewriteCommandVector(argv ...[]byte) {
+	client.argv = argv
+}
+
+// reset prepare the client to process the next command
+func (client *RedisClient) reset() {
+	client.argv = nil
+	client.reqtype = 0
+	client.multibulklen = 0
+	client.bulklen = -1
+}
+
+func (client *RedisClient) fd() int {
+	if client.file == nil {
+		f, err := client.conn.(*net.TCPConn).File()
+		if err != nil {
+			fmt.Printf("Get net.Conn File failed:%v\n", err)
+			return -1
+		}
+		client.file = f
 	}
-	return int(f.Fd())
+	return int(client.file.Fd())
 }
@@ -1,5 +1,15 @@
 package server
 
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
 type RedisCommand struct {
 	Name  string
 	Proc  RedisCommandProc
@@ -14,3 +24,332 @@ type RedisCommand struct {
 }
 
 type RedisCommandProc func(client *RedisClient)
+
+// redisCommandTable every command served by the server.
+// Arity: a positive value means exactly that number of arguments (command
+// name included), a negative value means at least -Arity arguments.
+var redisCommandTable = []*RedisCommand{
+	{Name: "ping", Proc: pingCommand, Arity: -1, Flags: 0},
+	{Name: "echo", Proc: echoCommand, Arity: 2, Flags: 0},
+	{Name: "auth", Proc: authCommand, Arity: -2, Flags: constant.REDIS_CMD_NOAUTH},
+	{Name: "quit", Proc: quitCommand, Arity: -1, Flags: constant.REDIS_CMD_NOAUTH},
+	{Name: "get", Proc: getCommand, Arity: 2, Flags: 0},
+	{Name: "set", Proc: setCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "setnx", Proc: setnxCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "setex", Proc: setexCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "psetex", Proc: psetexCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "getset", Proc: getsetCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "getdel", Proc: getdelCommand, Arity: 2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "getex", Proc: getexCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "mget", Proc: mgetCommand, Arity: -2, Flags: 0},
+	{Name: "mset", Proc: msetCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "msetnx", Proc: msetnxCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "append", Proc: appendCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "strlen", Proc: strlenCommand, Arity: 2, Flags: 0},
+	{Name: "getrange", Proc: getrangeCommand, Arity: 4, Flags: 0},
+	{Name: "setrange", Proc: setrangeCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "incr", Proc: incrCommand, Arity: 2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "decr", Proc: decrCommand, Arity: 2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "incrby", Proc: incrbyCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "decrby", Proc: decrbyCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "incrbyfloat", Proc: incrbyfloatCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "lpush", Proc: lpushCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "rpush", Proc: rpushCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "lpushx", Proc: lpushxCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "rpushx", Proc: rpushxCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "lpop", Proc: lpopCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "rpop", Proc: rpopCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "llen", Proc: llenCommand, Arity: 2, Flags: 0},
+	{Name: "lindex", Proc: lindexCommand, Arity: 3, Flags: 0},
+	{Name: "lset", Proc: lsetCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "linsert", Proc: linsertCommand, Arity: 5, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "lrange", Proc: lrangeCommand, Arity: 4, Flags: 0},
+	{Name: "ltrim", Proc: ltrimCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "lrem", Proc: lremCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "lpos", Proc: lposCommand, Arity: -3, Flags: 0},
+	{Name: "lmove", Proc: lmoveCommand, Arity: 5, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "rpoplpush", Proc: rpoplpushCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "blpop", Proc: blpopCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "brpop", Proc: brpopCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "blmove", Proc: blmoveCommand, Arity: 6, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "brpoplpush", Proc: brpoplpushCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "hset", Proc: hsetCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "hsetnx", Proc: hsetnxCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "hget", Proc: hgetCommand, Arity: 3, Flags: 0},
+	{Name: "hmget", Proc: hmgetCommand, Arity: -3, Flags: 0},
+	{Name: "hdel", Proc: hdelCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "hlen", Proc: hlenCommand, Arity: 2, Flags: 0},
+	{Name: "hstrlen", Proc: hstrlenCommand, Arity: 3, Flags: 0},
+	{Name: "hexists", Proc: hexistsCommand, Arity: 3, Flags: 0},
+	{Name: "hkeys", Proc: hkeysCommand, Arity: 2, Flags: 0},
+	{Name: "hvals", Proc: hvalsCommand, Arity: 2, Flags: 0},
+	{Name: "hgetall", Proc: hgetallCommand, Arity: 2, Flags: 0},
+	{Name: "hscan", Proc: hscanCommand, Arity: -3, Flags: 0},
+	{Name: "hincrby", Proc: hincrbyCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "hincrbyfloat", Proc: hincrbyfloatCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "hrandfield", Proc: hrandfieldCommand, Arity: -2, Flags: 0},
+	{Name: "sadd", Proc: saddCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "srem", Proc: sremCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "smove", Proc: smoveCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "sismember", Proc: sismemberCommand, Arity: 3, Flags: 0},
+	{Name: "smismember", Proc: smismemberCommand, Arity: -3, Flags: 0},
+	{Name: "scard", Proc: scardCommand, Arity: 2, Flags: 0},
+	{Name: "spop", Proc: spopCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "srandmember", Proc: srandmemberCommand, Arity: -2, Flags: 0},
+	{Name: "sinter", Proc: sinterCommand, Arity: -2, Flags: 0},
+	{Name: "sinterstore", Proc: sinterstoreCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "sintercard", Proc: sintercardCommand, Arity: -3, Flags: 0},
+	{Name: "sunion", Proc: sunionCommand, Arity: -2, Flags: 0},
+	{Name: "sunionstore", Proc: sunionstoreCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "sdiff", Proc: sdiffCommand, Arity: -2, Flags: 0},
+	{Name: "sdiffstore", Proc: sdiffstoreCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "smembers", Proc: smembersCommand, Arity: 2, Flags: 0},
+	{Name: "sscan", Proc: sscanCommand, Arity: -3, Flags: 0},
+	{Name: "zadd", Proc: zaddCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "zincrby", Proc: zincrbyCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "zrem", Proc: zremCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "zremrangebyscore", Proc: zremrangebyscoreCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "zremrangebyrank", Proc: zremrangebyrankCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "zremrangebylex", Proc: zremrangebylexCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "zunionstore", Proc: zunionstoreCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "zinterstore", Proc: zinterstoreCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "zrange", Proc: zrangeCommand, Arity: -4, Flags: 0},
+	{Name: "zrangestore", Proc: zrangestoreCommand, Arity: -5, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "zrangebyscore", Proc: zrangebyscoreCommand, Arity: -4, Flags: 0},
+	{Name: "zrevrangebyscore", Proc: zrevrangebyscoreCommand, Arity: -4, Flags: 0},
+	{Name: "zrangebylex", Proc: zrangebylexCommand, Arity: -4, Flags: 0},
+	{Name: "zrevrangebylex", Proc: zrevrangebylexCommand, Arity: -4, Flags: 0},
+	{Name: "zcount", Proc: zcountCommand, Arity: 4, Flags: 0},
+	{Name: "zlexcount", Proc: zlexcountCommand, Arity: 4, Flags: 0},
+	{Name: "zrevrange", Proc: zrevrangeCommand, Arity: -4, Flags: 0},
+	{Name: "zcard", Proc: zcardCommand, Arity: 2, Flags: 0},
+	{Name: "zscan", Proc: zscanCommand, Arity: -3, Flags: 0},
+	{Name: "zscore", Proc: zscoreCommand, Arity: 3, Flags: 0},
+	{Name: "zmscore", Proc: zmscoreCommand, Arity: -3, Flags: 0},
+	{Name: "zrank", Proc: zrankCommand, Arity: -3, Flags: 0},
+	{Name: "zrevrank", Proc: zrevrankCommand, Arity: -3, Flags: 0},
+	{Name: "zpopmin", Proc: zpopminCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "zpopmax", Proc: zpopmaxCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "bzpopmin", Proc: bzpopminCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "bzpopmax", Proc: bzpopmaxCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "setbit", Proc: setbitCommand, Arity: 4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "getbit", Proc: getbitCommand, Arity: 3, Flags: 0},
+	{Name: "bitfield", Proc: bitfieldCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "bitfield_ro", Proc: bitfieldroCommand, Arity: -2, Flags: 0},
+	{Name: "bitop", Proc: bitopCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "bitcount", Proc: bitcountCommand, Arity: -2, Flags: 0},
+	{Name: "bitpos", Proc: bitposCommand, Arity: -3, Flags: 0},
+	{Name: "pfadd", Proc: pfaddCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "pfcount", Proc: pfcountCommand, Arity: -2, Flags: 0},
+	{Name: "pfmerge", Proc: pfmergeCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "xadd", Proc: xaddCommand, Arity: -5, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "xrange", Proc: xrangeCommand, Arity: -4, Flags: 0},
+	{Name: "xrevrange", Proc: xrevrangeCommand, Arity: -4, Flags: 0},
+	{Name: "xlen", Proc: xlenCommand, Arity: 2, Flags: 0},
+	{Name: "xdel", Proc: xdelCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xtrim", Proc: xtrimCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xread", Proc: xreadCommand, Arity: -4, Flags: 0},
+	{Name: "xreadgroup", Proc: xreadgroupCommand, Arity: -7, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xgroup", Proc: xgroupCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "xack", Proc: xackCommand, Arity: -4, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xpending", Proc: xpendingCommand, Arity: -3, Flags: 0},
+	{Name: "xclaim", Proc: xclaimCommand, Arity: -6, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xautoclaim", Proc: xautoclaimCommand, Arity: -6, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "xinfo", Proc: xinfoCommand, Arity: -2, Flags: 0},
+	{Name: "geoadd", Proc: geoaddCommand, Arity: -5, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "geohash", Proc: geohashCommand, Arity: -2, Flags: 0},
+	{Name: "geopos", Proc: geoposCommand, Arity: -2, Flags: 0},
+	{Name: "geodist", Proc: geodistCommand, Arity: -4, Flags: 0},
+	{Name: "geosearch", Proc: geosearchCommand, Arity: -7, Flags: 0},
+	{Name: "geosearchstore", Proc: geosearchstoreCommand, Arity: -8, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "del", Proc: delCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "unlink", Proc: unlinkCommand, Arity: -2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "exists", Proc: existsCommand, Arity: -2, Flags: 0},
+	{Name: "touch", Proc: touchCommand, Arity: -2, Flags: 0},
+	{Name: "type", Proc: typeCommand, Arity: 2, Flags: 0},
+	{Name: "keys", Proc: keysCommand, Arity: 2, Flags: 0},
+	{Name: "scan", Proc: scanCommand, Arity: -2, Flags: 0},
+	{Name: "randomkey", Proc: randomkeyCommand, Arity: 1, Flags: 0},
+	{Name: "rename", Proc: renameCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "renamenx", Proc: renamenxCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "copy", Proc: copyCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_DENYOOM},
+	{Name: "object", Proc: objectCommand, Arity: -2, Flags: 0},
+	{Name: "select", Proc: selectCommand, Arity: 2, Flags: 0},
+	{Name: "move", Proc: moveCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "swapdb", Proc: swapdbCommand, Arity: 3, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_ADMIN},
+	{Name: "dbsize", Proc: dbsizeCommand, Arity: 1, Flags: 0},
+	{Name: "flushdb", Proc: flushdbCommand, Arity: -1, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_ADMIN},
+	{Name: "flushall", Proc: flushallCommand, Arity: -1, Flags: constant.REDIS_CMD_WRITE | constant.REDIS_CMD_ADMIN},
+	{Name: "expire", Proc: expireCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "pexpire", Proc: pexpireCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "expireat", Proc: expireatCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "pexpireat", Proc: pexpireatCommand, Arity: -3, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "ttl", Proc: ttlCommand, Arity: 2, Flags: 0},
+	{Name: "pttl", Proc: pttlCommand, Arity: 2, Flags: 0},
+	{Name: "persist", Proc: persistCommand, Arity: 2, Flags: constant.REDIS_CMD_WRITE},
+	{Name: "save", Proc: saveCommand, Arity: 1, Flags: constant.REDIS_CMD_ADMIN},
+	{Name: "bgsave", Proc: bgsaveCommand, Arity: -1, Flags: constant.REDIS_CMD_ADMIN},
+	{Name: "lastsave", Proc: lastsaveCommand, Arity: 1, Flags: 0},
+	{Name: "info", Proc: infoCommand, Arity: -1, Flags: 0},
+}
+
+// populateCommandTable build the lookup table, its dict type ignores the
+// case of the names
+func (svr *RedisServer) populateCommandTable() {
+	svr.commands = dict.New(commandTableDictType)
+	for _, cmd := range redisCommandTable {
+		svr.commands.Add(cmd.Name, cmd)
+	}
+}
+
+// lookupCommand find command by name, case insensitive
+func (svr *RedisServer) lookupCommand(name []byte) *RedisCommand {
+	cmd, ok := svr.commands.FetchValue(string(name))
+	if !ok {
+		return nil
+	}
+	return cmd.(*RedisCommand)
+}
+
+// processCommand is called once a complete request is parsed into
+// client.argv. The command is looked up, checked against arity, auth and
+// command flags, then executed.
+func (svr *RedisServer) processCommand(client *RedisClient) {
+	cmd := svr.lookupCommand(client.argv[0])
+	if cmd == nil {
+		args := ""
+		for _, arg := range client.argv[1:] {
+			if len(args) >= 128 {
+				break
+			}
+			args += fmt.Sprintf("'%.128s' ", arg)
+		}
+		client.addReplyErrorFormat("unknown command '%.128s', with args beginning with: %s",
+			client.argv[0], args)
+		return
+	}
+	if (cmd.Arity > 0 && cmd.Arity != len(client.argv)) || len(client.argv) < -cmd.Arity {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", cmd.Name)
+		return
+	}
+
+	conf := svr.conf
+	if conf.RequirePass != "" && !client.authenticated && (cmd.Flags&constant.REDIS_CMD_NOAUTH) == 0 {
+		client.addReplyError("-NOAUTH Authentication required.")
+		return
+	}
+
+	if (cmd.Flags&constant.REDIS_CMD_ADMIN) > 0 && !client.adminCommandsAllowed() {
+		client.addReplyErrorFormat("%s command not allowed. If the enable-admin-commands option is set to \"local\", "+
+			"you can run it from a local connection, otherwise you need to set this option in the configuration file, "+
+			"and then restart the server.", strings.ToUpper(cmd.Name))
+		return
+	}
+
+	if (cmd.Flags&constant.REDIS_CMD_DENYOOM) > 0 && conf.MaxMemory > 0 && svr.statUsedMemory > conf.MaxMemory {
+		client.addReplyError("-OOM command not allowed when used memory > 'maxmemory'.")
+		return
+	}
+
+	// don't accept writes the AOF can't persist
+	if (cmd.Flags & constant.REDIS_CMD_WRITE) > 0 {
+		if err := svr.aofWriteError(); err != nil {
+			client.addReplyErrorFormat("-MISCONF Errors writing to the AOF file: %v", err)
+			return
+		}
+	}
+
+	svr.call(client, cmd)
+
+	// the command may have pushed data to keys other clients are blocked on
+	if len(svr.readyKeys) > 0 {
+		svr.handleClientsBlockedOnKeys()
+	}
+}
+
+// call execute the command implementation. A command that changed the
+// dataset is propagated to the AOF, with the arguments it may have
+// rewritten to make its replay deterministic.
+func (svr *RedisServer) call(client *RedisClient, cmd *RedisCommand) {
+	client.cmd = cmd
+	client.flags &^= constant.REDIS_PREVENT_PROP
+	dirty := svr.dirty
+	cmd.Proc(client)
+	if svr.dirty > dirty && (client.flags&constant.REDIS_PREVENT_PROP) == 0 {
+		svr.propagate(client.db.id, client.argv)
+	}
+}
+
+// updateUsedMemory sample the bytes of heap allocated by the server.
+// ReadMemStats stops the world, so it runs from serverCron and the
+// commands check the last sample.
+func (svr *RedisServer) updateUsedMemory() {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	svr.statUsedMemory = int64(stats.HeapAlloc)
+}
+
+// adminCommandsAllowed true when enable-admin-commands lets the client run
+// the commands flagged REDIS_CMD_ADMIN
+func (client *RedisClient) adminCommandsAllowed() bool {
+	switch client.svr.conf.EnableAdminCommands {
+	case constant.ADMIN_COMMANDS_YES:
+		return true
+	case constant.ADMIN_COMMANDS_LOCAL:
+		switch addr := client.conn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			return addr.IP.IsLoopback()
+		case *net.UnixAddr:
+			return true
+		}
+	}
+	return false
+}
+
+// ======================= commands ===========================
+
+func pingCommand(client *RedisClient) {
+	if len(client.argv) > 2 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", client.cmd.Name)
+		return
+	}
+	if len(client.argv) == 1 {
+		client.addReply(shared.pong)
+	} else {
+		client.addReplyBulk(client.argv[1])
+	}
+}
+
+func quitCommand(client *RedisClient) {
+	client.addReply(shared.ok)
+	client.flags |= constant.REDIS_CLOSE_AFTER_REPLY
+}
+
+func echoCommand(client *RedisClient) {
+	client.addReplyBulk(client.argv[1])
+}
+
+func authCommand(client *RedisClient) {
+	if len(client.argv) > 3 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	conf := client.svr.conf
+	password := client.argv[len(client.argv)-1]
+	if len(client.argv) == 3 && string(client.argv[1]) != "default" {
+		client.addReplyError("-WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	if conf.RequirePass == "" {
+		client.addReplyError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	if string(password) != conf.RequirePass {
+		client.authenticated = false
+		client.addReplyError("-WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	client.authenticated = true
+	client.addReply(shared.ok)
+}
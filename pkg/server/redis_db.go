@@ -0,0 +1,712 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
+// redisDb a logical database, clients select it by index
+type redisDb struct {
+	id      int
+	svr     *RedisServer
+	dict    *dict.Dict // the keyspace of this db, key -> *RedisObject
+	expires *dict.Dict // keys with a TTL -> int64 unix time in ms
+
+	blockingKeys map[string][]*RedisClient // keys with clients waiting for data, in FIFO order
+	readyKeys    map[string]struct{}       // blocked keys that received data, avoids duplicates in svr.readyKeys
+}
+
+func newRedisDb(svr *RedisServer, id int) *redisDb {
+	return &redisDb{
+		id:      id,
+		svr:     svr,
+		dict:    dict.New(dbDictType),
+		expires: dict.New(keyptrDictType),
+
+		blockingKeys: map[string][]*RedisClient{},
+		readyKeys:    map[string]struct{}{},
+	}
+}
+
+// initDbs create the configured number of databases
+func (svr *RedisServer) initDbs() {
+	svr.dbs = make([]*redisDb, svr.conf.DBNum)
+	for i := 0; i < svr.conf.DBNum; i++ {
+		svr.dbs[i] = newRedisDb(svr, i)
+	}
+}
+
+// selectDb switch the client to the db with index id
+func (client *RedisClient) selectDb(id int) error {
+	if id < 0 || id >= len(client.svr.dbs) {
+		return errors.New("DB index is out of range")
+	}
+	client.db = client.svr.dbs[id]
+	return nil
+}
+
+// ======================= low level keyspace API ===========================
+
+// lookupKey return the value of key or nil, updating the access time
+// and, with an LFU policy, the access frequency. The shared objects are
+// left alone, they are the value of many keys.
+func (db *redisDb) lookupKey(key []byte) *RedisObject {
+	de := db.dict.Find(string(key))
+	if de == nil {
+		return nil
+	}
+	val := de.Val.(*RedisObject)
+	if val.RefCount == constant.REDIS_SHARED_REFCOUNT {
+		return val
+	}
+	if db.svr.lfuEnabled() {
+		db.svr.updateLFU(val)
+	}
+	val.Lru = time.Now().UnixMilli()
+	return val
+}
+
+// lookupKeyRead lookup a key for a read operation, a logically expired
+// key is deleted and reported as missing
+func (db *redisDb) lookupKeyRead(key []byte) *RedisObject {
+	db.expireIfNeeded(key)
+	return db.lookupKey(key)
+}
+
+// lookupKeyReadNoTouch like lookupKeyRead but the access time and
+// frequency are left alone, for commands inspecting the key like TYPE
+// and OBJECT
+func (db *redisDb) lookupKeyReadNoTouch(key []byte) *RedisObject {
+	db.expireIfNeeded(key)
+	val, ok := db.dict.FetchValue(string(key))
+	if !ok {
+		return nil
+	}
+	return val.(*RedisObject)
+}
+
+// lookupKeyWrite lookup a key for a write operation. Every command that
+// modifies a value in place must fetch it with this function: while a
+// background save is in progress the values of its snapshot not written
+// yet by the saver are replaced with a private copy, so the saver never
+// sees them change.
+//
+// The copy is a deep one made by the event loop, the command blocks the
+// server for a time proportional to the size of the value: up to seconds
+// for a container of millions of elements. The time spent is reported by
+// INFO as cow_clone_usec and latest_cow_clone_usec.
+func (db *redisDb) lookupKeyWrite(key []byte) *RedisObject {
+	db.expireIfNeeded(key)
+	o := db.lookupKey(key)
+	if o != nil && db.svr.inSnapshot(o) {
+		start := time.Now()
+		dup := objectDup(o)
+		dup.Lfu = o.Lfu
+		db.dbOverwrite(key, dup)
+		o = dup
+		db.svr.statCowLastTime = time.Since(start).Microseconds()
+		db.svr.statCowTime += db.svr.statCowLastTime
+		db.svr.statCowClones++
+	}
+	return o
+}
+
+// dbAdd add the key to the db. It's up to the caller to check the key
+// does not already exist.
+func (db *redisDb) dbAdd(key []byte, val *RedisObject) {
+	db.dict.Add(string(key), val)
+	db.signalKeyAsReady(key)
+}
+
+// dbOverwrite replace the value of an existing key
+func (db *redisDb) dbOverwrite(key []byte, val *RedisObject) {
+	db.dict.Replace(string(key), val)
+}
+
+// setKey high level set operation: the key is created or overwritten, the
+// TTL is discarded unless keepttl is set
+func (db *redisDb) setKey(key []byte, val *RedisObject, keepttl bool) {
+	db.dict.Replace(string(key), val)
+	db.signalKeyAsReady(key)
+	if !keepttl {
+		db.expires.Delete(string(key))
+	}
+}
+
+// dbDelete remove the key and its TTL, return false when the key did not exist
+func (db *redisDb) dbDelete(key []byte) bool {
+	if !db.dict.Delete(string(key)) {
+		return false
+	}
+	if db.expires.Len() > 0 {
+		db.expires.Delete(string(key))
+	}
+	return true
+}
+
+// dbExists check the key exists, expired keys are reported as missing
+func (db *redisDb) dbExists(key []byte) bool {
+	db.expireIfNeeded(key)
+	return db.dict.Find(string(key)) != nil
+}
+
+// dbRandomKey return a random key or nil when the db is empty. Expired
+// keys met along the way are deleted.
+func (db *redisDb) dbRandomKey() []byte {
+	for db.dict.Len() > 0 {
+		key := []byte(db.dict.GetFairRandomKey().Key)
+		if db.expireIfNeeded(key) {
+			// search for another key, this one expired
+			continue
+		}
+		return key
+	}
+	return nil
+}
+
+func (db *redisDb) dbSize() int {
+	return db.dict.Len()
+}
+
+// emptyDb remove every key, return the number of keys removed
+func (db *redisDb) emptyDb() int {
+	removed := db.dict.Len()
+	db.dict.Empty()
+	db.expires.Empty()
+	return removed
+}
+
+// emptyData remove every key from every db
+func (svr *RedisServer) emptyData() int {
+	removed := 0
+	for _, db := range svr.dbs {
+		removed += db.emptyDb()
+	}
+	return removed
+}
+
+// ======================= commands ===========================
+
+func delGenericCommand(client *RedisClient) {
+	numdel := int64(0)
+	for _, key := range client.argv[1:] {
+		client.db.expireIfNeeded(key)
+		if client.db.dbDelete(key) {
+			client.svr.dirty++
+			numdel++
+		}
+	}
+	client.addReplyLongLong(numdel)
+}
+
+func delCommand(client *RedisClient) {
+	delGenericCommand(client)
+}
+
+// unlinkCommand like DEL: in Redis the values are reclaimed in a
+// background thread, here the garbage collector already does that
+func unlinkCommand(client *RedisClient) {
+	delGenericCommand(client)
+}
+
+// existsCommand count the existing keys, a key given more than once is
+// counted more than once
+func existsCommand(client *RedisClient) {
+	count := int64(0)
+	for _, key := range client.argv[1:] {
+		if client.db.dbExists(key) {
+			count++
+		}
+	}
+	client.addReplyLongLong(count)
+}
+
+// touchCommand count the existing keys, updating their access time
+func touchCommand(client *RedisClient) {
+	touched := int64(0)
+	for _, key := range client.argv[1:] {
+		if client.db.lookupKeyRead(key) != nil {
+			touched++
+		}
+	}
+	client.addReplyLongLong(touched)
+}
+
+// typeName the name of a value type as reported by TYPE
+func typeName(o *RedisObject) string {
+	if o == nil {
+		return "none"
+	}
+	switch o.Type {
+	case constant.REDIS_STRING:
+		return "string"
+	case constant.REDIS_LIST:
+		return "list"
+	case constant.REDIS_SET:
+		return "set"
+	case constant.REDIS_ZSET:
+		return "zset"
+	case constant.REDIS_HASH:
+		return "hash"
+	case constant.REDIS_STREAM:
+		return "stream"
+	}
+	return "unknown"
+}
+
+func typeCommand(client *RedisClient) {
+	client.addReplyStatus(typeName(client.db.lookupKeyReadNoTouch(client.argv[1])))
+}
+
+func keysCommand(client *RedisClient) {
+	pattern := client.argv[1]
+	allkeys := len(pattern) == 1 && pattern[0] == '*'
+	keys := make([][]byte, 0)
+	it := client.db.dict.GetIterator()
+	defer it.Release()
+	for de := it.Next(); de != nil; de = it.Next() {
+		key := []byte(de.Key)
+		if !allkeys && !core.StringMatchLen(pattern, key, false) {
+			continue
+		}
+		if client.db.keyIsExpired(key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	client.addReplyMultiBulkLen(len(keys))
+	for _, key := range keys {
+		client.addReplyBulk(key)
+	}
+}
+
+// parseScanCursorOrReply parse the cursor of the SCAN family like strtoul
+// does: a sign is accepted and negative values wrap around
+func parseScanCursorOrReply(client *RedisClient, arg []byte) (uint64, bool) {
+	if len(arg) == 0 {
+		return 0, true
+	}
+	digits, neg := arg, false
+	if digits[0] == '+' || digits[0] == '-' {
+		neg = digits[0] == '-'
+		digits = digits[1:]
+	}
+	cursor, err := strconv.ParseUint(string(digits), 10, 64)
+	if err != nil {
+		client.addReplyError("invalid cursor")
+		return 0, false
+	}
+	if neg {
+		cursor = -cursor
+	}
+	return cursor, true
+}
+
+// scanGenericCommand the implementation of SCAN, SSCAN, HSCAN and ZSCAN.
+// o is nil to scan the keyspace of the client db, otherwise it is the
+// set, hash or sorted set to scan.
+//
+// Hash table encoded values are scanned with the dict cursor, the small
+// encodings are returned in a single call with a 0 cursor.
+func scanGenericCommand(client *RedisClient, o *RedisObject, cursor uint64) {
+	count := int64(10)
+	var pat []byte
+	usePattern := false
+	typename := ""
+
+	// the options follow the cursor, skip the key argument if needed
+	i := 2
+	if o != nil {
+		i = 3
+	}
+
+	// step 1: parse options
+	for i < len(client.argv) {
+		j := len(client.argv) - i
+		opt := strings.ToLower(string(client.argv[i]))
+		if opt == "count" && j >= 2 {
+			var ok bool
+			if count, ok = client.getLongLongOrReply(client.argv[i+1], ""); !ok {
+				return
+			}
+			if count < 1 {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			i += 2
+		} else if opt == "match" && j >= 2 {
+			pat = client.argv[i+1]
+			// the pattern may be skipped if it is "*"
+			usePattern = !(len(pat) == 1 && pat[0] == '*')
+			i += 2
+		} else if opt == "type" && o == nil && j >= 2 {
+			// SCAN for a particular type only applies to the db dict
+			typename = string(client.argv[i+1])
+			i += 2
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	// step 2: iterate the collection. Hashes and sorted sets return a
+	// flat list of field value (member score) pairs.
+	var ht *dict.Dict
+	if o == nil {
+		ht = client.db.dict
+	} else if o.Type == constant.REDIS_SET && o.Encoding == constant.REDIS_ENCODING_HT {
+		ht = o.Ptr.(*dict.Dict)
+	} else if o.Type == constant.REDIS_HASH && o.Encoding == constant.REDIS_ENCODING_HT {
+		ht = o.Ptr.(*dict.Dict)
+	} else if o.Type == constant.REDIS_ZSET && o.Encoding == constant.REDIS_ENCODING_SKIPLIST {
+		ht = o.Ptr.(*zset).dict
+	}
+	pairs := o != nil && (o.Type == constant.REDIS_HASH || o.Type == constant.REDIS_ZSET)
+
+	keys := make([][]byte, 0)
+	if ht != nil {
+		callback := func(de *dict.Entry) {
+			keys = append(keys, []byte(de.Key))
+			if o == nil {
+				return
+			}
+			switch o.Type {
+			case constant.REDIS_HASH:
+				keys = append(keys, append([]byte(nil), de.Val.([]byte)...))
+			case constant.REDIS_ZSET:
+				keys = append(keys, []byte(formatDouble(de.Val.(float64))))
+			}
+		}
+		// the max number of iterations is ten times COUNT, so if the
+		// hash table is in a pathological state (very sparsely populated)
+		// we avoid to block too much time at the cost of returning no or
+		// very few elements
+		maxiterations := count * 10
+		for {
+			cursor = ht.Scan(cursor, callback)
+			if cursor == 0 || maxiterations == 0 || int64(len(keys)) >= count {
+				break
+			}
+			maxiterations--
+		}
+	} else if o.Type == constant.REDIS_SET {
+		keys = setTypeMembers(o)
+		cursor = 0
+	} else if o.Type == constant.REDIS_HASH {
+		hi := hashTypeInitIterator(o)
+		for field, value, ok := hi.next(); ok; field, value, ok = hi.next() {
+			keys = append(keys, field, value)
+		}
+		cursor = 0
+	} else if o.Type == constant.REDIS_ZSET {
+		zi := zsetInitIterator(o, 0, false)
+		for entry, ok := zi.next(); ok; entry, ok = zi.next() {
+			keys = append(keys, entry.ele, []byte(formatDouble(entry.score)))
+		}
+		cursor = 0
+	} else {
+		panic("Not handled encoding in SCAN.")
+	}
+
+	// step 3: filter elements, for pairs only the key is matched and the
+	// value goes with it
+	step := 1
+	if pairs {
+		step = 2
+	}
+	filtered := keys[:0]
+	for j := 0; j < len(keys); j += step {
+		key := keys[j]
+		// filter element if it does not match the pattern
+		if usePattern && !core.StringMatchLen(pat, key, false) {
+			continue
+		}
+		// filter an element if it isn't the type we want
+		if o == nil && typename != "" && !strings.EqualFold(typename, typeName(client.db.lookupKeyReadNoTouch(key))) {
+			continue
+		}
+		// filter element if it is an expired key
+		if o == nil && client.db.expireIfNeeded(key) {
+			continue
+		}
+		filtered = append(filtered, keys[j:j+step]...)
+	}
+
+	// step 4: reply to the client
+	client.addReplyMultiBulkLen(2)
+	client.addReplyBulkString(strconv.FormatUint(cursor, 10))
+	client.addReplyMultiBulkLen(len(filtered))
+	for _, key := range filtered {
+		client.addReplyBulk(key)
+	}
+}
+
+// scanCommand SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func scanCommand(client *RedisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[1])
+	if !ok {
+		return
+	}
+	scanGenericCommand(client, nil, cursor)
+}
+
+func randomkeyCommand(client *RedisClient) {
+	key := client.db.dbRandomKey()
+	if key == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyBulk(key)
+}
+
+func renameGenericCommand(client *RedisClient, nx bool) {
+	db := client.db
+	src, dst := client.argv[1], client.argv[2]
+
+	// when source and dest key is the same no operation is performed, but
+	// we still return an error on a missing key
+	samekey := string(src) == string(dst)
+
+	o := db.lookupKeyWrite(src)
+	if o == nil {
+		client.addReplyError(shared.nokeyerr)
+		return
+	}
+	if samekey {
+		if nx {
+			client.addReply(shared.czero)
+		} else {
+			client.addReply(shared.ok)
+		}
+		return
+	}
+
+	expire := db.getExpire(src)
+	if db.lookupKeyWrite(dst) != nil {
+		if nx {
+			client.addReply(shared.czero)
+			return
+		}
+		// overwrite: delete the old key before creating the new one
+		// with the same name
+		db.dbDelete(dst)
+	}
+	db.dbAdd(dst, o)
+	if expire != -1 {
+		db.setExpire(dst, expire)
+	}
+	db.dbDelete(src)
+	client.svr.dirty++
+	if nx {
+		client.addReply(shared.cone)
+	} else {
+		client.addReply(shared.ok)
+	}
+}
+
+func renameCommand(client *RedisClient) {
+	renameGenericCommand(client, false)
+}
+
+func renamenxCommand(client *RedisClient) {
+	renameGenericCommand(client, true)
+}
+
+// copyCommand COPY source destination [DB destination-db] [REPLACE]
+func copyCommand(client *RedisClient) {
+	svr := client.svr
+	src, dst := client.db, client.db
+	replace := false
+	for j := 3; j < len(client.argv); j++ {
+		opt := strings.ToLower(string(client.argv[j]))
+		if opt == "replace" {
+			replace = true
+		} else if opt == "db" && j+1 < len(client.argv) {
+			dbid, ok := client.getIntOrReply(client.argv[j+1], "")
+			if !ok {
+				return
+			}
+			if dbid < 0 || dbid >= len(svr.dbs) {
+				client.addReplyError("DB index is out of range")
+				return
+			}
+			dst = svr.dbs[dbid]
+			j++
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	// if the user select the same DB as the source DB and using newkey as
+	// the same key it is probably an error
+	key, newkey := client.argv[1], client.argv[2]
+	if src == dst && string(key) == string(newkey) {
+		client.addReplyError("source and destination objects are the same")
+		return
+	}
+
+	o := src.lookupKeyRead(key)
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	expire := src.getExpire(key)
+
+	// return zero if the key already exists in the target DB, with
+	// REPLACE the key is deleted from the target DB
+	if dst.lookupKeyWrite(newkey) != nil {
+		if !replace {
+			client.addReply(shared.czero)
+			return
+		}
+		dst.dbDelete(newkey)
+	}
+
+	newobj := objectDup(o)
+	dst.dbAdd(newkey, newobj)
+	if expire != -1 {
+		dst.setExpire(newkey, expire)
+	}
+	svr.dirty++
+	client.addReply(shared.cone)
+}
+
+func selectCommand(client *RedisClient) {
+	id, ok := client.getIntOrReply(client.argv[1], "")
+	if !ok {
+		return
+	}
+	if err := client.selectDb(id); err != nil {
+		client.addReplyError(err.Error())
+		return
+	}
+	client.addReply(shared.ok)
+}
+
+func dbsizeCommand(client *RedisClient) {
+	client.addReplyLongLong(int64(client.db.dbSize()))
+}
+
+// getFlushAsyncOrReply parse the optional ASYNC|SYNC argument of FLUSHDB and
+// FLUSHALL. Memory is reclaimed by the garbage collector either way.
+func getFlushAsyncOrReply(client *RedisClient) bool {
+	if len(client.argv) > 2 {
+		client.addReplyError(shared.syntaxerr)
+		return false
+	}
+	if len(client.argv) == 2 {
+		mode := strings.ToLower(string(client.argv[1]))
+		if mode != "async" && mode != "sync" {
+			client.addReplyError(shared.syntaxerr)
+			return false
+		}
+	}
+	return true
+}
+
+func flushdbCommand(client *RedisClient) {
+	if !getFlushAsyncOrReply(client) {
+		return
+	}
+	client.svr.dirty += int64(client.db.emptyDb())
+	client.addReply(shared.ok)
+}
+
+func flushallCommand(client *RedisClient) {
+	if !getFlushAsyncOrReply(client) {
+		return
+	}
+	svr := client.svr
+	svr.dirty += int64(svr.emptyData())
+	// a background save in progress would bring the flushed keys back
+	svr.killRDBChild()
+	// with save points the empty dataset is saved right away, so a
+	// restart doesn't bring the flushed keys back
+	if len(svr.conf.Saves) > 0 && !svr.loading {
+		svr.rdbSave(svr.rdbFilename())
+	}
+	client.addReply(shared.ok)
+	svr.dirty++
+	// the save resets dirty, so call can't tell the dataset changed
+	svr.propagate(client.db.id, client.argv)
+	client.flags |= constant.REDIS_PREVENT_PROP
+}
+
+func moveCommand(client *RedisClient) {
+	svr := client.svr
+	src := client.db
+	dbid, ok := client.getIntOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	if dbid < 0 || dbid >= len(svr.dbs) {
+		client.addReplyError("DB index is out of range")
+		return
+	}
+	dst := svr.dbs[dbid]
+
+	// if the user is moving using as target the same DB as the source DB
+	// it is probably an error
+	if src == dst {
+		client.addReplyError("source and destination objects are the same")
+		return
+	}
+
+	key := client.argv[1]
+	o := src.lookupKeyWrite(key)
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+
+	// return zero if the key already exists in the target DB
+	if dst.lookupKeyWrite(key) != nil {
+		client.addReply(shared.czero)
+		return
+	}
+	expire := src.getExpire(key)
+	dst.dbAdd(key, o)
+	if expire != -1 {
+		dst.setExpire(key, expire)
+	}
+	src.dbDelete(key)
+	svr.dirty++
+	client.addReply(shared.cone)
+}
+
+func swapdbCommand(client *RedisClient) {
+	svr := client.svr
+	id1, ok := client.getIntOrReply(client.argv[1], "invalid first DB index")
+	if !ok {
+		return
+	}
+	id2, ok := client.getIntOrReply(client.argv[2], "invalid second DB index")
+	if !ok {
+		return
+	}
+	if id1 < 0 || id1 >= len(svr.dbs) || id2 < 0 || id2 >= len(svr.dbs) {
+		client.addReplyError("DB index is out of range")
+		return
+	}
+	if id1 != id2 {
+		db1, db2 := svr.dbs[id1], svr.dbs[id2]
+		// swap the content, clients connected to a db keep the index
+		// and see the other dataset
+		db1.dict, db2.dict = db2.dict, db1.dict
+		db1.expires, db2.expires = db2.expires, db1.expires
+
+		// blocked clients stay in their db, the new dataset may hold the
+		// keys they are waiting for
+		db1.scanDatabaseForReadyKeys()
+		db2.scanDatabaseForReadyKeys()
+	}
+	svr.dirty++
+	client.addReply(shared.ok)
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+)
+
+// ======================= expires API ===========================
+
+// setExpire set the absolute unix time in milliseconds when key expires.
+// The key must exist.
+func (db *redisDb) setExpire(key []byte, when int64) {
+	if db.dict.Find(string(key)) == nil {
+		return
+	}
+	db.expires.Replace(string(key), when)
+}
+
+// getExpire return the expire time of key, or -1 if it has no TTL
+func (db *redisDb) getExpire(key []byte) int64 {
+	if db.expires.Len() == 0 {
+		return -1
+	}
+	when, ok := db.expires.FetchValue(string(key))
+	if !ok {
+		return -1
+	}
+	return when.(int64)
+}
+
+// removeExpire drop the TTL of key, return false if it had none
+func (db *redisDb) removeExpire(key []byte) bool {
+	return db.expires.Delete(string(key))
+}
+
+// keyIsExpired check if the TTL of key is in the past
+func (db *redisDb) keyIsExpired(key []byte) bool {
+	when := db.getExpire(key)
+	if when < 0 {
+		return false
+	}
+	// while loading the AOF keys don't expire, the DEL of the keys that
+	// expired is in the file
+	if db.svr.loading {
+		return false
+	}
+	return time.Now().UnixMilli() > when
+}
+
+// checkAlreadyExpired check if an expire time set by a command is already
+// in the past, the key is then deleted instead. While loading the AOF the
+// key is kept, its deletion follows in the file.
+func (svr *RedisServer) checkAlreadyExpired(when int64) bool {
+	return when <= time.Now().UnixMilli() && !svr.loading
+}
+
+// expireIfNeeded lazy expiration: called when a key is accessed, delete it
+// if it is logically expired. Return true if the key was deleted.
+func (db *redisDb) expireIfNeeded(key []byte) bool {
+	if !db.keyIsExpired(key) {
+		return false
+	}
+	db.deleteExpiredKey(key)
+	return true
+}
+
+// deleteExpiredKey remove a key whose TTL is in the past, the deletion is
+// propagated to the AOF as a DEL
+func (db *redisDb) deleteExpiredKey(key []byte) {
+	db.svr.propagate(db.id, [][]byte{[]byte("DEL"), key})
+	db.svr.statExpiredKeys++
+	db.dbDelete(key)
+}
+
+// activeExpireCycle try to reclaim expired keys that are never accessed
+// again. A few random keys with a TTL are sampled from every db, when
+// more than 25% of the sampled keys were expired the db is sampled again.
+// The cycle stops once its time budget is used, the next call resumes
+// from the db where it stopped.
+func (svr *RedisServer) activeExpireCycle() {
+	start := time.Now()
+	// we can use at max ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC percentage of
+	// CPU time per call
+	timelimit := time.Duration(1000000*constant.ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC/
+		constant.REDIS_DEFAULT_HZ/100) * time.Microsecond
+
+	dbsPerCall := len(svr.dbs)
+	for j := 0; j < dbsPerCall; j++ {
+		db := svr.dbs[svr.activeExpireDb%len(svr.dbs)]
+		svr.activeExpireDb++
+
+		iteration := 0
+		for {
+			num := db.expires.Len()
+			if num == 0 {
+				break
+			}
+			if num > constant.ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP {
+				num = constant.ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP
+			}
+
+			now := time.Now().UnixMilli()
+			expired := 0
+			for _, de := range db.expires.GetSomeKeys(num) {
+				// the sample may hold the same key twice
+				when, ok := db.expires.FetchValue(de.Key)
+				if ok && now > when.(int64) {
+					db.deleteExpiredKey([]byte(de.Key))
+					expired++
+				}
+			}
+
+			// we can't block forever here even if there are many keys to
+			// expire, so check the time limit every 16 iterations
+			iteration++
+			if (iteration&0xf) == 0 && time.Since(start) > timelimit {
+				return
+			}
+			if expired <= constant.ACTIVE_EXPIRE_CYCLE_LOOKUPS_PER_LOOP/4 {
+				break
+			}
+		}
+		if time.Since(start) > timelimit {
+			return
+		}
+	}
+}
+
+// ======================= commands ===========================
+
+const (
+	expireNX = 1 << iota
+	expireXX
+	expireGT
+	expireLT
+)
+
+// parseExpireFlags parse the NX|XX|GT|LT options of the EXPIRE family
+func parseExpireFlags(client *RedisClient, args [][]byte) (int, bool) {
+	flags := 0
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "nx":
+			flags |= expireNX
+		case "xx":
+			flags |= expireXX
+		case "gt":
+			flags |= expireGT
+		case "lt":
+			flags |= expireLT
+		default:
+			client.addReplyErrorFormat("Unsupported option %s", arg)
+			return 0, false
+		}
+	}
+	if (flags&expireNX) > 0 && (flags&(expireXX|expireGT|expireLT)) > 0 {
+		client.addReplyError("NX and XX, GT or LT options at the same time are not compatible")
+		return 0, false
+	}
+	if (flags&expireGT) > 0 && (flags&expireLT) > 0 {
+		client.addReplyError("GT and LT options at the same time are not compatible")
+		return 0, false
+	}
+	return flags, true
+}
+
+// expireGenericCommand implementation of EXPIRE, PEXPIRE, EXPIREAT and
+// PEXPIREAT. basetime is 0 for the *AT variants or the current time in ms,
+// unitSeconds tells if argv[2] is in seconds or milliseconds.
+func expireGenericCommand(client *RedisClient, basetime int64, unitSeconds bool) {
+	key := client.argv[1]
+	when, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	flags, ok := parseExpireFlags(client, client.argv[3:])
+	if !ok {
+		return
+	}
+
+	// EXPIRE allows negative numbers, but we can at least detect an
+	// overflow by either unit conversion or basetime addition
+	if unitSeconds {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			client.addReplyErrorFormat("invalid expire time in '%s' command", client.cmd.Name)
+			return
+		}
+		when *= 1000
+	}
+	if when > math.MaxInt64-basetime {
+		client.addReplyErrorFormat("invalid expire time in '%s' command", client.cmd.Name)
+		return
+	}
+	when += basetime
+
+	db := client.db
+	if db.lookupKeyWrite(key) == nil {
+		client.addReply(shared.czero)
+		return
+	}
+
+	if flags != 0 {
+		current := db.getExpire(key)
+		// a key without TTL is handled as an infinite TTL
+		if (flags&expireNX) > 0 && current != -1 {
+			client.addReply(shared.czero)
+			return
+		}
+		if (flags&expireXX) > 0 && current == -1 {
+			client.addReply(shared.czero)
+			return
+		}
+		if (flags&expireGT) > 0 && (current == -1 || when <= current) {
+			client.addReply(shared.czero)
+			return
+		}
+		if (flags&expireLT) > 0 && current != -1 && when >= current {
+			client.addReply(shared.czero)
+			return
+		}
+	}
+
+	if client.svr.checkAlreadyExpired(when) {
+		// an expire time in the past deletes the key
+		db.dbDelete(key)
+		client.rewriteCommandVector([]byte("DEL"), key)
+	} else {
+		db.setExpire(key, when)
+		// the AOF gets the absolute time, replaying a relative TTL
+		// later would extend it
+		client.rewriteCommandVector([]byte("PEXPIREAT"), key, strconv.AppendInt(nil, when, 10))
+	}
+	client.svr.dirty++
+	client.addReply(shared.cone)
+}
+
+func expireCommand(client *RedisClient) {
+	expireGenericCommand(client, time.Now().UnixMilli(), true)
+}
+
+func pexpireCommand(client *RedisClient) {
+	expireGenericCommand(client, time.Now().UnixMilli(), false)
+}
+
+func expireatCommand(client *RedisClient) {
+	expireGenericCommand(client, 0, true)
+}
+
+func pexpireatCommand(client *RedisClient) {
+	expireGenericCommand(client, 0, false)
+}
+
+func ttlGenericCommand(client *RedisClient, outputMs bool) {
+	key := client.argv[1]
+	db := client.db
+	if db.lookupKeyRead(key) == nil {
+		client.addReplyLongLong(-2)
+		return
+	}
+	expire := db.getExpire(key)
+	if expire == -1 {
+		client.addReplyLongLong(-1)
+		return
+	}
+	ttl := expire - time.Now().UnixMilli()
+	if ttl < 0 {
+		ttl = 0
+	}
+	if outputMs {
+		client.addReplyLongLong(ttl)
+	} else {
+		client.addReplyLongLong((ttl + 500) / 1000)
+	}
+}
+
+func ttlCommand(client *RedisClient) {
+	ttlGenericCommand(client, false)
+}
+
+func pttlCommand(client *RedisClient) {
+	ttlGenericCommand(client, true)
+}
+
+func persistCommand(client *RedisClient) {
+	key := client.argv[1]
+	db := client.db
+	if db.lookupKeyWrite(key) == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !db.removeExpire(key) {
+		client.addReply(shared.czero)
+		return
+	}
+	client.svr.dirty++
+	client.addReply(shared.cone)
+}
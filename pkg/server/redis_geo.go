@@ -0,0 +1,539 @@
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// Geo sets are ordinary sorted sets: the score of every member is the 52
+// bits geohash of its position (see core.GeohashEncode), so a box of the
+// geohash grid is a score range and the sorted set engine does the rest.
+
+// geoPoint a member found by a search
+type geoPoint struct {
+	longitude float64
+	latitude  float64
+	dist      float64 // in meters until converted to the unit of the reply
+	score     float64
+	member    []byte
+}
+
+// geo search sort orders
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+// decodeGeohash return the position of a member from its score
+func decodeGeohash(bits float64) (float64, float64, bool) {
+	hash := core.GeoHashBits{Bits: uint64(bits), Step: core.GEO_STEP_MAX}
+	return core.GeohashDecodeToLongLatWGS84(hash)
+}
+
+// extractLongLatOrReply parse a longitude and latitude pair
+func extractLongLatOrReply(client *RedisClient, argv [][]byte) (float64, float64, bool) {
+	var xy [2]float64
+	for i := 0; i < 2; i++ {
+		v, ok := client.getDoubleOrReply(argv[i], "")
+		if !ok {
+			return 0, 0, false
+		}
+		xy[i] = v
+	}
+	if xy[0] < core.GEO_LONG_MIN || xy[0] > core.GEO_LONG_MAX ||
+		xy[1] < core.GEO_LAT_MIN || xy[1] > core.GEO_LAT_MAX {
+		client.addReplyErrorFormat("invalid longitude,latitude pair %f,%f", xy[0], xy[1])
+		return 0, 0, false
+	}
+	return xy[0], xy[1], true
+}
+
+// longLatFromMember return the position of a member of the geo set
+func longLatFromMember(zobj *RedisObject, member []byte) (float64, float64, bool) {
+	score, ok := zsetScore(zobj, member)
+	if !ok {
+		return 0, 0, false
+	}
+	return decodeGeohash(score)
+}
+
+// extractUnitOrReply return the meters per unit of the unit argument
+func extractUnitOrReply(client *RedisClient, arg []byte) (float64, bool) {
+	switch strings.ToLower(string(arg)) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	client.addReplyError("unsupported unit provided. please use M, KM, FT, MI")
+	return 0, false
+}
+
+// extractDistanceOrReply parse "radius unit" into the shape
+func extractDistanceOrReply(client *RedisClient, argv [][]byte, shape *core.GeoShape) bool {
+	distance, ok := client.getDoubleOrReply(argv[0], "need numeric radius")
+	if !ok {
+		return false
+	}
+	if distance < 0 {
+		client.addReplyError("radius cannot be negative")
+		return false
+	}
+	conversion, ok := extractUnitOrReply(client, argv[1])
+	if !ok {
+		return false
+	}
+	shape.Radius, shape.Conversion = distance, conversion
+	return true
+}
+
+// extractBoxOrReply parse "width height unit" into the shape
+func extractBoxOrReply(client *RedisClient, argv [][]byte, shape *core.GeoShape) bool {
+	width, ok := client.getDoubleOrReply(argv[0], "need numeric width")
+	if !ok {
+		return false
+	}
+	height, ok := client.getDoubleOrReply(argv[1], "need numeric height")
+	if !ok {
+		return false
+	}
+	if height < 0 || width < 0 {
+		client.addReplyError("height or width cannot be negative")
+		return false
+	}
+	conversion, ok := extractUnitOrReply(client, argv[2])
+	if !ok {
+		return false
+	}
+	shape.Width, shape.Height, shape.Conversion = width, height, conversion
+	return true
+}
+
+// addReplyDoubleDistance reply with a distance with 4 decimals
+func (client *RedisClient) addReplyDoubleDistance(d float64) {
+	client.addReplyBulkString(strconv.FormatFloat(d, 'f', 4, 64))
+}
+
+// addReplyHumanDouble reply with a coordinate with 17 decimals, trailing
+// zeros removed
+func (client *RedisClient) addReplyHumanDouble(d float64) {
+	s := strconv.FormatFloat(d, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	s = strings.TrimSuffix(s, ".")
+	client.addReplyBulkString(s)
+}
+
+// geoGetPointsInRange append to points the members with a score in
+// [min, max) lying in the shape. limit stops the search once points has
+// that many elements, 0 for no limit.
+func geoGetPointsInRange(zobj *RedisObject, min, max float64, shape *core.GeoShape, points []geoPoint, limit int) []geoPoint {
+	r := &core.ZRangeSpec{Min: min, Max: max, Maxex: true}
+	first, last, ok := zsetRankRangeByScore(zobj, r)
+	if !ok {
+		return points
+	}
+	zi := zsetInitIterator(zobj, first, false)
+	for rank := first; rank <= last; rank++ {
+		entry, _ := zi.next()
+		longitude, latitude, ok := decodeGeohash(entry.score)
+		if !ok {
+			continue
+		}
+		dist, ok := shape.Contains(longitude, latitude)
+		if !ok {
+			continue
+		}
+		points = append(points, geoPoint{
+			longitude: longitude,
+			latitude:  latitude,
+			dist:      dist,
+			score:     entry.score,
+			member:    entry.ele,
+		})
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+	}
+	return points
+}
+
+// membersOfAllNeighbors search the members in the box of the center of
+// the shape and in its neighbors
+func membersOfAllNeighbors(zobj *RedisObject, radius *core.GeoHashRadius, shape *core.GeoShape, limit int) []geoPoint {
+	n := &radius.Neighbors
+	boxes := [...]core.GeoHashBits{radius.Hash, n.North, n.South, n.East, n.West,
+		n.NorthEast, n.NorthWest, n.SouthEast, n.SouthWest}
+
+	var points []geoPoint
+	lastProcessed := 0
+	for i, box := range boxes {
+		if box.IsZero() {
+			continue
+		}
+		// with a huge radius adjacent neighbors can be the same box,
+		// which would duplicate the members
+		if lastProcessed != 0 && box == boxes[lastProcessed] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		min := float64(box.Align52Bits())
+		box.Bits++
+		max := float64(box.Align52Bits())
+		points = geoGetPointsInRange(zobj, min, max, shape, points, limit)
+		lastProcessed = i
+	}
+	return points
+}
+
+// ======================= commands ===========================
+
+// geoaddCommand GEOADD key [NX|XX] [CH] longitude latitude member [...]
+// The command is turned into a ZADD with the geohashes as scores.
+func geoaddCommand(client *RedisClient) {
+	longidx := 2
+	xx, nx := false, false
+	for ; longidx < len(client.argv); longidx++ {
+		opt := strings.ToLower(string(client.argv[longidx]))
+		if opt == "nx" {
+			nx = true
+		} else if opt == "xx" {
+			xx = true
+		} else if opt != "ch" {
+			break
+		}
+	}
+	if (len(client.argv)-longidx)%3 != 0 || (xx && nx) {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	elements := (len(client.argv) - longidx) / 3
+	argv := make([][]byte, longidx+elements*2)
+	argv[0] = []byte("zadd")
+	copy(argv[1:], client.argv[1:longidx])
+	for i := 0; i < elements; i++ {
+		arg := client.argv[longidx+i*3:]
+		longitude, latitude, ok := extractLongLatOrReply(client, arg)
+		if !ok {
+			return
+		}
+		hash, _ := core.GeohashEncodeWGS84(longitude, latitude, core.GEO_STEP_MAX)
+		argv[longidx+i*2] = strconv.AppendUint(nil, hash.Align52Bits(), 10)
+		argv[longidx+i*2+1] = arg[2]
+	}
+	client.argv = argv
+	zaddCommand(client)
+}
+
+// geohashCommand GEOHASH key member [member ...]
+// Reply with the standard 11 characters geohash strings of the members.
+func geohashCommand(client *RedisClient) {
+	const geoalphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	client.addReplyMultiBulkLen(len(client.argv) - 2)
+	for _, member := range client.argv[2:] {
+		var longitude, latitude float64
+		ok := zobj != nil
+		if ok {
+			longitude, latitude, ok = longLatFromMember(zobj, member)
+		}
+		if !ok {
+			client.addReply(shared.nullbulk)
+			continue
+		}
+		// the positions are indexed with the latitude range -85,85 while
+		// the standard uses -90,90, so re-encode with the standard ranges
+		hash, _ := core.GeohashEncode(core.GeoHashRange{Min: -180, Max: 180},
+			core.GeoHashRange{Min: -90, Max: 90}, longitude, latitude, 26)
+		buf := make([]byte, 11)
+		for i := range buf {
+			idx := uint64(0)
+			// 52 bits make 10 characters, the 11th is assumed to be zero
+			if i < 10 {
+				idx = (hash.Bits >> (52 - uint((i+1)*5))) & 0x1f
+			}
+			buf[i] = geoalphabet[idx]
+		}
+		client.addReplyBulk(buf)
+	}
+}
+
+// geoposCommand GEOPOS key member [member ...]
+func geoposCommand(client *RedisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	client.addReplyMultiBulkLen(len(client.argv) - 2)
+	for _, member := range client.argv[2:] {
+		var longitude, latitude float64
+		ok := zobj != nil
+		if ok {
+			longitude, latitude, ok = longLatFromMember(zobj, member)
+		}
+		if !ok {
+			client.addReply(shared.nullmultibulk)
+			continue
+		}
+		client.addReplyMultiBulkLen(2)
+		client.addReplyHumanDouble(longitude)
+		client.addReplyHumanDouble(latitude)
+	}
+}
+
+// geodistCommand GEODIST key member1 member2 [M|KM|FT|MI]
+func geodistCommand(client *RedisClient) {
+	toMeter := 1.0
+	if len(client.argv) == 5 {
+		var ok bool
+		if toMeter, ok = extractUnitOrReply(client, client.argv[4]); !ok {
+			return
+		}
+	} else if len(client.argv) > 5 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	// both members are needed, otherwise the reply is null
+	lon1, lat1, ok1 := longLatFromMember(zobj, client.argv[2])
+	lon2, lat2, ok2 := longLatFromMember(zobj, client.argv[3])
+	if !ok1 || !ok2 {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyDoubleDistance(core.GeohashGetDistance(lon1, lat1, lon2, lat2) / toMeter)
+}
+
+// geosearchGenericCommand GEOSEARCH key and GEOSEARCHSTORE dst key followed
+// by FROMMEMBER member | FROMLONLAT longitude latitude,
+// BYRADIUS radius unit | BYBOX width height unit, [ASC|DESC],
+// [COUNT count [ANY]], [WITHCOORD] [WITHDIST] [WITHHASH] or [STOREDIST]
+func geosearchGenericCommand(client *RedisClient, store bool) {
+	argv := client.argv
+	srcKeyIndex, baseArgs := 1, 2
+	var storekey []byte
+	if store {
+		srcKeyIndex, baseArgs = 2, 3
+		storekey = argv[1]
+	}
+
+	zobj := client.db.lookupKeyRead(argv[srcKeyIndex])
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	var shape core.GeoShape
+	withdist, withhash, withcoords, storedist := false, false, false, false
+	var frommember []byte
+	fromloc, byradius, bybox := false, false, false
+	sortOrder := geoSortNone
+	any := false
+	count := int64(0)
+	remaining := argv[baseArgs:]
+	for i := 0; i < len(remaining); i++ {
+		arg := strings.ToLower(string(remaining[i]))
+		more := len(remaining) - i - 1
+		switch {
+		case arg == "withdist":
+			withdist = true
+		case arg == "withhash":
+			withhash = true
+		case arg == "withcoord":
+			withcoords = true
+		case arg == "storedist" && store:
+			storedist = true
+		case arg == "any":
+			any = true
+		case arg == "asc":
+			sortOrder = geoSortAsc
+		case arg == "desc":
+			sortOrder = geoSortDesc
+		case arg == "count" && more >= 1:
+			c, ok := client.getLongLongOrReply(remaining[i+1], "")
+			if !ok {
+				return
+			}
+			if c <= 0 {
+				client.addReplyError("COUNT must be > 0")
+				return
+			}
+			count = c
+			i++
+		case arg == "frommember" && more >= 1:
+			if fromloc {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			frommember = remaining[i+1]
+			i++
+		case arg == "fromlonlat" && more >= 2:
+			if frommember != nil {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			longitude, latitude, ok := extractLongLatOrReply(client, remaining[i+1:])
+			if !ok {
+				return
+			}
+			shape.Longitude, shape.Latitude = longitude, latitude
+			fromloc = true
+			i += 2
+		case arg == "byradius" && more >= 2:
+			if bybox {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			if !extractDistanceOrReply(client, remaining[i+1:], &shape) {
+				return
+			}
+			byradius = true
+			i += 2
+		case arg == "bybox" && more >= 3:
+			if byradius {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			if !extractBoxOrReply(client, remaining[i+1:], &shape) {
+				return
+			}
+			shape.IsBox = true
+			bybox = true
+			i += 3
+		default:
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	if store && (withdist || withhash || withcoords) {
+		client.addReplyError("GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options")
+		return
+	}
+	if frommember == nil && !fromloc {
+		client.addReplyErrorFormat("exactly one of FROMMEMBER or FROMLONLAT can be specified for %s", client.cmd.Name)
+		return
+	}
+	if !byradius && !bybox {
+		client.addReplyErrorFormat("exactly one of BYRADIUS and BYBOX can be specified for %s", client.cmd.Name)
+		return
+	}
+	if any && count == 0 {
+		client.addReplyError("the ANY argument requires COUNT argument")
+		return
+	}
+
+	// return ASAP when the source key does not exist
+	if zobj == nil {
+		if store {
+			storeZsetResult(client, storekey, nil)
+		} else {
+			client.addReply(shared.emptymultibulk)
+		}
+		return
+	}
+
+	if frommember != nil {
+		longitude, latitude, ok := longLatFromMember(zobj, frommember)
+		if !ok {
+			client.addReplyError("could not decode requested zset member")
+			return
+		}
+		shape.Longitude, shape.Latitude = longitude, latitude
+	}
+
+	// COUNT without ordering makes little sense, the closest members are
+	// returned. ANY returns the first members found instead.
+	if count != 0 && sortOrder == geoSortNone && !any {
+		sortOrder = geoSortAsc
+	}
+
+	radius := core.GeohashCalculateAreasByShapeWGS84(&shape)
+	limit := 0
+	if any {
+		limit = int(count)
+	}
+	points := membersOfAllNeighbors(zobj, &radius, &shape, limit)
+
+	switch sortOrder {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if count > 0 && int64(len(points)) > count {
+		points = points[:count]
+	}
+	for i := range points {
+		points[i].dist /= shape.Conversion
+	}
+
+	if store {
+		entries := make([]zsetEntry, len(points))
+		for i, p := range points {
+			entries[i] = zsetEntry{ele: p.member, score: p.score}
+			if storedist {
+				entries[i].score = p.dist
+			}
+		}
+		storeZsetResult(client, storekey, entries)
+		return
+	}
+
+	options := 0
+	for _, opt := range []bool{withdist, withhash, withcoords} {
+		if opt {
+			options++
+		}
+	}
+	client.addReplyMultiBulkLen(len(points))
+	for _, p := range points {
+		// with options every result is a nested multibulk
+		if options > 0 {
+			client.addReplyMultiBulkLen(options + 1)
+		}
+		client.addReplyBulk(p.member)
+		if withdist {
+			client.addReplyDoubleDistance(p.dist)
+		}
+		if withhash {
+			client.addReplyLongLong(int64(p.score))
+		}
+		if withcoords {
+			client.addReplyMultiBulkLen(2)
+			client.addReplyHumanDouble(p.longitude)
+			client.addReplyHumanDouble(p.latitude)
+		}
+	}
+}
+
+func geosearchCommand(client *RedisClient) {
+	geosearchGenericCommand(client, false)
+}
+
+func geosearchstoreCommand(client *RedisClient) {
+	geosearchGenericCommand(client, true)
+}
@@ -0,0 +1,583 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
+// ======================= hash API ===========================
+
+// hashTypeTryConversion convert a zipmap encoded hash to a hash table
+// when one of the arguments is longer than hash-max-zipmap-value
+func (svr *RedisServer) hashTypeTryConversion(o *RedisObject, args [][]byte) {
+	if o.Encoding != constant.REDIS_ENCODING_ZIPMAP {
+		return
+	}
+	for _, arg := range args {
+		if len(arg) > svr.conf.HashMaxZipMapValue {
+			svr.hashTypeConvert(o)
+			return
+		}
+	}
+}
+
+// hashTypeConvert convert a zipmap encoded hash to a hash table
+func (svr *RedisServer) hashTypeConvert(o *RedisObject) {
+	zm := o.Ptr.(*core.Zipmap)
+	ht := dict.New(hashDictType)
+	// presize the dict to avoid rehashing
+	ht.Expand(zm.Len())
+	for p, field, value, ok := zm.Next(zm.Rewind()); ok; p, field, value, ok = zm.Next(p) {
+		ht.Add(string(field), append([]byte(nil), value...))
+	}
+	o.Ptr = ht
+	o.Encoding = constant.REDIS_ENCODING_HT
+}
+
+// hashTypeGet the value of field, the returned slice must not be modified
+func hashTypeGet(o *RedisObject, field []byte) ([]byte, bool) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		return o.Ptr.(*core.Zipmap).Get(field)
+	case constant.REDIS_ENCODING_HT:
+		value, ok := o.Ptr.(*dict.Dict).FetchValue(string(field))
+		if !ok {
+			return nil, false
+		}
+		return value.([]byte), true
+	}
+	panic("Unknown hash encoding")
+}
+
+// hashTypeExists check if field is in the hash
+func hashTypeExists(o *RedisObject, field []byte) bool {
+	_, ok := hashTypeGet(o, field)
+	return ok
+}
+
+// hashTypeSet set field to value, return true when the field already
+// existed and was updated. The hash is converted to a hash table when it
+// grows past hash-max-zipmap-entries, the caller must call
+// hashTypeTryConversion for the length of the arguments.
+func (svr *RedisServer) hashTypeSet(o *RedisObject, field, value []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		zm := o.Ptr.(*core.Zipmap)
+		update := zm.Set(field, value)
+		// check if the zipmap needs to be converted
+		if zm.Len() > svr.conf.HashMaxZipMapEntries {
+			svr.hashTypeConvert(o)
+		}
+		return update
+	case constant.REDIS_ENCODING_HT:
+		return !o.Ptr.(*dict.Dict).Replace(string(field), append([]byte(nil), value...))
+	}
+	panic("Unknown hash encoding")
+}
+
+// hashTypeDelete remove field, return false when it did not exist
+func hashTypeDelete(o *RedisObject, field []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		return o.Ptr.(*core.Zipmap).Del(field)
+	case constant.REDIS_ENCODING_HT:
+		ht := o.Ptr.(*dict.Dict)
+		if !ht.Delete(string(field)) {
+			return false
+		}
+		// always check if the dictionary needs a resize after a delete
+		if htNeedsResize(ht) {
+			ht.Resize()
+		}
+		return true
+	}
+	panic("Unknown hash encoding")
+}
+
+// hashTypeLength number of fields in the hash
+func hashTypeLength(o *RedisObject) int {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		return o.Ptr.(*core.Zipmap).Len()
+	case constant.REDIS_ENCODING_HT:
+		return o.Ptr.(*dict.Dict).Len()
+	}
+	panic("Unknown hash encoding")
+}
+
+// hashTypeDup duplicate a hash object, used by COPY
+func hashTypeDup(o *RedisObject) *RedisObject {
+	var dup *RedisObject
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		dup = createObject(constant.REDIS_HASH, o.Ptr.(*core.Zipmap).Dup())
+	case constant.REDIS_ENCODING_HT:
+		h := o.Ptr.(*dict.Dict)
+		duph := dict.New(hashDictType)
+		duph.Expand(h.Len())
+		it := h.GetIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			duph.Add(de.Key, append([]byte(nil), de.Val.([]byte)...))
+		}
+		it.Release()
+		dup = createObject(constant.REDIS_HASH, duph)
+	default:
+		panic("Unknown hash encoding")
+	}
+	dup.Encoding = o.Encoding
+	return dup
+}
+
+// hashTypeRandomElement a random field of a non empty hash
+func hashTypeRandomElement(o *RedisObject) []byte {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		target := rand.Intn(hashTypeLength(o))
+		hi := hashTypeInitIterator(o)
+		for field, _, ok := hi.next(); ok; field, _, ok = hi.next() {
+			if target == 0 {
+				return field
+			}
+			target--
+		}
+		return nil
+	case constant.REDIS_ENCODING_HT:
+		return []byte(o.Ptr.(*dict.Dict).GetFairRandomKey().Key)
+	}
+	panic("Unknown hash encoding")
+}
+
+// hashTypeIterator iterate the fields of a hash regardless of its
+// encoding. The hash must not be modified during the iteration.
+type hashTypeIterator struct {
+	o       *RedisObject
+	offset  int           // zipmap: offset of the next entry
+	entries []*dict.Entry // hash table: the entries, collected at init time
+	pos     int           // hash table: index of the next entry
+}
+
+func hashTypeInitIterator(o *RedisObject) *hashTypeIterator {
+	hi := &hashTypeIterator{o: o}
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_ZIPMAP:
+		hi.offset = o.Ptr.(*core.Zipmap).Rewind()
+	case constant.REDIS_ENCODING_HT:
+		ht := o.Ptr.(*dict.Dict)
+		hi.entries = make([]*dict.Entry, 0, ht.Len())
+		it := ht.GetIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			hi.entries = append(hi.entries, de)
+		}
+		it.Release()
+	default:
+		panic("Unknown hash encoding")
+	}
+	return hi
+}
+
+// next return the next field and its value, false when done
+func (hi *hashTypeIterator) next() (field, value []byte, ok bool) {
+	if hi.o.Encoding == constant.REDIS_ENCODING_ZIPMAP {
+		hi.offset, field, value, ok = hi.o.Ptr.(*core.Zipmap).Next(hi.offset)
+		return field, value, ok
+	}
+	if hi.pos >= len(hi.entries) {
+		return nil, nil, false
+	}
+	de := hi.entries[hi.pos]
+	hi.pos++
+	return []byte(de.Key), de.Val.([]byte), true
+}
+
+// hashTypeLookupWriteOrCreate return the hash at key, creating it when
+// missing. On type mismatch an error is sent and nil returned.
+func hashTypeLookupWriteOrCreate(client *RedisClient, key []byte) *RedisObject {
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		o = createHashObject()
+		client.db.dbAdd(key, o)
+		return o
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return nil
+	}
+	return o
+}
+
+// ======================= commands ===========================
+
+func hsetCommand(client *RedisClient) {
+	if len(client.argv)%2 == 1 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", client.cmd.Name)
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+	svr := client.svr
+	svr.hashTypeTryConversion(o, client.argv[2:])
+
+	created := 0
+	for j := 2; j < len(client.argv); j += 2 {
+		if !svr.hashTypeSet(o, client.argv[j], client.argv[j+1]) {
+			created++
+		}
+	}
+	svr.dirty += int64((len(client.argv) - 2) / 2)
+	client.addReplyLongLong(int64(created))
+}
+
+func hsetnxCommand(client *RedisClient) {
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+	svr := client.svr
+	svr.hashTypeTryConversion(o, client.argv[2:4])
+
+	if hashTypeExists(o, client.argv[2]) {
+		client.addReply(shared.czero)
+		return
+	}
+	svr.hashTypeSet(o, client.argv[2], client.argv[3])
+	svr.dirty++
+	client.addReply(shared.cone)
+}
+
+func hgetCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+	value, ok := hashTypeGet(o, client.argv[2])
+	if !ok {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyBulk(value)
+}
+
+func hmgetCommand(client *RedisClient) {
+	// don't abort when the key cannot be found, non-existing keys are
+	// empty hashes and HMGET should respond with a series of null bulks
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o != nil && !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+
+	fields := client.argv[2:]
+	client.addReplyMultiBulkLen(len(fields))
+	for _, field := range fields {
+		if o == nil {
+			client.addReply(shared.nullbulk)
+			continue
+		}
+		value, ok := hashTypeGet(o, field)
+		if !ok {
+			client.addReply(shared.nullbulk)
+			continue
+		}
+		client.addReplyBulk(value)
+	}
+}
+
+func hdelCommand(client *RedisClient) {
+	key := client.argv[1]
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+
+	deleted := 0
+	for _, field := range client.argv[2:] {
+		if hashTypeDelete(o, field) {
+			deleted++
+			if hashTypeLength(o) == 0 {
+				client.db.dbDelete(key)
+				break
+			}
+		}
+	}
+	client.svr.dirty += int64(deleted)
+	client.addReplyLongLong(int64(deleted))
+}
+
+func hlenCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+	client.addReplyLongLong(int64(hashTypeLength(o)))
+}
+
+func hstrlenCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+	value, _ := hashTypeGet(o, client.argv[2])
+	client.addReplyLongLong(int64(len(value)))
+}
+
+func hexistsCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+	if hashTypeExists(o, client.argv[2]) {
+		client.addReply(shared.cone)
+	} else {
+		client.addReply(shared.czero)
+	}
+}
+
+// flags of genericHgetallCommand
+const (
+	hashKeys = 1 << iota
+	hashValues
+)
+
+// genericHgetallCommand implementation of HKEYS, HVALS and HGETALL
+func genericHgetallCommand(client *RedisClient, flags int) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+
+	length := hashTypeLength(o)
+	if flags == hashKeys|hashValues {
+		length *= 2
+	}
+	client.addReplyMultiBulkLen(length)
+	hi := hashTypeInitIterator(o)
+	for field, value, ok := hi.next(); ok; field, value, ok = hi.next() {
+		if (flags & hashKeys) > 0 {
+			client.addReplyBulk(field)
+		}
+		if (flags & hashValues) > 0 {
+			client.addReplyBulk(value)
+		}
+	}
+}
+
+func hkeysCommand(client *RedisClient) {
+	genericHgetallCommand(client, hashKeys)
+}
+
+func hvalsCommand(client *RedisClient) {
+	genericHgetallCommand(client, hashValues)
+}
+
+func hgetallCommand(client *RedisClient) {
+	genericHgetallCommand(client, hashKeys|hashValues)
+}
+
+func hincrbyCommand(client *RedisClient) {
+	incr, ok := client.getLongLongOrReply(client.argv[3], "")
+	if !ok {
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+
+	field := client.argv[2]
+	var value int64
+	if current, ok := hashTypeGet(o, field); ok {
+		if value, ok = core.String2ll(current); !ok {
+			client.addReplyError("hash value is not an integer")
+			return
+		}
+	}
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		client.addReplyError("increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	newValue := strconv.AppendInt(nil, value, 10)
+	svr := client.svr
+	svr.hashTypeTryConversion(o, [][]byte{newValue})
+	svr.hashTypeSet(o, field, newValue)
+	svr.dirty++
+	client.addReplyLongLong(value)
+}
+
+func hincrbyfloatCommand(client *RedisClient) {
+	incr, ok := client.getDoubleOrReply(client.argv[3], "")
+	if !ok {
+		return
+	}
+	if math.IsInf(incr, 0) {
+		client.addReplyError("value is NaN or Infinity")
+		return
+	}
+	o := hashTypeLookupWriteOrCreate(client, client.argv[1])
+	if o == nil {
+		return
+	}
+
+	field := client.argv[2]
+	var value float64
+	if current, ok := hashTypeGet(o, field); ok {
+		if value, ok = getDoubleFromBytes(current); !ok {
+			client.addReplyError("hash value is not a float")
+			return
+		}
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		client.addReplyError("increment would produce NaN or Infinity")
+		return
+	}
+
+	// same formatting as INCRBYFLOAT
+	if value == 0 {
+		value = 0 // turn -0 into 0
+	}
+	newValue := []byte(strconv.FormatFloat(value, 'f', -1, 64))
+	svr := client.svr
+	svr.hashTypeTryConversion(o, [][]byte{newValue})
+	svr.hashTypeSet(o, field, newValue)
+	svr.dirty++
+	client.addReplyBulk(newValue)
+
+	// propagate as HSET of the result, like INCRBYFLOAT
+	client.rewriteCommandVector([]byte("HSET"), client.argv[1], field, newValue)
+}
+
+// hrandfieldWithCountCommand HRANDFIELD key count [WITHVALUES]
+//
+// A positive count returns up to count distinct fields, a negative count
+// returns exactly -count fields that may repeat.
+func hrandfieldWithCountCommand(client *RedisClient, count int64, withvalues bool) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+
+	// collect the pairs once, then sample them
+	var fields, values [][]byte
+	hi := hashTypeInitIterator(o)
+	for field, value, ok := hi.next(); ok; field, value, ok = hi.next() {
+		fields = append(fields, field)
+		values = append(values, value)
+	}
+	size := int64(len(fields))
+
+	var picks []int
+	if count < 0 {
+		// the same field may be returned multiple times
+		count = -count
+	} else {
+		if count > size {
+			count = size
+		}
+		picks = rand.Perm(int(size))[:count]
+	}
+
+	if withvalues {
+		client.addReplyMultiBulkLen(int(count * 2))
+	} else {
+		client.addReplyMultiBulkLen(int(count))
+	}
+	for j := int64(0); j < count; j++ {
+		var i int
+		if picks != nil {
+			i = picks[j]
+		} else {
+			i = rand.Intn(int(size))
+		}
+		client.addReplyBulk(fields[i])
+		if withvalues {
+			client.addReplyBulk(values[i])
+		}
+	}
+}
+
+func hrandfieldCommand(client *RedisClient) {
+	if len(client.argv) >= 3 {
+		count, ok := client.getLongLongOrReply(client.argv[2], "")
+		if !ok {
+			return
+		}
+		withvalues := false
+		if len(client.argv) > 4 || (len(client.argv) == 4 && strings.ToLower(string(client.argv[3])) != "withvalues") {
+			client.addReplyError(shared.syntaxerr)
+			return
+		} else if len(client.argv) == 4 {
+			withvalues = true
+			if count < -math.MaxInt64/2 || count > math.MaxInt64/2 {
+				client.addReplyError("value is out of range")
+				return
+			}
+		}
+		hrandfieldWithCountCommand(client, count, withvalues)
+		return
+	}
+
+	// handle variant without <count> argument, reply with a simple bulk
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_HASH) {
+		return
+	}
+	client.addReplyBulk(hashTypeRandomElement(o))
+}
+
+// hscanCommand HSCAN key cursor [MATCH pattern] [COUNT count]
+func hscanCommand(client *RedisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	h := client.db.lookupKeyRead(client.argv[1])
+	if h == nil {
+		client.addReply(shared.emptyscan)
+		return
+	}
+	if !client.checkType(h, constant.REDIS_HASH) {
+		return
+	}
+	scanGenericCommand(client, h, cursor)
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// HyperLogLogs are stored as ordinary string values holding the redis
+// HLL byte layout (see core.HyperLogLog), so they can be read with GET and
+// persisted like any other string.
+
+const invalidHllErr = "-WRONGTYPE Key is not a valid HyperLogLog string value."
+const corruptedHllErr = "-INVALIDOBJ Corrupted HLL object detected"
+
+// isHLLObjectOrReply check that o is a string holding a valid HLL header,
+// otherwise reply with an error
+func isHLLObjectOrReply(client *RedisClient, o *RedisObject) bool {
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return false
+	}
+	if o.Encoding != constant.REDIS_ENCODING_RAW ||
+		!core.NewHyperLogLogFromBytes(o.Ptr.(*core.SdsHdr).Bytes()).IsValid() {
+		client.addReplyError(invalidHllErr)
+		return false
+	}
+	return true
+}
+
+// createHLLObject create a string object holding an empty HLL
+func createHLLObject() *RedisObject {
+	return createStringObject(core.NewHyperLogLog().Bytes())
+}
+
+// pfaddCommand PFADD key [element ...]
+func pfaddCommand(client *RedisClient) {
+	db := client.db
+	key := client.argv[1]
+	updated := false
+
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		// create the key with a string value of the exact length to hold
+		// our HLL data structure
+		o = createHLLObject()
+		db.dbAdd(key, o)
+		updated = true
+	} else {
+		if !isHLLObjectOrReply(client, o) {
+			return
+		}
+		o = db.dbUnshareStringValue(key, o)
+	}
+
+	// perform the low level ADD operation for every element
+	s := o.Ptr.(*core.SdsHdr)
+	hll := core.NewHyperLogLogFromBytes(s.Bytes())
+	changed, ok := hll.Add(client.argv[2:], client.svr.conf.HllSparseMaxBytes)
+	if !ok {
+		client.addReplyError(corruptedHllErr)
+		return
+	}
+	if changed {
+		hll.InvalidateCache()
+		s.Cpy(hll.Bytes())
+		updated = true
+	}
+	if updated {
+		client.svr.dirty++
+		client.addReply(shared.cone)
+	} else {
+		client.addReply(shared.czero)
+	}
+}
+
+// pfcountCommand PFCOUNT key [key ...]
+// With a single key the cardinality is cached in the HLL header. With
+// many keys the cardinality of the union is returned.
+func pfcountCommand(client *RedisClient) {
+	db := client.db
+
+	// case 1: multi-key keys, cardinality of the union. When multiple
+	// keys are specified, PFCOUNT actually computes the cardinality of the
+	// merge of the N HLLs specified
+	if len(client.argv) > 2 {
+		max := make([]uint8, core.HLL_REGISTERS)
+		for _, key := range client.argv[1:] {
+			o := db.lookupKeyRead(key)
+			if o == nil {
+				// assume empty HLL for non existing var
+				continue
+			}
+			if !isHLLObjectOrReply(client, o) {
+				return
+			}
+			if !core.NewHyperLogLogFromBytes(o.Ptr.(*core.SdsHdr).Bytes()).MergeInto(max) {
+				client.addReplyError(corruptedHllErr)
+				return
+			}
+		}
+		client.addReplyLongLong(int64(core.HllCount(max)))
+		return
+	}
+
+	// case 2: cardinality of the single HLL. The user specified a single
+	// key, either return the cached value or compute one and update the
+	// cache
+	key := client.argv[1]
+	o := db.lookupKeyRead(key)
+	if o == nil {
+		// no key? cardinality is zero since no element was added,
+		// otherwise we would have a key as HLLADD creates it as a side
+		// effect
+		client.addReply(shared.czero)
+		return
+	}
+	if !isHLLObjectOrReply(client, o) {
+		return
+	}
+	hll := core.NewHyperLogLogFromBytes(o.Ptr.(*core.SdsHdr).Bytes())
+	card, ok := hll.CachedCard()
+	if !ok {
+		// recompute it and update the cached value
+		regs, ok := hll.Registers()
+		if !ok {
+			client.addReplyError(corruptedHllErr)
+			return
+		}
+		card = core.HllCount(regs)
+		o = db.dbUnshareStringValue(key, o)
+		core.NewHyperLogLogFromBytes(o.Ptr.(*core.SdsHdr).Bytes()).SetCachedCard(card)
+		client.svr.dirty++
+	}
+	client.addReplyLongLong(int64(card))
+}
+
+// pfmergeCommand PFMERGE dest src1 src2 src3 ... srcN
+// The destination takes part in the merge when it exists
+func pfmergeCommand(client *RedisClient) {
+	db := client.db
+	max := make([]uint8, core.HLL_REGISTERS)
+	useDense := false
+
+	// compute an HLL with M[i] = MAX(M[i]_j). We store the maximum into
+	// the max array of registers
+	for _, key := range client.argv[1:] {
+		o := db.lookupKeyRead(key)
+		if o == nil {
+			continue
+		}
+		if !isHLLObjectOrReply(client, o) {
+			return
+		}
+		hll := core.NewHyperLogLogFromBytes(o.Ptr.(*core.SdsHdr).Bytes())
+		// if at least one involved HLL is dense, use the dense
+		// representation as target ASAP to save time and avoid the
+		// conversion step
+		if !hll.IsSparse() {
+			useDense = true
+		}
+		if !hll.MergeInto(max) {
+			client.addReplyError(corruptedHllErr)
+			return
+		}
+	}
+
+	// create / unshare the destination key's value if needed
+	destkey := client.argv[1]
+	o := db.lookupKeyWrite(destkey)
+	if o == nil {
+		o = createHLLObject()
+		db.dbAdd(destkey, o)
+	} else {
+		o = db.dbUnshareStringValue(destkey, o)
+	}
+
+	// write the resulting HLL to the destination HLL registers
+	s := o.Ptr.(*core.SdsHdr)
+	hll := core.NewHyperLogLogFromBytes(s.Bytes())
+	sparseMaxBytes := client.svr.conf.HllSparseMaxBytes
+	if useDense {
+		sparseMaxBytes = 0
+	}
+	hll.SetRegisters(max, sparseMaxBytes)
+	s.Cpy(hll.Bytes())
+	client.svr.dirty++
+	client.addReply(shared.ok)
+}
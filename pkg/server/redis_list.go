@@ -0,0 +1,833 @@
+package server
+
+import (
+	"math"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// ======================= list API ===========================
+
+// listTypeTryConversion convert a listpack encoded list to a quicklist
+// when adding values would exceed list-max-ziplist-entries elements or one
+// of the values is bigger than list-max-ziplist-value
+func (svr *RedisServer) listTypeTryConversion(o *RedisObject, values [][]byte) {
+	if o.Encoding != constant.REDIS_ENCODING_LISTPACK {
+		return
+	}
+	conf := svr.conf
+	if o.Ptr.(*core.Listpack).Len()+len(values) > conf.ListMaxZipListEntries {
+		svr.listTypeConvert(o)
+		return
+	}
+	for _, value := range values {
+		if len(value) > conf.ListMaxZipListValue {
+			svr.listTypeConvert(o)
+			return
+		}
+	}
+}
+
+// listTypeConvert convert a listpack encoded list to a quicklist
+func (svr *RedisServer) listTypeConvert(o *RedisObject) {
+	lp := o.Ptr.(*core.Listpack)
+	fill := svr.conf.ListMaxZipListEntries
+	ql := core.NewQuicklist(fill)
+	if lp.Len() <= fill {
+		// the listpack becomes the first node as it is
+		ql.AppendListpack(lp)
+	} else {
+		for p := lp.First(); p != -1; p = lp.Next(p) {
+			ql.Push(lp.GetValue(p), core.QUICKLIST_TAIL)
+		}
+	}
+	o.Ptr = ql
+	o.Encoding = constant.REDIS_ENCODING_QUICKLIST
+}
+
+// listTypePush add value at the head or the tail of the list, the caller
+// must call listTypeTryConversion first
+func listTypePush(o *RedisObject, value []byte, where int) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		if where == core.QUICKLIST_HEAD {
+			lp.Prepend(value)
+		} else {
+			lp.Append(value)
+		}
+	case constant.REDIS_ENCODING_QUICKLIST:
+		o.Ptr.(*core.Quicklist).Push(value, where)
+	default:
+		panic("Unknown list encoding")
+	}
+}
+
+// listTypePop remove and return the element at the head or the tail,
+// nil when the list is empty
+func listTypePop(o *RedisObject, where int) []byte {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		p := lp.First()
+		if where != core.QUICKLIST_HEAD {
+			p = lp.Last()
+		}
+		if p == -1 {
+			return nil
+		}
+		value := lp.GetValue(p)
+		lp.Delete(p)
+		return value
+	case constant.REDIS_ENCODING_QUICKLIST:
+		value, ok := o.Ptr.(*core.Quicklist).Pop(where)
+		if !ok {
+			return nil
+		}
+		return value
+	}
+	panic("Unknown list encoding")
+}
+
+// listTypeLength number of elements in the list
+func listTypeLength(o *RedisObject) int {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		return o.Ptr.(*core.Listpack).Len()
+	case constant.REDIS_ENCODING_QUICKLIST:
+		return o.Ptr.(*core.Quicklist).Count()
+	}
+	panic("Unknown list encoding")
+}
+
+// listTypeDup duplicate a list object, used by COPY
+func listTypeDup(o *RedisObject) *RedisObject {
+	var dup *RedisObject
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		dup = createObject(constant.REDIS_LIST, o.Ptr.(*core.Listpack).Dup())
+	case constant.REDIS_ENCODING_QUICKLIST:
+		dup = createObject(constant.REDIS_LIST, o.Ptr.(*core.Quicklist).Dup())
+	default:
+		panic("Unknown list encoding")
+	}
+	dup.Encoding = o.Encoding
+	return dup
+}
+
+// listTypeIterator iterate a list regardless of its encoding
+type listTypeIterator struct {
+	o         *RedisObject
+	direction int
+	offset    int                 // listpack: offset of the next element, -1 when done
+	iter      *core.QuicklistIter // quicklist
+}
+
+// listTypeEntry an element returned by listTypeIterator.next
+type listTypeEntry struct {
+	li     *listTypeIterator
+	offset int                  // listpack
+	qe     *core.QuicklistEntry // quicklist
+}
+
+// listTypeInitIterator iterate starting at index in the given direction
+// (core.QUICKLIST_HEAD iterates from head to tail)
+func listTypeInitIterator(o *RedisObject, index int, direction int) *listTypeIterator {
+	li := &listTypeIterator{o: o, direction: direction}
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		li.offset = o.Ptr.(*core.Listpack).Seek(index)
+	case constant.REDIS_ENCODING_QUICKLIST:
+		li.iter = o.Ptr.(*core.Quicklist).GetIteratorAtIdx(direction, index)
+	default:
+		panic("Unknown list encoding")
+	}
+	return li
+}
+
+// next return the current element and move the iterator forward
+func (li *listTypeIterator) next() (*listTypeEntry, bool) {
+	if li.o.Encoding == constant.REDIS_ENCODING_QUICKLIST {
+		qe, ok := li.iter.Next()
+		if !ok {
+			return nil, false
+		}
+		return &listTypeEntry{li: li, qe: qe}, true
+	}
+
+	if li.offset == -1 {
+		return nil, false
+	}
+	lp := li.o.Ptr.(*core.Listpack)
+	entry := &listTypeEntry{li: li, offset: li.offset}
+	if li.direction == core.QUICKLIST_HEAD {
+		li.offset = lp.Next(li.offset)
+	} else {
+		li.offset = lp.Prev(li.offset)
+	}
+	return entry, true
+}
+
+// value a copy of the element
+func (entry *listTypeEntry) value() []byte {
+	if entry.qe != nil {
+		return entry.qe.Value
+	}
+	return entry.li.o.Ptr.(*core.Listpack).GetValue(entry.offset)
+}
+
+// equals compare the element with value
+func (entry *listTypeEntry) equals(value []byte) bool {
+	if entry.qe != nil {
+		return string(entry.qe.Value) == string(value)
+	}
+	return entry.li.o.Ptr.(*core.Listpack).Compare(entry.offset, value)
+}
+
+// delete remove the element, the iterator continues with the following one
+func (li *listTypeIterator) delete(entry *listTypeEntry) {
+	if li.o.Encoding == constant.REDIS_ENCODING_QUICKLIST {
+		li.o.Ptr.(*core.Quicklist).DelEntry(li.iter, entry.qe)
+		return
+	}
+	next := li.o.Ptr.(*core.Listpack).Delete(entry.offset)
+	// towards the tail the following element moved to the deleted offset,
+	// towards the head the previous offset is still valid
+	if li.direction == core.QUICKLIST_HEAD {
+		li.offset = next
+	}
+}
+
+// listTypeInsert add value before (core.QUICKLIST_HEAD) or after
+// (core.QUICKLIST_TAIL) the element, the iterator must not be used anymore
+func listTypeInsert(entry *listTypeEntry, value []byte, where int) {
+	o := entry.li.o
+	if o.Encoding == constant.REDIS_ENCODING_QUICKLIST {
+		ql := o.Ptr.(*core.Quicklist)
+		if where == core.QUICKLIST_TAIL {
+			ql.InsertAfter(entry.qe, value)
+		} else {
+			ql.InsertBefore(entry.qe, value)
+		}
+		return
+	}
+	o.Ptr.(*core.Listpack).Insert(value, entry.offset, where == core.QUICKLIST_TAIL)
+}
+
+// listTypeReplaceAtIndex overwrite the element at index, return false
+// when index is out of range
+func listTypeReplaceAtIndex(o *RedisObject, index int, value []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		p := lp.Seek(index)
+		if p == -1 {
+			return false
+		}
+		lp.Replace(p, value)
+		return true
+	case constant.REDIS_ENCODING_QUICKLIST:
+		return o.Ptr.(*core.Quicklist).ReplaceAtIndex(index, value)
+	}
+	panic("Unknown list encoding")
+}
+
+// listTypeIndex the element at index, nil when out of range
+func listTypeIndex(o *RedisObject, index int) []byte {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		p := lp.Seek(index)
+		if p == -1 {
+			return nil
+		}
+		return lp.GetValue(p)
+	case constant.REDIS_ENCODING_QUICKLIST:
+		entry, ok := o.Ptr.(*core.Quicklist).Index(index)
+		if !ok {
+			return nil
+		}
+		return entry.Value
+	}
+	panic("Unknown list encoding")
+}
+
+// listTypeDelRange remove count elements starting at index start
+func listTypeDelRange(o *RedisObject, start, count int) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		o.Ptr.(*core.Listpack).DeleteRange(start, count)
+	case constant.REDIS_ENCODING_QUICKLIST:
+		o.Ptr.(*core.Quicklist).DelRange(start, count)
+	default:
+		panic("Unknown list encoding")
+	}
+}
+
+// ======================= commands ===========================
+
+// getListPositionOrReply parse LEFT|RIGHT
+func getListPositionOrReply(client *RedisClient, arg []byte) (int, bool) {
+	switch strings.ToLower(string(arg)) {
+	case "left":
+		return core.QUICKLIST_HEAD, true
+	case "right":
+		return core.QUICKLIST_TAIL, true
+	}
+	client.addReplyError(shared.syntaxerr)
+	return 0, false
+}
+
+// listPositionName the LEFT|RIGHT argument for where, used to propagate
+// the blocking moves as LMOVE
+func listPositionName(where int) []byte {
+	if where == core.QUICKLIST_HEAD {
+		return []byte("LEFT")
+	}
+	return []byte("RIGHT")
+}
+
+// listPopCommandName the non blocking pop from where, used to propagate
+// BLPOP and BRPOP
+func listPopCommandName(where int) []byte {
+	if where == core.QUICKLIST_HEAD {
+		return []byte("LPOP")
+	}
+	return []byte("RPOP")
+}
+
+// getPositiveLongLongOrReply parse a non negative integer
+func (client *RedisClient) getPositiveLongLongOrReply(arg []byte, msg string) (int64, bool) {
+	if msg == "" {
+		msg = "value is out of range, must be positive"
+	}
+	v, ok := client.getLongLongOrReply(arg, "")
+	if !ok {
+		return 0, false
+	}
+	if v < 0 {
+		client.addReplyError(msg)
+		return 0, false
+	}
+	return v, true
+}
+
+// pushGenericCommand implementation of LPUSH, RPUSH, LPUSHX and RPUSHX.
+// With xx the values are only pushed when the list already exists.
+func pushGenericCommand(client *RedisClient, where int, xx bool) {
+	db := client.db
+	key := client.argv[1]
+	lobj := db.lookupKeyWrite(key)
+	if lobj == nil {
+		if xx {
+			client.addReply(shared.czero)
+			return
+		}
+		lobj = createListpackObject()
+		db.dbAdd(key, lobj)
+	} else if !client.checkType(lobj, constant.REDIS_LIST) {
+		return
+	}
+
+	values := client.argv[2:]
+	client.svr.listTypeTryConversion(lobj, values)
+	for _, value := range values {
+		listTypePush(lobj, value, where)
+	}
+	client.svr.dirty += int64(len(values))
+	client.addReplyLongLong(int64(listTypeLength(lobj)))
+}
+
+func lpushCommand(client *RedisClient) {
+	pushGenericCommand(client, core.QUICKLIST_HEAD, false)
+}
+
+func rpushCommand(client *RedisClient) {
+	pushGenericCommand(client, core.QUICKLIST_TAIL, false)
+}
+
+func lpushxCommand(client *RedisClient) {
+	pushGenericCommand(client, core.QUICKLIST_HEAD, true)
+}
+
+func rpushxCommand(client *RedisClient) {
+	pushGenericCommand(client, core.QUICKLIST_TAIL, true)
+}
+
+// popGenericCommand implementation of LPOP and RPOP with the optional count
+func popGenericCommand(client *RedisClient, where int) {
+	if len(client.argv) > 3 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", client.cmd.Name)
+		return
+	}
+	hascount := len(client.argv) == 3
+	var count int64
+	if hascount {
+		var ok bool
+		if count, ok = client.getPositiveLongLongOrReply(client.argv[2], ""); !ok {
+			return
+		}
+	}
+
+	db := client.db
+	key := client.argv[1]
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		if hascount {
+			client.addReply(shared.nullmultibulk)
+		} else {
+			client.addReply(shared.nullbulk)
+		}
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+	if hascount && count == 0 {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+
+	if !hascount {
+		client.addReplyBulk(listTypePop(o, where))
+	} else {
+		llen := int64(listTypeLength(o))
+		if count > llen {
+			count = llen
+		}
+		client.addReplyMultiBulkLen(int(count))
+		for i := int64(0); i < count; i++ {
+			client.addReplyBulk(listTypePop(o, where))
+		}
+	}
+	if listTypeLength(o) == 0 {
+		db.dbDelete(key)
+	}
+	client.svr.dirty++
+}
+
+func lpopCommand(client *RedisClient) {
+	popGenericCommand(client, core.QUICKLIST_HEAD)
+}
+
+func rpopCommand(client *RedisClient) {
+	popGenericCommand(client, core.QUICKLIST_TAIL)
+}
+
+func llenCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+	client.addReplyLongLong(int64(listTypeLength(o)))
+}
+
+func lindexCommand(client *RedisClient) {
+	index, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+	value := listTypeIndex(o, int(index))
+	if value == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyBulk(value)
+}
+
+func lsetCommand(client *RedisClient) {
+	index, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	key := client.argv[1]
+	value := client.argv[3]
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		client.addReplyError("no such key")
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	client.svr.listTypeTryConversion(o, [][]byte{value})
+	if !listTypeReplaceAtIndex(o, int(index), value) {
+		client.addReplyError("index out of range")
+		return
+	}
+	client.svr.dirty++
+	client.addReply(shared.ok)
+}
+
+func linsertCommand(client *RedisClient) {
+	var where int
+	switch strings.ToLower(string(client.argv[2])) {
+	case "after":
+		where = core.QUICKLIST_TAIL
+	case "before":
+		where = core.QUICKLIST_HEAD
+	default:
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	pivot := client.argv[3]
+	value := client.argv[4]
+	o := client.db.lookupKeyWrite(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	client.svr.listTypeTryConversion(o, [][]byte{value})
+	li := listTypeInitIterator(o, 0, core.QUICKLIST_HEAD)
+	inserted := false
+	for entry, ok := li.next(); ok; entry, ok = li.next() {
+		if entry.equals(pivot) {
+			listTypeInsert(entry, value, where)
+			inserted = true
+			break
+		}
+	}
+	if !inserted {
+		client.addReply(shared.cnegone)
+		return
+	}
+	client.svr.dirty++
+	client.addReplyLongLong(int64(listTypeLength(o)))
+}
+
+func lrangeCommand(client *RedisClient) {
+	start, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := client.getLongLongOrReply(client.argv[3], "")
+	if !ok {
+		return
+	}
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	// convert negative indexes
+	llen := int64(listTypeLength(o))
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	// invariant: start >= 0, so this test will be true when end < 0.
+	// The range is empty when start > end or start >= length.
+	if start > end || start >= llen {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	rangelen := int(end - start + 1)
+
+	client.addReplyMultiBulkLen(rangelen)
+	li := listTypeInitIterator(o, int(start), core.QUICKLIST_HEAD)
+	for i := 0; i < rangelen; i++ {
+		entry, _ := li.next()
+		client.addReplyBulk(entry.value())
+	}
+}
+
+func ltrimCommand(client *RedisClient) {
+	start, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := client.getLongLongOrReply(client.argv[3], "")
+	if !ok {
+		return
+	}
+	key := client.argv[1]
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		client.addReply(shared.ok)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	// convert negative indexes
+	llen := int64(listTypeLength(o))
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	var ltrim, rtrim int64
+	if start > end || start >= llen {
+		// out of range start or start > end result in empty list
+		ltrim = llen
+		rtrim = 0
+	} else {
+		if end >= llen {
+			end = llen - 1
+		}
+		ltrim = start
+		rtrim = llen - end - 1
+	}
+
+	listTypeDelRange(o, 0, int(ltrim))
+	listTypeDelRange(o, -int(rtrim), int(rtrim))
+	if listTypeLength(o) == 0 {
+		client.db.dbDelete(key)
+	}
+	client.svr.dirty += ltrim + rtrim
+	client.addReply(shared.ok)
+}
+
+func lremCommand(client *RedisClient) {
+	toremove, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	key := client.argv[1]
+	value := client.argv[3]
+	o := client.db.lookupKeyWrite(key)
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	var li *listTypeIterator
+	if toremove < 0 {
+		toremove = -toremove
+		li = listTypeInitIterator(o, -1, core.QUICKLIST_TAIL)
+	} else {
+		li = listTypeInitIterator(o, 0, core.QUICKLIST_HEAD)
+	}
+
+	var removed int64
+	for entry, ok := li.next(); ok; entry, ok = li.next() {
+		if entry.equals(value) {
+			li.delete(entry)
+			removed++
+			if toremove != 0 && removed == toremove {
+				break
+			}
+		}
+	}
+
+	if removed > 0 {
+		client.svr.dirty += removed
+		if listTypeLength(o) == 0 {
+			client.db.dbDelete(key)
+		}
+	}
+	client.addReplyLongLong(removed)
+}
+
+// lposCommand LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+//
+// RANK is the position of the first match to return, negative ranks
+// search from the tail. COUNT returns up to num-matches positions (0 means
+// all of them). MAXLEN limits the number of compared elements.
+func lposCommand(client *RedisClient) {
+	ele := client.argv[2]
+	var rank int64 = 1
+	var count int64 = -1
+	var maxlen int64
+
+	for j := 3; j < len(client.argv); j++ {
+		opt := strings.ToLower(string(client.argv[j]))
+		moreargs := len(client.argv) - 1 - j
+		var ok bool
+		switch {
+		case opt == "rank" && moreargs > 0:
+			j++
+			if rank, ok = client.getLongLongOrReply(client.argv[j], ""); !ok {
+				return
+			}
+			if rank == math.MinInt64 {
+				client.addReplyError("value is out of range")
+				return
+			}
+			if rank == 0 {
+				client.addReplyError("RANK can't be zero: use 1 to start from the first match, " +
+					"2 from the second ... or use negative to start from the end of the list")
+				return
+			}
+		case opt == "count" && moreargs > 0:
+			j++
+			if count, ok = client.getPositiveLongLongOrReply(client.argv[j], "COUNT can't be negative"); !ok {
+				return
+			}
+		case opt == "maxlen" && moreargs > 0:
+			j++
+			if maxlen, ok = client.getPositiveLongLongOrReply(client.argv[j], "MAXLEN can't be negative"); !ok {
+				return
+			}
+		default:
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		if count != -1 {
+			client.addReply(shared.emptymultibulk)
+		} else {
+			client.addReply(shared.nullbulk)
+		}
+		return
+	}
+	if !client.checkType(o, constant.REDIS_LIST) {
+		return
+	}
+
+	// a negative rank searches from the tail
+	llen := int64(listTypeLength(o))
+	var li *listTypeIterator
+	forward := rank > 0
+	if forward {
+		li = listTypeInitIterator(o, 0, core.QUICKLIST_HEAD)
+	} else {
+		rank = -rank
+		li = listTypeInitIterator(o, -1, core.QUICKLIST_TAIL)
+	}
+
+	var index, matches int64
+	matchindex := int64(-1)
+	var positions []int64
+	for entry, ok := li.next(); ok && (maxlen == 0 || index < maxlen); entry, ok = li.next() {
+		if entry.equals(ele) {
+			matches++
+			if forward {
+				matchindex = index
+			} else {
+				matchindex = llen - index - 1
+			}
+			if matches >= rank {
+				if count == -1 {
+					break
+				}
+				positions = append(positions, matchindex)
+				if count != 0 && matches-rank+1 >= count {
+					break
+				}
+			}
+		}
+		index++
+		// remember if we exit the loop without a match
+		matchindex = -1
+	}
+
+	if count != -1 {
+		client.addReplyMultiBulkLen(len(positions))
+		for _, pos := range positions {
+			client.addReplyLongLong(pos)
+		}
+		return
+	}
+	if matchindex == -1 {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyLongLong(matchindex)
+}
+
+// lmoveHandlePush push value to the destination list, creating it if
+// needed. dobj is the current value of dstkey, already type checked.
+func lmoveHandlePush(client *RedisClient, dstkey []byte, dobj *RedisObject, value []byte, where int) {
+	if dobj == nil {
+		dobj = createListpackObject()
+		client.db.dbAdd(dstkey, dobj)
+	}
+	client.svr.listTypeTryConversion(dobj, [][]byte{value})
+	listTypePush(dobj, value, where)
+	// always send the pushed value to the client
+	client.addReplyBulk(value)
+}
+
+// lmoveGenericCommand pop an element from wherefrom of the source list and
+// push it to whereto of the destination list
+func lmoveGenericCommand(client *RedisClient, wherefrom, whereto int) {
+	db := client.db
+	srckey := client.argv[1]
+	dstkey := client.argv[2]
+	sobj := db.lookupKeyWrite(srckey)
+	if sobj == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(sobj, constant.REDIS_LIST) {
+		return
+	}
+	if listTypeLength(sobj) == 0 {
+		// this may only happen after loading very old RDB files
+		client.addReply(shared.nullbulk)
+		return
+	}
+	dobj := db.lookupKeyWrite(dstkey)
+	if dobj != nil && !client.checkType(dobj, constant.REDIS_LIST) {
+		return
+	}
+
+	value := listTypePop(sobj, wherefrom)
+	lmoveHandlePush(client, dstkey, dobj, value, whereto)
+
+	// delete the source list when it is empty
+	if listTypeLength(sobj) == 0 {
+		db.dbDelete(srckey)
+	}
+	client.svr.dirty++
+}
+
+func lmoveCommand(client *RedisClient) {
+	wherefrom, ok := getListPositionOrReply(client, client.argv[3])
+	if !ok {
+		return
+	}
+	whereto, ok := getListPositionOrReply(client, client.argv[4])
+	if !ok {
+		return
+	}
+	lmoveGenericCommand(client, wherefrom, whereto)
+}
+
+func rpoplpushCommand(client *RedisClient) {
+	lmoveGenericCommand(client, core.QUICKLIST_TAIL, core.QUICKLIST_HEAD)
+}
@@ -0,0 +1,465 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
+// RedisObject a value stored in the keyspace
+type RedisObject struct {
+	Type     int
+	Encoding int
+	Lru      int64 // unix time in milliseconds of the last access
+	Lfu      uint8 // logarithmic access frequency, tracked with the LFU maxmemory policies
+	RefCount int
+	epoch    uint64 // objectEpoch when the object was created or saved, see inSnapshot
+	// the value, depending on Type and Encoding:
+	// strings: *core.SdsHdr (raw) or *int64 (int)
+	// lists:   *core.Listpack or *core.Quicklist
+	// hashes:  *core.Zipmap or *dict.Dict with []byte values (hash table)
+	// sets:    *core.Intset or *dict.Dict with nil values (hash table)
+	// zsets:   *core.Listpack or *zset (skiplist)
+	// streams: *stream
+	Ptr interface{}
+}
+
+// sharedIntegers string objects for the small integers, they are shared by
+// every key holding the value and never modified in place
+var sharedIntegers = func() []*RedisObject {
+	objs := make([]*RedisObject, constant.REDIS_SHARED_INTEGERS)
+	for i := range objs {
+		value := int64(i)
+		objs[i] = &RedisObject{
+			Type:     constant.REDIS_STRING,
+			Encoding: constant.REDIS_ENCODING_INT,
+			Lfu:      constant.REDIS_LFU_INIT_VAL,
+			RefCount: constant.REDIS_SHARED_REFCOUNT,
+			Ptr:      &value,
+		}
+	}
+	return objs
+}()
+
+// objectEpoch incremented every time a background save takes a snapshot
+// of the keyspace, objects created before belong to the snapshot and are
+// cloned before being modified, until the saver has written them
+var objectEpoch uint64
+
+func createObject(objType int, ptr interface{}) *RedisObject {
+	return &RedisObject{
+		Type:     objType,
+		Encoding: constant.REDIS_ENCODING_RAW,
+		Lru:      time.Now().UnixMilli(),
+		Lfu:      constant.REDIS_LFU_INIT_VAL,
+		RefCount: 1,
+		epoch:    objectEpoch,
+		Ptr:      ptr,
+	}
+}
+
+// createStringObject create a raw string object holding a copy of data
+func createStringObject(data []byte) *RedisObject {
+	return createObject(constant.REDIS_STRING, core.SdsNewLen(data))
+}
+
+// createStringObjectFromLongLong create an integer encoded string object,
+// small values return a shared object
+func createStringObjectFromLongLong(value int64) *RedisObject {
+	if value >= 0 && value < constant.REDIS_SHARED_INTEGERS {
+		return sharedIntegers[value]
+	}
+	return createIntObject(value)
+}
+
+// createStringObjectFromLongLongForValue like createStringObjectFromLongLong
+// for an object stored in a key, see shareIntegers
+func (svr *RedisServer) createStringObjectFromLongLongForValue(value int64) *RedisObject {
+	if svr.shareIntegers() {
+		return createStringObjectFromLongLong(value)
+	}
+	return createIntObject(value)
+}
+
+// createIntObject create an integer encoded string object that is not shared
+func createIntObject(value int64) *RedisObject {
+	o := createObject(constant.REDIS_STRING, &value)
+	o.Encoding = constant.REDIS_ENCODING_INT
+	return o
+}
+
+// shareIntegers true when the keys can hold the shared integers. Not with
+// an LRU or LFU policy: a shared object has no access time or frequency of
+// its own.
+func (svr *RedisServer) shareIntegers() bool {
+	return !svr.lruEnabled() && !svr.lfuEnabled()
+}
+
+// createListpackObject create an empty list stored as a single listpack
+func createListpackObject() *RedisObject {
+	o := createObject(constant.REDIS_LIST, core.NewListpack())
+	o.Encoding = constant.REDIS_ENCODING_LISTPACK
+	return o
+}
+
+// createQuicklistObject create an empty list stored as a quicklist
+func createQuicklistObject(fill int) *RedisObject {
+	o := createObject(constant.REDIS_LIST, core.NewQuicklist(fill))
+	o.Encoding = constant.REDIS_ENCODING_QUICKLIST
+	return o
+}
+
+// createHashObject create an empty hash stored as a zipmap
+func createHashObject() *RedisObject {
+	o := createObject(constant.REDIS_HASH, core.NewZipmap())
+	o.Encoding = constant.REDIS_ENCODING_ZIPMAP
+	return o
+}
+
+// createSetObject create an empty set stored as a hash table
+func createSetObject() *RedisObject {
+	o := createObject(constant.REDIS_SET, dict.New(setDictType))
+	o.Encoding = constant.REDIS_ENCODING_HT
+	return o
+}
+
+// createIntsetObject create an empty set stored as an intset
+func createIntsetObject() *RedisObject {
+	o := createObject(constant.REDIS_SET, core.NewIntset())
+	o.Encoding = constant.REDIS_ENCODING_INTSET
+	return o
+}
+
+// createZsetObject create an empty sorted set stored as a skiplist
+func createZsetObject() *RedisObject {
+	o := createObject(constant.REDIS_ZSET, &zset{dict: dict.New(zsetDictType), zsl: core.NewZskiplist()})
+	o.Encoding = constant.REDIS_ENCODING_SKIPLIST
+	return o
+}
+
+// createZsetListpackObject create an empty sorted set stored as a listpack
+func createZsetListpackObject() *RedisObject {
+	o := createObject(constant.REDIS_ZSET, core.NewListpack())
+	o.Encoding = constant.REDIS_ENCODING_LISTPACK
+	return o
+}
+
+// createStreamObject create an empty stream
+func createStreamObject() *RedisObject {
+	o := createObject(constant.REDIS_STREAM, &stream{Stream: core.NewStream(), cgroups: map[string]*streamCG{}})
+	o.Encoding = constant.REDIS_ENCODING_STREAM
+	return o
+}
+
+// dupStringObject duplicate a string object, the copy is never shared
+// with o so it can be modified in place
+func dupStringObject(o *RedisObject) *RedisObject {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		value := *o.Ptr.(*int64)
+		d := createObject(constant.REDIS_STRING, &value)
+		d.Encoding = constant.REDIS_ENCODING_INT
+		return d
+	}
+	return createObject(constant.REDIS_STRING, o.Ptr.(*core.SdsHdr).Dup())
+}
+
+// objectDup duplicate an object of any type, the copy shares nothing with
+// o and is created in the current epoch
+func objectDup(o *RedisObject) *RedisObject {
+	switch o.Type {
+	case constant.REDIS_STRING:
+		return dupStringObject(o)
+	case constant.REDIS_LIST:
+		return listTypeDup(o)
+	case constant.REDIS_SET:
+		return setTypeDup(o)
+	case constant.REDIS_ZSET:
+		return zsetDup(o)
+	case constant.REDIS_HASH:
+		return hashTypeDup(o)
+	case constant.REDIS_STREAM:
+		return streamDup(o)
+	}
+	panic("Unknown object type")
+}
+
+// tryObjectEncoding try to encode a string object as an integer in order
+// to save space, return the object to use in place of o
+func (svr *RedisServer) tryObjectEncoding(o *RedisObject) *RedisObject {
+	if o.Type != constant.REDIS_STRING || o.Encoding != constant.REDIS_ENCODING_RAW {
+		return o
+	}
+	s := o.Ptr.(*core.SdsHdr)
+	// strings longer than 20 chars can't be a 64 bit integer
+	if s.Len > 20 {
+		return o
+	}
+	value, ok := s.ToLongLong()
+	if !ok {
+		return o
+	}
+	if svr.shareIntegers() && value >= 0 && value < constant.REDIS_SHARED_INTEGERS {
+		return sharedIntegers[value]
+	}
+	o.Encoding = constant.REDIS_ENCODING_INT
+	o.Ptr = &value
+	return o
+}
+
+// isShared shared objects must be copied before modifying them
+func (o *RedisObject) isShared() bool {
+	return o.RefCount > 1
+}
+
+// stringObjectBytes the content of a string object, integer encoded
+// values are converted to their decimal representation
+func stringObjectBytes(o *RedisObject) []byte {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		return strconv.AppendInt(nil, *o.Ptr.(*int64), 10)
+	}
+	return o.Ptr.(*core.SdsHdr).Bytes()
+}
+
+// stringObjectLen length of the string representation
+func stringObjectLen(o *RedisObject) int64 {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		return int64(len(strconv.FormatInt(*o.Ptr.(*int64), 10)))
+	}
+	return o.Ptr.(*core.SdsHdr).Len
+}
+
+// checkType reply with a WRONGTYPE error when o is not of type objType
+func (client *RedisClient) checkType(o *RedisObject, objType int) bool {
+	if o.Type != objType {
+		client.addReplyError(shared.wrongtypeerr)
+		return false
+	}
+	return true
+}
+
+// getLongLongFromObject parse a string object as int64
+func getLongLongFromObject(o *RedisObject) (int64, bool) {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		return *o.Ptr.(*int64), true
+	}
+	return o.Ptr.(*core.SdsHdr).ToLongLong()
+}
+
+// getDoubleFromBytes parse a float the way strtod does, rejecting
+// surrounding spaces and NaN
+func getDoubleFromBytes(b []byte) (float64, bool) {
+	if len(b) == 0 || isSpaceByte(b[0]) || isSpaceByte(b[len(b)-1]) {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		// out of range values are accepted as +/-inf like strtod does
+		if numErr, ok := err.(*strconv.NumError); !ok || numErr.Err != strconv.ErrRange {
+			return 0, false
+		}
+	}
+	if math.IsNaN(value) {
+		return 0, false
+	}
+	return value, true
+}
+
+func isSpaceByte(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\v' || c == '\f'
+}
+
+// getDoubleFromObject parse a string object as float64
+func getDoubleFromObject(o *RedisObject) (float64, bool) {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		return float64(*o.Ptr.(*int64)), true
+	}
+	return getDoubleFromBytes(o.Ptr.(*core.SdsHdr).Bytes())
+}
+
+// getDoubleOrReply parse arg as a float64, on error reply to the client
+// with msg (or the default message when msg is empty)
+func (client *RedisClient) getDoubleOrReply(arg []byte, msg string) (float64, bool) {
+	v, ok := getDoubleFromBytes(arg)
+	if !ok {
+		if msg == "" {
+			msg = "value is not a valid float"
+		}
+		client.addReplyError(msg)
+		return 0, false
+	}
+	return v, true
+}
+
+// getLongLongOrReply parse arg as a int64, on error reply to the client
+// with msg (or the default message when msg is empty)
+func (client *RedisClient) getLongLongOrReply(arg []byte, msg string) (int64, bool) {
+	v, ok := core.String2ll(arg)
+	if !ok {
+		if msg == "" {
+			msg = "value is not an integer or out of range"
+		}
+		client.addReplyError(msg)
+		return 0, false
+	}
+	return v, true
+}
+
+// getIntOrReply like getLongLongOrReply but also check the value fits in an int
+func (client *RedisClient) getIntOrReply(arg []byte, msg string) (int, bool) {
+	v, ok := client.getLongLongOrReply(arg, msg)
+	if !ok {
+		return 0, false
+	}
+	if int64(int(v)) != v {
+		if msg == "" {
+			msg = "value is out of range"
+		}
+		client.addReplyError(msg)
+		return 0, false
+	}
+	return int(v), true
+}
+
+// ======================= LFU ===========================
+
+// lfuEnabled true when the maxmemory policy evicts the least frequently
+// used keys, only then the access frequency is tracked
+func (svr *RedisServer) lfuEnabled() bool {
+	return strings.HasSuffix(svr.conf.MaxMemoryPolicy, "-lfu")
+}
+
+// lruEnabled true when the maxmemory policy evicts the least recently
+// used keys
+func (svr *RedisServer) lruEnabled() bool {
+	return strings.HasSuffix(svr.conf.MaxMemoryPolicy, "-lru")
+}
+
+// lfuLogIncr increment the counter with a probability that decreases as
+// the counter grows: with the default log factor it saturates at 255
+// after about a million accesses
+func (svr *RedisServer) lfuLogIncr(counter uint8) uint8 {
+	if counter == 255 {
+		return 255
+	}
+	baseval := float64(counter) - float64(constant.REDIS_LFU_INIT_VAL)
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*float64(svr.conf.LfuLogFactor) + 1)
+	if rand.Float64() < p {
+		counter++
+	}
+	return counter
+}
+
+// lfuDecrAndReturn the counter of o decremented by one for every decay
+// period elapsed since the last access. o is not modified.
+func (svr *RedisServer) lfuDecrAndReturn(o *RedisObject) uint8 {
+	if svr.conf.LfuDecayTime <= 0 {
+		return o.Lfu
+	}
+	elapsed := (time.Now().UnixMilli() - o.Lru) / 60000
+	periods := elapsed / int64(svr.conf.LfuDecayTime)
+	if periods >= int64(o.Lfu) {
+		return 0
+	}
+	return o.Lfu - uint8(periods)
+}
+
+// updateLFU account an access to o: the counter is first decayed, then
+// incremented. Must be called before the access time is updated.
+func (svr *RedisServer) updateLFU(o *RedisObject) {
+	o.Lfu = svr.lfuLogIncr(svr.lfuDecrAndReturn(o))
+}
+
+// ======================= OBJECT command ===========================
+
+// strEncoding the name of an encoding as reported by OBJECT ENCODING
+func strEncoding(encoding int) string {
+	switch encoding {
+	case constant.REDIS_ENCODING_RAW:
+		return "raw"
+	case constant.REDIS_ENCODING_INT:
+		return "int"
+	case constant.REDIS_ENCODING_HT:
+		return "hashtable"
+	case constant.REDIS_ENCODING_ZIPMAP:
+		return "zipmap"
+	case constant.REDIS_ENCODING_LINKEDLIST:
+		return "linkedlist"
+	case constant.REDIS_ENCODING_ZIPLIST:
+		return "ziplist"
+	case constant.REDIS_ENCODING_INTSET:
+		return "intset"
+	case constant.REDIS_ENCODING_SKIPLIST:
+		return "skiplist"
+	case constant.REDIS_ENCODING_EMBSTR:
+		return "embstr"
+	case constant.REDIS_ENCODING_QUICKLIST:
+		return "quicklist"
+	case constant.REDIS_ENCODING_STREAM:
+		return "stream"
+	case constant.REDIS_ENCODING_LISTPACK:
+		return "listpack"
+	}
+	return "unknown"
+}
+
+func objectCommand(client *RedisClient) {
+	svr := client.svr
+	sub := strings.ToLower(string(client.argv[1]))
+	if len(client.argv) == 2 && sub == "help" {
+		addReplyHelp(client, "OBJECT", []string{
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of the <key>. The returned integer is",
+			"    proportional to the logarithm of the recent access frequency of the key.",
+			"IDLETIME <key>",
+			"    Return the idle time of the <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+		})
+		return
+	}
+	if len(client.argv) != 3 || (sub != "encoding" && sub != "refcount" && sub != "idletime" && sub != "freq") {
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+	o := client.db.lookupKeyReadNoTouch(client.argv[2])
+	if o == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	switch sub {
+	case "encoding":
+		client.addReplyBulkString(strEncoding(o.Encoding))
+	case "refcount":
+		client.addReplyLongLong(int64(o.RefCount))
+	case "idletime":
+		if svr.lfuEnabled() {
+			client.addReplyError("An LFU maxmemory policy is selected, idle time not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		if o.RefCount == constant.REDIS_SHARED_REFCOUNT {
+			client.addReplyError("The value is a shared integer, idle time not tracked. Select an LRU or LFU maxmemory policy to track it.")
+			return
+		}
+		client.addReplyLongLong((time.Now().UnixMilli() - o.Lru) / 1000)
+	case "freq":
+		if !svr.lfuEnabled() {
+			client.addReplyError("An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.")
+			return
+		}
+		client.addReplyLongLong(int64(svr.lfuDecrAndReturn(o)))
+	}
+}
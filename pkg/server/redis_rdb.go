@@ -0,0 +1,1781 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/crc64"
+	"github.com/0226zy/myredis/pkg/dict"
+	"github.com/0226zy/myredis/pkg/log"
+	"github.com/0226zy/myredis/pkg/lzf"
+)
+
+// streamNodeMaxEntries entries per listpack node when a stream is saved
+const streamNodeMaxEntries int = 100
+
+// flags of the entries in the listpack nodes of a stream
+const (
+	streamItemFlagNone       = 0      // no special flags
+	streamItemFlagDeleted    = 1 << 0 // entry is deleted, skip it
+	streamItemFlagSameFields = 1 << 1 // same fields as the master entry
+)
+
+// rdbMaxStringLen longest string accepted by the loader, a corrupted
+// length must not turn into a huge allocation
+const rdbMaxStringLen uint64 = 512 * 1024 * 1024
+
+// rdbFilename the path of the RDB file, dbfilename inside dir
+func (svr *RedisServer) rdbFilename() string {
+	return filepath.Join(svr.conf.Dir, svr.conf.DBFileName)
+}
+
+// ======================= save ===========================
+
+// The save functions write to a bufio.Writer without checking errors:
+// the writer keeps the first error and returns it from Flush, that is
+// called once the whole dataset was written.
+
+// rdbWriter the writer of the save functions, compress enables the LZF
+// compression of the strings (rdbcompression) and version is the RDB
+// version of the file (rdb-version), it selects the types of the values
+type rdbWriter struct {
+	*bufio.Writer
+	compress bool
+	version  int
+}
+
+func rdbSaveType(w *rdbWriter, t byte) {
+	w.WriteByte(t)
+}
+
+// rdbSaveLen save a length with the smallest length encoding
+func rdbSaveLen(w *rdbWriter, l uint64) {
+	var buf [9]byte
+	switch {
+	case l < 1<<6:
+		// save a 6 bit len
+		w.WriteByte(byte(l) | constant.REDIS_RDB_6BITLEN<<6)
+	case l < 1<<14:
+		// save a 14 bit len
+		buf[0] = byte(l>>8) | constant.REDIS_RDB_14BITLEN<<6
+		buf[1] = byte(l)
+		w.Write(buf[:2])
+	case l <= math.MaxUint32:
+		// save a 32 bit len
+		buf[0] = constant.REDIS_RDB_32BITLEN
+		binary.BigEndian.PutUint32(buf[1:], uint32(l))
+		w.Write(buf[:5])
+	default:
+		// save a 64 bit len
+		buf[0] = constant.REDIS_RDB_64BITLEN
+		binary.BigEndian.PutUint64(buf[1:], l)
+		w.Write(buf[:9])
+	}
+}
+
+// rdbEncodeInteger encode value with the special integer encodings of
+// strings, nil when it doesn't fit in 32 bits
+func rdbEncodeInteger(value int64) []byte {
+	switch {
+	case value >= math.MinInt8 && value <= math.MaxInt8:
+		return []byte{constant.REDIS_RDB_ENCVAL<<6 | byte(constant.REDIS_RDB_ENC_INT8), byte(value)}
+	case value >= math.MinInt16 && value <= math.MaxInt16:
+		enc := []byte{constant.REDIS_RDB_ENCVAL<<6 | byte(constant.REDIS_RDB_ENC_INT16), 0, 0}
+		binary.LittleEndian.PutUint16(enc[1:], uint16(value))
+		return enc
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		enc := []byte{constant.REDIS_RDB_ENCVAL<<6 | byte(constant.REDIS_RDB_ENC_INT32), 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(enc[1:], uint32(value))
+		return enc
+	}
+	return nil
+}
+
+// rdbTryIntegerEncoding the integer encoding of s when s is the canonical
+// decimal representation of a number that fits in 32 bits, else nil
+func rdbTryIntegerEncoding(s []byte) []byte {
+	// strings longer than 11 chars can't be a 32 bit integer
+	if len(s) > 11 {
+		return nil
+	}
+	value, ok := core.String2ll(s)
+	if !ok || strconv.FormatInt(value, 10) != string(s) {
+		return nil
+	}
+	return rdbEncodeInteger(value)
+}
+
+// rdbSaveLzfString save s compressed with LZF, return false when the
+// compression doesn't save at least 4 bytes and nothing was written
+func rdbSaveLzfString(w *rdbWriter, s []byte) bool {
+	// we require at least four bytes compression for this to be worth it
+	if len(s) <= 4 {
+		return false
+	}
+	c := make([]byte, len(s)-4)
+	clen := lzf.Compress(s, c)
+	if clen == 0 {
+		return false
+	}
+	w.WriteByte(constant.REDIS_RDB_ENCVAL<<6 | byte(constant.REDIS_RDB_ENC_LZF))
+	rdbSaveLen(w, uint64(clen))
+	rdbSaveLen(w, uint64(len(s)))
+	w.Write(c[:clen])
+	return true
+}
+
+// rdbSaveRawString save a string, numbers are saved as integers and the
+// strings longer than 20 bytes are compressed when rdbcompression is on
+func rdbSaveRawString(w *rdbWriter, s []byte) {
+	if enc := rdbTryIntegerEncoding(s); enc != nil {
+		w.Write(enc)
+		return
+	}
+	if w.compress && len(s) > 20 && rdbSaveLzfString(w, s) {
+		return
+	}
+	rdbSaveLen(w, uint64(len(s)))
+	w.Write(s)
+}
+
+// rdbSaveLongLongAsStringObject save an integer as a string
+func rdbSaveLongLongAsStringObject(w *rdbWriter, value int64) {
+	if enc := rdbEncodeInteger(value); enc != nil {
+		w.Write(enc)
+		return
+	}
+	s := strconv.AppendInt(nil, value, 10)
+	rdbSaveLen(w, uint64(len(s)))
+	w.Write(s)
+}
+
+func rdbSaveStringObject(w *rdbWriter, o *RedisObject) {
+	if o.Encoding == constant.REDIS_ENCODING_INT {
+		rdbSaveLongLongAsStringObject(w, *o.Ptr.(*int64))
+		return
+	}
+	rdbSaveRawString(w, o.Ptr.(*core.SdsHdr).Bytes())
+}
+
+// rdbSaveBinaryDoubleValue save a double as its 8 bytes IEEE 754
+// representation, little endian
+func rdbSaveBinaryDoubleValue(w *rdbWriter, value float64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(value))
+	w.Write(buf[:])
+}
+
+// rdbSaveMillisecondTime save a unix time in ms, little endian
+func rdbSaveMillisecondTime(w *rdbWriter, t int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(t))
+	w.Write(buf[:])
+}
+
+// rdbEncodeStreamID the 128 bit big endian form of an ID, used as key of
+// the listpack nodes and in the PELs
+func rdbEncodeStreamID(id core.StreamID) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, id.Ms)
+	binary.BigEndian.PutUint64(buf[8:], id.Seq)
+	return buf
+}
+
+func rdbDecodeStreamID(buf []byte) core.StreamID {
+	return core.StreamID{Ms: binary.BigEndian.Uint64(buf), Seq: binary.BigEndian.Uint64(buf[8:])}
+}
+
+// rdbSaveObjectType save the RDB type of o
+func rdbSaveObjectType(w *rdbWriter, o *RedisObject) {
+	switch o.Type {
+	case constant.REDIS_STRING:
+		rdbSaveType(w, constant.REDIS_RDB_TYPE_STRING)
+	case constant.REDIS_LIST:
+		rdbSaveType(w, constant.REDIS_RDB_TYPE_LIST)
+	case constant.REDIS_SET:
+		rdbSaveType(w, constant.REDIS_RDB_TYPE_SET)
+	case constant.REDIS_ZSET:
+		rdbSaveType(w, constant.REDIS_RDB_TYPE_ZSET_2)
+	case constant.REDIS_HASH:
+		rdbSaveType(w, constant.REDIS_RDB_TYPE_HASH)
+	case constant.REDIS_STREAM:
+		rdbSaveType(w, rdbStreamType(w.version))
+	default:
+		panic("Unknown object type")
+	}
+}
+
+// rdbStreamType the type of the streams in the RDB files of version
+func rdbStreamType(version int) byte {
+	switch {
+	case version >= 11:
+		return constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_3
+	case version == 10:
+		return constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_2
+	}
+	return constant.REDIS_RDB_TYPE_STREAM_LISTPACKS
+}
+
+// rdbSaveObject save the value of o, its type is saved by rdbSaveObjectType
+func rdbSaveObject(w *rdbWriter, o *RedisObject) {
+	switch o.Type {
+	case constant.REDIS_STRING:
+		rdbSaveStringObject(w, o)
+	case constant.REDIS_LIST:
+		rdbSaveLen(w, uint64(listTypeLength(o)))
+		li := listTypeInitIterator(o, 0, core.QUICKLIST_HEAD)
+		for entry, ok := li.next(); ok; entry, ok = li.next() {
+			rdbSaveRawString(w, entry.value())
+		}
+	case constant.REDIS_SET:
+		rdbSaveLen(w, uint64(setTypeSize(o)))
+		si := setTypeInitIterator(o)
+		for member, ok := si.next(); ok; member, ok = si.next() {
+			rdbSaveRawString(w, member)
+		}
+	case constant.REDIS_ZSET:
+		rdbSaveLen(w, uint64(zsetLength(o)))
+		zi := zsetInitIterator(o, 0, false)
+		for entry, ok := zi.next(); ok; entry, ok = zi.next() {
+			rdbSaveRawString(w, entry.ele)
+			rdbSaveBinaryDoubleValue(w, entry.score)
+		}
+	case constant.REDIS_HASH:
+		rdbSaveLen(w, uint64(hashTypeLength(o)))
+		hi := hashTypeInitIterator(o)
+		for field, value, ok := hi.next(); ok; field, value, ok = hi.next() {
+			rdbSaveRawString(w, field)
+			rdbSaveRawString(w, value)
+		}
+	case constant.REDIS_STREAM:
+		rdbSaveStreamObject(w, o.Ptr.(*stream))
+	default:
+		panic("Unknown object type")
+	}
+}
+
+// rdbSaveStreamObject save a stream the way Redis stores it: the entries
+// as listpack nodes keyed by the ID of their first entry, then the
+// metadata and the consumer groups. The fields missing from the stream
+// type of w.version are left out, see rdbLoadStreamObject.
+func rdbSaveStreamObject(w *rdbWriter, s *stream) {
+	rdbtype := rdbStreamType(w.version)
+	n := s.Len()
+	rdbSaveLen(w, uint64((n+streamNodeMaxEntries-1)/streamNodeMaxEntries))
+	for start := 0; start < n; start += streamNodeMaxEntries {
+		end := start + streamNodeMaxEntries
+		if end > n {
+			end = n
+		}
+		master := s.Entry(start)
+		rdbSaveRawString(w, rdbEncodeStreamID(master.ID))
+		rdbSaveRawString(w, streamEncodeListpackNode(s, start, end).Bytes())
+	}
+
+	// metadata
+	rdbSaveLen(w, uint64(n))
+	rdbSaveLen(w, s.LastID.Ms)
+	rdbSaveLen(w, s.LastID.Seq)
+	if rdbtype != constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+		rdbSaveLen(w, s.FirstID.Ms)
+		rdbSaveLen(w, s.FirstID.Seq)
+		rdbSaveLen(w, s.MaxDeletedEntryID.Ms)
+		rdbSaveLen(w, s.MaxDeletedEntryID.Seq)
+		rdbSaveLen(w, s.EntriesAdded)
+	}
+
+	// consumer groups
+	cgs := s.sortedCGs()
+	rdbSaveLen(w, uint64(len(cgs)))
+	for _, cg := range cgs {
+		rdbSaveRawString(w, []byte(cg.name))
+		rdbSaveLen(w, cg.lastID.Ms)
+		rdbSaveLen(w, cg.lastID.Seq)
+		if rdbtype != constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+			rdbSaveLen(w, uint64(cg.entriesRead))
+		}
+
+		// the global PEL with the delivery metadata
+		rdbSaveLen(w, uint64(cg.pel.len()))
+		for _, id := range cg.pel.ids {
+			nack := cg.pel.get(id)
+			w.Write(rdbEncodeStreamID(id))
+			rdbSaveMillisecondTime(w, nack.deliveryTime)
+			rdbSaveLen(w, uint64(nack.deliveryCount))
+		}
+
+		// the consumers, their PEL only references the global one
+		consumers := cg.sortedConsumers()
+		rdbSaveLen(w, uint64(len(consumers)))
+		for _, consumer := range consumers {
+			rdbSaveRawString(w, []byte(consumer.name))
+			rdbSaveMillisecondTime(w, consumer.seenTime)
+			if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_3 {
+				rdbSaveMillisecondTime(w, consumer.activeTime)
+			}
+			rdbSaveLen(w, uint64(consumer.pel.len()))
+			for _, id := range consumer.pel.ids {
+				w.Write(rdbEncodeStreamID(id))
+			}
+		}
+	}
+}
+
+// streamEncodeListpackNode build the listpack node of the entries in
+// [start, end). The fields of the first entry become the master fields,
+// the entries with the same fields only store their values.
+func streamEncodeListpackNode(s *stream, start, end int) *core.Listpack {
+	lpAppendInteger := func(lp *core.Listpack, v int64) {
+		lp.Append(strconv.AppendInt(nil, v, 10))
+	}
+
+	master := s.Entry(start)
+	masterFields := make([][]byte, 0, len(master.Fields)/2)
+	for i := 0; i < len(master.Fields); i += 2 {
+		masterFields = append(masterFields, master.Fields[i])
+	}
+
+	lp := core.NewListpack()
+	// master entry: count, deleted, num-fields, the fields and a 0 terminator
+	lpAppendInteger(lp, int64(end-start))
+	lpAppendInteger(lp, 0)
+	lpAppendInteger(lp, int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.Append(field)
+	}
+	lpAppendInteger(lp, 0)
+
+	for i := start; i < end; i++ {
+		e := s.Entry(i)
+		numfields := len(e.Fields) / 2
+		flags := streamItemFlagNone
+		if numfields == len(masterFields) {
+			flags = streamItemFlagSameFields
+			for j, field := range masterFields {
+				if !bytes.Equal(e.Fields[2*j], field) {
+					flags = streamItemFlagNone
+					break
+				}
+			}
+		}
+		lpAppendInteger(lp, int64(flags))
+		lpAppendInteger(lp, int64(e.ID.Ms-master.ID.Ms))
+		lpAppendInteger(lp, int64(e.ID.Seq-master.ID.Seq))
+		if flags&streamItemFlagSameFields != 0 {
+			for j := 1; j < len(e.Fields); j += 2 {
+				lp.Append(e.Fields[j])
+			}
+			lpAppendInteger(lp, int64(numfields+3))
+		} else {
+			lpAppendInteger(lp, int64(numfields))
+			for _, fv := range e.Fields {
+				lp.Append(fv)
+			}
+			lpAppendInteger(lp, int64(2*numfields+4))
+		}
+	}
+	return lp
+}
+
+// rdbSaveKeyValuePair save a key with its value, expire time and the
+// access time or frequency of the eviction policy. Keys already expired
+// are not saved.
+func rdbSaveKeyValuePair(w *rdbWriter, k *rdbSnapshotKey, now int64) {
+	if k.expire != -1 {
+		// if this key is already expired skip it
+		if k.expire < now {
+			return
+		}
+		rdbSaveType(w, constant.REDIS_RDB_OPCODE_EXPIRETIME_MS)
+		rdbSaveMillisecondTime(w, k.expire)
+	}
+	if k.lruIdle != -1 {
+		rdbSaveType(w, constant.REDIS_RDB_OPCODE_IDLE)
+		rdbSaveLen(w, uint64(k.lruIdle))
+	}
+	if k.lfuFreq != -1 {
+		rdbSaveType(w, constant.REDIS_RDB_OPCODE_FREQ)
+		w.WriteByte(byte(k.lfuFreq))
+	}
+	rdbSaveObjectType(w, k.val)
+	rdbSaveRawString(w, []byte(k.key))
+	rdbSaveObject(w, k.val)
+}
+
+// rdbSaveAuxField save an AUX field, a string to string pair describing
+// the RDB file
+func rdbSaveAuxField(w *rdbWriter, key string, val []byte) {
+	rdbSaveType(w, constant.REDIS_RDB_OPCODE_AUX)
+	rdbSaveRawString(w, []byte(key))
+	rdbSaveRawString(w, val)
+}
+
+// rdbSnapshot a point in time view of the dataset
+type rdbSnapshot struct {
+	ctime    int64  // unix time of the snapshot
+	epoch    uint64 // objectEpoch of the snapshot
+	usedMem  uint64 // memory allocated by the server at that time
+	compress bool   // rdbcompression at that time
+	version  int    // rdb-version at that time
+	aofBase  bool   // the snapshot is the RDB preamble of an AOF
+	dbs      []rdbSnapshotDb
+	paused   []*dict.Dict // values whose rehashing is paused, see snapshotDataset
+}
+
+// rdbSnapshotDb the keys of a non empty db
+type rdbSnapshotDb struct {
+	id      int
+	keys    []rdbSnapshotKey
+	expires []rdbSnapshotExpire // the TTLs, joined with the keys by the saver
+}
+
+// rdbSnapshotExpire the TTL of a key of the snapshot
+type rdbSnapshotExpire struct {
+	key  string
+	when int64 // unix time in ms
+}
+
+// rdbSnapshotKey a key of the dataset at the time of the snapshot
+type rdbSnapshotKey struct {
+	key     string
+	val     *RedisObject
+	expire  int64 // unix time in ms, -1 when the key has no TTL
+	lruIdle int64 // idle time in seconds, -1 when the policy is not LRU
+	lfuFreq int   // access frequency, -1 when the policy is not LFU
+}
+
+// snapshotDataset take a point in time view of the dataset: only the keys
+// are copied, the values are shared with the keyspace until the saver
+// writes them or a write clones them (see lookupKeyWrite). Starting a new epoch marks every
+// existing object as part of the snapshot.
+//
+// It runs in the event loop, so it only copies the entries of the dicts:
+// the TTLs are looked up by the saver. For a background save the reads
+// of the server must not move the entries of a dict being saved, the
+// rehashing of those values is paused until resumeRehashing.
+func (svr *RedisServer) snapshotDataset(background bool) *rdbSnapshot {
+	objectEpoch++
+	snapshot := &rdbSnapshot{
+		ctime:    time.Now().Unix(),
+		epoch:    objectEpoch,
+		usedMem:  uint64(svr.statUsedMemory),
+		compress: svr.conf.RDBCompression,
+		version:  svr.conf.RDBVersion,
+	}
+	lru, lfu := svr.lruEnabled(), svr.lfuEnabled()
+	now := time.Now().UnixMilli()
+	for _, db := range svr.dbs {
+		if db.dbSize() == 0 {
+			continue
+		}
+		sdb := rdbSnapshotDb{
+			id:      db.id,
+			keys:    make([]rdbSnapshotKey, 0, db.dbSize()),
+			expires: make([]rdbSnapshotExpire, 0, db.expires.Len()),
+		}
+		it := db.dict.GetSafeIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			val := de.Val.(*RedisObject)
+			if background && val.Encoding == constant.REDIS_ENCODING_HT {
+				if d := val.Ptr.(*dict.Dict); d.IsRehashing() {
+					d.PauseRehashing()
+					snapshot.paused = append(snapshot.paused, d)
+				}
+			}
+			k := rdbSnapshotKey{
+				key:     de.Key,
+				val:     val,
+				expire:  -1,
+				lruIdle: -1,
+				lfuFreq: -1,
+			}
+			if lru {
+				k.lruIdle = (now - val.Lru) / 1000
+				if k.lruIdle < 0 {
+					k.lruIdle = 0
+				}
+			} else if lfu {
+				k.lfuFreq = int(svr.lfuDecrAndReturn(val))
+			}
+			sdb.keys = append(sdb.keys, k)
+		}
+		it.Release()
+		it = db.expires.GetSafeIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			sdb.expires = append(sdb.expires, rdbSnapshotExpire{key: de.Key, when: de.Val.(int64)})
+		}
+		it.Release()
+		snapshot.dbs = append(snapshot.dbs, sdb)
+	}
+	return snapshot
+}
+
+// resumeRehashing resume the rehashing paused by snapshotDataset, once
+// the saver is done with the snapshot
+func (snapshot *rdbSnapshot) resumeRehashing() {
+	for _, d := range snapshot.paused {
+		d.ResumeRehashing()
+	}
+	snapshot.paused = nil
+}
+
+// joinExpires set the expire of the keys of sdb from its TTLs
+func (sdb *rdbSnapshotDb) joinExpires() {
+	if len(sdb.expires) == 0 {
+		return
+	}
+	expires := make(map[string]int64, len(sdb.expires))
+	for _, e := range sdb.expires {
+		expires[e.key] = e.when
+	}
+	for i := range sdb.keys {
+		if when, ok := expires[sdb.keys[i].key]; ok {
+			sdb.keys[i].expire = when
+		}
+	}
+}
+
+// inSnapshot true when o belongs to the snapshot of the background save
+// in progress and the saver didn't write it yet, it must not be modified
+// in place. The saver moves the written objects to the epoch of the
+// snapshot, the only field it writes.
+func (svr *RedisServer) inSnapshot(o *RedisObject) bool {
+	return svr.rdbChild != nil && o.RefCount != constant.REDIS_SHARED_REFCOUNT &&
+		atomic.LoadUint64(&o.epoch) < objectEpoch
+}
+
+// errRdbSaveAborted the background save was killed, e.g. by FLUSHALL
+var errRdbSaveAborted = errors.New("background save aborted")
+
+// rdbChecksumWriter compute the checksum of the bytes written
+type rdbChecksumWriter struct {
+	crc uint64
+}
+
+func (cw *rdbChecksumWriter) Write(p []byte) (int, error) {
+	cw.crc = crc64.Update(cw.crc, p)
+	return len(p), nil
+}
+
+// rdbSaveRio write the snapshot to out in the RDB format. The save stops
+// with errRdbSaveAborted as soon as abort is set, abort is nil for the
+// foreground saves.
+func rdbSaveRio(out io.Writer, snapshot *rdbSnapshot, abort *atomic.Bool) error {
+	var cw rdbChecksumWriter
+	w := &rdbWriter{
+		Writer:   bufio.NewWriterSize(io.MultiWriter(out, &cw), 64*1024),
+		compress: snapshot.compress,
+		version:  snapshot.version,
+	}
+
+	w.WriteString(fmt.Sprintf("REDIS%04d", snapshot.version))
+	rdbSaveAuxField(w, "redis-ver", []byte(constant.REDIS_VERSION))
+	rdbSaveAuxField(w, "redis-bits", strconv.AppendInt(nil, strconv.IntSize, 10))
+	rdbSaveAuxField(w, "ctime", strconv.AppendInt(nil, snapshot.ctime, 10))
+	rdbSaveAuxField(w, "used-mem", strconv.AppendUint(nil, snapshot.usedMem, 10))
+	aofBase := []byte("0")
+	if snapshot.aofBase {
+		aofBase = []byte("1")
+	}
+	rdbSaveAuxField(w, "aof-base", aofBase)
+
+	now := time.Now().UnixMilli()
+	for d := range snapshot.dbs {
+		sdb := &snapshot.dbs[d]
+		sdb.joinExpires()
+
+		// write the SELECT DB opcode
+		rdbSaveType(w, constant.REDIS_RDB_OPCODE_SELECTDB)
+		rdbSaveLen(w, uint64(sdb.id))
+
+		// write the RESIZE DB opcode
+		rdbSaveType(w, constant.REDIS_RDB_OPCODE_RESIZEDB)
+		rdbSaveLen(w, uint64(len(sdb.keys)))
+		rdbSaveLen(w, uint64(len(sdb.expires)))
+
+		// write every entry of this DB
+		for i := range sdb.keys {
+			if abort != nil && abort.Load() {
+				return errRdbSaveAborted
+			}
+			k := &sdb.keys[i]
+			rdbSaveKeyValuePair(w, k, now)
+			// the value is written, the server can now modify it in place
+			if k.val.RefCount != constant.REDIS_SHARED_REFCOUNT {
+				atomic.StoreUint64(&k.val.epoch, snapshot.epoch)
+			}
+		}
+	}
+	rdbSaveType(w, constant.REDIS_RDB_OPCODE_EOF)
+
+	// the CRC64 checksum of everything written so far
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	var cksum [8]byte
+	binary.LittleEndian.PutUint64(cksum[:], cw.crc)
+	w.Write(cksum[:])
+	return w.Flush()
+}
+
+// rdbSaveSnapshot write the snapshot on disk. The file is written to
+// tmpfile that is renamed over filename only once complete, so a crash in
+// the middle of the save never leaves a truncated RDB. It doesn't touch
+// the server, the background saves call it from their own goroutine.
+func rdbSaveSnapshot(filename, tmpfile string, snapshot *rdbSnapshot, abort *atomic.Bool) error {
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		log.RedisLog(log.REDIS_WARNING, "Failed opening .rdb for saving: %v", err)
+		return err
+	}
+
+	err = rdbSaveRio(f, snapshot, abort)
+	// make sure data will not remain on the OS's output buffers
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		if err != errRdbSaveAborted {
+			log.RedisLog(log.REDIS_WARNING, "Write error saving DB on disk: %v", err)
+		}
+		return err
+	}
+
+	// use RENAME to make sure the DB file is changed atomically only
+	// if the generate DB file is ok
+	if err := os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		log.RedisLog(log.REDIS_WARNING, "Error moving temp DB file on the final destination: %v", err)
+		return err
+	}
+	return nil
+}
+
+// rdbSave save the dataset on disk in the foreground
+func (svr *RedisServer) rdbSave(filename string) error {
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := rdbSaveSnapshot(filename, tmpfile, svr.snapshotDataset(false), nil); err != nil {
+		return err
+	}
+	log.RedisLog(log.REDIS_NOTICE, "DB saved on disk")
+	svr.dirty = 0
+	svr.lastsave = time.Now().Unix()
+	svr.lastbgsaveStatus = true
+	return nil
+}
+
+// rdbChild a background save in progress
+type rdbChild struct {
+	done     chan error  // receives the result of the save
+	abort    atomic.Bool // set to stop the save
+	start    time.Time
+	snapshot *rdbSnapshot
+}
+
+// rdbSaveBackground save the dataset on disk while the server keeps
+// serving the clients: a goroutine writes a snapshot of the keyspace, the
+// result is collected by the cron with checkChildrenDone.
+func (svr *RedisServer) rdbSaveBackground(filename string) error {
+	if svr.rdbChild != nil {
+		return errors.New("background save already in progress")
+	}
+	svr.dirtyBeforeBgsave = svr.dirty
+	svr.lastbgsaveTry = time.Now().Unix()
+
+	start := time.Now()
+	snapshot := svr.snapshotDataset(true)
+	svr.statForkTime = time.Since(start).Microseconds()
+	child := &rdbChild{done: make(chan error, 1), start: time.Now(), snapshot: snapshot}
+	tmpfile := filepath.Join(filepath.Dir(filename), fmt.Sprintf("temp-bg-%d.rdb", os.Getpid()))
+	go func() {
+		child.done <- rdbSaveSnapshot(filename, tmpfile, snapshot, &child.abort)
+	}()
+	svr.rdbChild = child
+	svr.rdbBgsaveScheduled = false
+	log.RedisLog(log.REDIS_NOTICE, "Background saving started")
+	return nil
+}
+
+// backgroundSaveDoneHandler called when the background save terminated
+func (svr *RedisServer) backgroundSaveDoneHandler(err error) {
+	child := svr.rdbChild
+	svr.rdbChild = nil
+	child.snapshot.resumeRehashing()
+	svr.rdbLastBgsaveTimeSec = int64(time.Since(child.start).Seconds())
+	switch {
+	case err == nil:
+		log.RedisLog(log.REDIS_NOTICE, "Background saving terminated with success")
+		svr.dirty -= svr.dirtyBeforeBgsave
+		svr.lastsave = time.Now().Unix()
+		svr.lastbgsaveStatus = true
+	case err == errRdbSaveAborted:
+		log.RedisLog(log.REDIS_WARNING, "Background saving terminated by signal")
+	default:
+		log.RedisLog(log.REDIS_WARNING, "Background saving error")
+		svr.lastbgsaveStatus = false
+	}
+}
+
+// checkChildrenDone collect the result of the background save if it
+// terminated
+func (svr *RedisServer) checkChildrenDone() {
+	if svr.rdbChild == nil {
+		return
+	}
+	select {
+	case err := <-svr.rdbChild.done:
+		svr.backgroundSaveDoneHandler(err)
+	default:
+	}
+}
+
+// killRDBChild stop the background save in progress and wait for it to
+// exit, its temp file is removed
+func (svr *RedisServer) killRDBChild() {
+	if svr.rdbChild == nil {
+		return
+	}
+	svr.rdbChild.abort.Store(true)
+	svr.backgroundSaveDoneHandler(<-svr.rdbChild.done)
+}
+
+// ======================= load ===========================
+
+// rdbReader read an RDB file computing the checksum of the bytes consumed
+// so far, to be compared with the one at the end of the file
+type rdbReader struct {
+	r   *bufio.Reader
+	crc uint64
+}
+
+func (r *rdbReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc = crc64.Update(r.crc, []byte{b})
+	}
+	return b, err
+}
+
+func (r *rdbReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc = crc64.Update(r.crc, p[:n])
+	return n, err
+}
+
+func rdbLoadType(r *rdbReader) (byte, error) {
+	return r.ReadByte()
+}
+
+// rdbLoadLen load a length, isencoded is true when the object is a
+// string in a special encoding, then the length is the encoding type
+func rdbLoadLen(r *rdbReader) (l uint64, isencoded bool, err error) {
+	var buf [8]byte
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case constant.REDIS_RDB_ENCVAL:
+		return uint64(b & 0x3F), true, nil
+	case constant.REDIS_RDB_6BITLEN:
+		return uint64(b & 0x3F), false, nil
+	case constant.REDIS_RDB_14BITLEN:
+		b2, err := r.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(b&0x3F)<<8 | uint64(b2), false, nil
+	}
+	switch b {
+	case constant.REDIS_RDB_32BITLEN:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:4])), false, nil
+	case constant.REDIS_RDB_64BITLEN:
+		if _, err := io.ReadFull(r, buf[:8]); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf[:8]), false, nil
+	}
+	return 0, false, fmt.Errorf("unknown length encoding %d in rdbLoadLen()", b)
+}
+
+// rdbLoadPlainLen load a length that can't be a special encoding
+func rdbLoadPlainLen(r *rdbReader) (uint64, error) {
+	l, isencoded, err := rdbLoadLen(r)
+	if err == nil && isencoded {
+		err = errors.New("unexpected string encoding in a length")
+	}
+	return l, err
+}
+
+// rdbLoadIntegerString load an integer encoded string, returned in its
+// decimal representation
+func rdbLoadIntegerString(r *rdbReader, enctype int) ([]byte, error) {
+	var buf [4]byte
+	var value int64
+	switch enctype {
+	case constant.REDIS_RDB_ENC_INT8:
+		if _, err := io.ReadFull(r, buf[:1]); err != nil {
+			return nil, err
+		}
+		value = int64(int8(buf[0]))
+	case constant.REDIS_RDB_ENC_INT16:
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return nil, err
+		}
+		value = int64(int16(binary.LittleEndian.Uint16(buf[:2])))
+	case constant.REDIS_RDB_ENC_INT32:
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return nil, err
+		}
+		value = int64(int32(binary.LittleEndian.Uint32(buf[:4])))
+	default:
+		return nil, fmt.Errorf("unknown RDB integer encoding type %d", enctype)
+	}
+	return strconv.AppendInt(nil, value, 10), nil
+}
+
+// rdbLoadString load a string saved by rdbSaveRawString
+func rdbLoadString(r *rdbReader) ([]byte, error) {
+	l, isencoded, err := rdbLoadLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if isencoded {
+		switch int(l) {
+		case constant.REDIS_RDB_ENC_INT8, constant.REDIS_RDB_ENC_INT16, constant.REDIS_RDB_ENC_INT32:
+			return rdbLoadIntegerString(r, int(l))
+		case constant.REDIS_RDB_ENC_LZF:
+			return rdbLoadLzfString(r)
+		}
+		return nil, fmt.Errorf("unknown RDB string encoding type %d", l)
+	}
+	if l > rdbMaxStringLen {
+		return nil, fmt.Errorf("invalid string length %d", l)
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// rdbLoadLzfString load a string compressed with LZF: the compressed
+// length, the original length and the compressed data
+func rdbLoadLzfString(r *rdbReader) ([]byte, error) {
+	clen, err := rdbLoadPlainLen(r)
+	if err != nil {
+		return nil, err
+	}
+	l, err := rdbLoadPlainLen(r)
+	if err != nil {
+		return nil, err
+	}
+	if clen > rdbMaxStringLen || l > rdbMaxStringLen {
+		return nil, fmt.Errorf("invalid LZF string length %d", l)
+	}
+	c := make([]byte, clen)
+	if _, err := io.ReadFull(r, c); err != nil {
+		return nil, err
+	}
+	val := make([]byte, l)
+	if n, err := lzf.Decompress(c, val); err != nil || n != len(val) {
+		return nil, errors.New("invalid LZF compressed string")
+	}
+	return val, nil
+}
+
+func rdbLoadBinaryDoubleValue(r *rdbReader) (float64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+func rdbLoadMillisecondTime(r *rdbReader) (int64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+func rdbLoadStreamID(r *rdbReader) (core.StreamID, error) {
+	var buf [16]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return core.StreamID{}, err
+	}
+	return rdbDecodeStreamID(buf[:]), nil
+}
+
+// rdbLoadObject load a value of the given RDB type. A nil object is an
+// empty key, it is not an error but the key is skipped.
+func (svr *RedisServer) rdbLoadObject(r *rdbReader, rdbtype byte) (*RedisObject, error) {
+	switch rdbtype {
+	case constant.REDIS_RDB_TYPE_STRING:
+		s, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		return svr.tryObjectEncoding(createStringObject(s)), nil
+
+	case constant.REDIS_RDB_TYPE_LIST:
+		elems, err := rdbLoadStrings(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		return svr.rdbCreateList(elems), nil
+
+	case constant.REDIS_RDB_TYPE_SET:
+		members, err := rdbLoadStrings(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		return svr.rdbCreateSet(members)
+
+	case constant.REDIS_RDB_TYPE_ZSET, constant.REDIS_RDB_TYPE_ZSET_2:
+		l, err := rdbLoadPlainLen(r)
+		if err != nil {
+			return nil, err
+		}
+		var members [][]byte
+		var scores []float64
+		for ; l > 0; l-- {
+			ele, err := rdbLoadString(r)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if rdbtype == constant.REDIS_RDB_TYPE_ZSET_2 {
+				score, err = rdbLoadBinaryDoubleValue(r)
+			} else {
+				score, err = rdbLoadDoubleValue(r)
+			}
+			if err != nil {
+				return nil, err
+			}
+			members = append(members, ele)
+			scores = append(scores, score)
+		}
+		return svr.rdbCreateZset(members, scores)
+
+	case constant.REDIS_RDB_TYPE_HASH:
+		pairs, err := rdbLoadStrings(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return svr.rdbCreateHash(pairs)
+
+	case constant.REDIS_RDB_TYPE_LIST_QUICKLIST, constant.REDIS_RDB_TYPE_LIST_QUICKLIST_2:
+		nodes, err := rdbLoadPlainLen(r)
+		if err != nil {
+			return nil, err
+		}
+		var elems [][]byte
+		for ; nodes > 0; nodes-- {
+			container := constant.REDIS_QUICKLIST_NODE_CONTAINER_PACKED
+			if rdbtype == constant.REDIS_RDB_TYPE_LIST_QUICKLIST_2 {
+				if container, err = rdbLoadPlainLen(r); err != nil {
+					return nil, err
+				}
+				if container != constant.REDIS_QUICKLIST_NODE_CONTAINER_PLAIN &&
+					container != constant.REDIS_QUICKLIST_NODE_CONTAINER_PACKED {
+					return nil, fmt.Errorf("quicklist integrity check failed: unknown container %d", container)
+				}
+			}
+			buf, err := rdbLoadString(r)
+			if err != nil {
+				return nil, err
+			}
+			if container == constant.REDIS_QUICKLIST_NODE_CONTAINER_PLAIN {
+				elems = append(elems, buf)
+				continue
+			}
+			// the nodes are ziplists up to version 9, then listpacks.
+			// Empty nodes are silently skipped.
+			var entries [][]byte
+			if rdbtype == constant.REDIS_RDB_TYPE_LIST_QUICKLIST {
+				var ok bool
+				if entries, ok = core.ZiplistEntries(buf); !ok {
+					return nil, errors.New("ziplist integrity check failed")
+				}
+			} else if entries, err = rdbListpackEntries(buf); err != nil {
+				return nil, err
+			}
+			elems = append(elems, entries...)
+		}
+		return svr.rdbCreateList(elems), nil
+
+	case constant.REDIS_RDB_TYPE_HASH_ZIPMAP, constant.REDIS_RDB_TYPE_LIST_ZIPLIST,
+		constant.REDIS_RDB_TYPE_SET_INTSET, constant.REDIS_RDB_TYPE_ZSET_ZIPLIST,
+		constant.REDIS_RDB_TYPE_HASH_ZIPLIST, constant.REDIS_RDB_TYPE_HASH_LISTPACK,
+		constant.REDIS_RDB_TYPE_ZSET_LISTPACK, constant.REDIS_RDB_TYPE_SET_LISTPACK:
+		// the value is saved as a single string holding the serialized
+		// structure: validate it and load its elements
+		buf, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := rdbDecodeCompactEncoding(buf, rdbtype)
+		if err != nil {
+			return nil, err
+		}
+		switch rdbtype {
+		case constant.REDIS_RDB_TYPE_LIST_ZIPLIST:
+			return svr.rdbCreateList(elems), nil
+		case constant.REDIS_RDB_TYPE_SET_INTSET, constant.REDIS_RDB_TYPE_SET_LISTPACK:
+			return svr.rdbCreateSet(elems)
+		case constant.REDIS_RDB_TYPE_ZSET_ZIPLIST, constant.REDIS_RDB_TYPE_ZSET_LISTPACK:
+			if len(elems)%2 != 0 {
+				return nil, errors.New("sorted set with an odd number of elements")
+			}
+			members := make([][]byte, 0, len(elems)/2)
+			scores := make([]float64, 0, len(elems)/2)
+			for i := 0; i < len(elems); i += 2 {
+				score, err := strconv.ParseFloat(string(elems[i+1]), 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid sorted set score %q", elems[i+1])
+				}
+				members = append(members, elems[i])
+				scores = append(scores, score)
+			}
+			return svr.rdbCreateZset(members, scores)
+		default:
+			if len(elems)%2 != 0 {
+				return nil, errors.New("hash with an odd number of elements")
+			}
+			return svr.rdbCreateHash(elems)
+		}
+
+	case constant.REDIS_RDB_TYPE_STREAM_LISTPACKS, constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_2,
+		constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_3:
+		return rdbLoadStreamObject(r, rdbtype)
+
+	case constant.REDIS_RDB_TYPE_MODULE_PRE_GA, constant.REDIS_RDB_TYPE_MODULE_2:
+		return nil, errors.New("the RDB file contains module data, modules are not supported")
+	}
+	return nil, fmt.Errorf("unknown RDB encoding type %d", rdbtype)
+}
+
+// rdbLoadStrings load a length followed by length*n strings
+func rdbLoadStrings(r *rdbReader, n uint64) ([][]byte, error) {
+	l, err := rdbLoadPlainLen(r)
+	if err != nil {
+		return nil, err
+	}
+	var elems [][]byte
+	for l *= n; l > 0; l-- {
+		ele, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, ele)
+	}
+	return elems, nil
+}
+
+// rdbListpackEntries validate a listpack loaded from the RDB file and
+// return its elements
+func rdbListpackEntries(buf []byte) ([][]byte, error) {
+	if !core.ListpackValidateIntegrity(buf) {
+		return nil, errors.New("listpack integrity check failed")
+	}
+	lp := core.NewListpackFromBytes(buf)
+	var entries [][]byte
+	for p := lp.First(); p != -1; p = lp.Next(p) {
+		entries = append(entries, lp.GetValue(p))
+	}
+	return entries, nil
+}
+
+// rdbDecodeCompactEncoding the elements of a zipmap, ziplist, intset or
+// listpack saved by older versions or by Redis, hashes and sorted sets
+// return the fields (members) followed by their values (scores)
+func rdbDecodeCompactEncoding(buf []byte, rdbtype byte) ([][]byte, error) {
+	switch rdbtype {
+	case constant.REDIS_RDB_TYPE_HASH_ZIPMAP:
+		if !core.ZipmapValidateIntegrity(buf) {
+			return nil, errors.New("zipmap integrity check failed")
+		}
+		zm := core.NewZipmapFromBytes(buf)
+		var pairs [][]byte
+		for p, key, value, ok := zm.Next(zm.Rewind()); ok; p, key, value, ok = zm.Next(p) {
+			pairs = append(pairs, append([]byte(nil), key...), append([]byte(nil), value...))
+		}
+		return pairs, nil
+
+	case constant.REDIS_RDB_TYPE_SET_INTSET:
+		if !core.IntsetValidateIntegrity(buf) {
+			return nil, errors.New("intset integrity check failed")
+		}
+		is := core.NewIntsetFromBytes(buf)
+		members := make([][]byte, 0, is.Len())
+		for i := 0; i < is.Len(); i++ {
+			members = append(members, strconv.AppendInt(nil, is.Get(i), 10))
+		}
+		return members, nil
+
+	case constant.REDIS_RDB_TYPE_LIST_ZIPLIST, constant.REDIS_RDB_TYPE_ZSET_ZIPLIST,
+		constant.REDIS_RDB_TYPE_HASH_ZIPLIST:
+		entries, ok := core.ZiplistEntries(buf)
+		if !ok {
+			return nil, errors.New("ziplist integrity check failed")
+		}
+		return entries, nil
+	}
+	return rdbListpackEntries(buf)
+}
+
+// rdbCreateList a list holding elems, nil when there are no elements
+func (svr *RedisServer) rdbCreateList(elems [][]byte) *RedisObject {
+	if len(elems) == 0 {
+		return nil
+	}
+	o := createListpackObject()
+	svr.listTypeTryConversion(o, elems)
+	for _, value := range elems {
+		listTypePush(o, value, core.QUICKLIST_TAIL)
+	}
+	return o
+}
+
+// rdbCreateSet a set holding members, nil when there are no members
+func (svr *RedisServer) rdbCreateSet(members [][]byte) (*RedisObject, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	var o *RedisObject
+	if len(members) <= svr.conf.SetMaxIntsetEntries {
+		o = createIntsetObject()
+	} else {
+		o = createSetObject()
+	}
+	for _, member := range members {
+		if !svr.setTypeAdd(o, member) {
+			return nil, errors.New("duplicate set members detected")
+		}
+	}
+	return o, nil
+}
+
+// rdbCreateZset a sorted set of members with their scores, nil when there
+// are no members
+func (svr *RedisServer) rdbCreateZset(members [][]byte, scores []float64) (*RedisObject, error) {
+	if len(members) == 0 {
+		return nil, nil
+	}
+	o := createZsetListpackObject()
+	for i, ele := range members {
+		if math.IsNaN(scores[i]) {
+			return nil, errors.New("zset with NAN score detected")
+		}
+		if _, out := svr.zsetAdd(o, scores[i], ele, 0); out&zaddOutAdded == 0 {
+			return nil, errors.New("duplicate zset fields detected")
+		}
+	}
+	return o, nil
+}
+
+// rdbCreateHash a hash of the field value pairs, nil when there are no
+// fields
+func (svr *RedisServer) rdbCreateHash(pairs [][]byte) (*RedisObject, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	o := createHashObject()
+	svr.hashTypeTryConversion(o, pairs)
+	for i := 0; i < len(pairs); i += 2 {
+		if svr.hashTypeSet(o, pairs[i], pairs[i+1]) {
+			return nil, errors.New("duplicate hash fields detected")
+		}
+	}
+	return o, nil
+}
+
+// rdbLoadDoubleValue load a score of the old zset type, saved as a string
+// prefixed by its length. 253, 254 and 255 stand for NaN, +inf and -inf.
+func rdbLoadDoubleValue(r *rdbReader) (float64, error) {
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch l {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid double value %q", buf)
+	}
+	return value, nil
+}
+
+// lpGetInteger the element at p of a stream listpack node as an integer
+func lpGetInteger(lp *core.Listpack, p int) (int64, error) {
+	if p == -1 {
+		return 0, errors.New("truncated stream listpack node")
+	}
+	str, value, isInt := lp.Get(p)
+	if isInt {
+		return value, nil
+	}
+	value, ok := core.String2ll(str)
+	if !ok {
+		return 0, errors.New("invalid integer in stream listpack node")
+	}
+	return value, nil
+}
+
+// lpGetElement the element at p of a stream listpack node as a string
+func lpGetElement(lp *core.Listpack, p int) ([]byte, error) {
+	if p == -1 {
+		return nil, errors.New("truncated stream listpack node")
+	}
+	return lp.GetValue(p), nil
+}
+
+// streamDecodeListpackNode append the valid entries of a listpack node to
+// the stream. master is the ID the node is keyed by.
+func streamDecodeListpackNode(s *core.Stream, master core.StreamID, lp *core.Listpack) error {
+	p := lp.First()
+	if p == -1 {
+		return errors.New("empty listpack inside stream")
+	}
+	count, err := lpGetInteger(lp, p)
+	if err != nil {
+		return err
+	}
+	p = lp.Next(p)
+	deleted, err := lpGetInteger(lp, p)
+	if err != nil {
+		return err
+	}
+	p = lp.Next(p)
+	numMasterFields, err := lpGetInteger(lp, p)
+	if err != nil {
+		return err
+	}
+	masterFields := make([][]byte, 0, numMasterFields)
+	for i := int64(0); i < numMasterFields; i++ {
+		p = lp.Next(p)
+		field, err := lpGetElement(lp, p)
+		if err != nil {
+			return err
+		}
+		masterFields = append(masterFields, field)
+	}
+	// skip the master entry terminator
+	p = lp.Next(p)
+
+	for i := int64(0); i < count+deleted; i++ {
+		var vals [3]int64 // flags, ms-diff, seq-diff
+		for j := range vals {
+			p = lp.Next(p)
+			if vals[j], err = lpGetInteger(lp, p); err != nil {
+				return err
+			}
+		}
+		flags := vals[0]
+		id := core.StreamID{Ms: master.Ms + uint64(vals[1]), Seq: master.Seq + uint64(vals[2])}
+
+		var fields [][]byte
+		if flags&streamItemFlagSameFields != 0 {
+			fields = make([][]byte, 0, 2*len(masterFields))
+			for _, field := range masterFields {
+				p = lp.Next(p)
+				value, err := lpGetElement(lp, p)
+				if err != nil {
+					return err
+				}
+				fields = append(fields, field, value)
+			}
+		} else {
+			p = lp.Next(p)
+			numfields, err := lpGetInteger(lp, p)
+			if err != nil {
+				return err
+			}
+			fields = make([][]byte, 0, 2*numfields)
+			for j := int64(0); j < 2*numfields; j++ {
+				p = lp.Next(p)
+				fv, err := lpGetElement(lp, p)
+				if err != nil {
+					return err
+				}
+				fields = append(fields, fv)
+			}
+		}
+		// skip lp-count
+		if p = lp.Next(p); p == -1 {
+			return errors.New("truncated stream listpack node")
+		}
+
+		if flags&streamItemFlagDeleted != 0 {
+			continue
+		}
+		if s.Len() > 0 && id.Compare(s.LastID) <= 0 {
+			return errors.New("stream entries out of order")
+		}
+		s.Append(id, fields)
+	}
+	return nil
+}
+
+// rdbLoadStreamObject load a stream saved by rdbSaveStreamObject. The
+// older stream types lack part of the metadata, that is computed from the
+// entries.
+func rdbLoadStreamObject(r *rdbReader, rdbtype byte) (*RedisObject, error) {
+	o := createStreamObject()
+	s := o.Ptr.(*stream)
+
+	nodes, err := rdbLoadPlainLen(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; nodes > 0; nodes-- {
+		nodekey, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(nodekey) != 16 {
+			return nil, errors.New("stream node key entry is not the size of a stream ID")
+		}
+		lpbuf, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		if !core.ListpackValidateIntegrity(lpbuf) {
+			return nil, errors.New("stream listpack integrity check failed")
+		}
+		if err := streamDecodeListpackNode(s.Stream, rdbDecodeStreamID(nodekey), core.NewListpackFromBytes(lpbuf)); err != nil {
+			return nil, err
+		}
+	}
+
+	// metadata: length, last ID, then since REDIS_RDB_TYPE_STREAM_LISTPACKS_2
+	// first ID, max deleted ID and entries added
+	var meta [8]uint64
+	nmeta := len(meta)
+	if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+		nmeta = 3
+	}
+	for i := 0; i < nmeta; i++ {
+		if meta[i], err = rdbLoadPlainLen(r); err != nil {
+			return nil, err
+		}
+	}
+	if meta[0] != uint64(s.Len()) {
+		return nil, errors.New("stream length inconsistent with the entries")
+	}
+	s.LastID = core.StreamID{Ms: meta[1], Seq: meta[2]}
+	if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+		// no entry was ever deleted as far as we know
+		s.EntriesAdded = uint64(s.Len())
+		if s.Len() > 0 {
+			s.FirstID = s.Entry(0).ID
+		}
+	} else {
+		s.FirstID = core.StreamID{Ms: meta[3], Seq: meta[4]}
+		s.MaxDeletedEntryID = core.StreamID{Ms: meta[5], Seq: meta[6]}
+		s.EntriesAdded = meta[7]
+	}
+
+	// consumer groups
+	ncgs, err := rdbLoadPlainLen(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; ncgs > 0; ncgs-- {
+		name, err := rdbLoadString(r)
+		if err != nil {
+			return nil, err
+		}
+		var cgmeta [3]uint64 // last ID, entries read
+		ncgmeta := len(cgmeta)
+		if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+			ncgmeta = 2
+		}
+		for i := 0; i < ncgmeta; i++ {
+			if cgmeta[i], err = rdbLoadPlainLen(r); err != nil {
+				return nil, err
+			}
+		}
+		lastID := core.StreamID{Ms: cgmeta[0], Seq: cgmeta[1]}
+		entriesRead := int64(cgmeta[2])
+		if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS {
+			entriesRead = streamEstimateEntriesRead(s, lastID)
+		}
+		cg := s.createCG(name, lastID, entriesRead)
+		if cg == nil {
+			return nil, errors.New("duplicated consumer group name")
+		}
+
+		// the global PEL
+		npel, err := rdbLoadPlainLen(r)
+		if err != nil {
+			return nil, err
+		}
+		for ; npel > 0; npel-- {
+			id, err := rdbLoadStreamID(r)
+			if err != nil {
+				return nil, err
+			}
+			nack := &streamNACK{}
+			if nack.deliveryTime, err = rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+			count, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return nil, err
+			}
+			nack.deliveryCount = int64(count)
+			if cg.pel.get(id) != nil {
+				return nil, errors.New("duplicated global PEL entry loading stream consumer group")
+			}
+			cg.pel.insert(id, nack)
+		}
+
+		// the consumers and their PEL
+		nconsumers, err := rdbLoadPlainLen(r)
+		if err != nil {
+			return nil, err
+		}
+		for ; nconsumers > 0; nconsumers-- {
+			cname, err := rdbLoadString(r)
+			if err != nil {
+				return nil, err
+			}
+			consumer := cg.createConsumer(cname)
+			if consumer == nil {
+				return nil, errors.New("duplicate stream consumer detected")
+			}
+			if consumer.seenTime, err = rdbLoadMillisecondTime(r); err != nil {
+				return nil, err
+			}
+			// the active time is saved since REDIS_RDB_TYPE_STREAM_LISTPACKS_3
+			consumer.activeTime = consumer.seenTime
+			if rdbtype == constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_3 {
+				if consumer.activeTime, err = rdbLoadMillisecondTime(r); err != nil {
+					return nil, err
+				}
+			}
+			npel, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return nil, err
+			}
+			for ; npel > 0; npel-- {
+				id, err := rdbLoadStreamID(r)
+				if err != nil {
+					return nil, err
+				}
+				nack := cg.pel.get(id)
+				if nack == nil || nack.consumer != nil {
+					return nil, errors.New("consumer PEL entry not found in the group PEL")
+				}
+				nack.consumer = consumer
+				consumer.pel.insert(id, nack)
+			}
+		}
+
+		// every pending entry must belong to a consumer
+		for _, nack := range cg.pel.nacks {
+			if nack.consumer == nil {
+				return nil, errors.New("stream CG PEL entry without consumer")
+			}
+		}
+	}
+	return o, nil
+}
+
+// rdbLoad load the dataset from an RDB file. A corrupted file is reported
+// as an error, the values loaded so far are left in the dbs.
+func (svr *RedisServer) rdbLoad(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return svr.rdbLoadRio(bufio.NewReaderSize(f, 64*1024), fi.Size(), false)
+}
+
+// rdbLoadRio load an RDB from br, size is the size of the input and
+// bounds the RESIZEDB hints. br is left right after the checksum. The RDB
+// preamble of an AOF keeps the keys already expired: the commands that
+// follow may still use them, the DEL of their expiration comes later in
+// the file.
+func (svr *RedisServer) rdbLoadRio(br *bufio.Reader, size int64, aofPreamble bool) (err error) {
+	r := &rdbReader{r: br}
+
+	// the values are validated while loaded, still a corrupted file
+	// reaching a panic is turned into a load error
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("corrupted RDB file: %v", e)
+		}
+	}()
+
+	var magic [9]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return fmt.Errorf("short read loading the RDB header: %v", err)
+	}
+	if !bytes.Equal(magic[:5], []byte("REDIS")) {
+		return errors.New("wrong signature trying to load DB from file")
+	}
+	rdbver, err := strconv.Atoi(string(magic[5:]))
+	if err != nil || rdbver < 1 || rdbver > constant.REDIS_RDB_VERSION {
+		return fmt.Errorf("can't handle RDB format version %s, the versions 1 to %d are supported",
+			magic[5:], constant.REDIS_RDB_VERSION)
+	}
+
+	db := svr.dbs[0]
+	expiretime, lruIdle, lfuFreq := int64(-1), int64(-1), -1
+	now := time.Now().UnixMilli()
+	emptyKeysSkipped := 0
+	for {
+		// read type
+		rdbtype, err := rdbLoadType(r)
+		if err != nil {
+			return err
+		}
+		switch rdbtype {
+		case constant.REDIS_RDB_OPCODE_EXPIRETIME:
+			// EXPIRETIME: load an expire, in seconds, for the next key
+			var buf [4]byte
+			if _, err := io.ReadFull(r, buf[:]); err != nil {
+				return err
+			}
+			expiretime = int64(int32(binary.LittleEndian.Uint32(buf[:]))) * 1000
+			continue
+		case constant.REDIS_RDB_OPCODE_EXPIRETIME_MS:
+			// EXPIRETIME_MS: milliseconds precision expire times, since
+			// RDB version 3
+			if expiretime, err = rdbLoadMillisecondTime(r); err != nil {
+				return err
+			}
+			continue
+		case constant.REDIS_RDB_OPCODE_FREQ:
+			// FREQ: LFU frequency of the next key
+			freq, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			lfuFreq = int(freq)
+			continue
+		case constant.REDIS_RDB_OPCODE_IDLE:
+			// IDLE: LRU idle time of the next key, in seconds
+			idle, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return err
+			}
+			lruIdle = int64(idle)
+			continue
+		case constant.REDIS_RDB_OPCODE_EOF:
+		case constant.REDIS_RDB_OPCODE_SELECTDB:
+			dbid, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return err
+			}
+			if dbid >= uint64(len(svr.dbs)) {
+				return fmt.Errorf("data file was created with a Redis server configured to handle more than %d databases", len(svr.dbs))
+			}
+			db = svr.dbs[dbid]
+			continue
+		case constant.REDIS_RDB_OPCODE_RESIZEDB:
+			// RESIZEDB: hint about the size of the hash tables of the
+			// current db, to avoid useless rehashing
+			dbsize, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return err
+			}
+			expiresSize, err := rdbLoadPlainLen(r)
+			if err != nil {
+				return err
+			}
+			// every key takes a few bytes of the file, a bigger hint
+			// comes from a corrupted file
+			if dbsize <= uint64(size) && expiresSize <= dbsize {
+				db.dict.Expand(int(dbsize))
+				db.expires.Expand(int(expiresSize))
+			}
+			continue
+		case constant.REDIS_RDB_OPCODE_AUX:
+			// AUX: generic string to string field, only a few are
+			// logged, the unknown ones are ignored
+			auxkey, err := rdbLoadString(r)
+			if err != nil {
+				return err
+			}
+			auxval, err := rdbLoadString(r)
+			if err != nil {
+				return err
+			}
+			svr.rdbLoadAuxField(string(auxkey), auxval)
+			continue
+		case constant.REDIS_RDB_OPCODE_MODULE_AUX:
+			return errors.New("the RDB file contains AUX module data I can't load: modules are not supported")
+		case constant.REDIS_RDB_OPCODE_FUNCTION_PRE_GA:
+			return errors.New("pre-release function format not supported")
+		case constant.REDIS_RDB_OPCODE_FUNCTION2:
+			return errors.New("the RDB file contains functions, they are not supported")
+		}
+		if rdbtype == constant.REDIS_RDB_OPCODE_EOF {
+			break
+		}
+
+		// read key and value
+		key, err := rdbLoadString(r)
+		if err != nil {
+			return err
+		}
+		val, err := svr.rdbLoadObject(r, rdbtype)
+		if err != nil {
+			return fmt.Errorf("loading key %q: %v", key, err)
+		}
+
+		switch {
+		case val == nil:
+			// empty keys are not created
+			if emptyKeysSkipped++; emptyKeysSkipped <= 10 {
+				log.RedisLog(log.REDIS_WARNING, "rdbLoadObject skipping empty key: %s", key)
+			}
+		case expiretime != -1 && expiretime < now && !aofPreamble:
+			// expired keys are not loaded
+		default:
+			if db.dict.Find(string(key)) != nil {
+				return fmt.Errorf("duplicate key %q found in RDB file", key)
+			}
+			db.dbAdd(key, val)
+			if expiretime != -1 {
+				db.setExpire(key, expiretime)
+			}
+			// restore the access time or frequency the eviction policy
+			// works with
+			if !val.isShared() {
+				if lfuFreq != -1 && svr.lfuEnabled() {
+					val.Lfu = uint8(lfuFreq)
+				} else if lruIdle != -1 && svr.lruEnabled() {
+					val.Lru = now - lruIdle*1000
+				}
+			}
+		}
+		expiretime, lruIdle, lfuFreq = -1, -1, -1
+	}
+
+	// verify the checksum, 0 means it was not computed
+	if rdbver >= 5 {
+		expected := r.crc
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return fmt.Errorf("short read loading the RDB checksum: %v", err)
+		}
+		cksum := binary.LittleEndian.Uint64(buf[:])
+		if cksum != 0 && cksum != expected {
+			return fmt.Errorf("wrong RDB checksum expected: (%x) got: (%x)", cksum, expected)
+		}
+	}
+	if emptyKeysSkipped > 0 {
+		log.RedisLog(log.REDIS_NOTICE, "Done loading RDB, empty keys skipped: %d", emptyKeysSkipped)
+	}
+	return nil
+}
+
+// rdbLoadAuxField handle an AUX field of the RDB file
+func (svr *RedisServer) rdbLoadAuxField(key string, val []byte) {
+	switch key {
+	case "redis-ver":
+		log.RedisLog(log.REDIS_NOTICE, "Loading RDB produced by version %s", val)
+	case "ctime":
+		if ctime, ok := core.String2ll(val); ok {
+			age := time.Now().Unix() - ctime
+			if age < 0 {
+				age = 0
+			}
+			log.RedisLog(log.REDIS_NOTICE, "RDB age %d seconds", age)
+		}
+	case "used-mem":
+		if usedmem, ok := core.String2ll(val); ok {
+			log.RedisLog(log.REDIS_NOTICE, "RDB memory usage when created %.2f Mb", float64(usedmem)/(1024*1024))
+		}
+	}
+}
+
+// ======================= commands ===========================
+
+func saveCommand(client *RedisClient) {
+	svr := client.svr
+	if svr.rdbChild != nil {
+		client.addReplyError("Background save already in progress")
+		return
+	}
+	if err := svr.rdbSave(svr.rdbFilename()); err != nil {
+		client.addReply(shared.err)
+		return
+	}
+	client.addReply(shared.ok)
+}
+
+// bgsaveCommand BGSAVE [SCHEDULE]
+func bgsaveCommand(client *RedisClient) {
+	svr := client.svr
+	schedule := false
+	if len(client.argv) > 1 {
+		if len(client.argv) == 2 && strings.EqualFold(string(client.argv[1]), "schedule") {
+			schedule = true
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	if svr.rdbChild != nil {
+		// with SCHEDULE the save starts as soon as the current one ends
+		if schedule {
+			svr.rdbBgsaveScheduled = true
+			client.addReplyStatus("Background saving scheduled")
+		} else {
+			client.addReplyError("Background save already in progress")
+		}
+		return
+	}
+	if err := svr.rdbSaveBackground(svr.rdbFilename()); err != nil {
+		client.addReply(shared.err)
+		return
+	}
+	client.addReplyStatus("Background saving started")
+}
+
+func lastsaveCommand(client *RedisClient) {
+	client.addReplyLongLong(client.svr.lastsave)
+}
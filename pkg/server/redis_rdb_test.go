@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/0226zy/myredis/pkg/constant"
+)
+
+// benchStrings the values of the string benchmarks, kind is text for
+// values that compress well or random for values that don't
+func benchStrings(kind string, size int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	vals := make([][]byte, 1000)
+	for i := range vals {
+		v := make([]byte, 0, size)
+		switch kind {
+		case "text":
+			for len(v) < size {
+				v = append(v, `{"id":`...)
+				v = strconv.AppendInt(v, int64(i), 10)
+				v = append(v, `,"name":"user`...)
+				v = strconv.AppendInt(v, int64(rnd.Intn(100)), 10)
+				v = append(v, `","status":"active"},`...)
+			}
+			v = v[:size]
+		case "random":
+			v = v[:size]
+			rnd.Read(v)
+		}
+		vals[i] = v
+	}
+	return vals
+}
+
+func rdbSaveStrings(vals [][]byte, compress bool) []byte {
+	var buf bytes.Buffer
+	w := &rdbWriter{Writer: bufio.NewWriter(&buf), compress: compress}
+	for _, v := range vals {
+		rdbSaveRawString(w, v)
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func TestRdbStringRoundTrip(t *testing.T) {
+	var vals [][]byte
+	for _, s := range []string{"", "a", "12345", "-1", "01", "9223372036854775808", "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"} {
+		vals = append(vals, []byte(s))
+	}
+	vals = append(vals, benchStrings("text", 1024)[:10]...)
+	vals = append(vals, benchStrings("random", 1024)[:10]...)
+
+	for _, compress := range []bool{false, true} {
+		data := rdbSaveStrings(vals, compress)
+		r := &rdbReader{r: bufio.NewReader(bytes.NewReader(data))}
+		for _, want := range vals {
+			got, err := rdbLoadString(r)
+			if err != nil {
+				t.Fatalf("compress %v: rdbLoadString: %v", compress, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("compress %v: loaded %q, want %q", compress, got, want)
+			}
+		}
+		if _, err := r.ReadByte(); err != io.EOF {
+			t.Fatalf("compress %v: trailing data after the strings", compress)
+		}
+	}
+}
+
+func TestRdbSaveVersion(t *testing.T) {
+	streamTypes := map[int]byte{
+		9:  constant.REDIS_RDB_TYPE_STREAM_LISTPACKS,
+		10: constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_2,
+		11: constant.REDIS_RDB_TYPE_STREAM_LISTPACKS_3,
+	}
+	for version := constant.REDIS_RDB_MIN_SAVE_VERSION; version <= constant.REDIS_RDB_VERSION; version++ {
+		var buf bytes.Buffer
+		if err := rdbSaveRio(&buf, &rdbSnapshot{version: version}, nil); err != nil {
+			t.Fatalf("version %d: rdbSaveRio: %v", version, err)
+		}
+		if want := fmt.Sprintf("REDIS%04d", version); !bytes.HasPrefix(buf.Bytes(), []byte(want)) {
+			t.Errorf("version %d: header %q, want %q", version, buf.Bytes()[:9], want)
+		}
+		if got := rdbStreamType(version); got != streamTypes[version] {
+			t.Errorf("version %d: stream type %d, want %d", version, got, streamTypes[version])
+		}
+	}
+}
+
+// The string benchmarks compare rdbcompression yes and no, the saved
+// bytes per value are reported as B/value.
+
+func benchmarkRdbSaveString(b *testing.B, kind string, size int, compress bool) {
+	vals := benchStrings(kind, size)
+	w := &rdbWriter{Writer: bufio.NewWriter(io.Discard), compress: compress}
+	b.SetBytes(int64(len(vals) * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, v := range vals {
+			rdbSaveRawString(w, v)
+		}
+	}
+	w.Flush()
+	b.StopTimer()
+	b.ReportMetric(float64(len(rdbSaveStrings(vals, compress)))/float64(len(vals)), "B/value")
+}
+
+func benchmarkRdbLoadString(b *testing.B, kind string, size int, compress bool) {
+	vals := benchStrings(kind, size)
+	data := rdbSaveStrings(vals, compress)
+	br := bufio.NewReader(nil)
+	b.SetBytes(int64(len(vals) * size))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		br.Reset(bytes.NewReader(data))
+		r := &rdbReader{r: br}
+		for range vals {
+			if _, err := rdbLoadString(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(len(data))/float64(len(vals)), "B/value")
+}
+
+func BenchmarkRdbSaveString(b *testing.B) {
+	for _, kind := range []string{"text", "random"} {
+		for _, size := range []int{64, 1024, 16384} {
+			for _, compress := range []bool{false, true} {
+				name := kind + "-" + strconv.Itoa(size) + "/rdbcompression=" + yesno(compress)
+				b.Run(name, func(b *testing.B) { benchmarkRdbSaveString(b, kind, size, compress) })
+			}
+		}
+	}
+}
+
+func BenchmarkRdbLoadString(b *testing.B) {
+	for _, kind := range []string{"text", "random"} {
+		for _, size := range []int{64, 1024, 16384} {
+			for _, compress := range []bool{false, true} {
+				name := kind + "-" + strconv.Itoa(size) + "/rdbcompression=" + yesno(compress)
+				b.Run(name, func(b *testing.B) { benchmarkRdbLoadString(b, kind, size, compress) })
+			}
+		}
+	}
+}
+
+func yesno(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
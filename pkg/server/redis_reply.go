@@ -0,0 +1,254 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/event"
+)
+
+// sharedObjects frequently used protocol replies
+type sharedObjects struct {
+	ok             []byte
+	err            []byte
+	pong           []byte
+	czero          []byte
+	cone           []byte
+	cnegone        []byte
+	nullbulk       []byte
+	nullmultibulk  []byte
+	emptymultibulk []byte
+	emptybulk      []byte
+	emptyscan      []byte
+	syntaxerr      string
+	wrongtypeerr   string
+	nokeyerr       string
+}
+
+var shared = sharedObjects{
+	ok:             []byte("+OK\r\n"),
+	err:            []byte("-ERR\r\n"),
+	pong:           []byte("+PONG\r\n"),
+	czero:          []byte(":0\r\n"),
+	cone:           []byte(":1\r\n"),
+	cnegone:        []byte(":-1\r\n"),
+	nullbulk:       []byte("$-1\r\n"),
+	nullmultibulk:  []byte("*-1\r\n"),
+	emptymultibulk: []byte("*0\r\n"),
+	emptybulk:      []byte("$0\r\n\r\n"),
+	emptyscan:      []byte("*2\r\n$1\r\n0\r\n*0\r\n"),
+	syntaxerr:      "syntax error",
+	wrongtypeerr:   "-WRONGTYPE Operation against a key holding the wrong kind of value",
+	nokeyerr:       "no such key",
+}
+
+// addReply queue the protocol data in the client reply list. The writable
+// event is installed when the list goes from empty to non-empty, the data
+// is sent by sendReplyToClient once the socket can accept it.
+func (client *RedisClient) addReply(data []byte) {
+	if (client.flags & constant.REDIS_CLOSE_AFTER_REPLY) > 0 {
+		return
+	}
+	// the client loading the AOF has no connection
+	if client.conn == nil {
+		return
+	}
+	if len(client.reply) == 0 {
+		if err := client.svr.eventLoop.CreateFileEvent(client.fd(), constant.AE_WRITABLE,
+			client.sendReplyToClient, client); err != nil {
+			fmt.Printf("create writable event failed:%v\n", err)
+			return
+		}
+	}
+
+	// with glueoutputbuf small replies are appended to the last chunk so
+	// many replies are sent with a single write
+	if client.svr.conf.GlueOutPutBuf && len(client.reply) > 0 {
+		last := client.reply[len(client.reply)-1]
+		if last.Len+int64(len(data)) <= int64(constant.REDIS_REPLY_CHUNK_BYTES) {
+			last.CatLen(data)
+			return
+		}
+	}
+	client.reply = append(client.reply, core.SdsNewLen(data))
+}
+
+// sendReplyToClient writable event handler, write as much of the reply list
+// as the socket accepts
+func (client *RedisClient) sendReplyToClient(eventLoop *event.AeEventLoop, fd int, clientData interface{}, mask int) error {
+	// the commands processed in this iteration of the event loop are not
+	// in the AOF yet, reply once beforeSleep wrote them
+	if client.svr.aofWritePending() {
+		return nil
+	}
+	totwritten := 0
+	for len(client.reply) > 0 {
+		buf := client.reply[0].Bytes()
+		if len(buf) == 0 {
+			client.reply = client.reply[1:]
+			continue
+		}
+
+		n, err := syscall.Write(fd, buf[client.sentlen:])
+		if err != nil {
+			if err == syscall.EAGAIN || err == syscall.EWOULDBLOCK || err == syscall.EINTR {
+				break
+			}
+			fmt.Printf("Error writing to client:%v\n", err)
+			client.svr.freeClient(client)
+			return err
+		}
+		client.sentlen += n
+		totwritten += n
+
+		if client.sentlen < len(buf) {
+			// partial write, the socket buffer is full
+			break
+		}
+		client.reply[0] = nil
+		client.reply = client.reply[1:]
+		client.sentlen = 0
+
+		// Note that we avoid to send more than REDIS_MAX_WRITE_PER_EVENT
+		// bytes, in a single threaded server it's a good idea to serve
+		// other clients as well, even if a very large request comes from
+		// super fast link that is always able to accept data.
+		if totwritten > constant.REDIS_MAX_WRITE_PER_EVENT {
+			break
+		}
+	}
+
+	if len(client.reply) == 0 {
+		client.reply = nil
+		client.sentlen = 0
+		eventLoop.DelFileEvent(fd, constant.AE_WRITABLE)
+
+		// close connection after entire reply has been sent
+		if (client.flags & constant.REDIS_CLOSE_AFTER_REPLY) > 0 {
+			client.svr.freeClient(client)
+		}
+	}
+	return nil
+}
+
+// addReplyError reply with an error. The message is prefixed with "-ERR "
+// unless it already carries its own error code like "-WRONGTYPE ..."
+func (client *RedisClient) addReplyError(msg string) {
+	if !strings.HasPrefix(msg, "-") {
+		msg = "-ERR " + msg
+	}
+	// newlines would break the protocol
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	client.addReply([]byte(msg + "\r\n"))
+}
+
+func (client *RedisClient) addReplyErrorFormat(format string, args ...interface{}) {
+	client.addReplyError(fmt.Sprintf(format, args...))
+}
+
+// addReplySubcommandSyntaxError reply to an unknown subcommand or a
+// subcommand with the wrong number of arguments
+func addReplySubcommandSyntaxError(client *RedisClient) {
+	client.addReplyErrorFormat("unknown subcommand or wrong number of arguments for '%s'. Try %s HELP.",
+		client.argv[1], strings.ToUpper(client.cmd.Name))
+}
+
+// addReplyHelp reply to the HELP subcommand of cmd with the help lines
+// of its subcommands
+func addReplyHelp(client *RedisClient, cmd string, help []string) {
+	client.addReplyMultiBulkLen(len(help) + 3)
+	client.addReplyStatus(cmd + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:")
+	for _, line := range help {
+		client.addReplyStatus(line)
+	}
+	client.addReplyStatus("HELP")
+	client.addReplyStatus("    Print this help.")
+}
+
+// addReplyStatus reply with a status like "+OK"
+func (client *RedisClient) addReplyStatus(status string) {
+	client.addReply([]byte("+" + status + "\r\n"))
+}
+
+// addReplyLongLong reply with an integer
+func (client *RedisClient) addReplyLongLong(ll int64) {
+	switch ll {
+	case 0:
+		client.addReply(shared.czero)
+	case 1:
+		client.addReply(shared.cone)
+	default:
+		client.addReplyLongLongWithPrefix(ll, ':')
+	}
+}
+
+func (client *RedisClient) addReplyLongLongWithPrefix(ll int64, prefix byte) {
+	buf := make([]byte, 0, 24)
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, ll, 10)
+	buf = append(buf, "\r\n"...)
+	client.addReply(buf)
+}
+
+// addReplyMultiBulkLen reply with the header of a multibulk of length n
+func (client *RedisClient) addReplyMultiBulkLen(n int) {
+	if n == 0 {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	client.addReplyLongLongWithPrefix(int64(n), '*')
+}
+
+// addReplyBulk reply with a binary safe bulk string
+func (client *RedisClient) addReplyBulk(data []byte) {
+	buf := make([]byte, 0, len(data)+16)
+	buf = append(buf, '$')
+	buf = strconv.AppendInt(buf, int64(len(data)), 10)
+	buf = append(buf, "\r\n"...)
+	buf = append(buf, data...)
+	buf = append(buf, "\r\n"...)
+	client.addReply(buf)
+}
+
+func (client *RedisClient) addReplyBulkString(s string) {
+	client.addReplyBulk([]byte(s))
+}
+
+func (client *RedisClient) addReplyBulkLongLong(ll int64) {
+	client.addReplyBulk(strconv.AppendInt(nil, ll, 10))
+}
+
+// addReplyDouble reply with a double as bulk string, using the shortest
+// representation that round trips
+func (client *RedisClient) addReplyDouble(d float64) {
+	client.addReplyBulkString(formatDouble(d))
+}
+
+// formatDouble shortest representation of d that parses back to the same
+// value, plain notation for 1e-6 <= |d| < 1e21 and exponent otherwise
+func formatDouble(d float64) string {
+	if math.IsInf(d, 0) {
+		if d > 0 {
+			return "inf"
+		}
+		return "-inf"
+	}
+	abs := math.Abs(d)
+	if d == 0 || (abs >= 1e-6 && abs < 1e21) {
+		return strconv.FormatFloat(d, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(d, 'e', -1, 64)
+}
+
+func (client *RedisClient) addReplyNullBulk() {
+	client.addReply(shared.nullbulk)
+}
+
+func (client *RedisClient) addReplyNullMultiBulk() {
+	client.addReply(shared.nullmultibulk)
+}
@@ -5,11 +5,15 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/0226zy/myredis/pkg/config"
 	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/dict"
 	"github.com/0226zy/myredis/pkg/event"
+	"github.com/0226zy/myredis/pkg/log"
 )
 
 // RedisServer redis server
@@ -19,16 +23,81 @@ type RedisServer struct {
 	ioReadyClients []*RedisClient
 	tcpServer      *tcpServer
 	clients        []*RedisClient
+	commands       *dict.Dict // command name -> *RedisCommand, case insensitive
+	dbs            []*redisDb
+
+	// blocking operations
+	blockedClients   int            // number of clients blocked in BLPOP and friends
+	readyKeys        []readyKey     // keys that received data while clients wait for them
+	unblockedClients []*RedisClient // clients to resume after being unblocked
+
+	// RDB persistence
+	dirty                int64     // changes to the dataset since the last save
+	lastsave             int64     // unix time of the last successful save
+	rdbChild             *rdbChild // background save in progress, nil if none
+	rdbBgsaveScheduled   bool      // BGSAVE SCHEDULE when the current save ends
+	dirtyBeforeBgsave    int64     // dirty when the last BGSAVE started
+	lastbgsaveTry        int64     // unix time of the last BGSAVE attempt
+	lastbgsaveStatus     bool      // false when the last BGSAVE failed
+	rdbLastBgsaveTimeSec int64     // duration of the last BGSAVE, -1 if none
+
+	// AOF persistence
+	aofFile                *os.File    // the AOF open for appending, nil when appendonly is off
+	aofBuf                 []byte      // commands to write before re-entering the event loop
+	aofSelectedDb          int         // db of the last SELECT written, -1 to force one
+	aofCurrentSize         int64       // size of the AOF
+	aofFsyncOffset         int64       // aofCurrentSize at the last fsync
+	aofLastFsync           int64       // unix time of the last fsync
+	aofFlushPostponedStart int64       // unix time the write started being postponed, 0 if not
+	aofDelayedFsync        int64       // writes that didn't wait for a slow fsync
+	aofLastWriteErr        error       // error of the last write, nil when it succeeded
+	aofFsyncer             *aofFsyncer // background fsync of everysec
+	loading                bool        // the AOF is being loaded
+
+	// cron
+	cronloops      int64
+	activeExpireDb int // next db to scan in the active expire cycle
+	resizeDb       int // next db to shrink in the cron
+	rehashDb       int // next db to rehash in the cron
+
+	// stats
+	statExpiredKeys int64
+	statUsedMemory  int64 // heap allocated, sampled by serverCron
+	statForkTime    int64 // microseconds spent taking the last background snapshot
+	statCowClones   int64 // values cloned by lookupKeyWrite during the background saves
+	statCowTime     int64 // microseconds spent cloning them
+	statCowLastTime int64 // microseconds spent cloning the last one
 }
 
+// dict types: every dict in the dataset hashes binary safe keys, only the
+// command table ignores the case of the names
+var (
+	dbDictType           = dict.DefaultType // db.dict, keys to *RedisObject
+	keyptrDictType       = dict.DefaultType // db.expires, keys to unix time in ms
+	setDictType          = dict.DefaultType // sets, members to nil
+	hashDictType         = dict.DefaultType // hashes, fields to []byte values
+	zsetDictType         = dict.DefaultType // sorted sets, members to float64 scores
+	commandTableDictType = &dict.DictType{
+		HashFunction: dict.GenCaseHashFunction,
+		KeyCompare:   strings.EqualFold,
+	}
+)
+
 // NewRedisServer create with config
 func NewRedisServer(redisConf *config.RedisConfig) *RedisServer {
-	return &RedisServer{
-		conf:           redisConf,
-		eventLoop:      event.NewAeEventLoop(),
-		clients:        []*RedisClient{},
-		ioReadyClients: []*RedisClient{},
+	svr := &RedisServer{
+		conf:                 redisConf,
+		eventLoop:            event.NewAeEventLoop(),
+		clients:              []*RedisClient{},
+		ioReadyClients:       []*RedisClient{},
+		lastsave:             time.Now().Unix(),
+		lastbgsaveStatus:     true,
+		rdbLastBgsaveTimeSec: -1,
 	}
+	svr.populateCommandTable()
+	svr.initDbs()
+	svr.updateUsedMemory()
+	return svr
 }
 
 func (svr *RedisServer) Init() {
@@ -47,8 +116,44 @@ func (svr *RedisServer) Init() {
 		os.Exit(1)
 	}
 
-	// TODO open appendonly file
+	svr.eventLoop.CreateTimeEvent(1, svr.serverCron, nil, nil)
 
+	svr.loadDataFromDisk()
+	if svr.conf.AppendOnly {
+		svr.openAppendOnlyFile()
+	}
+}
+
+// loadDataFromDisk load the dataset at startup, from the AOF when
+// appendonly is enabled and it exists, otherwise from the RDB file. A
+// missing file is an empty dataset.
+func (svr *RedisServer) loadDataFromDisk() {
+	start := time.Now()
+	if svr.conf.AppendOnly {
+		err := svr.loadAppendOnlyFile(svr.aofFilename())
+		if err == nil {
+			log.RedisLog(log.REDIS_NOTICE, "DB loaded from append only file: %.3f seconds", time.Since(start).Seconds())
+			return
+		}
+		if !os.IsNotExist(err) {
+			log.RedisLog(log.REDIS_WARNING, "Fatal error loading the AOF: %v. Exiting.", err)
+			fmt.Fprintf(os.Stderr, "Fatal error loading the AOF %s: %v. Exiting.\n", svr.aofFilename(), err)
+			os.Exit(1)
+		}
+		// no AOF yet: start from the RDB, openAppendOnlyFile turns the
+		// dataset into the base of the AOF
+	}
+	err := svr.rdbLoad(svr.rdbFilename())
+	if err == nil {
+		log.RedisLog(log.REDIS_NOTICE, "DB loaded from disk: %.3f seconds", time.Since(start).Seconds())
+		return
+	}
+	if os.IsNotExist(err) {
+		return
+	}
+	log.RedisLog(log.REDIS_WARNING, "Fatal error loading the DB: %v. Exiting.", err)
+	fmt.Fprintf(os.Stderr, "Fatal error loading the DB %s: %v. Exiting.\n", svr.rdbFilename(), err)
+	os.Exit(1)
 }
 
 // Serve 主循环
@@ -76,6 +181,125 @@ func (svr *RedisServer) beforeSleep() {
 	conf := svr.conf
 	if conf.VmEnabled && len(svr.ioReadyClients) > 0 {
 	}
+
+	// serve the requests clients accumulated while blocked
+	svr.processUnblockedClients()
+
+	// write the AOF before the replies are sent, and before the next
+	// commands are processed. After a write error the cron retries.
+	if svr.aofLastWriteErr == nil {
+		svr.flushAppendOnlyFile()
+	}
+}
+
+// serverCron periodic task called REDIS_DEFAULT_HZ times per second
+func (svr *RedisServer) serverCron(eventLoop *event.AeEventLoop, id int64, clientData interface{}) int64 {
+	svr.cronloops++
+
+	// maxmemory is checked against this sample
+	svr.updateUsedMemory()
+
+	// retry the AOF write once per second after an error, and the write
+	// postponed by a slow fsync
+	if svr.aofFlushPostponedStart != 0 ||
+		(svr.aofLastWriteErr != nil && svr.cronloops%int64(constant.REDIS_DEFAULT_HZ) == 0) {
+		svr.flushAppendOnlyFile()
+	}
+
+	// reclaim expired keys nobody is accessing
+	svr.activeExpireCycle()
+
+	// shrink and rehash the dicts of the dbs
+	svr.databasesCron()
+
+	now := time.Now().Unix()
+	if svr.rdbChild != nil {
+		// check if the background save terminated
+		svr.checkChildrenDone()
+	} else {
+		// save if we reached one of the save points. After a failed
+		// BGSAVE wait REDIS_BGSAVE_RETRY_DELAY seconds before trying
+		// again
+		for _, sp := range svr.conf.Saves {
+			if svr.dirty >= sp.MinKeys && now-svr.lastsave > sp.Seconds &&
+				(now-svr.lastbgsaveTry > constant.REDIS_BGSAVE_RETRY_DELAY || svr.lastbgsaveStatus) {
+				log.RedisLog(log.REDIS_NOTICE, "%d changes in %d seconds. Saving...", sp.MinKeys, sp.Seconds)
+				svr.rdbSaveBackground(svr.rdbFilename())
+				break
+			}
+		}
+	}
+
+	// start the BGSAVE scheduled while another one was in progress
+	if svr.rdbChild == nil && svr.rdbBgsaveScheduled &&
+		(now-svr.lastbgsaveTry > constant.REDIS_BGSAVE_RETRY_DELAY || svr.lastbgsaveStatus) {
+		svr.rdbSaveBackground(svr.rdbFilename())
+	}
+
+	return int64(1000 / constant.REDIS_DEFAULT_HZ)
+}
+
+// htNeedsResize true when less than 10% of the buckets of d are used
+func htNeedsResize(d *dict.Dict) bool {
+	size := d.Slots()
+	used := d.Len()
+	return size > dict.DICT_HT_INITIAL_SIZE && used*100/size < constant.REDIS_HT_MINFILL
+}
+
+// tryResizeHashTables shrink the dicts of the db when they are mostly
+// empty, to save memory
+func (db *redisDb) tryResizeHashTables() {
+	if htNeedsResize(db.dict) {
+		db.dict.Resize()
+	}
+	if htNeedsResize(db.expires) {
+		db.expires.Resize()
+	}
+}
+
+// incrementallyRehash use 1 millisecond of CPU time to rehash the dicts
+// of the db, return true if some work was done
+func (db *redisDb) incrementallyRehash() bool {
+	// keys dictionary
+	if db.dict.IsRehashing() {
+		db.dict.RehashMilliseconds(1)
+		return true // already used our millisecond for this loop...
+	}
+	// expires
+	if db.expires.IsRehashing() {
+		db.expires.RehashMilliseconds(1)
+		return true
+	}
+	return false
+}
+
+// databasesCron background work on the dbs: the dicts are shrunk when
+// mostly empty and rehashed even if no client touches them, a few dbs
+// per call
+func (svr *RedisServer) databasesCron() {
+	dbsPerCall := constant.CRON_DBS_PER_CALL
+	if dbsPerCall > len(svr.dbs) {
+		dbsPerCall = len(svr.dbs)
+	}
+
+	// resize
+	for j := 0; j < dbsPerCall; j++ {
+		svr.dbs[svr.resizeDb%len(svr.dbs)].tryResizeHashTables()
+		svr.resizeDb++
+	}
+
+	// rehash
+	if svr.conf.ActiveRehashing {
+		for j := 0; j < dbsPerCall; j++ {
+			if svr.dbs[svr.rehashDb].incrementallyRehash() {
+				// if the function did some work, stop here, we'll do
+				// more at the next cron loop
+				break
+			}
+			// if this db didn't need rehash, we'll try the next one
+			svr.rehashDb = (svr.rehashDb + 1) % len(svr.dbs)
+		}
+	}
 }
 
 func (svr *RedisServer) createClient(conn net.Conn) error {
@@ -98,12 +322,16 @@ func (svr *RedisServer) createClient(conn net.Conn) error {
 	if svr.limitClient() {
 		// 达到最大链接限制
 		conn.Write([]byte("-ERR max number of clients reached\r\n"))
+		file.Close()
+		conn.Close()
 		return errors.New("max number of clients reached")
 	}
 
-	client := NewRedisClient(conn)
+	client := NewRedisClient(svr, conn, file)
+	client.selectDb(0)
 	if err := svr.eventLoop.CreateFileEvent(client.fd(), constant.AE_READABLE, client.onRead, client); err != nil {
 		fmt.Printf("create file event faield:%v\n", err)
+		client.file.Close()
 		return err
 	}
 
@@ -112,7 +340,31 @@ func (svr *RedisServer) createClient(conn net.Conn) error {
 
 }
 
-func (svr *RedisServer) freeClient(client *RedisClient) {}
+func (svr *RedisServer) freeClient(client *RedisClient) {
+	if (client.flags & constant.REDIS_BLOCKED) > 0 {
+		svr.unblockClient(client)
+	}
+	for i, c := range svr.unblockedClients {
+		if c == client {
+			svr.unblockedClients = append(svr.unblockedClients[:i], svr.unblockedClients[i+1:]...)
+			break
+		}
+	}
+
+	fd := client.fd()
+	svr.eventLoop.DelFileEvent(fd, constant.AE_READABLE|constant.AE_WRITABLE)
+	client.file.Close()
+	client.conn.Close()
+	client.querybuf = nil
+	client.argv = nil
+
+	for i, c := range svr.clients {
+		if c == client {
+			svr.clients = append(svr.clients[:i], svr.clients[i+1:]...)
+			break
+		}
+	}
+}
 
 func (svr *RedisServer) limitClient() bool {
 
@@ -121,3 +373,87 @@ func (svr *RedisServer) limitClient() bool {
 	}
 	return false
 }
+
+// genRedisInfoString the text of INFO for the section, "default", "all"
+// and "everything" select every section
+func (svr *RedisServer) genRedisInfoString(section string) string {
+	section = strings.ToLower(section)
+	all := section == "default" || section == "all" || section == "everything"
+	var b strings.Builder
+
+	if all || section == "persistence" {
+		bgsaveInProgress, currentBgsaveTimeSec := 0, int64(-1)
+		if svr.rdbChild != nil {
+			bgsaveInProgress = 1
+			currentBgsaveTimeSec = int64(time.Since(svr.rdbChild.start).Seconds())
+		}
+		bgsaveStatus := "ok"
+		if !svr.lastbgsaveStatus {
+			bgsaveStatus = "err"
+		}
+		fmt.Fprintf(&b, "# Persistence\r\n"+
+			"rdb_changes_since_last_save:%d\r\n"+
+			"rdb_bgsave_in_progress:%d\r\n"+
+			"rdb_last_save_time:%d\r\n"+
+			"rdb_last_bgsave_status:%s\r\n"+
+			"rdb_last_bgsave_time_sec:%d\r\n"+
+			"rdb_current_bgsave_time_sec:%d\r\n",
+			svr.dirty, bgsaveInProgress, svr.lastsave, bgsaveStatus,
+			svr.rdbLastBgsaveTimeSec, currentBgsaveTimeSec)
+		aofEnabled, aofStatus := 0, "ok"
+		if svr.aofFile != nil {
+			aofEnabled = 1
+		}
+		if svr.aofWriteError() != nil {
+			aofStatus = "err"
+		}
+		fmt.Fprintf(&b, "aof_enabled:%d\r\n"+
+			"aof_last_write_status:%s\r\n",
+			aofEnabled, aofStatus)
+		if svr.aofFile != nil {
+			fmt.Fprintf(&b, "aof_current_size:%d\r\n"+
+				"aof_buffer_length:%d\r\n"+
+				"aof_delayed_fsync:%d\r\n",
+				svr.aofCurrentSize, len(svr.aofBuf), svr.aofDelayedFsync)
+		}
+	}
+
+	if all || section == "stats" {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# Stats\r\n"+
+			"expired_keys:%d\r\n"+
+			"latest_fork_usec:%d\r\n"+
+			"cow_clones:%d\r\n"+
+			"cow_clone_usec:%d\r\n"+
+			"latest_cow_clone_usec:%d\r\n",
+			svr.statExpiredKeys, svr.statForkTime,
+			svr.statCowClones, svr.statCowTime, svr.statCowLastTime)
+	}
+
+	if all || section == "keyspace" {
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# Keyspace\r\n")
+		for _, db := range svr.dbs {
+			if keys := db.dbSize(); keys > 0 {
+				fmt.Fprintf(&b, "db%d:keys=%d,expires=%d\r\n", db.id, keys, db.expires.Len())
+			}
+		}
+	}
+	return b.String()
+}
+
+// infoCommand INFO [section]
+func infoCommand(client *RedisClient) {
+	section := "default"
+	if len(client.argv) == 2 {
+		section = string(client.argv[1])
+	} else if len(client.argv) > 2 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+	client.addReplyBulkString(client.svr.genRedisInfoString(section))
+}
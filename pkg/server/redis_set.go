@@ -0,0 +1,732 @@
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
+// ======================= set API ===========================
+
+// isIntegerMember check if value can be stored in an intset
+func isIntegerMember(value []byte) (int64, bool) {
+	if len(value) > 20 {
+		return 0, false
+	}
+	return core.String2ll(value)
+}
+
+// setTypeCreate create a set object able to hold value
+func setTypeCreate(value []byte) *RedisObject {
+	if _, ok := isIntegerMember(value); ok {
+		return createIntsetObject()
+	}
+	return createSetObject()
+}
+
+// setTypeAdd add value to the set, return false when it is already a
+// member. Intsets are converted to hash tables when value is not an
+// integer or the set grows past set-max-intset-entries.
+func (svr *RedisServer) setTypeAdd(o *RedisObject, value []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		return o.Ptr.(*dict.Dict).Add(string(value), nil)
+	case constant.REDIS_ENCODING_INTSET:
+		is := o.Ptr.(*core.Intset)
+		if v, ok := isIntegerMember(value); ok {
+			if !is.Add(v) {
+				return false
+			}
+			// convert to regular set when the intset contains too many entries
+			if is.Len() > svr.conf.SetMaxIntsetEntries {
+				setTypeConvert(o)
+			}
+			return true
+		}
+		// failed to get integer from value, convert to regular set
+		setTypeConvert(o)
+		o.Ptr.(*dict.Dict).Add(string(value), nil)
+		return true
+	}
+	panic("Unknown set encoding")
+}
+
+// setTypeRemove remove value, return false when it is not a member
+func setTypeRemove(o *RedisObject, value []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		set := o.Ptr.(*dict.Dict)
+		if !set.Delete(string(value)) {
+			return false
+		}
+		if htNeedsResize(set) {
+			set.Resize()
+		}
+		return true
+	case constant.REDIS_ENCODING_INTSET:
+		v, ok := isIntegerMember(value)
+		return ok && o.Ptr.(*core.Intset).Remove(v)
+	}
+	panic("Unknown set encoding")
+}
+
+// setTypeIsMember check if value is in the set
+func setTypeIsMember(o *RedisObject, value []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		return o.Ptr.(*dict.Dict).Find(string(value)) != nil
+	case constant.REDIS_ENCODING_INTSET:
+		v, ok := isIntegerMember(value)
+		return ok && o.Ptr.(*core.Intset).Find(v)
+	}
+	panic("Unknown set encoding")
+}
+
+// setTypeSize number of members
+func setTypeSize(o *RedisObject) int {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		return o.Ptr.(*dict.Dict).Len()
+	case constant.REDIS_ENCODING_INTSET:
+		return o.Ptr.(*core.Intset).Len()
+	}
+	panic("Unknown set encoding")
+}
+
+// setTypeDup duplicate a set object, used by COPY
+func setTypeDup(o *RedisObject) *RedisObject {
+	var dup *RedisObject
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		set := o.Ptr.(*dict.Dict)
+		dupset := dict.New(setDictType)
+		dupset.Expand(set.Len())
+		it := set.GetIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			dupset.Add(de.Key, nil)
+		}
+		it.Release()
+		dup = createObject(constant.REDIS_SET, dupset)
+	case constant.REDIS_ENCODING_INTSET:
+		dup = createObject(constant.REDIS_SET, o.Ptr.(*core.Intset).Dup())
+	default:
+		panic("Unknown set encoding")
+	}
+	dup.Encoding = o.Encoding
+	return dup
+}
+
+// setTypeConvert convert an intset encoded set to a hash table
+func setTypeConvert(o *RedisObject) {
+	is := o.Ptr.(*core.Intset)
+	set := dict.New(setDictType)
+	// presize the dict to avoid rehashing
+	set.Expand(is.Len())
+	for i := 0; i < is.Len(); i++ {
+		set.Add(strconv.FormatInt(is.Get(i), 10), nil)
+	}
+	o.Ptr = set
+	o.Encoding = constant.REDIS_ENCODING_HT
+}
+
+// setTypeIterator iterate the members of a set regardless of its
+// encoding. The set must not be modified during the iteration.
+type setTypeIterator struct {
+	o       *RedisObject
+	members []string // hash table: the members, collected at init time
+	pos     int
+}
+
+func setTypeInitIterator(o *RedisObject) *setTypeIterator {
+	si := &setTypeIterator{o: o}
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		set := o.Ptr.(*dict.Dict)
+		si.members = make([]string, 0, set.Len())
+		it := set.GetIterator()
+		for de := it.Next(); de != nil; de = it.Next() {
+			si.members = append(si.members, de.Key)
+		}
+		it.Release()
+	case constant.REDIS_ENCODING_INTSET:
+	default:
+		panic("Unknown set encoding")
+	}
+	return si
+}
+
+// next return the next member, false when done
+func (si *setTypeIterator) next() ([]byte, bool) {
+	if si.o.Encoding == constant.REDIS_ENCODING_INTSET {
+		is := si.o.Ptr.(*core.Intset)
+		if si.pos >= is.Len() {
+			return nil, false
+		}
+		si.pos++
+		return strconv.AppendInt(nil, is.Get(si.pos-1), 10), true
+	}
+	if si.pos >= len(si.members) {
+		return nil, false
+	}
+	si.pos++
+	return []byte(si.members[si.pos-1]), true
+}
+
+// setTypeRandomElement a random member of a non empty set
+func setTypeRandomElement(o *RedisObject) []byte {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_HT:
+		return []byte(o.Ptr.(*dict.Dict).GetFairRandomKey().Key)
+	case constant.REDIS_ENCODING_INTSET:
+		is := o.Ptr.(*core.Intset)
+		return strconv.AppendInt(nil, is.Get(rand.Intn(is.Len())), 10)
+	}
+	panic("Unknown set encoding")
+}
+
+// setTypeMembers every member of the set
+func setTypeMembers(o *RedisObject) [][]byte {
+	members := make([][]byte, 0, setTypeSize(o))
+	si := setTypeInitIterator(o)
+	for member, ok := si.next(); ok; member, ok = si.next() {
+		members = append(members, member)
+	}
+	return members
+}
+
+// ======================= commands ===========================
+
+func saddCommand(client *RedisClient) {
+	svr := client.svr
+	key := client.argv[1]
+	set := client.db.lookupKeyWrite(key)
+	if set == nil {
+		set = setTypeCreate(client.argv[2])
+		client.db.dbAdd(key, set)
+	} else if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+
+	added := 0
+	for _, member := range client.argv[2:] {
+		if svr.setTypeAdd(set, member) {
+			added++
+		}
+	}
+	svr.dirty += int64(added)
+	client.addReplyLongLong(int64(added))
+}
+
+func sremCommand(client *RedisClient) {
+	key := client.argv[1]
+	set := client.db.lookupKeyWrite(key)
+	if set == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+
+	deleted := 0
+	for _, member := range client.argv[2:] {
+		if setTypeRemove(set, member) {
+			deleted++
+			if setTypeSize(set) == 0 {
+				client.db.dbDelete(key)
+				break
+			}
+		}
+	}
+	client.svr.dirty += int64(deleted)
+	client.addReplyLongLong(int64(deleted))
+}
+
+func smoveCommand(client *RedisClient) {
+	db := client.db
+	srckey, dstkey, member := client.argv[1], client.argv[2], client.argv[3]
+	srcset := db.lookupKeyWrite(srckey)
+	dstset := db.lookupKeyWrite(dstkey)
+
+	// if the source key does not exist return 0
+	if srcset == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	// if the source key has the wrong type, or the destination key is set
+	// and has the wrong type, return an error
+	if !client.checkType(srcset, constant.REDIS_SET) ||
+		(dstset != nil && !client.checkType(dstset, constant.REDIS_SET)) {
+		return
+	}
+
+	// if srcset and dstset are equal, SMOVE is a no-op
+	if srcset == dstset {
+		if setTypeIsMember(srcset, member) {
+			client.addReply(shared.cone)
+		} else {
+			client.addReply(shared.czero)
+		}
+		return
+	}
+
+	// if the element cannot be removed from the src set, return 0
+	if !setTypeRemove(srcset, member) {
+		client.addReply(shared.czero)
+		return
+	}
+	// remove the src set from the database when empty
+	if setTypeSize(srcset) == 0 {
+		db.dbDelete(srckey)
+	}
+	client.svr.dirty++
+
+	// create the destination set when it doesn't exist
+	if dstset == nil {
+		dstset = setTypeCreate(member)
+		db.dbAdd(dstkey, dstset)
+	}
+	if client.svr.setTypeAdd(dstset, member) {
+		client.svr.dirty++
+	}
+	client.addReply(shared.cone)
+}
+
+func sismemberCommand(client *RedisClient) {
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	if setTypeIsMember(set, client.argv[2]) {
+		client.addReply(shared.cone)
+	} else {
+		client.addReply(shared.czero)
+	}
+}
+
+func smismemberCommand(client *RedisClient) {
+	// don't abort when the key cannot be found, non-existing keys are
+	// empty sets
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set != nil && !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	members := client.argv[2:]
+	client.addReplyMultiBulkLen(len(members))
+	for _, member := range members {
+		if set != nil && setTypeIsMember(set, member) {
+			client.addReply(shared.cone)
+		} else {
+			client.addReply(shared.czero)
+		}
+	}
+}
+
+func scardCommand(client *RedisClient) {
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	client.addReplyLongLong(int64(setTypeSize(set)))
+}
+
+// spopWithCountCommand SPOP key count
+func spopWithCountCommand(client *RedisClient) {
+	count, ok := client.getPositiveLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	key := client.argv[1]
+	set := client.db.lookupKeyWrite(key)
+	if set == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	if count == 0 {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+
+	size := int64(setTypeSize(set))
+	// the number of requested elements is greater than or equal to the
+	// number of elements inside the set: simply return the whole set
+	if count >= size {
+		members := setTypeMembers(set)
+		client.db.dbDelete(key)
+		client.svr.dirty++
+		client.addReplyMultiBulkLen(len(members))
+		for _, member := range members {
+			client.addReplyBulk(member)
+		}
+		// propagate as DEL, the popped members are random
+		client.rewriteCommandVector([]byte("DEL"), key)
+		return
+	}
+
+	// propagate as SREM of the popped members
+	argv := make([][]byte, 0, count+2)
+	argv = append(argv, []byte("SREM"), key)
+	client.addReplyMultiBulkLen(int(count))
+	for i := int64(0); i < count; i++ {
+		member := setTypeRandomElement(set)
+		setTypeRemove(set, member)
+		client.addReplyBulk(member)
+		argv = append(argv, member)
+	}
+	client.svr.dirty += count
+	client.rewriteCommandVector(argv...)
+}
+
+func spopCommand(client *RedisClient) {
+	if len(client.argv) == 3 {
+		spopWithCountCommand(client)
+		return
+	} else if len(client.argv) > 3 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	key := client.argv[1]
+	set := client.db.lookupKeyWrite(key)
+	if set == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	member := setTypeRandomElement(set)
+	setTypeRemove(set, member)
+	if setTypeSize(set) == 0 {
+		client.db.dbDelete(key)
+	}
+	client.svr.dirty++
+	client.addReplyBulk(member)
+
+	// propagate as SREM of the popped member
+	client.rewriteCommandVector([]byte("SREM"), key, member)
+}
+
+// srandmemberWithCountCommand SRANDMEMBER key count
+//
+// A positive count returns up to count distinct members, a negative count
+// returns exactly -count members that may repeat.
+func srandmemberWithCountCommand(client *RedisClient) {
+	count, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	if count == 0 {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+
+	members := setTypeMembers(set)
+	size := int64(len(members))
+	if count < 0 {
+		// the same element may be returned multiple times
+		count = -count
+		client.addReplyMultiBulkLen(int(count))
+		for i := int64(0); i < count; i++ {
+			client.addReplyBulk(members[rand.Intn(int(size))])
+		}
+		return
+	}
+	if count > size {
+		count = size
+	}
+	client.addReplyMultiBulkLen(int(count))
+	for _, i := range rand.Perm(int(size))[:count] {
+		client.addReplyBulk(members[i])
+	}
+}
+
+func srandmemberCommand(client *RedisClient) {
+	if len(client.argv) == 3 {
+		srandmemberWithCountCommand(client)
+		return
+	} else if len(client.argv) > 3 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	client.addReplyBulk(setTypeRandomElement(set))
+}
+
+// lookupSetsOrReply lookup the sets at keys, missing keys are returned as
+// nil. On type mismatch an error is sent and false returned.
+func lookupSetsOrReply(client *RedisClient, keys [][]byte, write bool) ([]*RedisObject, bool) {
+	sets := make([]*RedisObject, len(keys))
+	for j, key := range keys {
+		var set *RedisObject
+		if write {
+			set = client.db.lookupKeyWrite(key)
+		} else {
+			set = client.db.lookupKeyRead(key)
+		}
+		if set != nil && !client.checkType(set, constant.REDIS_SET) {
+			return nil, false
+		}
+		sets[j] = set
+	}
+	return sets, true
+}
+
+// setsIntersection the members of the intersection, stopping at limit
+// members when limit > 0. The smallest set is iterated and every member is
+// checked against the other sets, from the smallest to the biggest.
+func setsIntersection(sets []*RedisObject, limit int) [][]byte {
+	for _, set := range sets {
+		// a missing key is an empty set, so the intersection is empty
+		if set == nil {
+			return nil
+		}
+	}
+	sorted := append([]*RedisObject(nil), sets...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return setTypeSize(sorted[i]) < setTypeSize(sorted[j])
+	})
+
+	var result [][]byte
+	si := setTypeInitIterator(sorted[0])
+	for member, ok := si.next(); ok; member, ok = si.next() {
+		found := true
+		for _, other := range sorted[1:] {
+			if other == sorted[0] {
+				continue
+			}
+			if !setTypeIsMember(other, member) {
+				found = false
+				break
+			}
+		}
+		if found {
+			result = append(result, member)
+			if limit > 0 && len(result) >= limit {
+				break
+			}
+		}
+	}
+	return result
+}
+
+// storeSetResult store members as a new set at dstkey, or delete dstkey
+// when there are no members, and reply with the cardinality
+func storeSetResult(client *RedisClient, dstkey []byte, members [][]byte) {
+	db := client.db
+	if len(members) == 0 {
+		if db.dbDelete(dstkey) {
+			client.svr.dirty++
+		}
+		client.addReply(shared.czero)
+		return
+	}
+	dstset := setTypeCreate(members[0])
+	for _, member := range members {
+		client.svr.setTypeAdd(dstset, member)
+	}
+	db.setKey(dstkey, dstset, false)
+	client.svr.dirty++
+	client.addReplyLongLong(int64(setTypeSize(dstset)))
+}
+
+func replySetMembers(client *RedisClient, members [][]byte) {
+	client.addReplyMultiBulkLen(len(members))
+	for _, member := range members {
+		client.addReplyBulk(member)
+	}
+}
+
+// sinterGenericCommand SINTER key [key ...] and SINTERSTORE dst key [key ...]
+func sinterGenericCommand(client *RedisClient, keys [][]byte, dstkey []byte) {
+	sets, ok := lookupSetsOrReply(client, keys, dstkey != nil)
+	if !ok {
+		return
+	}
+	members := setsIntersection(sets, 0)
+	if dstkey != nil {
+		storeSetResult(client, dstkey, members)
+		return
+	}
+	replySetMembers(client, members)
+}
+
+func sinterCommand(client *RedisClient) {
+	sinterGenericCommand(client, client.argv[1:], nil)
+}
+
+func sinterstoreCommand(client *RedisClient) {
+	sinterGenericCommand(client, client.argv[2:], client.argv[1])
+}
+
+// sintercardCommand SINTERCARD numkeys key [key ...] [LIMIT limit]
+func sintercardCommand(client *RedisClient) {
+	numkeys, ok := client.getLongLongOrReply(client.argv[1], "numkeys should be greater than 0")
+	if !ok {
+		return
+	}
+	if numkeys <= 0 {
+		client.addReplyError("numkeys should be greater than 0")
+		return
+	}
+	if numkeys > int64(len(client.argv)-2) {
+		client.addReplyError("Number of keys can't be greater than number of args")
+		return
+	}
+
+	var limit int64
+	for j := 2 + int(numkeys); j < len(client.argv); j++ {
+		opt := strings.ToLower(string(client.argv[j]))
+		if opt == "limit" && j+1 < len(client.argv) {
+			j++
+			if limit, ok = client.getPositiveLongLongOrReply(client.argv[j], "LIMIT can't be negative"); !ok {
+				return
+			}
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	sets, ok := lookupSetsOrReply(client, client.argv[2:2+numkeys], false)
+	if !ok {
+		return
+	}
+	client.addReplyLongLong(int64(len(setsIntersection(sets, int(limit)))))
+}
+
+const (
+	setOpUnion = iota
+	setOpDiff
+)
+
+// sunionDiffGenericCommand implementation of SUNION, SDIFF and their
+// STORE variants
+func sunionDiffGenericCommand(client *RedisClient, keys [][]byte, dstkey []byte, op int) {
+	sets, ok := lookupSetsOrReply(client, keys, dstkey != nil)
+	if !ok {
+		return
+	}
+
+	// the result is accumulated in a hash table, members keep the order
+	// they are found in
+	seen := map[string]struct{}{}
+	var members [][]byte
+	switch op {
+	case setOpUnion:
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			si := setTypeInitIterator(set)
+			for member, ok := si.next(); ok; member, ok = si.next() {
+				if _, dup := seen[string(member)]; !dup {
+					seen[string(member)] = struct{}{}
+					members = append(members, member)
+				}
+			}
+		}
+	case setOpDiff:
+		if sets[0] != nil {
+			si := setTypeInitIterator(sets[0])
+			for member, ok := si.next(); ok; member, ok = si.next() {
+				found := false
+				for _, other := range sets[1:] {
+					if other == nil {
+						continue
+					}
+					if other == sets[0] || setTypeIsMember(other, member) {
+						found = true
+						break
+					}
+				}
+				if !found {
+					members = append(members, member)
+				}
+			}
+		}
+	}
+
+	if dstkey != nil {
+		storeSetResult(client, dstkey, members)
+		return
+	}
+	replySetMembers(client, members)
+}
+
+func sunionCommand(client *RedisClient) {
+	sunionDiffGenericCommand(client, client.argv[1:], nil, setOpUnion)
+}
+
+func sunionstoreCommand(client *RedisClient) {
+	sunionDiffGenericCommand(client, client.argv[2:], client.argv[1], setOpUnion)
+}
+
+func sdiffCommand(client *RedisClient) {
+	sunionDiffGenericCommand(client, client.argv[1:], nil, setOpDiff)
+}
+
+func sdiffstoreCommand(client *RedisClient) {
+	sunionDiffGenericCommand(client, client.argv[2:], client.argv[1], setOpDiff)
+}
+
+func smembersCommand(client *RedisClient) {
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	replySetMembers(client, setTypeMembers(set))
+}
+
+// sscanCommand SSCAN key cursor [MATCH pattern] [COUNT count]
+func sscanCommand(client *RedisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	set := client.db.lookupKeyRead(client.argv[1])
+	if set == nil {
+		client.addReply(shared.emptyscan)
+		return
+	}
+	if !client.checkType(set, constant.REDIS_SET) {
+		return
+	}
+	scanGenericCommand(client, set, cursor)
+}
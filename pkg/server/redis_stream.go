@@ -0,0 +1,1928 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// Streams keep their entries in a core.Stream plus the consumer groups.
+// A group tracks the last ID delivered to its consumers and the pending
+// entries list (PEL): the entries delivered but not yet acknowledged.
+// Every consumer has its own PEL, sharing the NACKs of the group one.
+
+const streamInvalidIDErr = "Invalid stream ID specified as stream command argument"
+
+// streamInvalidEntriesRead the entries read counter of a group is unknown
+const streamInvalidEntriesRead int64 = -1
+
+// streamApproxTrimLimit max entries removed by a "~" trim without LIMIT
+const streamApproxTrimLimit int64 = 10000
+
+// stream trimming strategies of XADD and XTRIM
+const (
+	trimStrategyNone = iota
+	trimStrategyMaxLen
+	trimStrategyMinID
+)
+
+// stream the value of a stream object
+type stream struct {
+	*core.Stream
+	cgroups map[string]*streamCG
+}
+
+// streamCG a consumer group
+type streamCG struct {
+	name        string
+	lastID      core.StreamID // last ID delivered to the consumers
+	entriesRead int64         // logical number of entries read, streamInvalidEntriesRead when unknown
+	pel         *streamPEL
+	consumers   map[string]*streamConsumer
+}
+
+// streamConsumer a consumer of a group
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // unix time in ms of the last interaction
+	activeTime int64 // unix time in ms of the last successful read or claim, -1 if never
+	pel        *streamPEL
+}
+
+// streamNACK a delivered but not yet acknowledged entry
+type streamNACK struct {
+	deliveryTime  int64 // unix time in ms of the last delivery
+	deliveryCount int64
+	consumer      *streamConsumer
+}
+
+// streamPEL a pending entries list ordered by ID. Entries are delivered
+// in ID order, so inserting is usually an append.
+type streamPEL struct {
+	ids   []core.StreamID
+	nacks map[core.StreamID]*streamNACK
+}
+
+func newStreamPEL() *streamPEL {
+	return &streamPEL{nacks: map[core.StreamID]*streamNACK{}}
+}
+
+// streamDup duplicate a stream object with its consumer groups, used by
+// COPY. The NACKs are shared by the PEL of a group and the PEL of their
+// consumer, the copy keeps them shared.
+func streamDup(o *RedisObject) *RedisObject {
+	s := o.Ptr.(*stream)
+	dup := createStreamObject()
+	dups := dup.Ptr.(*stream)
+	dups.Stream = s.Stream.Dup()
+	for name, cg := range s.cgroups {
+		dupcg := &streamCG{
+			name:        cg.name,
+			lastID:      cg.lastID,
+			entriesRead: cg.entriesRead,
+			pel:         newStreamPEL(),
+			consumers:   make(map[string]*streamConsumer, len(cg.consumers)),
+		}
+		for cname, consumer := range cg.consumers {
+			dupcg.consumers[cname] = &streamConsumer{
+				name:       consumer.name,
+				seenTime:   consumer.seenTime,
+				activeTime: consumer.activeTime,
+				pel:        newStreamPEL(),
+			}
+		}
+		dupcg.pel.ids = append([]core.StreamID(nil), cg.pel.ids...)
+		for id, nack := range cg.pel.nacks {
+			dupnack := *nack
+			dupnack.consumer = dupcg.consumers[nack.consumer.name]
+			dupcg.pel.nacks[id] = &dupnack
+		}
+		for cname, consumer := range cg.consumers {
+			dupconsumer := dupcg.consumers[cname]
+			dupconsumer.pel.ids = append([]core.StreamID(nil), consumer.pel.ids...)
+			for id := range consumer.pel.nacks {
+				dupconsumer.pel.nacks[id] = dupcg.pel.nacks[id]
+			}
+		}
+		dups.cgroups[name] = dupcg
+	}
+	return dup
+}
+
+func (pel *streamPEL) len() int {
+	return len(pel.ids)
+}
+
+func (pel *streamPEL) get(id core.StreamID) *streamNACK {
+	return pel.nacks[id]
+}
+
+// seek return the index of the first ID >= id
+func (pel *streamPEL) seek(id core.StreamID) int {
+	return sort.Search(len(pel.ids), func(i int) bool {
+		return pel.ids[i].Compare(id) >= 0
+	})
+}
+
+// insert add or replace the NACK of id
+func (pel *streamPEL) insert(id core.StreamID, nack *streamNACK) {
+	if _, ok := pel.nacks[id]; !ok {
+		n := len(pel.ids)
+		if n == 0 || pel.ids[n-1].Compare(id) < 0 {
+			pel.ids = append(pel.ids, id)
+		} else {
+			i := pel.seek(id)
+			pel.ids = append(pel.ids, core.StreamID{})
+			copy(pel.ids[i+1:], pel.ids[i:])
+			pel.ids[i] = id
+		}
+	}
+	pel.nacks[id] = nack
+}
+
+// remove delete id from the PEL, return false if it was not pending
+func (pel *streamPEL) remove(id core.StreamID) bool {
+	if _, ok := pel.nacks[id]; !ok {
+		return false
+	}
+	delete(pel.nacks, id)
+	i := pel.seek(id)
+	pel.ids = append(pel.ids[:i], pel.ids[i+1:]...)
+	return true
+}
+
+// ======================= groups and consumers ===========================
+
+func (s *stream) lookupCG(name []byte) *streamCG {
+	return s.cgroups[string(name)]
+}
+
+// createCG create a group, return nil if a group with that name exists
+func (s *stream) createCG(name []byte, id core.StreamID, entriesRead int64) *streamCG {
+	if _, ok := s.cgroups[string(name)]; ok {
+		return nil
+	}
+	cg := &streamCG{
+		name:        string(name),
+		lastID:      id,
+		entriesRead: entriesRead,
+		pel:         newStreamPEL(),
+		consumers:   map[string]*streamConsumer{},
+	}
+	s.cgroups[cg.name] = cg
+	return cg
+}
+
+// sortedCGs return the groups ordered by name
+func (s *stream) sortedCGs() []*streamCG {
+	cgs := make([]*streamCG, 0, len(s.cgroups))
+	for _, cg := range s.cgroups {
+		cgs = append(cgs, cg)
+	}
+	sort.Slice(cgs, func(i, j int) bool { return cgs[i].name < cgs[j].name })
+	return cgs
+}
+
+func (cg *streamCG) lookupConsumer(name []byte) *streamConsumer {
+	return cg.consumers[string(name)]
+}
+
+// createConsumer create a consumer, return nil if it exists
+func (cg *streamCG) createConsumer(name []byte) *streamConsumer {
+	if _, ok := cg.consumers[string(name)]; ok {
+		return nil
+	}
+	consumer := &streamConsumer{
+		name:       string(name),
+		seenTime:   time.Now().UnixMilli(),
+		activeTime: -1,
+		pel:        newStreamPEL(),
+	}
+	cg.consumers[consumer.name] = consumer
+	return consumer
+}
+
+// touchConsumer return the consumer, created if missing, marked as seen
+func (cg *streamCG) touchConsumer(name []byte) *streamConsumer {
+	consumer := cg.lookupConsumer(name)
+	if consumer == nil {
+		consumer = cg.createConsumer(name)
+	}
+	consumer.seenTime = time.Now().UnixMilli()
+	return consumer
+}
+
+// delConsumer remove the consumer and its pending entries from the group
+func (cg *streamCG) delConsumer(consumer *streamConsumer) {
+	for _, id := range consumer.pel.ids {
+		cg.pel.remove(id)
+	}
+	delete(cg.consumers, consumer.name)
+}
+
+// sortedConsumers return the consumers ordered by name
+func (cg *streamCG) sortedConsumers() []*streamConsumer {
+	consumers := make([]*streamConsumer, 0, len(cg.consumers))
+	for _, consumer := range cg.consumers {
+		consumers = append(consumers, consumer)
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].name < consumers[j].name })
+	return consumers
+}
+
+// streamEstimateEntriesRead like EstimateDistanceFromFirstEverEntry but
+// return streamInvalidEntriesRead when the distance is unknown
+func streamEstimateEntriesRead(s *stream, id core.StreamID) int64 {
+	if v, ok := s.EstimateDistanceFromFirstEverEntry(id); ok {
+		return v
+	}
+	return streamInvalidEntriesRead
+}
+
+// streamCGLag return the number of entries the group still has to read,
+// false when it can't be computed
+func streamCGLag(s *stream, cg *streamCG) (int64, bool) {
+	if s.EntriesAdded == 0 {
+		return 0, true
+	}
+	if cg.entriesRead != streamInvalidEntriesRead && !s.RangeHasTombstones(&cg.lastID, nil) {
+		// no fragmentation ahead, the counter of the group is valid
+		return int64(s.EntriesAdded) - cg.entriesRead, true
+	}
+	if entriesRead := streamEstimateEntriesRead(s, cg.lastID); entriesRead != streamInvalidEntriesRead {
+		return int64(s.EntriesAdded) - entriesRead, true
+	}
+	return 0, false
+}
+
+// ======================= stream type API ===========================
+
+// streamNextID compute the ID of a new entry. requested is nil for an
+// automatic ID, seqGiven is false for the <ms>-* form. Return false when
+// the ID is not greater than the last one.
+func streamNextID(s *stream, requested *core.StreamID, seqGiven bool) (core.StreamID, bool) {
+	last := s.LastID
+	var id core.StreamID
+	if requested == nil {
+		ms := uint64(time.Now().UnixMilli())
+		if ms > last.Ms {
+			id = core.StreamID{Ms: ms}
+		} else {
+			var ok bool
+			if id, ok = last.Incr(); !ok {
+				return id, false
+			}
+		}
+	} else if !seqGiven && requested.Ms == last.Ms {
+		// the sequence would advance past the last one
+		if last.Seq == math.MaxUint64 {
+			return id, false
+		}
+		id = core.StreamID{Ms: last.Ms, Seq: last.Seq + 1}
+	} else {
+		id = *requested
+	}
+	if id.Compare(last) <= 0 {
+		return id, false
+	}
+	return id, true
+}
+
+// streamRange return up to count entries (0 for all) with an ID between
+// start and end included, from end to start when rev is set
+func streamRange(s *stream, start, end core.StreamID, count int64, rev bool) []*core.StreamEntry {
+	var entries []*core.StreamEntry
+	if start.Compare(end) > 0 {
+		return entries
+	}
+	full := func() bool { return count > 0 && int64(len(entries)) >= count }
+	if !rev {
+		for i := s.Seek(start); i < s.Len() && !full(); i++ {
+			e := s.Entry(i)
+			if e.ID.Compare(end) > 0 {
+				break
+			}
+			entries = append(entries, e)
+		}
+	} else {
+		i := s.Seek(end)
+		if i == s.Len() || s.Entry(i).ID.Compare(end) > 0 {
+			i--
+		}
+		for ; i >= 0 && !full(); i-- {
+			e := s.Entry(i)
+			if e.ID.Compare(start) < 0 {
+				break
+			}
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// streamDeliverToGroup return up to count entries with an ID >= start,
+// moving forward the last delivered ID of the group. Unless noack the
+// entries become pending for consumer.
+func streamDeliverToGroup(s *stream, group *streamCG, consumer *streamConsumer, start core.StreamID, count int64, noack bool) []*core.StreamEntry {
+	entries := streamRange(s, start, core.StreamIDMax, count, false)
+	now := time.Now().UnixMilli()
+	for _, e := range entries {
+		id := e.ID
+		if id.Compare(group.lastID) > 0 {
+			if group.entriesRead != streamInvalidEntriesRead && !s.RangeHasTombstones(&id, nil) {
+				// no deletions ahead, the counter keeps tracking the group
+				group.entriesRead++
+			} else if s.EntriesAdded != 0 {
+				group.entriesRead = streamEstimateEntriesRead(s, id)
+			}
+			group.lastID = id
+		}
+		if noack {
+			continue
+		}
+		nack := group.pel.get(id)
+		if nack == nil {
+			nack = &streamNACK{consumer: consumer}
+			group.pel.insert(id, nack)
+		} else if nack.consumer != consumer {
+			// the entry was pending for another consumer, after XGROUP SETID
+			nack.consumer.pel.remove(id)
+			nack.consumer = consumer
+		}
+		nack.deliveryTime = now
+		nack.deliveryCount = 1
+		consumer.pel.insert(id, nack)
+	}
+	if len(entries) > 0 {
+		consumer.activeTime = now
+	}
+	return entries
+}
+
+// streamReadConsumerPEL return up to count entries pending for consumer
+// with an ID >= start. Entries deleted meanwhile are returned without
+// fields.
+func streamReadConsumerPEL(s *stream, consumer *streamConsumer, start core.StreamID, count int64) []*core.StreamEntry {
+	var entries []*core.StreamEntry
+	now := time.Now().UnixMilli()
+	for i := consumer.pel.seek(start); i < consumer.pel.len(); i++ {
+		if count > 0 && int64(len(entries)) >= count {
+			break
+		}
+		id := consumer.pel.ids[i]
+		e := s.Lookup(id)
+		if e == nil {
+			entries = append(entries, &core.StreamEntry{ID: id})
+			continue
+		}
+		nack := consumer.pel.nacks[id]
+		nack.deliveryTime = now
+		nack.deliveryCount++
+		entries = append(entries, e)
+	}
+	if len(entries) > 0 {
+		consumer.activeTime = now
+	}
+	return entries
+}
+
+// streamPropagateXCLAIM propagate the NACK of id as an XCLAIM forcing its
+// final state, so loading the AOF doesn't depend on the time. For an
+// entry no longer in the stream the XCLAIM drops the NACK.
+func streamPropagateXCLAIM(client *RedisClient, key []byte, group *streamCG, id core.StreamID, nack *streamNACK) {
+	client.svr.propagate(client.db.id, [][]byte{
+		[]byte("XCLAIM"), key, []byte(group.name), []byte(nack.consumer.name), []byte("0"), []byte(id.String()),
+		[]byte("TIME"), strconv.AppendInt(nil, nack.deliveryTime, 10),
+		[]byte("RETRYCOUNT"), strconv.AppendInt(nil, nack.deliveryCount, 10),
+		[]byte("FORCE"), []byte("JUSTID"), []byte("LASTID"), []byte(group.lastID.String()),
+	})
+}
+
+// streamPropagateGroupID propagate the last delivered ID and the entries
+// read counter of group
+func streamPropagateGroupID(client *RedisClient, key []byte, group *streamCG) {
+	client.svr.propagate(client.db.id, [][]byte{
+		[]byte("XGROUP"), []byte("SETID"), key, []byte(group.name), []byte(group.lastID.String()),
+		[]byte("ENTRIESREAD"), strconv.AppendInt(nil, group.entriesRead, 10),
+	})
+}
+
+// streamTouchConsumerPropagate touchConsumer for the commands propagating
+// their own effects, a new consumer is propagated as XGROUP CREATECONSUMER
+func streamTouchConsumerPropagate(client *RedisClient, key []byte, group *streamCG, name []byte) *streamConsumer {
+	if group.lookupConsumer(name) == nil {
+		client.svr.propagate(client.db.id, [][]byte{
+			[]byte("XGROUP"), []byte("CREATECONSUMER"), key, []byte(group.name), name,
+		})
+	}
+	return group.touchConsumer(name)
+}
+
+// streamPropagateGroupRead propagate the effects of XREADGROUP on group:
+// an XCLAIM for every entry delivered, and the new last delivered ID when
+// it moved from lastID. Entries deleted from the stream are returned
+// without fields and left alone.
+func streamPropagateGroupRead(client *RedisClient, key []byte, group *streamCG, entries []*core.StreamEntry, lastID core.StreamID) {
+	for _, e := range entries {
+		if e.Fields == nil {
+			continue
+		}
+		if nack := group.pel.get(e.ID); nack != nil {
+			streamPropagateXCLAIM(client, key, group, e.ID, nack)
+		}
+	}
+	if group.lastID != lastID {
+		streamPropagateGroupID(client, key, group)
+	}
+}
+
+// streamTrim trim the stream as requested by XADD or XTRIM, return the
+// number of removed entries
+func streamTrim(s *stream, args *streamAddTrimArgs) int64 {
+	switch args.trimStrategy {
+	case trimStrategyMaxLen:
+		return s.TrimByLen(args.maxlen, args.limit)
+	case trimStrategyMinID:
+		return s.TrimByMinID(args.minid, args.limit)
+	}
+	return 0
+}
+
+// ======================= parsing and replies ===========================
+
+// streamGenericParseIDOrReply parse a stream ID argument, a missing
+// sequence part is set to missingSeq. Unless strict "-" and "+" are the
+// smallest and the greatest ID. When seqGiven is not nil the <ms>-* form
+// is accepted and reported. A nil client parses silently.
+func streamGenericParseIDOrReply(client *RedisClient, arg []byte, missingSeq uint64, strict bool, seqGiven *bool) (core.StreamID, bool) {
+	if !strict && len(arg) == 1 {
+		if arg[0] == '-' {
+			return core.StreamIDMin, true
+		} else if arg[0] == '+' {
+			return core.StreamIDMax, true
+		}
+	}
+	id, given, ok := core.ParseStreamID(arg, missingSeq, seqGiven != nil)
+	if !ok {
+		if client != nil {
+			client.addReplyError(streamInvalidIDErr)
+		}
+		return id, false
+	}
+	if seqGiven != nil {
+		*seqGiven = given
+	}
+	return id, true
+}
+
+func streamParseIDOrReply(client *RedisClient, arg []byte, missingSeq uint64) (core.StreamID, bool) {
+	return streamGenericParseIDOrReply(client, arg, missingSeq, false, nil)
+}
+
+func streamParseStrictIDOrReply(client *RedisClient, arg []byte, missingSeq uint64, seqGiven *bool) (core.StreamID, bool) {
+	return streamGenericParseIDOrReply(client, arg, missingSeq, true, seqGiven)
+}
+
+// streamParseIntervalIDOrReply parse a range bound, "(" in front of the
+// ID makes it exclusive
+func streamParseIntervalIDOrReply(client *RedisClient, arg []byte, missingSeq uint64) (core.StreamID, bool, bool) {
+	if len(arg) > 1 && arg[0] == '(' {
+		id, ok := streamParseStrictIDOrReply(client, arg[1:], missingSeq, nil)
+		return id, true, ok
+	}
+	id, ok := streamParseIDOrReply(client, arg, missingSeq)
+	return id, false, ok
+}
+
+// streamParseRangeOrReply parse the start and end bounds of XRANGE,
+// XREVRANGE and XPENDING, exclusive bounds are turned into inclusive ones
+func streamParseRangeOrReply(client *RedisClient, startArg, endArg []byte) (start, end core.StreamID, ok bool) {
+	start, startex, ok := streamParseIntervalIDOrReply(client, startArg, 0)
+	if !ok {
+		return
+	}
+	if startex {
+		if start, ok = start.Incr(); !ok {
+			client.addReplyError("invalid start ID for the interval")
+			return
+		}
+	}
+	end, endex, ok := streamParseIntervalIDOrReply(client, endArg, math.MaxUint64)
+	if !ok {
+		return
+	}
+	if endex {
+		if end, ok = end.Decr(); !ok {
+			client.addReplyError("invalid end ID for the interval")
+			return
+		}
+	}
+	return start, end, true
+}
+
+func (client *RedisClient) addReplyStreamID(id core.StreamID) {
+	client.addReplyBulkString(id.String())
+}
+
+// addReplyStreamEntry reply with [id, [field, value, ...]], an entry
+// without fields was deleted and gets a null array
+func (client *RedisClient) addReplyStreamEntry(e *core.StreamEntry) {
+	client.addReplyMultiBulkLen(2)
+	client.addReplyStreamID(e.ID)
+	if e.Fields == nil {
+		client.addReply(shared.nullmultibulk)
+		return
+	}
+	client.addReplyMultiBulkLen(len(e.Fields))
+	for _, f := range e.Fields {
+		client.addReplyBulk(f)
+	}
+}
+
+func (client *RedisClient) addReplyStreamEntries(entries []*core.StreamEntry) {
+	client.addReplyMultiBulkLen(len(entries))
+	for _, e := range entries {
+		client.addReplyStreamEntry(e)
+	}
+}
+
+// streamAddTrimArgs the options of XADD and XTRIM
+type streamAddTrimArgs struct {
+	id           core.StreamID
+	idGiven      bool // false for "*"
+	seqGiven     bool // false for <ms>-*
+	noMkStream   bool
+	trimStrategy int
+	approxTrim   bool
+	limit        int64 // max entries to trim, 0 for no limit
+	maxlen       int64
+	minid        core.StreamID
+}
+
+// streamParseAddOrTrimArgsOrReply parse the options of XADD or XTRIM
+// starting at argv[2]. For XADD return the index of the ID, that ends
+// the options. Return -1 on error.
+func streamParseAddOrTrimArgsOrReply(client *RedisClient, args *streamAddTrimArgs, xadd bool) int {
+	argv := client.argv
+	limitGiven := false
+	i := 2
+	for ; i < len(argv); i++ {
+		moreargs := len(argv) - 1 - i
+		opt := strings.ToLower(string(argv[i]))
+		if xadd && opt == "*" {
+			break
+		} else if (opt == "maxlen" || opt == "minid") && moreargs > 0 {
+			if args.trimStrategy != trimStrategyNone {
+				client.addReplyError("syntax error, MAXLEN and MINID options at the same time are not compatible")
+				return -1
+			}
+			args.approxTrim = false
+			next := string(argv[i+1])
+			if moreargs >= 2 && next == "~" {
+				args.approxTrim = true
+				i++
+			} else if moreargs >= 2 && next == "=" {
+				i++
+			}
+			if opt == "maxlen" {
+				maxlen, ok := client.getLongLongOrReply(argv[i+1], "")
+				if !ok {
+					return -1
+				}
+				if maxlen < 0 {
+					client.addReplyError("The MAXLEN argument must be >= 0.")
+					return -1
+				}
+				args.maxlen = maxlen
+				args.trimStrategy = trimStrategyMaxLen
+			} else {
+				minid, ok := streamParseStrictIDOrReply(client, argv[i+1], 0, nil)
+				if !ok {
+					return -1
+				}
+				args.minid = minid
+				args.trimStrategy = trimStrategyMinID
+			}
+			i++
+		} else if opt == "limit" && moreargs > 0 {
+			limit, ok := client.getLongLongOrReply(argv[i+1], "")
+			if !ok {
+				return -1
+			}
+			if limit < 0 || limit > 1000000 {
+				client.addReplyError("The LIMIT argument must be >= 0.")
+				return -1
+			}
+			args.limit = limit
+			limitGiven = true
+			i++
+		} else if xadd && opt == "nomkstream" {
+			args.noMkStream = true
+		} else if xadd {
+			// a syntax error or the ID
+			id, ok := streamParseStrictIDOrReply(client, argv[i], 0, &args.seqGiven)
+			if !ok {
+				return -1
+			}
+			args.id = id
+			args.idGiven = true
+			break
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return -1
+		}
+	}
+
+	if args.limit != 0 && args.trimStrategy == trimStrategyNone {
+		client.addReplyError("syntax error, LIMIT cannot be used without specifying a trimming strategy")
+		return -1
+	}
+	if !xadd && args.trimStrategy == trimStrategyNone {
+		client.addReplyError("syntax error, XTRIM must be called with a trimming strategy")
+		return -1
+	}
+	if limitGiven {
+		if !args.approxTrim {
+			client.addReplyError("syntax error, LIMIT cannot be used without the special ~ option")
+			return -1
+		}
+	} else if args.approxTrim {
+		args.limit = streamApproxTrimLimit
+	} else {
+		args.limit = 0
+	}
+	return i
+}
+
+// lookupStreamOrReply return the stream object at key, nil when missing.
+// On wrong type reply with an error and return false.
+func lookupStreamOrReply(client *RedisClient, key []byte, write bool) (*RedisObject, bool) {
+	var o *RedisObject
+	if write {
+		o = client.db.lookupKeyWrite(key)
+	} else {
+		o = client.db.lookupKeyRead(key)
+	}
+	if o != nil && !client.checkType(o, constant.REDIS_STREAM) {
+		return nil, false
+	}
+	return o, true
+}
+
+// ======================= commands ===========================
+
+// xaddCommand XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold
+// [LIMIT count]] *|id field value [field value ...]
+func xaddCommand(client *RedisClient) {
+	var args streamAddTrimArgs
+	idpos := streamParseAddOrTrimArgsOrReply(client, &args, true)
+	if idpos < 0 {
+		return
+	}
+	// return ASAP if 0-0 was given so we avoid possibly creating a key
+	if args.idGiven && args.seqGiven && args.id.IsZero() {
+		client.addReplyError("The ID specified in XADD must be greater than 0-0")
+		return
+	}
+	fieldpos := idpos + 1
+	if n := len(client.argv) - fieldpos; n < 2 || n%2 == 1 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", client.cmd.Name)
+		return
+	}
+
+	db := client.db
+	key := client.argv[1]
+	o, ok := lookupStreamOrReply(client, key, true)
+	if !ok {
+		return
+	}
+	if o == nil {
+		if args.noMkStream {
+			client.addReply(shared.nullbulk)
+			return
+		}
+		o = createStreamObject()
+		db.dbAdd(key, o)
+	}
+	s := o.Ptr.(*stream)
+	if s.LastID == core.StreamIDMax {
+		client.addReplyError("The stream has exhausted the last possible ID, unable to add more items")
+		return
+	}
+
+	var requested *core.StreamID
+	if args.idGiven {
+		requested = &args.id
+	}
+	id, ok := streamNextID(s, requested, args.seqGiven)
+	if !ok {
+		client.addReplyError("The ID specified in XADD is equal or smaller than the target stream top item")
+		return
+	}
+	s.Append(id, client.argv[fieldpos:])
+	client.addReplyStreamID(id)
+	client.svr.dirty++
+	// propagate the ID that was generated, not "*"
+	client.argv[idpos] = []byte(id.String())
+
+	if args.trimStrategy != trimStrategyNone {
+		streamTrim(s, &args)
+	}
+	// clients blocked in XREAD wait on keys that already exist
+	db.signalKeyAsReady(key)
+}
+
+// xrangeGenericCommand XRANGE key start end [COUNT count], XREVRANGE
+// takes end before start
+func xrangeGenericCommand(client *RedisClient, rev bool) {
+	startArg, endArg := client.argv[2], client.argv[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, end, ok := streamParseRangeOrReply(client, startArg, endArg)
+	if !ok {
+		return
+	}
+
+	count := int64(-1)
+	for j := 4; j < len(client.argv); j++ {
+		additional := len(client.argv) - j - 1
+		if strings.EqualFold(string(client.argv[j]), "count") && additional >= 1 {
+			if count, ok = client.getLongLongOrReply(client.argv[j+1], ""); !ok {
+				return
+			}
+			if count < 0 {
+				count = 0
+			}
+			j++
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	o, ok := lookupStreamOrReply(client, client.argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if count == 0 {
+		client.addReply(shared.nullmultibulk)
+		return
+	}
+	if count == -1 {
+		count = 0
+	}
+	client.addReplyStreamEntries(streamRange(o.Ptr.(*stream), start, end, count, rev))
+}
+
+func xrangeCommand(client *RedisClient) {
+	xrangeGenericCommand(client, false)
+}
+
+func xrevrangeCommand(client *RedisClient) {
+	xrangeGenericCommand(client, true)
+}
+
+// xlenCommand XLEN key
+func xlenCommand(client *RedisClient) {
+	o, ok := lookupStreamOrReply(client, client.argv[1], false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	client.addReplyLongLong(int64(o.Ptr.(*stream).Len()))
+}
+
+// xdelCommand XDEL key id [id ...]
+func xdelCommand(client *RedisClient) {
+	o, ok := lookupStreamOrReply(client, client.argv[1], true)
+	if !ok {
+		return
+	}
+	// parse every ID first, so the command is executed all or nothing
+	ids := make([]core.StreamID, 0, len(client.argv)-2)
+	for _, arg := range client.argv[2:] {
+		id, ok := streamParseStrictIDOrReply(client, arg, 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+
+	s := o.Ptr.(*stream)
+	var deleted int64
+	for _, id := range ids {
+		if s.Delete(id) {
+			deleted++
+		}
+	}
+	client.svr.dirty += deleted
+	client.addReplyLongLong(deleted)
+}
+
+// xtrimCommand XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count]
+func xtrimCommand(client *RedisClient) {
+	o, ok := lookupStreamOrReply(client, client.argv[1], true)
+	if !ok {
+		return
+	}
+	var args streamAddTrimArgs
+	if streamParseAddOrTrimArgsOrReply(client, &args, false) < 0 {
+		return
+	}
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	deleted := streamTrim(o.Ptr.(*stream), &args)
+	client.svr.dirty += deleted
+	client.addReplyLongLong(deleted)
+}
+
+// streamReadResult the entries read from a stream by XREAD
+type streamReadResult struct {
+	key     []byte
+	entries []*core.StreamEntry
+}
+
+func (client *RedisClient) addReplyStreamReadResults(results []streamReadResult) {
+	client.addReplyMultiBulkLen(len(results))
+	for _, r := range results {
+		client.addReplyMultiBulkLen(2)
+		client.addReplyBulk(r.key)
+		client.addReplyStreamEntries(r.entries)
+	}
+}
+
+// xreadGenericCommand XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...]
+// id [id ...] and XREADGROUP GROUP group consumer [COUNT count] [BLOCK ms]
+// [NOACK] STREAMS key [key ...] id [id ...]
+func xreadGenericCommand(client *RedisClient, xreadgroup bool) {
+	argv := client.argv
+	block := false
+	var timeout, count int64
+	var groupname, consumername []byte
+	noack := false
+	streamsArg, streamsCount := 0, 0
+
+	cmdname := "xread"
+	symbol := '$'
+	if xreadgroup {
+		cmdname, symbol = "xreadgroup", '>'
+	}
+	for i := 1; i < len(argv) && streamsArg == 0; i++ {
+		moreargs := len(argv) - i - 1
+		opt := strings.ToLower(string(argv[i]))
+		switch {
+		case opt == "block" && moreargs > 0:
+			i++
+			t, ok := getTimeoutMsOrReply(client, argv[i])
+			if !ok {
+				return
+			}
+			block, timeout = true, t
+		case opt == "count" && moreargs > 0:
+			i++
+			c, ok := client.getLongLongOrReply(argv[i], "")
+			if !ok {
+				return
+			}
+			if c < 0 {
+				c = 0
+			}
+			count = c
+		case opt == "streams" && moreargs > 0:
+			streamsArg = i + 1
+			streamsCount = len(argv) - streamsArg
+			if streamsCount%2 != 0 {
+				client.addReplyErrorFormat("Unbalanced '%s' list of streams: for each stream key an ID or '%c' must be specified.", cmdname, symbol)
+				return
+			}
+			streamsCount /= 2
+		case opt == "group" && moreargs >= 2:
+			if !xreadgroup {
+				client.addReplyError("The GROUP option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			groupname, consumername = argv[i+1], argv[i+2]
+			i += 2
+		case opt == "noack":
+			if !xreadgroup {
+				client.addReplyError("The NOACK option is only supported by XREADGROUP. You called XREAD instead.")
+				return
+			}
+			noack = true
+		default:
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+	// STREAMS is mandatory
+	if streamsArg == 0 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+	if xreadgroup && groupname == nil {
+		client.addReplyError("Missing GROUP option for XREADGROUP")
+		return
+	}
+
+	// parse the IDs and resolve the groups
+	db := client.db
+	keys := argv[streamsArg : streamsArg+streamsCount]
+	ids := make([]core.StreamID, streamsCount)
+	var groups []*streamCG
+	if xreadgroup {
+		groups = make([]*streamCG, streamsCount)
+	}
+	for i, key := range keys {
+		arg := argv[streamsArg+streamsCount+i]
+		// XREADGROUP modifies the groups
+		o, ok := lookupStreamOrReply(client, key, xreadgroup)
+		if !ok {
+			return
+		}
+		if xreadgroup {
+			var group *streamCG
+			if o != nil {
+				group = o.Ptr.(*stream).lookupCG(groupname)
+			}
+			if group == nil {
+				client.addReplyErrorFormat("-NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, groupname)
+				return
+			}
+			groups[i] = group
+		}
+
+		switch string(arg) {
+		case "$":
+			if xreadgroup {
+				client.addReplyError("The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.")
+				return
+			}
+			if o != nil {
+				ids[i] = o.Ptr.(*stream).LastID
+			}
+		case ">":
+			if !xreadgroup {
+				client.addReplyError("The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.")
+				return
+			}
+			// the greatest ID stands for ">", the actual ID is the last
+			// delivered one of the group at the time the client is served
+			ids[i] = core.StreamIDMax
+		default:
+			id, ok := streamParseStrictIDOrReply(client, arg, 0, nil)
+			if !ok {
+				return
+			}
+			ids[i] = id
+		}
+	}
+
+	// XREADGROUP propagates the changes to the groups itself, replaying
+	// it would depend on the time and on the consumer PELs
+	if xreadgroup {
+		client.flags |= constant.REDIS_PREVENT_PROP
+	}
+
+	// try to serve the client synchronously
+	var results []streamReadResult
+	for i, key := range keys {
+		var o *RedisObject
+		if xreadgroup {
+			o = db.lookupKeyWrite(key)
+		} else {
+			o = db.lookupKeyRead(key)
+		}
+		if o == nil {
+			continue
+		}
+		s := o.Ptr.(*stream)
+		gt := ids[i] // entries must have an ID greater than this
+		serve, history := false, false
+		var consumer *streamConsumer
+		var lastID core.StreamID // last delivered ID of the group before the read
+		if xreadgroup {
+			lastID = groups[i].lastID
+			if gt != core.StreamIDMax {
+				// any ID but ">" reads the history of the consumer
+				serve, history = true, true
+			} else if last := s.Last(); last != nil && last.ID.Compare(groups[i].lastID) > 0 {
+				serve = true
+				gt = groups[i].lastID
+			}
+			consumer = streamTouchConsumerPropagate(client, key, groups[i], consumername)
+		} else if last := s.Last(); last != nil && last.ID.Compare(gt) > 0 {
+			serve = true
+		}
+		if !serve {
+			continue
+		}
+
+		start, _ := gt.Incr()
+		var entries []*core.StreamEntry
+		if history {
+			entries = streamReadConsumerPEL(s, consumer, start, count)
+		} else if xreadgroup {
+			entries = streamDeliverToGroup(s, groups[i], consumer, start, count, noack)
+		} else {
+			entries = streamRange(s, start, core.StreamIDMax, count, false)
+		}
+		results = append(results, streamReadResult{key: key, entries: entries})
+		if xreadgroup {
+			streamPropagateGroupRead(client, key, groups[i], entries, lastID)
+			client.svr.dirty++
+		}
+	}
+	if len(results) > 0 {
+		client.addReplyStreamReadResults(results)
+		return
+	}
+
+	if block {
+		client.blockForKeys(constant.REDIS_STREAM, keys, timeout, nil, 0, 0)
+		bpop := &client.bpop
+		bpop.streamIDs = make(map[string]core.StreamID, len(keys))
+		for i, key := range keys {
+			// with a duplicated key the first ID wins
+			if _, ok := bpop.streamIDs[string(key)]; !ok {
+				bpop.streamIDs[string(key)] = ids[i]
+			}
+		}
+		bpop.xreadCount = count
+		bpop.xreadGroup = groupname
+		bpop.xreadConsumer = consumername
+		bpop.xreadNoAck = noack
+		return
+	}
+
+	// no BLOCK option nor any stream to serve, reply like a timeout
+	client.addReply(shared.nullmultibulk)
+}
+
+func xreadCommand(client *RedisClient) {
+	xreadGenericCommand(client, false)
+}
+
+func xreadgroupCommand(client *RedisClient) {
+	xreadGenericCommand(client, true)
+}
+
+// serveClientBlockedOnStream serve a client blocked in XREAD or XREADGROUP
+// if the stream has entries after the ID it waits for
+func serveClientBlockedOnStream(receiver *RedisClient, key []byte, o *RedisObject) {
+	s := o.Ptr.(*stream)
+	bpop := &receiver.bpop
+	gt := bpop.streamIDs[string(key)]
+
+	var group *streamCG
+	if bpop.xreadGroup != nil {
+		group = s.lookupCG(bpop.xreadGroup)
+		if group == nil {
+			receiver.addReplyError("-NOGROUP the consumer group this client was blocked on no longer exists")
+			receiver.svr.unblockClient(receiver)
+			return
+		}
+		gt = group.lastID
+	}
+	last := s.Last()
+	if last == nil || last.ID.Compare(gt) <= 0 {
+		return
+	}
+
+	start, _ := gt.Incr()
+	var entries []*core.StreamEntry
+	if group != nil {
+		consumer := streamTouchConsumerPropagate(receiver, key, group, bpop.xreadConsumer)
+		entries = streamDeliverToGroup(s, group, consumer, start, bpop.xreadCount, bpop.xreadNoAck)
+		streamPropagateGroupRead(receiver, key, group, entries, gt)
+		receiver.svr.dirty++
+	} else {
+		entries = streamRange(s, start, core.StreamIDMax, bpop.xreadCount, false)
+	}
+	receiver.addReplyStreamReadResults([]streamReadResult{{key: key, entries: entries}})
+	receiver.svr.unblockClient(receiver)
+}
+
+// lookupCGOrReply return the stream at key and its group, replying with
+// a NOGROUP error when any of them is missing. write is true for the
+// commands modifying the group.
+func lookupCGOrReply(client *RedisClient, key, groupname []byte, write bool) (*stream, *streamCG, bool) {
+	o, ok := lookupStreamOrReply(client, key, write)
+	if !ok {
+		return nil, nil, false
+	}
+	var group *streamCG
+	if o != nil {
+		group = o.Ptr.(*stream).lookupCG(groupname)
+	}
+	if group == nil {
+		client.addReplyErrorFormat("-NOGROUP No such key '%s' or consumer group '%s'", key, groupname)
+		return nil, nil, false
+	}
+	return o.Ptr.(*stream), group, true
+}
+
+// xgroupCommand XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n]
+// XGROUP SETID key group id|$ [ENTRIESREAD n]
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func xgroupCommand(client *RedisClient) {
+	argv := client.argv
+	opt := strings.ToLower(string(argv[1]))
+	if len(argv) == 2 && opt == "help" {
+		addReplyHelp(client, "XGROUP", []string{
+			"CREATE <key> <groupname> <id|$> [option]",
+			"    Create a new consumer group. Options are:",
+			"    * MKSTREAM",
+			"      Create the empty stream if it does not exist.",
+			"    * ENTRIESREAD entries_read",
+			"      Set the group's entries_read counter (internal use).",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"    Create a new consumer in the specified group.",
+			"DELCONSUMER <key> <groupname> <consumer>",
+			"    Remove the specified consumer.",
+			"DESTROY <key> <groupname>",
+			"    Remove the specified group.",
+			"SETID <key> <groupname> <id|$> [ENTRIESREAD entries_read]",
+			"    Set the current group ID and entries_read counter.",
+		})
+		return
+	}
+	if len(argv) < 4 {
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+
+	db := client.db
+	key, grpname := argv[2], argv[3]
+	mkstream := false
+	entriesRead := streamInvalidEntriesRead
+	if opt == "create" || opt == "setid" {
+		for i := 5; i < len(argv); {
+			arg := strings.ToLower(string(argv[i]))
+			if opt == "create" && arg == "mkstream" {
+				mkstream = true
+				i++
+			} else if arg == "entriesread" && i+1 < len(argv) {
+				v, ok := client.getLongLongOrReply(argv[i+1], "")
+				if !ok {
+					return
+				}
+				if v < 0 && v != streamInvalidEntriesRead {
+					client.addReplyError("value for ENTRIESREAD must be positive or -1")
+					return
+				}
+				entriesRead = v
+				i += 2
+			} else {
+				addReplySubcommandSyntaxError(client)
+				return
+			}
+		}
+	}
+
+	o, ok := lookupStreamOrReply(client, key, true)
+	if !ok {
+		return
+	}
+	var s *stream
+	var cg *streamCG
+	if o != nil {
+		s = o.Ptr.(*stream)
+		cg = s.lookupCG(grpname)
+	}
+	if !mkstream {
+		if s == nil {
+			client.addReplyError("The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			return
+		}
+		if cg == nil && (opt == "setid" || opt == "createconsumer" || opt == "delconsumer") {
+			client.addReplyErrorFormat("-NOGROUP No such consumer group '%s' for key name '%s'", grpname, key)
+			return
+		}
+	}
+
+	switch {
+	case opt == "create" && len(argv) >= 5 && len(argv) <= 8:
+		var id core.StreamID
+		if string(argv[4]) == "$" {
+			if s != nil {
+				id = s.LastID
+			}
+			if entriesRead == streamInvalidEntriesRead && s != nil {
+				entriesRead = int64(s.EntriesAdded)
+			}
+		} else if id, ok = streamParseStrictIDOrReply(client, argv[4], 0, nil); !ok {
+			return
+		}
+		// MKSTREAM is handled now that the command can no longer fail
+		if s == nil {
+			o = createStreamObject()
+			db.dbAdd(key, o)
+			s = o.Ptr.(*stream)
+		}
+		if s.createCG(grpname, id, entriesRead) == nil {
+			client.addReplyError("-BUSYGROUP Consumer Group name already exists")
+			return
+		}
+		client.addReply(shared.ok)
+		client.svr.dirty++
+	case opt == "setid" && (len(argv) == 5 || len(argv) == 7):
+		var id core.StreamID
+		if string(argv[4]) == "$" {
+			id = s.LastID
+		} else if id, ok = streamParseIDOrReply(client, argv[4], 0); !ok {
+			return
+		}
+		cg.lastID = id
+		cg.entriesRead = entriesRead
+		client.addReply(shared.ok)
+		client.svr.dirty++
+	case opt == "destroy" && len(argv) == 4:
+		if cg == nil {
+			client.addReply(shared.czero)
+			return
+		}
+		delete(s.cgroups, cg.name)
+		client.addReply(shared.cone)
+		client.svr.dirty++
+		// clients blocked in XREADGROUP on this group get a NOGROUP error
+		db.signalKeyAsReady(key)
+	case opt == "createconsumer" && len(argv) == 5:
+		if cg.createConsumer(argv[4]) == nil {
+			client.addReply(shared.czero)
+			return
+		}
+		client.addReply(shared.cone)
+		client.svr.dirty++
+	case opt == "delconsumer" && len(argv) == 5:
+		var pending int64
+		if consumer := cg.lookupConsumer(argv[4]); consumer != nil {
+			pending = int64(consumer.pel.len())
+			cg.delConsumer(consumer)
+			client.svr.dirty++
+		}
+		client.addReplyLongLong(pending)
+	default:
+		addReplySubcommandSyntaxError(client)
+	}
+}
+
+// xackCommand XACK key group id [id ...]
+func xackCommand(client *RedisClient) {
+	o, ok := lookupStreamOrReply(client, client.argv[1], true)
+	if !ok {
+		return
+	}
+	var group *streamCG
+	if o != nil {
+		group = o.Ptr.(*stream).lookupCG(client.argv[2])
+	}
+	// parse every ID first, the command can't fail once some entries
+	// are acknowledged
+	ids := make([]core.StreamID, 0, len(client.argv)-3)
+	for _, arg := range client.argv[3:] {
+		id, ok := streamParseStrictIDOrReply(client, arg, 0, nil)
+		if !ok {
+			return
+		}
+		ids = append(ids, id)
+	}
+	if group == nil {
+		client.addReply(shared.czero)
+		return
+	}
+
+	var acknowledged int64
+	for _, id := range ids {
+		nack := group.pel.get(id)
+		if nack == nil {
+			continue
+		}
+		group.pel.remove(id)
+		nack.consumer.pel.remove(id)
+		acknowledged++
+	}
+	client.svr.dirty += acknowledged
+	client.addReplyLongLong(acknowledged)
+}
+
+// xpendingCommand XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func xpendingCommand(client *RedisClient) {
+	argv := client.argv
+	justinfo := len(argv) == 3
+	if !justinfo && (len(argv) < 6 || len(argv) > 9) {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	// parse the range first, to report syntax errors before other errors
+	var minidle, count int64
+	var start, end core.StreamID
+	var consumername []byte
+	if !justinfo {
+		ok := false
+		startidx := 3
+		if strings.EqualFold(string(argv[3]), "idle") {
+			if minidle, ok = client.getLongLongOrReply(argv[4], ""); !ok {
+				return
+			}
+			// IDLE needs start, end and count too
+			if len(argv) < 8 {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			startidx += 2
+		} else if len(argv) > 7 {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+		if count, ok = client.getLongLongOrReply(argv[startidx+2], ""); !ok {
+			return
+		}
+		if count < 0 {
+			count = 0
+		}
+		if start, end, ok = streamParseRangeOrReply(client, argv[startidx], argv[startidx+1]); !ok {
+			return
+		}
+		if startidx+3 < len(argv) {
+			consumername = argv[startidx+3]
+		}
+	}
+
+	_, group, ok := lookupCGOrReply(client, argv[1], argv[2], false)
+	if !ok {
+		return
+	}
+
+	if justinfo {
+		client.addReplyMultiBulkLen(4)
+		client.addReplyLongLong(int64(group.pel.len()))
+		if group.pel.len() == 0 {
+			client.addReply(shared.nullbulk)
+			client.addReply(shared.nullbulk)
+			client.addReply(shared.nullmultibulk)
+			return
+		}
+		client.addReplyStreamID(group.pel.ids[0])
+		client.addReplyStreamID(group.pel.ids[group.pel.len()-1])
+		var pending []*streamConsumer
+		for _, consumer := range group.sortedConsumers() {
+			if consumer.pel.len() > 0 {
+				pending = append(pending, consumer)
+			}
+		}
+		client.addReplyMultiBulkLen(len(pending))
+		for _, consumer := range pending {
+			client.addReplyMultiBulkLen(2)
+			client.addReplyBulkString(consumer.name)
+			client.addReplyBulkLongLong(int64(consumer.pel.len()))
+		}
+		return
+	}
+
+	pel := group.pel
+	if consumername != nil {
+		consumer := group.lookupConsumer(consumername)
+		// an unknown consumer has nothing pending
+		if consumer == nil {
+			client.addReply(shared.emptymultibulk)
+			return
+		}
+		pel = consumer.pel
+	}
+	now := time.Now().UnixMilli()
+	type pendingEntry struct {
+		id   core.StreamID
+		nack *streamNACK
+	}
+	var entries []pendingEntry
+	for i := pel.seek(start); i < pel.len() && int64(len(entries)) < count; i++ {
+		id := pel.ids[i]
+		if id.Compare(end) > 0 {
+			break
+		}
+		nack := pel.nacks[id]
+		if minidle > 0 && now-nack.deliveryTime < minidle {
+			continue
+		}
+		entries = append(entries, pendingEntry{id: id, nack: nack})
+	}
+	client.addReplyMultiBulkLen(len(entries))
+	for _, e := range entries {
+		idle := now - e.nack.deliveryTime
+		if idle < 0 {
+			idle = 0
+		}
+		client.addReplyMultiBulkLen(4)
+		client.addReplyStreamID(e.id)
+		client.addReplyBulkString(e.nack.consumer.name)
+		client.addReplyLongLong(idle)
+		client.addReplyLongLong(e.nack.deliveryCount)
+	}
+}
+
+// streamClaim make the NACK of id pending for consumer
+func streamClaim(group *streamCG, consumer *streamConsumer, id core.StreamID, nack *streamNACK) {
+	if nack.consumer != consumer {
+		// the consumer is nil for the NACKs created by XCLAIM FORCE
+		if nack.consumer != nil {
+			nack.consumer.pel.remove(id)
+		}
+		consumer.pel.insert(id, nack)
+		nack.consumer = consumer
+	}
+}
+
+// streamDropDeletedNACK remove the NACK of an entry no longer in the stream
+func streamDropDeletedNACK(group *streamCG, id core.StreamID, nack *streamNACK) {
+	group.pel.remove(id)
+	nack.consumer.pel.remove(id)
+}
+
+// xclaimCommand XCLAIM key group consumer min-idle-time id [id ...]
+// [IDLE ms] [TIME unix-time-ms] [RETRYCOUNT count] [FORCE] [JUSTID]
+// [LASTID id]
+func xclaimCommand(client *RedisClient) {
+	argv := client.argv
+	s, group, ok := lookupCGOrReply(client, argv[1], argv[2], true)
+	if !ok {
+		return
+	}
+	minidle, ok := client.getLongLongOrReply(argv[4], "Invalid min-idle-time argument for XCLAIM")
+	if !ok {
+		return
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+
+	// the IDs come first, parse them so the command is all or nothing.
+	// The first argument that is not an ID starts the options.
+	var ids []core.StreamID
+	j := 5
+	for ; j < len(argv); j++ {
+		id, ok := streamParseStrictIDOrReply(nil, argv[j], 0, nil)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	now := time.Now().UnixMilli()
+	deliverytime := int64(-1)
+	retrycount := int64(-1)
+	force, justid := false, false
+	var lastID core.StreamID
+	for ; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		opt := strings.ToLower(string(argv[j]))
+		switch {
+		case opt == "force":
+			force = true
+		case opt == "justid":
+			justid = true
+		case opt == "idle" && moreargs > 0:
+			j++
+			idle, ok := client.getLongLongOrReply(argv[j], "Invalid IDLE option argument for XCLAIM")
+			if !ok {
+				return
+			}
+			deliverytime = now - idle
+		case opt == "time" && moreargs > 0:
+			j++
+			if deliverytime, ok = client.getLongLongOrReply(argv[j], "Invalid TIME option argument for XCLAIM"); !ok {
+				return
+			}
+		case opt == "retrycount" && moreargs > 0:
+			j++
+			if retrycount, ok = client.getLongLongOrReply(argv[j], "Invalid RETRYCOUNT option argument for XCLAIM"); !ok {
+				return
+			}
+		case opt == "lastid" && moreargs > 0:
+			j++
+			if lastID, ok = streamParseStrictIDOrReply(client, argv[j], 0, nil); !ok {
+				return
+			}
+		default:
+			client.addReplyErrorFormat("Unrecognized XCLAIM option '%s'", argv[j])
+			return
+		}
+	}
+
+	// the claims are propagated as XCLAIM forcing the final state of the
+	// NACKs, the idle times of the replay would differ
+	client.flags |= constant.REDIS_PREVENT_PROP
+	if lastID.Compare(group.lastID) > 0 {
+		group.lastID = lastID
+		streamPropagateGroupID(client, argv[1], group)
+		client.svr.dirty++
+	}
+	// a bogus delivery time is not an error, clients may compute it
+	// with a clock a bit in the future
+	if deliverytime < 0 || deliverytime > now {
+		deliverytime = now
+	}
+
+	consumer := streamTouchConsumerPropagate(client, argv[1], group, argv[3])
+	var claimed []*core.StreamEntry
+	for _, id := range ids {
+		nack := group.pel.get(id)
+		e := s.Lookup(id)
+		if e == nil {
+			// the entry was deleted, clear it from the PEL
+			if nack != nil {
+				streamPropagateXCLAIM(client, argv[1], group, id, nack)
+				streamDropDeletedNACK(group, id, nack)
+				client.svr.dirty++
+			}
+			continue
+		}
+		// FORCE creates the NACK of an entry that is not pending, so
+		// XCLAIM can also fill the PEL
+		if force && nack == nil {
+			nack = &streamNACK{}
+			group.pel.insert(id, nack)
+		}
+		if nack == nil {
+			continue
+		}
+		// a NACK just created by FORCE has no consumer and ignores minidle
+		if nack.consumer != nil && minidle > 0 && now-nack.deliveryTime < minidle {
+			continue
+		}
+		streamClaim(group, consumer, id, nack)
+		nack.deliveryTime = deliverytime
+		if retrycount >= 0 {
+			nack.deliveryCount = retrycount
+		} else if !justid {
+			nack.deliveryCount++
+		}
+		claimed = append(claimed, e)
+		consumer.activeTime = now
+		streamPropagateXCLAIM(client, argv[1], group, id, nack)
+		client.svr.dirty++
+	}
+
+	client.addReplyMultiBulkLen(len(claimed))
+	for _, e := range claimed {
+		if justid {
+			client.addReplyStreamID(e.ID)
+		} else {
+			client.addReplyStreamEntry(e)
+		}
+	}
+}
+
+// xautoclaimCommand XAUTOCLAIM key group consumer min-idle-time start
+// [COUNT count] [JUSTID]
+func xautoclaimCommand(client *RedisClient) {
+	argv := client.argv
+	minidle, ok := client.getLongLongOrReply(argv[4], "Invalid min-idle-time argument for XAUTOCLAIM")
+	if !ok {
+		return
+	}
+	if minidle < 0 {
+		minidle = 0
+	}
+	start, startex, ok := streamParseIntervalIDOrReply(client, argv[5], 0)
+	if !ok {
+		return
+	}
+	if startex {
+		if start, ok = start.Incr(); !ok {
+			client.addReplyError("invalid start ID for the interval")
+			return
+		}
+	}
+
+	// every claimed entry costs at most attemptsFactor PEL lookups
+	const attemptsFactor = 10
+	count := int64(100)
+	justid := false
+	for j := 6; j < len(argv); j++ {
+		moreargs := len(argv) - 1 - j
+		opt := strings.ToLower(string(argv[j]))
+		if opt == "count" && moreargs > 0 {
+			c, ok := core.String2ll(argv[j+1])
+			if !ok || c < 1 || c > math.MaxInt64/attemptsFactor {
+				client.addReplyError("COUNT must be > 0")
+				return
+			}
+			count = c
+			j++
+		} else if opt == "justid" {
+			justid = true
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	s, group, ok := lookupCGOrReply(client, argv[1], argv[2], true)
+	if !ok {
+		return
+	}
+
+	// propagated as XCLAIM like XCLAIM itself
+	client.flags |= constant.REDIS_PREVENT_PROP
+	attempts := count * attemptsFactor
+	now := time.Now().UnixMilli()
+	consumer := streamTouchConsumerPropagate(client, argv[1], group, argv[3])
+	var claimed []*core.StreamEntry
+	var deleted []core.StreamID
+	i := group.pel.seek(start)
+	for ; attempts > 0 && count > 0 && i < group.pel.len(); attempts-- {
+		id := group.pel.ids[i]
+		nack := group.pel.nacks[id]
+		e := s.Lookup(id)
+		if e == nil {
+			// the entry was deleted, clear it from the PEL
+			streamPropagateXCLAIM(client, argv[1], group, id, nack)
+			streamDropDeletedNACK(group, id, nack)
+			deleted = append(deleted, id)
+			client.svr.dirty++
+			// count limits the size of the reply
+			count--
+			continue
+		}
+		i++
+		if minidle > 0 && now-nack.deliveryTime < minidle {
+			continue
+		}
+		streamClaim(group, consumer, id, nack)
+		nack.deliveryTime = now
+		if !justid {
+			nack.deliveryCount++
+		}
+		claimed = append(claimed, e)
+		count--
+		streamPropagateXCLAIM(client, argv[1], group, id, nack)
+		client.svr.dirty++
+	}
+	if len(claimed) > 0 {
+		consumer.activeTime = now
+	}
+
+	// the next pending entry is the cursor of the next call, 0-0 when
+	// the whole PEL was scanned
+	var next core.StreamID
+	if i < group.pel.len() {
+		next = group.pel.ids[i]
+	}
+	client.addReplyMultiBulkLen(3)
+	client.addReplyStreamID(next)
+	client.addReplyMultiBulkLen(len(claimed))
+	for _, e := range claimed {
+		if justid {
+			client.addReplyStreamID(e.ID)
+		} else {
+			client.addReplyStreamEntry(e)
+		}
+	}
+	client.addReplyMultiBulkLen(len(deleted))
+	for _, id := range deleted {
+		client.addReplyStreamID(id)
+	}
+}
+
+// xinfoCommand XINFO CONSUMERS key group
+// XINFO GROUPS key
+// XINFO STREAM key [FULL [COUNT count]]
+func xinfoCommand(client *RedisClient) {
+	argv := client.argv
+	opt := strings.ToLower(string(argv[1]))
+	if opt == "help" {
+		if len(argv) != 2 {
+			addReplySubcommandSyntaxError(client)
+			return
+		}
+		addReplyHelp(client, "XINFO", []string{
+			"CONSUMERS <key> <groupname>",
+			"    Show consumers of <groupname>.",
+			"GROUPS <key>",
+			"    Show the stream consumer groups.",
+			"STREAM <key> [FULL [COUNT <count>]",
+			"    Show information about the stream.",
+		})
+		return
+	}
+	if len(argv) < 3 {
+		addReplySubcommandSyntaxError(client)
+		return
+	}
+
+	key := argv[2]
+	o, ok := lookupStreamOrReply(client, key, false)
+	if !ok {
+		return
+	}
+	if o == nil {
+		client.addReplyError(shared.nokeyerr)
+		return
+	}
+	s := o.Ptr.(*stream)
+	now := time.Now().UnixMilli()
+
+	switch {
+	case opt == "consumers" && len(argv) == 4:
+		cg := s.lookupCG(argv[3])
+		if cg == nil {
+			client.addReplyErrorFormat("-NOGROUP No such consumer group '%s' for key name '%s'", argv[3], key)
+			return
+		}
+		consumers := cg.sortedConsumers()
+		client.addReplyMultiBulkLen(len(consumers))
+		for _, consumer := range consumers {
+			inactive := int64(-1)
+			if consumer.activeTime != -1 {
+				inactive = now - consumer.activeTime
+			}
+			client.addReplyMultiBulkLen(8)
+			client.addReplyBulkString("name")
+			client.addReplyBulkString(consumer.name)
+			client.addReplyBulkString("pending")
+			client.addReplyLongLong(int64(consumer.pel.len()))
+			client.addReplyBulkString("idle")
+			client.addReplyLongLong(now - consumer.seenTime)
+			client.addReplyBulkString("inactive")
+			client.addReplyLongLong(inactive)
+		}
+	case opt == "groups" && len(argv) == 3:
+		cgs := s.sortedCGs()
+		client.addReplyMultiBulkLen(len(cgs))
+		for _, cg := range cgs {
+			client.addReplyMultiBulkLen(12)
+			client.addReplyBulkString("name")
+			client.addReplyBulkString(cg.name)
+			client.addReplyBulkString("consumers")
+			client.addReplyLongLong(int64(len(cg.consumers)))
+			client.addReplyBulkString("pending")
+			client.addReplyLongLong(int64(cg.pel.len()))
+			client.addReplyBulkString("last-delivered-id")
+			client.addReplyStreamID(cg.lastID)
+			addReplyStreamCGCounters(client, s, cg)
+		}
+	case opt == "stream":
+		full := false
+		count := int64(10)
+		if len(argv) > 3 {
+			if !strings.EqualFold(string(argv[3]), "full") || (len(argv) != 4 && len(argv) != 6) {
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+			full = true
+			if len(argv) == 6 {
+				if !strings.EqualFold(string(argv[4]), "count") {
+					client.addReplyError(shared.syntaxerr)
+					return
+				}
+				if count, ok = client.getLongLongOrReply(argv[5], ""); !ok {
+					return
+				}
+				if count < 0 {
+					count = 10
+				}
+			}
+		}
+		xinfoReplyWithStreamInfo(client, s, full, count)
+	default:
+		addReplySubcommandSyntaxError(client)
+	}
+}
+
+// addReplyStreamCGCounters reply with the entries-read and lag fields of
+// a group, null when unknown
+func addReplyStreamCGCounters(client *RedisClient, s *stream, cg *streamCG) {
+	client.addReplyBulkString("entries-read")
+	if cg.entriesRead != streamInvalidEntriesRead {
+		client.addReplyLongLong(cg.entriesRead)
+	} else {
+		client.addReply(shared.nullbulk)
+	}
+	client.addReplyBulkString("lag")
+	if lag, ok := streamCGLag(s, cg); ok {
+		client.addReplyLongLong(lag)
+	} else {
+		client.addReply(shared.nullbulk)
+	}
+}
+
+// xinfoReplyWithStreamInfo reply to XINFO STREAM. The entries live in a
+// single slice, so the radix tree fields of redis are not reported.
+// FULL reports up to count entries, and pending entries per group and
+// consumer, 0 meaning all of them.
+func xinfoReplyWithStreamInfo(client *RedisClient, s *stream, full bool, count int64) {
+	fields := 8
+	if full {
+		fields = 7
+	}
+	client.addReplyMultiBulkLen(fields * 2)
+	client.addReplyBulkString("length")
+	client.addReplyLongLong(int64(s.Len()))
+	client.addReplyBulkString("last-generated-id")
+	client.addReplyStreamID(s.LastID)
+	client.addReplyBulkString("max-deleted-entry-id")
+	client.addReplyStreamID(s.MaxDeletedEntryID)
+	client.addReplyBulkString("entries-added")
+	client.addReplyLongLong(int64(s.EntriesAdded))
+	client.addReplyBulkString("recorded-first-entry-id")
+	client.addReplyStreamID(s.FirstID)
+
+	if !full {
+		client.addReplyBulkString("groups")
+		client.addReplyLongLong(int64(len(s.cgroups)))
+		for _, name := range []string{"first-entry", "last-entry"} {
+			client.addReplyBulkString(name)
+			e := s.First()
+			if name == "last-entry" {
+				e = s.Last()
+			}
+			if e == nil {
+				client.addReply(shared.nullbulk)
+			} else {
+				client.addReplyStreamEntry(e)
+			}
+		}
+		return
+	}
+
+	client.addReplyBulkString("entries")
+	client.addReplyStreamEntries(streamRange(s, core.StreamIDMin, core.StreamIDMax, count, false))
+
+	limit := func(n int) int {
+		if count > 0 && int64(n) > count {
+			return int(count)
+		}
+		return n
+	}
+	cgs := s.sortedCGs()
+	client.addReplyBulkString("groups")
+	client.addReplyMultiBulkLen(len(cgs))
+	for _, cg := range cgs {
+		client.addReplyMultiBulkLen(14)
+		client.addReplyBulkString("name")
+		client.addReplyBulkString(cg.name)
+		client.addReplyBulkString("last-delivered-id")
+		client.addReplyStreamID(cg.lastID)
+		addReplyStreamCGCounters(client, s, cg)
+		client.addReplyBulkString("pel-count")
+		client.addReplyLongLong(int64(cg.pel.len()))
+		client.addReplyBulkString("pending")
+		n := limit(cg.pel.len())
+		client.addReplyMultiBulkLen(n)
+		for _, id := range cg.pel.ids[:n] {
+			nack := cg.pel.nacks[id]
+			client.addReplyMultiBulkLen(4)
+			client.addReplyStreamID(id)
+			client.addReplyBulkString(nack.consumer.name)
+			client.addReplyLongLong(nack.deliveryTime)
+			client.addReplyLongLong(nack.deliveryCount)
+		}
+
+		consumers := cg.sortedConsumers()
+		client.addReplyBulkString("consumers")
+		client.addReplyMultiBulkLen(len(consumers))
+		for _, consumer := range consumers {
+			client.addReplyMultiBulkLen(10)
+			client.addReplyBulkString("name")
+			client.addReplyBulkString(consumer.name)
+			client.addReplyBulkString("seen-time")
+			client.addReplyLongLong(consumer.seenTime)
+			client.addReplyBulkString("active-time")
+			client.addReplyLongLong(consumer.activeTime)
+			client.addReplyBulkString("pel-count")
+			client.addReplyLongLong(int64(consumer.pel.len()))
+			client.addReplyBulkString("pending")
+			n := limit(consumer.pel.len())
+			client.addReplyMultiBulkLen(n)
+			for _, id := range consumer.pel.ids[:n] {
+				nack := consumer.pel.nacks[id]
+				client.addReplyMultiBulkLen(3)
+				client.addReplyStreamID(id)
+				client.addReplyLongLong(nack.deliveryTime)
+				client.addReplyLongLong(nack.deliveryCount)
+			}
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+)
+
+// flags of SET and GETEX
+const (
+	objSetNX   = 1 << iota // set if key not exists
+	objSetXX               // set if key exists
+	objSetGet              // return the old value
+	objKeepTTL             // keep the existing TTL
+	objEX                  // expire in seconds
+	objPX                  // expire in milliseconds
+	objEXAT                // expire at unix time in seconds
+	objPXAT                // expire at unix time in milliseconds
+	objPersist             // remove the TTL (GETEX only)
+)
+
+// checkStringLength strings are limited to REDIS_PROTO_MAX_BULK_LEN bytes
+func (client *RedisClient) checkStringLength(size int64) bool {
+	if size > constant.REDIS_PROTO_MAX_BULK_LEN {
+		client.addReplyError("string exceeds maximum allowed size (proto-max-bulk-len)")
+		return false
+	}
+	return true
+}
+
+// dbUnshareStringValue make sure the string stored at key can be safely
+// modified in place: shared, integer encoded or snapshotted values are
+// replaced with a private raw copy. Return the object to modify.
+func (db *redisDb) dbUnshareStringValue(key []byte, o *RedisObject) *RedisObject {
+	if o.isShared() || o.Encoding != constant.REDIS_ENCODING_RAW || db.svr.inSnapshot(o) {
+		o = createStringObject(stringObjectBytes(o))
+		db.dbOverwrite(key, o)
+	}
+	return o
+}
+
+// parseExtendedStringArguments parse the options of SET (isSet) or GETEX.
+// Return the flags and the expire argument if any.
+func parseExtendedStringArguments(client *RedisClient, args [][]byte, isSet bool) (int, []byte, bool) {
+	flags := 0
+	var expire []byte
+	for j := 0; j < len(args); j++ {
+		opt := strings.ToLower(string(args[j]))
+		var next []byte
+		if j+1 < len(args) {
+			next = args[j+1]
+		}
+		switch {
+		case opt == "nx" && isSet && (flags&(objSetXX)) == 0:
+			flags |= objSetNX
+		case opt == "xx" && isSet && (flags&(objSetNX)) == 0:
+			flags |= objSetXX
+		case opt == "get" && isSet:
+			flags |= objSetGet
+		case opt == "keepttl" && isSet && (flags&(objPersist|objEX|objEXAT|objPX|objPXAT)) == 0:
+			flags |= objKeepTTL
+		case opt == "persist" && !isSet && (flags&(objEX|objEXAT|objPX|objPXAT|objKeepTTL)) == 0:
+			flags |= objPersist
+		case opt == "ex" && next != nil && (flags&(objKeepTTL|objPersist|objEXAT|objPX|objPXAT)) == 0:
+			flags |= objEX
+			expire = next
+			j++
+		case opt == "px" && next != nil && (flags&(objKeepTTL|objPersist|objEX|objEXAT|objPXAT)) == 0:
+			flags |= objPX
+			expire = next
+			j++
+		case opt == "exat" && next != nil && (flags&(objKeepTTL|objPersist|objEX|objPX|objPXAT)) == 0:
+			flags |= objEXAT
+			expire = next
+			j++
+		case opt == "pxat" && next != nil && (flags&(objKeepTTL|objPersist|objEX|objEXAT|objPX)) == 0:
+			flags |= objPXAT
+			expire = next
+			j++
+		default:
+			client.addReplyError(shared.syntaxerr)
+			return 0, nil, false
+		}
+	}
+	return flags, expire, true
+}
+
+// getExpireMillisecondsOrReply convert the expire argument to an absolute
+// unix time in milliseconds according to the EX/PX/EXAT/PXAT flag
+func getExpireMillisecondsOrReply(client *RedisClient, expire []byte, flags int) (int64, bool) {
+	when, ok := client.getLongLongOrReply(expire, "")
+	if !ok {
+		return 0, false
+	}
+	unitSeconds := (flags & (objEX | objEXAT)) > 0
+	if when <= 0 || (unitSeconds && when > math.MaxInt64/1000) {
+		client.addReplyErrorFormat("invalid expire time in '%s' command", client.cmd.Name)
+		return 0, false
+	}
+	if unitSeconds {
+		when *= 1000
+	}
+	if (flags & (objEX | objPX)) > 0 {
+		now := time.Now().UnixMilli()
+		if when > math.MaxInt64-now {
+			client.addReplyErrorFormat("invalid expire time in '%s' command", client.cmd.Name)
+			return 0, false
+		}
+		when += now
+	}
+	return when, true
+}
+
+// getGenericCommand reply with the string value of argv[1]. Return false
+// when the key holds another type.
+func getGenericCommand(client *RedisClient) bool {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReplyNullBulk()
+		return true
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return false
+	}
+	client.addReplyBulk(stringObjectBytes(o))
+	return true
+}
+
+// setGenericCommand implements SET and the SETNX/SETEX/PSETEX variants.
+// okReply and abortReply are sent when the value is set or not set because
+// of NX/XX, nil means the default reply.
+func setGenericCommand(client *RedisClient, flags int, key []byte, val *RedisObject, expire []byte, okReply, abortReply []byte) {
+	var when int64
+	if expire != nil {
+		var ok bool
+		if when, ok = getExpireMillisecondsOrReply(client, expire, flags); !ok {
+			return
+		}
+	}
+
+	if (flags & objSetGet) > 0 {
+		if !getGenericCommand(client) {
+			return
+		}
+	}
+
+	db := client.db
+	found := db.lookupKeyWrite(key) != nil
+	if ((flags&objSetNX) > 0 && found) || ((flags&objSetXX) > 0 && !found) {
+		if (flags & objSetGet) == 0 {
+			if abortReply != nil {
+				client.addReply(abortReply)
+			} else {
+				client.addReplyNullBulk()
+			}
+		}
+		return
+	}
+
+	db.setKey(key, val, (flags&objKeepTTL) > 0)
+	client.svr.dirty++
+	if expire != nil {
+		if client.svr.checkAlreadyExpired(when) {
+			// EXAT/PXAT in the past, the key is deleted right away
+			db.dbDelete(key)
+			client.rewriteCommandVector([]byte("DEL"), key)
+		} else {
+			db.setExpire(key, when)
+			// propagate the absolute time, so the key expires at the same
+			// time when the AOF is loaded
+			client.rewriteCommandVector([]byte("SET"), key, stringObjectBytes(val),
+				[]byte("PXAT"), strconv.AppendInt(nil, when, 10))
+		}
+	}
+
+	if (flags & objSetGet) == 0 {
+		if okReply != nil {
+			client.addReply(okReply)
+		} else {
+			client.addReply(shared.ok)
+		}
+	}
+}
+
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
+func setCommand(client *RedisClient) {
+	flags, expire, ok := parseExtendedStringArguments(client, client.argv[3:], true)
+	if !ok {
+		return
+	}
+	val := client.svr.tryObjectEncoding(createStringObject(client.argv[2]))
+	setGenericCommand(client, flags, client.argv[1], val, expire, nil, nil)
+}
+
+func setnxCommand(client *RedisClient) {
+	val := client.svr.tryObjectEncoding(createStringObject(client.argv[2]))
+	setGenericCommand(client, objSetNX, client.argv[1], val, nil, shared.cone, shared.czero)
+}
+
+func setexCommand(client *RedisClient) {
+	val := client.svr.tryObjectEncoding(createStringObject(client.argv[3]))
+	setGenericCommand(client, objEX, client.argv[1], val, client.argv[2], nil, nil)
+}
+
+func psetexCommand(client *RedisClient) {
+	val := client.svr.tryObjectEncoding(createStringObject(client.argv[3]))
+	setGenericCommand(client, objPX, client.argv[1], val, client.argv[2], nil, nil)
+}
+
+func getCommand(client *RedisClient) {
+	getGenericCommand(client)
+}
+
+func getsetCommand(client *RedisClient) {
+	if !getGenericCommand(client) {
+		return
+	}
+	val := client.svr.tryObjectEncoding(createStringObject(client.argv[2]))
+	client.db.setKey(client.argv[1], val, false)
+	client.svr.dirty++
+}
+
+func getdelCommand(client *RedisClient) {
+	if !getGenericCommand(client) {
+		return
+	}
+	if client.db.dbDelete(client.argv[1]) {
+		client.svr.dirty++
+	}
+}
+
+// GETEX key [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|PERSIST]
+func getexCommand(client *RedisClient) {
+	flags, expire, ok := parseExtendedStringArguments(client, client.argv[2:], false)
+	if !ok {
+		return
+	}
+
+	key := client.argv[1]
+	db := client.db
+	o := db.lookupKeyRead(key)
+	if o == nil {
+		client.addReplyNullBulk()
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+
+	var when int64
+	if expire != nil {
+		if when, ok = getExpireMillisecondsOrReply(client, expire, flags); !ok {
+			return
+		}
+	}
+
+	client.addReplyBulk(stringObjectBytes(o))
+
+	if expire != nil {
+		if client.svr.checkAlreadyExpired(when) {
+			db.dbDelete(key)
+			client.rewriteCommandVector([]byte("DEL"), key)
+		} else {
+			db.setExpire(key, when)
+			client.rewriteCommandVector([]byte("PEXPIREAT"), key, strconv.AppendInt(nil, when, 10))
+		}
+		client.svr.dirty++
+	} else if (flags & objPersist) > 0 {
+		if db.removeExpire(key) {
+			client.rewriteCommandVector([]byte("PERSIST"), key)
+			client.svr.dirty++
+		}
+	}
+}
+
+func mgetCommand(client *RedisClient) {
+	client.addReplyMultiBulkLen(len(client.argv) - 1)
+	for _, key := range client.argv[1:] {
+		o := client.db.lookupKeyRead(key)
+		if o == nil || o.Type != constant.REDIS_STRING {
+			client.addReplyNullBulk()
+		} else {
+			client.addReplyBulk(stringObjectBytes(o))
+		}
+	}
+}
+
+func msetGenericCommand(client *RedisClient, nx bool) {
+	if (len(client.argv) % 2) == 0 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", client.cmd.Name)
+		return
+	}
+
+	// handle the NX flag. The MSETNX semantic is to return zero and don't
+	// set anything if at least one key already exists.
+	db := client.db
+	if nx {
+		for j := 1; j < len(client.argv); j += 2 {
+			if db.lookupKeyWrite(client.argv[j]) != nil {
+				client.addReply(shared.czero)
+				return
+			}
+		}
+	}
+
+	for j := 1; j < len(client.argv); j += 2 {
+		val := client.svr.tryObjectEncoding(createStringObject(client.argv[j+1]))
+		db.setKey(client.argv[j], val, false)
+	}
+	client.svr.dirty += int64((len(client.argv) - 1) / 2)
+	if nx {
+		client.addReply(shared.cone)
+	} else {
+		client.addReply(shared.ok)
+	}
+}
+
+func msetCommand(client *RedisClient) {
+	msetGenericCommand(client, false)
+}
+
+func msetnxCommand(client *RedisClient) {
+	msetGenericCommand(client, true)
+}
+
+func appendCommand(client *RedisClient) {
+	key := client.argv[1]
+	db := client.db
+	var totlen int64
+
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		// create the key
+		o = client.svr.tryObjectEncoding(createStringObject(client.argv[2]))
+		db.dbAdd(key, o)
+		totlen = stringObjectLen(o)
+	} else {
+		if !client.checkType(o, constant.REDIS_STRING) {
+			return
+		}
+		// "append" is an argument, so always an sds
+		if !client.checkStringLength(stringObjectLen(o) + int64(len(client.argv[2]))) {
+			return
+		}
+		// append the value
+		o = db.dbUnshareStringValue(key, o)
+		s := o.Ptr.(*core.SdsHdr)
+		s.CatLen(client.argv[2])
+		totlen = s.Len
+	}
+	client.svr.dirty++
+	client.addReplyLongLong(totlen)
+}
+
+func strlenCommand(client *RedisClient) {
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	client.addReplyLongLong(stringObjectLen(o))
+}
+
+func getrangeCommand(client *RedisClient) {
+	start, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	end, ok := client.getLongLongOrReply(client.argv[3], "")
+	if !ok {
+		return
+	}
+
+	o := client.db.lookupKeyRead(client.argv[1])
+	if o == nil {
+		client.addReply(shared.emptybulk)
+		return
+	}
+	if !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	str := stringObjectBytes(o)
+	strlen := int64(len(str))
+
+	// convert negative indexes
+	if start < 0 && end < 0 && start > end {
+		client.addReply(shared.emptybulk)
+		return
+	}
+	if start < 0 {
+		start = strlen + start
+	}
+	if end < 0 {
+		end = strlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+
+	// precondition: end >= 0 && end < strlen, so the only condition where
+	// nothing can be returned is: start > end
+	if start > end || strlen == 0 {
+		client.addReply(shared.emptybulk)
+		return
+	}
+	client.addReplyBulk(str[start : end+1])
+}
+
+func setrangeCommand(client *RedisClient) {
+	key := client.argv[1]
+	value := client.argv[3]
+	db := client.db
+
+	offset, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	if offset < 0 {
+		client.addReplyError("offset is out of range")
+		return
+	}
+
+	o := db.lookupKeyWrite(key)
+	if o == nil {
+		// return 0 when setting nothing on a non-existing string
+		if len(value) == 0 {
+			client.addReply(shared.czero)
+			return
+		}
+		// return when the resulting string exceeds allowed size
+		if !client.checkStringLength(offset + int64(len(value))) {
+			return
+		}
+		o = createObject(constant.REDIS_STRING, core.SdsEmpty())
+		db.dbAdd(key, o)
+	} else {
+		if !client.checkType(o, constant.REDIS_STRING) {
+			return
+		}
+		// return existing string length when setting nothing
+		olen := stringObjectLen(o)
+		if len(value) == 0 {
+			client.addReplyLongLong(olen)
+			return
+		}
+		if !client.checkStringLength(offset + int64(len(value))) {
+			return
+		}
+		// create a copy when the object is shared or encoded
+		o = db.dbUnshareStringValue(key, o)
+	}
+
+	s := o.Ptr.(*core.SdsHdr)
+	s.GrowZero(offset + int64(len(value)))
+	copy(s.Buf[offset:], value)
+	client.svr.dirty++
+	client.addReplyLongLong(s.Len)
+}
+
+func incrDecrCommand(client *RedisClient, incr int64) {
+	key := client.argv[1]
+	db := client.db
+
+	o := db.lookupKeyWrite(key)
+	if o != nil && !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	value := int64(0)
+	if o != nil {
+		var ok bool
+		if value, ok = getLongLongFromObject(o); !ok {
+			client.addReplyError("value is not an integer or out of range")
+			return
+		}
+	}
+
+	oldvalue := value
+	if (incr < 0 && oldvalue < 0 && incr < math.MinInt64-oldvalue) ||
+		(incr > 0 && oldvalue > 0 && incr > math.MaxInt64-oldvalue) {
+		client.addReplyError("increment or decrement would overflow")
+		return
+	}
+	value += incr
+
+	if o != nil && !o.isShared() && o.Encoding == constant.REDIS_ENCODING_INT &&
+		(value < 0 || value >= constant.REDIS_SHARED_INTEGERS || !client.svr.shareIntegers()) {
+		// reuse the integer encoded object, no allocation needed
+		*o.Ptr.(*int64) = value
+	} else {
+		newObj := client.svr.createStringObjectFromLongLongForValue(value)
+		if o != nil {
+			db.dbOverwrite(key, newObj)
+		} else {
+			db.dbAdd(key, newObj)
+		}
+	}
+	client.svr.dirty++
+	client.addReplyLongLongWithPrefix(value, ':')
+}
+
+func incrCommand(client *RedisClient) {
+	incrDecrCommand(client, 1)
+}
+
+func decrCommand(client *RedisClient) {
+	incrDecrCommand(client, -1)
+}
+
+func incrbyCommand(client *RedisClient) {
+	incr, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	incrDecrCommand(client, incr)
+}
+
+func decrbyCommand(client *RedisClient) {
+	incr, ok := client.getLongLongOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+	// overflow check on negation
+	if incr == math.MinInt64 {
+		client.addReplyError("decrement would overflow")
+		return
+	}
+	incrDecrCommand(client, -incr)
+}
+
+func incrbyfloatCommand(client *RedisClient) {
+	key := client.argv[1]
+	db := client.db
+
+	o := db.lookupKeyWrite(key)
+	if o != nil && !client.checkType(o, constant.REDIS_STRING) {
+		return
+	}
+	value := float64(0)
+	if o != nil {
+		var ok bool
+		if value, ok = getDoubleFromObject(o); !ok {
+			client.addReplyError("value is not a valid float")
+			return
+		}
+	}
+	incr, ok := client.getDoubleOrReply(client.argv[2], "")
+	if !ok {
+		return
+	}
+
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		client.addReplyError("increment would produce NaN or Infinity")
+		return
+	}
+
+	// the shortest decimal representation that parses back to the same
+	// value, never in exponent form
+	if value == 0 {
+		value = 0 // turn -0 into 0
+	}
+	newObj := createStringObject([]byte(strconv.FormatFloat(value, 'f', -1, 64)))
+	if o != nil {
+		db.dbOverwrite(key, newObj)
+	} else {
+		db.dbAdd(key, newObj)
+	}
+	client.svr.dirty++
+	client.addReplyBulk(newObj.Ptr.(*core.SdsHdr).Bytes())
+
+	// always propagate INCRBYFLOAT as a SET of the result, so float
+	// precision or formatting differences can't change the value loaded
+	// from the AOF
+	client.rewriteCommandVector([]byte("SET"), key, newObj.Ptr.(*core.SdsHdr).Bytes(), []byte("KEEPTTL"))
+}
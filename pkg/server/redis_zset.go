@@ -0,0 +1,1554 @@
+package server
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/0226zy/myredis/pkg/constant"
+	"github.com/0226zy/myredis/pkg/core"
+	"github.com/0226zy/myredis/pkg/dict"
+)
+
+// Sorted sets use two encodings. Small sets are a single listpack where
+// every element is stored as a member entry followed by a score entry,
+// ordered by score and then by member. Bigger sets use a zset: a skiplist
+// ordering the elements, with span tracking so ranks are computed in
+// O(log N), plus a dict mapping members to scores for O(1) lookups.
+
+// zset the skiplist encoding of sorted sets
+type zset struct {
+	dict *dict.Dict // member -> float64 score
+	zsl  *core.Zskiplist
+}
+
+// score the score of ele, false when it is not a member
+func (zs *zset) score(ele string) (float64, bool) {
+	score, ok := zs.dict.FetchValue(ele)
+	if !ok {
+		return 0, false
+	}
+	return score.(float64), true
+}
+
+// zsetEntry a member with its score
+type zsetEntry struct {
+	ele   []byte
+	score float64
+}
+
+// ZADD input flags
+const (
+	zaddInIncr = 1 << iota // increment the score instead of setting it
+	zaddInNX               // don't touch elements not already existing
+	zaddInXX               // only touch elements already existing
+	zaddInGT               // only update existing when new scores are higher
+	zaddInLT               // only update existing when new scores are lower
+)
+
+// ZADD output flags
+const (
+	zaddOutNop     = 1 << iota // operation not performed because of conditionals
+	zaddOutNaN                 // the resulting score is not a number
+	zaddOutAdded               // the element was new and was added
+	zaddOutUpdated             // the element already existed, score updated
+)
+
+// kinds of ranges of ZRANGE and ZREMRANGE
+const (
+	zrangeAuto = iota
+	zrangeRank
+	zrangeScore
+	zrangeLex
+)
+
+// pop positions of ZPOP and BZPOP
+const (
+	zsetMin = iota
+	zsetMax
+)
+
+// ======================= range parsing ===========================
+
+// zslParseRange parse the min and max of a score range, a leading "("
+// makes a bound exclusive
+func zslParseRange(min, max []byte) (*core.ZRangeSpec, bool) {
+	spec := &core.ZRangeSpec{}
+	var ok bool
+	if len(min) > 0 && min[0] == '(' {
+		spec.Minex = true
+		min = min[1:]
+	}
+	if spec.Min, ok = getDoubleFromBytes(min); !ok {
+		return nil, false
+	}
+	if len(max) > 0 && max[0] == '(' {
+		spec.Maxex = true
+		max = max[1:]
+	}
+	if spec.Max, ok = getDoubleFromBytes(max); !ok {
+		return nil, false
+	}
+	return spec, true
+}
+
+// zslParseLexRangeItem parse a bound of a lex range: "-", "+", or a
+// string prefixed by "[" (inclusive) or "(" (exclusive)
+func zslParseLexRangeItem(item []byte) (core.ZLexBound, bool) {
+	if len(item) == 0 {
+		return core.ZLexBound{}, false
+	}
+	switch item[0] {
+	case '+':
+		if len(item) != 1 {
+			return core.ZLexBound{}, false
+		}
+		return core.ZLexBound{Kind: core.ZLEX_BOUND_MAX}, true
+	case '-':
+		if len(item) != 1 {
+			return core.ZLexBound{}, false
+		}
+		return core.ZLexBound{Kind: core.ZLEX_BOUND_MIN}, true
+	case '(':
+		return core.ZLexBound{Value: string(item[1:]), Exclusive: true}, true
+	case '[':
+		return core.ZLexBound{Value: string(item[1:])}, true
+	}
+	return core.ZLexBound{}, false
+}
+
+// zslParseLexRange parse the min and max of a lex range
+func zslParseLexRange(min, max []byte) (*core.ZLexRangeSpec, bool) {
+	spec := &core.ZLexRangeSpec{}
+	var ok bool
+	if spec.Min, ok = zslParseLexRangeItem(min); !ok {
+		return nil, false
+	}
+	if spec.Max, ok = zslParseLexRangeItem(max); !ok {
+		return nil, false
+	}
+	return spec, true
+}
+
+// ======================= listpack encoding ===========================
+
+// zzlGetScore the score entry at p
+func zzlGetScore(lp *core.Listpack, p int) float64 {
+	str, value, isInt := lp.Get(p)
+	if isInt {
+		return float64(value)
+	}
+	score, _ := getDoubleFromBytes(str)
+	return score
+}
+
+// zzlFind the offset and score of ele, -1 when not found
+func zzlFind(lp *core.Listpack, ele []byte) (int, float64) {
+	for p := lp.First(); p != -1; {
+		sp := lp.Next(p)
+		if lp.Compare(p, ele) {
+			return p, zzlGetScore(lp, sp)
+		}
+		p = lp.Next(sp)
+	}
+	return -1, 0
+}
+
+// zzlInsert insert ele keeping the elements ordered by score and member,
+// the caller makes sure ele is not already in the listpack
+func zzlInsert(lp *core.Listpack, ele []byte, score float64) {
+	scorebuf := []byte(formatDouble(score))
+	for p := lp.First(); p != -1; {
+		sp := lp.Next(p)
+		s := zzlGetScore(lp, sp)
+		if s > score || (s == score && string(lp.GetValue(p)) > string(ele)) {
+			// insert the member and then the score before p
+			p = lp.Insert(ele, p, false)
+			lp.Insert(scorebuf, p, true)
+			return
+		}
+		p = lp.Next(sp)
+	}
+	lp.Append(ele)
+	lp.Append(scorebuf)
+}
+
+// zzlDelete delete the element at p and its score
+func zzlDelete(lp *core.Listpack, p int) {
+	p = lp.Delete(p)
+	lp.Delete(p)
+}
+
+// ======================= zset API ===========================
+
+// zsetTypeCreate create a sorted set for sizeHint elements whose longest
+// member is valueLenHint bytes
+func (svr *RedisServer) zsetTypeCreate(sizeHint, valueLenHint int) *RedisObject {
+	if sizeHint <= svr.conf.ZsetMaxZipListEntries && valueLenHint <= svr.conf.ZsetMaxZipListValue {
+		return createZsetListpackObject()
+	}
+	return createZsetObject()
+}
+
+// zsetLength number of elements
+func zsetLength(o *RedisObject) int {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		return o.Ptr.(*core.Listpack).Len() / 2
+	case constant.REDIS_ENCODING_SKIPLIST:
+		return o.Ptr.(*zset).zsl.Len()
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetConvertToSkiplist convert a listpack encoded sorted set
+func zsetConvertToSkiplist(o *RedisObject) {
+	lp := o.Ptr.(*core.Listpack)
+	zs := &zset{dict: dict.New(zsetDictType), zsl: core.NewZskiplist()}
+	// presize the dict to avoid rehashing
+	zs.dict.Expand(lp.Len() / 2)
+	for p := lp.First(); p != -1; {
+		sp := lp.Next(p)
+		ele := string(lp.GetValue(p))
+		score := zzlGetScore(lp, sp)
+		zs.zsl.Insert(score, ele)
+		zs.dict.Add(ele, score)
+		p = lp.Next(sp)
+	}
+	o.Ptr = zs
+	o.Encoding = constant.REDIS_ENCODING_SKIPLIST
+}
+
+// zsetDup duplicate a sorted set object, used by COPY. The skiplist is
+// rebuilt from the tail so that every insert is a prepend.
+func zsetDup(o *RedisObject) *RedisObject {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		dup := createObject(constant.REDIS_ZSET, o.Ptr.(*core.Listpack).Dup())
+		dup.Encoding = constant.REDIS_ENCODING_LISTPACK
+		return dup
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zs := o.Ptr.(*zset)
+		dup := createZsetObject()
+		dupzs := dup.Ptr.(*zset)
+		for node := zs.zsl.Last(); node != nil; node = node.Prev() {
+			dupzs.zsl.Insert(node.Score, node.Ele)
+			dupzs.dict.Add(node.Ele, node.Score)
+		}
+		return dup
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetScore the score of member
+func zsetScore(o *RedisObject, member []byte) (float64, bool) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		p, score := zzlFind(o.Ptr.(*core.Listpack), member)
+		return score, p != -1
+	case constant.REDIS_ENCODING_SKIPLIST:
+		return o.Ptr.(*zset).score(string(member))
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetAdd add a new element or update the score of an existing one,
+// according to the zaddIn flags. Return the new score (when incrementing
+// the score is the result) and the zaddOut flags describing what was done.
+func (svr *RedisServer) zsetAdd(o *RedisObject, score float64, ele []byte, inflags int) (float64, int) {
+	incr := inflags&zaddInIncr != 0
+	nx := inflags&zaddInNX != 0
+	xx := inflags&zaddInXX != 0
+	gt := inflags&zaddInGT != 0
+	lt := inflags&zaddInLT != 0
+
+	// NaN as input is an error regardless of all the other parameters
+	if math.IsNaN(score) {
+		return 0, zaddOutNaN
+	}
+
+	curscore, exists := zsetScore(o, ele)
+	if exists {
+		// NX? return, same element already exists
+		if nx {
+			return curscore, zaddOutNop
+		}
+		// prepare the score for the increment if needed
+		if incr {
+			score += curscore
+			if math.IsNaN(score) {
+				return 0, zaddOutNaN
+			}
+		}
+		// GT/LT? only update if score is greater/less than current
+		if (lt && score >= curscore) || (gt && score <= curscore) {
+			return curscore, zaddOutNop
+		}
+		if score == curscore {
+			return score, 0
+		}
+		switch o.Encoding {
+		case constant.REDIS_ENCODING_LISTPACK:
+			// remove and re-insert when score changed
+			lp := o.Ptr.(*core.Listpack)
+			p, _ := zzlFind(lp, ele)
+			zzlDelete(lp, p)
+			zzlInsert(lp, ele, score)
+		case constant.REDIS_ENCODING_SKIPLIST:
+			zs := o.Ptr.(*zset)
+			zs.zsl.UpdateScore(curscore, string(ele), score)
+			zs.dict.Replace(string(ele), score)
+		}
+		return score, zaddOutUpdated
+	}
+	if xx {
+		return 0, zaddOutNop
+	}
+
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		zzlInsert(o.Ptr.(*core.Listpack), ele, score)
+		// check if the element is too large or the list becomes too long
+		if zsetLength(o) > svr.conf.ZsetMaxZipListEntries || len(ele) > svr.conf.ZsetMaxZipListValue {
+			zsetConvertToSkiplist(o)
+		}
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zs := o.Ptr.(*zset)
+		zs.zsl.Insert(score, string(ele))
+		zs.dict.Add(string(ele), score)
+	default:
+		panic("Unknown sorted set encoding")
+	}
+	return score, zaddOutAdded
+}
+
+// zsetDel remove ele, return false when it is not a member
+func zsetDel(o *RedisObject, ele []byte) bool {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		p, _ := zzlFind(lp, ele)
+		if p == -1 {
+			return false
+		}
+		zzlDelete(lp, p)
+		return true
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zs := o.Ptr.(*zset)
+		score, ok := zs.score(string(ele))
+		if !ok {
+			return false
+		}
+		zs.dict.Delete(string(ele))
+		zs.zsl.Delete(score, string(ele))
+		if htNeedsResize(zs.dict) {
+			zs.dict.Resize()
+		}
+		return true
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetRank the 0 based rank of ele and its score, in descending order
+// when reverse is set
+func zsetRank(o *RedisObject, ele []byte, reverse bool) (int, float64, bool) {
+	length := zsetLength(o)
+	rank := 0
+	var score float64
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		p := lp.First()
+		for p != -1 && !lp.Compare(p, ele) {
+			p = lp.Next(lp.Next(p))
+			rank++
+		}
+		if p == -1 {
+			return 0, 0, false
+		}
+		score = zzlGetScore(lp, lp.Next(p))
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zs := o.Ptr.(*zset)
+		var ok bool
+		if score, ok = zs.score(string(ele)); !ok {
+			return 0, 0, false
+		}
+		rank = zs.zsl.GetRank(score, string(ele)) - 1
+	default:
+		panic("Unknown sorted set encoding")
+	}
+	if reverse {
+		rank = length - 1 - rank
+	}
+	return rank, score, true
+}
+
+// zsetRankRangeByScore the 0 based ranks of the first and last elements
+// in the score range, false when no element is in range
+func zsetRankRangeByScore(o *RedisObject, r *core.ZRangeSpec) (int, int, bool) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		lp := o.Ptr.(*core.Listpack)
+		start, end := -1, -1
+		rank := 0
+		for p := lp.First(); p != -1; rank++ {
+			sp := lp.Next(p)
+			score := zzlGetScore(lp, sp)
+			if !r.ValueLteMax(score) {
+				break
+			}
+			if r.ValueGteMin(score) {
+				if start == -1 {
+					start = rank
+				}
+				end = rank
+			}
+			p = lp.Next(sp)
+		}
+		return start, end, start != -1
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zsl := o.Ptr.(*zset).zsl
+		first := zsl.FirstInRange(r)
+		if first == nil {
+			return 0, 0, false
+		}
+		last := zsl.LastInRange(r)
+		return zsl.GetRank(first.Score, first.Ele) - 1, zsl.GetRank(last.Score, last.Ele) - 1, true
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetRankRangeByLex the 0 based ranks of the first and last elements in
+// the lex range, false when no element is in range. The elements are
+// expected to have all the same score.
+func zsetRankRangeByLex(o *RedisObject, r *core.ZLexRangeSpec) (int, int, bool) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		if r.IsEmpty() {
+			return 0, 0, false
+		}
+		lp := o.Ptr.(*core.Listpack)
+		start, end := -1, -1
+		rank := 0
+		for p := lp.First(); p != -1; rank++ {
+			ele := string(lp.GetValue(p))
+			if !r.ValueLteMax(ele) {
+				break
+			}
+			if r.ValueGteMin(ele) {
+				if start == -1 {
+					start = rank
+				}
+				end = rank
+			}
+			p = lp.Next(lp.Next(p))
+		}
+		return start, end, start != -1
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zsl := o.Ptr.(*zset).zsl
+		first := zsl.FirstInLexRange(r)
+		if first == nil {
+			return 0, 0, false
+		}
+		last := zsl.LastInLexRange(r)
+		return zsl.GetRank(first.Score, first.Ele) - 1, zsl.GetRank(last.Score, last.Ele) - 1, true
+	}
+	panic("Unknown sorted set encoding")
+}
+
+// zsetDeleteRangeByRank delete the elements with 0 based rank between
+// start and end, inclusive
+func zsetDeleteRangeByRank(o *RedisObject, start, end int) {
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		o.Ptr.(*core.Listpack).DeleteRange(2*start, 2*(end-start+1))
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zs := o.Ptr.(*zset)
+		for _, node := range zs.zsl.DeleteRangeByRank(start+1, end+1) {
+			zs.dict.Delete(node.Ele)
+		}
+		if htNeedsResize(zs.dict) {
+			zs.dict.Resize()
+		}
+	default:
+		panic("Unknown sorted set encoding")
+	}
+}
+
+// zsetIterator walk a sorted set starting at a rank, in ascending or
+// descending order. The set must not be modified during the iteration.
+type zsetIterator struct {
+	o       *RedisObject
+	reverse bool
+	p       int                 // listpack: offset of the next member, -1 when done
+	node    *core.ZskiplistNode // skiplist: the next node, nil when done
+}
+
+func zsetInitIterator(o *RedisObject, rank int, reverse bool) *zsetIterator {
+	zi := &zsetIterator{o: o, reverse: reverse}
+	switch o.Encoding {
+	case constant.REDIS_ENCODING_LISTPACK:
+		zi.p = o.Ptr.(*core.Listpack).Seek(2 * rank)
+	case constant.REDIS_ENCODING_SKIPLIST:
+		zi.node = o.Ptr.(*zset).zsl.GetElementByRank(rank + 1)
+	default:
+		panic("Unknown sorted set encoding")
+	}
+	return zi
+}
+
+// next return the next element, false when done
+func (zi *zsetIterator) next() (zsetEntry, bool) {
+	if zi.o.Encoding == constant.REDIS_ENCODING_LISTPACK {
+		if zi.p == -1 {
+			return zsetEntry{}, false
+		}
+		lp := zi.o.Ptr.(*core.Listpack)
+		sp := lp.Next(zi.p)
+		entry := zsetEntry{ele: lp.GetValue(zi.p), score: zzlGetScore(lp, sp)}
+		if zi.reverse {
+			// the previous entry is the score of the previous member
+			if zi.p = lp.Prev(zi.p); zi.p != -1 {
+				zi.p = lp.Prev(zi.p)
+			}
+		} else {
+			zi.p = lp.Next(sp)
+		}
+		return entry, true
+	}
+	if zi.node == nil {
+		return zsetEntry{}, false
+	}
+	entry := zsetEntry{ele: []byte(zi.node.Ele), score: zi.node.Score}
+	if zi.reverse {
+		zi.node = zi.node.Prev()
+	} else {
+		zi.node = zi.node.Next()
+	}
+	return entry, true
+}
+
+// zsetEntries every element of the sorted set, in ascending order
+func zsetEntries(o *RedisObject) []zsetEntry {
+	entries := make([]zsetEntry, 0, zsetLength(o))
+	zi := zsetInitIterator(o, 0, false)
+	for entry, ok := zi.next(); ok; entry, ok = zi.next() {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// zsetPop remove and return the element with the lowest or the highest
+// score, the set must not be empty
+func zsetPop(o *RedisObject, where int) zsetEntry {
+	rank := 0
+	if where == zsetMax {
+		rank = zsetLength(o) - 1
+	}
+	entry, _ := zsetInitIterator(o, rank, false).next()
+	zsetDeleteRangeByRank(o, rank, rank)
+	return entry
+}
+
+// storeZsetResult store entries as a new sorted set at dstkey, or delete
+// dstkey when there are no entries, and reply with the cardinality
+func storeZsetResult(client *RedisClient, dstkey []byte, entries []zsetEntry) {
+	svr := client.svr
+	db := client.db
+	if len(entries) == 0 {
+		if db.dbDelete(dstkey) {
+			svr.dirty++
+		}
+		client.addReply(shared.czero)
+		return
+	}
+	maxelelen := 0
+	for _, entry := range entries {
+		if len(entry.ele) > maxelelen {
+			maxelelen = len(entry.ele)
+		}
+	}
+	dstobj := svr.zsetTypeCreate(len(entries), maxelelen)
+	for _, entry := range entries {
+		svr.zsetAdd(dstobj, entry.score, entry.ele, 0)
+	}
+	db.setKey(dstkey, dstobj, false)
+	svr.dirty++
+	client.addReplyLongLong(int64(zsetLength(dstobj)))
+}
+
+// replyZsetEntries reply with the members, followed by their score when
+// withscores is set
+func replyZsetEntries(client *RedisClient, entries []zsetEntry, withscores bool) {
+	if withscores {
+		client.addReplyMultiBulkLen(2 * len(entries))
+	} else {
+		client.addReplyMultiBulkLen(len(entries))
+	}
+	for _, entry := range entries {
+		client.addReplyBulk(entry.ele)
+		if withscores {
+			client.addReplyDouble(entry.score)
+		}
+	}
+}
+
+// ======================= commands ===========================
+
+// zaddGenericCommand ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member
+// [score member ...] and ZINCRBY key increment member
+func zaddGenericCommand(client *RedisClient, flags int) {
+	svr := client.svr
+	key := client.argv[1]
+	ch := false
+
+	// parse options, at the end scoreidx is the index of the first score
+	scoreidx := 2
+	for ; scoreidx < len(client.argv); scoreidx++ {
+		opt := strings.ToLower(string(client.argv[scoreidx]))
+		if opt == "nx" {
+			flags |= zaddInNX
+		} else if opt == "xx" {
+			flags |= zaddInXX
+		} else if opt == "ch" {
+			ch = true
+		} else if opt == "incr" {
+			flags |= zaddInIncr
+		} else if opt == "gt" {
+			flags |= zaddInGT
+		} else if opt == "lt" {
+			flags |= zaddInLT
+		} else {
+			break
+		}
+	}
+	incr := flags&zaddInIncr != 0
+	nx := flags&zaddInNX != 0
+	xx := flags&zaddInXX != 0
+	gt := flags&zaddInGT != 0
+	lt := flags&zaddInLT != 0
+
+	// after the options, we expect to have an even number of args, since
+	// we expect any number of score-element pairs
+	elements := len(client.argv) - scoreidx
+	if elements%2 != 0 || elements == 0 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+	elements /= 2
+
+	// check for incompatible options
+	if nx && xx {
+		client.addReplyError("XX and NX options at the same time are not compatible")
+		return
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		client.addReplyError("GT, LT, and/or NX options at the same time are not compatible")
+		return
+	}
+	if incr && elements > 1 {
+		client.addReplyError("INCR option supports a single increment-element pair")
+		return
+	}
+
+	// start parsing all the scores, we need to emit any syntax error
+	// before executing additions to the sorted set, as the command should
+	// either execute fully or nothing at all
+	scores := make([]float64, elements)
+	maxelelen := 0
+	for j := 0; j < elements; j++ {
+		score, ok := client.getDoubleOrReply(client.argv[scoreidx+j*2], "")
+		if !ok {
+			return
+		}
+		scores[j] = score
+		if l := len(client.argv[scoreidx+j*2+1]); l > maxelelen {
+			maxelelen = l
+		}
+	}
+
+	zobj := client.db.lookupKeyWrite(key)
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	if zobj == nil {
+		if xx {
+			// no key + XX option: nothing to do
+			if incr {
+				client.addReply(shared.nullbulk)
+			} else {
+				client.addReply(shared.czero)
+			}
+			return
+		}
+		zobj = svr.zsetTypeCreate(elements, maxelelen)
+		client.db.dbAdd(key, zobj)
+	}
+
+	added, updated, processed := 0, 0, 0
+	var score float64
+	for j := 0; j < elements; j++ {
+		newscore, retflags := svr.zsetAdd(zobj, scores[j], client.argv[scoreidx+j*2+1], flags)
+		if retflags&zaddOutNaN != 0 {
+			client.addReplyError("resulting score is not a number (NaN)")
+			svr.dirty += int64(added + updated)
+			return
+		}
+		if retflags&zaddOutAdded != 0 {
+			added++
+		}
+		if retflags&zaddOutUpdated != 0 {
+			updated++
+		}
+		if retflags&zaddOutNop == 0 {
+			processed++
+		}
+		score = newscore
+	}
+	svr.dirty += int64(added + updated)
+
+	if incr {
+		// ZINCRBY or INCR option
+		if processed > 0 {
+			client.addReplyDouble(score)
+		} else {
+			client.addReply(shared.nullbulk)
+		}
+	} else if ch {
+		client.addReplyLongLong(int64(added + updated))
+	} else {
+		client.addReplyLongLong(int64(added))
+	}
+}
+
+func zaddCommand(client *RedisClient) {
+	zaddGenericCommand(client, 0)
+}
+
+func zincrbyCommand(client *RedisClient) {
+	zaddGenericCommand(client, zaddInIncr)
+}
+
+func zremCommand(client *RedisClient) {
+	key := client.argv[1]
+	zobj := client.db.lookupKeyWrite(key)
+	if zobj == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	deleted := 0
+	for _, member := range client.argv[2:] {
+		if zsetDel(zobj, member) {
+			deleted++
+			if zsetLength(zobj) == 0 {
+				client.db.dbDelete(key)
+				break
+			}
+		}
+	}
+	client.svr.dirty += int64(deleted)
+	client.addReplyLongLong(int64(deleted))
+}
+
+func zscoreCommand(client *RedisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	score, ok := zsetScore(zobj, client.argv[2])
+	if !ok {
+		client.addReply(shared.nullbulk)
+		return
+	}
+	client.addReplyDouble(score)
+}
+
+func zmscoreCommand(client *RedisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	members := client.argv[2:]
+	client.addReplyMultiBulkLen(len(members))
+	for _, member := range members {
+		if zobj == nil {
+			client.addReply(shared.nullbulk)
+			continue
+		}
+		if score, ok := zsetScore(zobj, member); ok {
+			client.addReplyDouble(score)
+		} else {
+			client.addReply(shared.nullbulk)
+		}
+	}
+}
+
+func zcardCommand(client *RedisClient) {
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	client.addReplyLongLong(int64(zsetLength(zobj)))
+}
+
+func zcountCommand(client *RedisClient) {
+	r, ok := zslParseRange(client.argv[2], client.argv[3])
+	if !ok {
+		client.addReplyError("min or max is not a float")
+		return
+	}
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	start, end, ok := zsetRankRangeByScore(zobj, r)
+	if !ok {
+		client.addReply(shared.czero)
+		return
+	}
+	client.addReplyLongLong(int64(end - start + 1))
+}
+
+func zlexcountCommand(client *RedisClient) {
+	r, ok := zslParseLexRange(client.argv[2], client.argv[3])
+	if !ok {
+		client.addReplyError("min or max not valid string range item")
+		return
+	}
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	start, end, ok := zsetRankRangeByLex(zobj, r)
+	if !ok {
+		client.addReply(shared.czero)
+		return
+	}
+	client.addReplyLongLong(int64(end - start + 1))
+}
+
+// zrankGenericCommand ZRANK/ZREVRANK key member [WITHSCORE]
+func zrankGenericCommand(client *RedisClient, reverse bool) {
+	withscore := false
+	if len(client.argv) > 4 {
+		client.addReplyErrorFormat("wrong number of arguments for '%s' command", strings.ToLower(string(client.argv[0])))
+		return
+	}
+	if len(client.argv) == 4 {
+		if strings.ToLower(string(client.argv[3])) != "withscore" {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+		withscore = true
+	}
+
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	var rank int
+	var score float64
+	ok := false
+	if zobj != nil {
+		rank, score, ok = zsetRank(zobj, client.argv[2], reverse)
+	}
+	if !ok {
+		if withscore {
+			client.addReply(shared.nullmultibulk)
+		} else {
+			client.addReply(shared.nullbulk)
+		}
+		return
+	}
+	if withscore {
+		client.addReplyMultiBulkLen(2)
+		client.addReplyLongLong(int64(rank))
+		client.addReplyDouble(score)
+		return
+	}
+	client.addReplyLongLong(int64(rank))
+}
+
+func zrankCommand(client *RedisClient) {
+	zrankGenericCommand(client, false)
+}
+
+func zrevrankCommand(client *RedisClient) {
+	zrankGenericCommand(client, true)
+}
+
+// zrangeGenericCommand implementation of ZRANGE, ZRANGESTORE and the
+// legacy ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE, ZRANGEBYLEX and
+// ZREVRANGEBYLEX. argvStart is the index of the source key, the result is
+// stored at dstkey when it is not nil.
+//
+//	ZRANGE key min max [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+//
+// For BYSCORE and BYLEX the REV variants take max before min.
+func zrangeGenericCommand(client *RedisClient, argvStart int, dstkey []byte, rangetype int, reverse bool) {
+	argv := client.argv
+	key := argv[argvStart]
+	withscores := false
+	var offset, limit int64 = 0, -1
+	hasLimit := false
+	// the direction and the kind of range are fixed by the legacy commands
+	legacy := rangetype != zrangeAuto
+
+	// step 1: skip the <src> <min> <max> args and parse remaining optional args
+	for j := argvStart + 3; j < len(argv); j++ {
+		opt := strings.ToLower(string(argv[j]))
+		leftargs := len(argv) - j - 1
+		if dstkey == nil && opt == "withscores" {
+			withscores = true
+		} else if opt == "limit" && leftargs >= 2 {
+			var ok bool
+			if offset, ok = client.getLongLongOrReply(argv[j+1], ""); !ok {
+				return
+			}
+			if limit, ok = client.getLongLongOrReply(argv[j+2], ""); !ok {
+				return
+			}
+			hasLimit = true
+			j += 2
+		} else if !legacy && !reverse && opt == "rev" {
+			reverse = true
+		} else if rangetype == zrangeAuto && opt == "bylex" {
+			rangetype = zrangeLex
+		} else if rangetype == zrangeAuto && opt == "byscore" {
+			rangetype = zrangeScore
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	// use defaults if not overridden by arguments
+	if rangetype == zrangeAuto {
+		rangetype = zrangeRank
+	}
+
+	// check for conflicting arguments
+	if hasLimit && rangetype == zrangeRank {
+		client.addReplyError("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		return
+	}
+	if withscores && rangetype == zrangeLex {
+		client.addReplyError("syntax error, WITHSCORES not supported in combination with BYLEX")
+		return
+	}
+
+	minArg, maxArg := argv[argvStart+1], argv[argvStart+2]
+	if reverse && rangetype != zrangeRank {
+		minArg, maxArg = maxArg, minArg
+	}
+
+	// step 2: parse the range
+	var start, end int64
+	var scoreRange *core.ZRangeSpec
+	var lexRange *core.ZLexRangeSpec
+	var ok bool
+	switch rangetype {
+	case zrangeRank:
+		if start, ok = client.getLongLongOrReply(minArg, ""); !ok {
+			return
+		}
+		if end, ok = client.getLongLongOrReply(maxArg, ""); !ok {
+			return
+		}
+	case zrangeScore:
+		if scoreRange, ok = zslParseRange(minArg, maxArg); !ok {
+			client.addReplyError("min or max is not a float")
+			return
+		}
+	case zrangeLex:
+		if lexRange, ok = zslParseLexRange(minArg, maxArg); !ok {
+			client.addReplyError("min or max not valid string range item")
+			return
+		}
+	}
+
+	// step 3: lookup the key and get the range
+	var zobj *RedisObject
+	if dstkey != nil {
+		zobj = client.db.lookupKeyWrite(key)
+	} else {
+		zobj = client.db.lookupKeyRead(key)
+	}
+	if zobj != nil && !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	var entries []zsetEntry
+	if zobj != nil {
+		entries = zsetRange(zobj, rangetype, start, end, scoreRange, lexRange, reverse, offset, limit)
+	}
+
+	// step 4: reply or store the result
+	if dstkey != nil {
+		storeZsetResult(client, dstkey, entries)
+		return
+	}
+	replyZsetEntries(client, entries, withscores)
+}
+
+// zsetRange the elements of a ZRANGE, in the order they are returned
+func zsetRange(zobj *RedisObject, rangetype int, start, end int64, scoreRange *core.ZRangeSpec,
+	lexRange *core.ZLexRangeSpec, reverse bool, offset, limit int64) []zsetEntry {
+	length := int64(zsetLength(zobj))
+	var first, last int64 // 0 based ranks in ascending order
+
+	if rangetype == zrangeRank {
+		// sanitize indexes
+		if start < 0 {
+			start = length + start
+		}
+		if end < 0 {
+			end = length + end
+		}
+		if start < 0 {
+			start = 0
+		}
+		// invariant: start >= 0, so this test will be true when end < 0.
+		// The range is empty when start > end or start >= length.
+		if start > end || start >= length {
+			return nil
+		}
+		if end >= length {
+			end = length - 1
+		}
+		// rank ranges are counted from the end in reverse order
+		if reverse {
+			first, last = length-1-end, length-1-start
+		} else {
+			first, last = start, end
+		}
+	} else {
+		var s, e int
+		var ok bool
+		if rangetype == zrangeScore {
+			s, e, ok = zsetRankRangeByScore(zobj, scoreRange)
+		} else {
+			s, e, ok = zsetRankRangeByLex(zobj, lexRange)
+		}
+		if !ok {
+			return nil
+		}
+		first, last = int64(s), int64(e)
+
+		// apply LIMIT, a negative offset returns nothing and a negative
+		// count returns every element from offset
+		if offset < 0 || offset > last-first {
+			return nil
+		}
+		if reverse {
+			last -= offset
+		} else {
+			first += offset
+		}
+		if limit >= 0 && limit < last-first+1 {
+			if reverse {
+				first = last - limit + 1
+			} else {
+				last = first + limit - 1
+			}
+		}
+	}
+
+	rangelen := int(last - first + 1)
+	if rangelen <= 0 {
+		return nil
+	}
+	entries := make([]zsetEntry, 0, rangelen)
+	rank := first
+	if reverse {
+		rank = last
+	}
+	zi := zsetInitIterator(zobj, int(rank), reverse)
+	for i := 0; i < rangelen; i++ {
+		entry, _ := zi.next()
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func zrangeCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeAuto, false)
+}
+
+func zrangestoreCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 2, client.argv[1], zrangeAuto, false)
+}
+
+func zrevrangeCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeRank, true)
+}
+
+func zrangebyscoreCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeScore, false)
+}
+
+func zrevrangebyscoreCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeScore, true)
+}
+
+func zrangebylexCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeLex, false)
+}
+
+func zrevrangebylexCommand(client *RedisClient) {
+	zrangeGenericCommand(client, 1, nil, zrangeLex, true)
+}
+
+// zremrangeGenericCommand ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX key min max
+func zremrangeGenericCommand(client *RedisClient, rangetype int) {
+	key := client.argv[1]
+	var start, end int64
+	var scoreRange *core.ZRangeSpec
+	var lexRange *core.ZLexRangeSpec
+	var ok bool
+
+	// step 1: parse the range
+	switch rangetype {
+	case zrangeRank:
+		if start, ok = client.getLongLongOrReply(client.argv[2], ""); !ok {
+			return
+		}
+		if end, ok = client.getLongLongOrReply(client.argv[3], ""); !ok {
+			return
+		}
+	case zrangeScore:
+		if scoreRange, ok = zslParseRange(client.argv[2], client.argv[3]); !ok {
+			client.addReplyError("min or max is not a float")
+			return
+		}
+	case zrangeLex:
+		if lexRange, ok = zslParseLexRange(client.argv[2], client.argv[3]); !ok {
+			client.addReplyError("min or max not valid string range item")
+			return
+		}
+	}
+
+	// step 2: lookup and range detection
+	zobj := client.db.lookupKeyWrite(key)
+	if zobj == nil {
+		client.addReply(shared.czero)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+
+	var first, last int
+	switch rangetype {
+	case zrangeRank:
+		// sanitize indexes
+		length := int64(zsetLength(zobj))
+		if start < 0 {
+			start = length + start
+		}
+		if end < 0 {
+			end = length + end
+		}
+		if start < 0 {
+			start = 0
+		}
+		if start > end || start >= length {
+			client.addReply(shared.czero)
+			return
+		}
+		if end >= length {
+			end = length - 1
+		}
+		first, last, ok = int(start), int(end), true
+	case zrangeScore:
+		first, last, ok = zsetRankRangeByScore(zobj, scoreRange)
+	case zrangeLex:
+		first, last, ok = zsetRankRangeByLex(zobj, lexRange)
+	}
+	if !ok {
+		client.addReply(shared.czero)
+		return
+	}
+
+	// step 3: perform the range deletion operation
+	zsetDeleteRangeByRank(zobj, first, last)
+	if zsetLength(zobj) == 0 {
+		client.db.dbDelete(key)
+	}
+	deleted := last - first + 1
+	client.svr.dirty += int64(deleted)
+	client.addReplyLongLong(int64(deleted))
+}
+
+func zremrangebyrankCommand(client *RedisClient) {
+	zremrangeGenericCommand(client, zrangeRank)
+}
+
+func zremrangebyscoreCommand(client *RedisClient) {
+	zremrangeGenericCommand(client, zrangeScore)
+}
+
+func zremrangebylexCommand(client *RedisClient) {
+	zremrangeGenericCommand(client, zrangeLex)
+}
+
+// zpopGenericCommand ZPOPMIN/ZPOPMAX key [count]
+func zpopGenericCommand(client *RedisClient, where int) {
+	if len(client.argv) > 3 {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+	count := int64(1)
+	if len(client.argv) == 3 {
+		var ok bool
+		if count, ok = client.getPositiveLongLongOrReply(client.argv[2], ""); !ok {
+			return
+		}
+	}
+
+	key := client.argv[1]
+	zobj := client.db.lookupKeyWrite(key)
+	if zobj == nil {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	if count == 0 {
+		client.addReply(shared.emptymultibulk)
+		return
+	}
+
+	if length := int64(zsetLength(zobj)); count > length {
+		count = length
+	}
+	entries := make([]zsetEntry, 0, count)
+	for i := int64(0); i < count; i++ {
+		entries = append(entries, zsetPop(zobj, where))
+	}
+	if zsetLength(zobj) == 0 {
+		client.db.dbDelete(key)
+	}
+	client.svr.dirty += count
+	replyZsetEntries(client, entries, true)
+}
+
+func zpopminCommand(client *RedisClient) {
+	zpopGenericCommand(client, zsetMin)
+}
+
+func zpopmaxCommand(client *RedisClient) {
+	zpopGenericCommand(client, zsetMax)
+}
+
+// zpopCommandName the non blocking pop from where, used to propagate
+// BZPOPMIN and BZPOPMAX
+func zpopCommandName(where int) []byte {
+	if where == zsetMin {
+		return []byte("ZPOPMIN")
+	}
+	return []byte("ZPOPMAX")
+}
+
+// serveClientBlockedOnSortedSet pop an element for a client blocked in
+// BZPOPMIN or BZPOPMAX and unblock it
+func serveClientBlockedOnSortedSet(receiver *RedisClient, key []byte, o *RedisObject) {
+	entry := zsetPop(o, receiver.bpop.wherefrom)
+	receiver.addReplyMultiBulkLen(3)
+	receiver.addReplyBulk(key)
+	receiver.addReplyBulk(entry.ele)
+	receiver.addReplyDouble(entry.score)
+	receiver.svr.propagate(receiver.db.id, [][]byte{zpopCommandName(receiver.bpop.wherefrom), key})
+	receiver.svr.dirty++
+	receiver.svr.unblockClient(receiver)
+}
+
+// bzpopGenericCommand BZPOPMIN/BZPOPMAX key [key ...] timeout
+// Pop from the first non empty sorted set, or block until one of the keys
+// receives data
+func bzpopGenericCommand(client *RedisClient, where int) {
+	last := len(client.argv) - 1
+	timeout, ok := getTimeoutOrReply(client, client.argv[last])
+	if !ok {
+		return
+	}
+
+	db := client.db
+	keys := client.argv[1:last]
+	for _, key := range keys {
+		o := db.lookupKeyWrite(key)
+		if o == nil {
+			continue
+		}
+		if !client.checkType(o, constant.REDIS_ZSET) {
+			return
+		}
+		// non empty sorted set, this is like a normal ZPOP
+		entry := zsetPop(o, where)
+		client.addReplyMultiBulkLen(3)
+		client.addReplyBulk(key)
+		client.addReplyBulk(entry.ele)
+		client.addReplyDouble(entry.score)
+		if zsetLength(o) == 0 {
+			db.dbDelete(key)
+		}
+		client.svr.dirty++
+		client.rewriteCommandVector(zpopCommandName(where), key)
+		return
+	}
+
+	// if the keys are all empty we need to block
+	client.blockForKeys(constant.REDIS_ZSET, keys, timeout, nil, where, 0)
+}
+
+func bzpopminCommand(client *RedisClient) {
+	bzpopGenericCommand(client, zsetMin)
+}
+
+func bzpopmaxCommand(client *RedisClient) {
+	bzpopGenericCommand(client, zsetMax)
+}
+
+// AGGREGATE modes of ZUNIONSTORE and ZINTERSTORE
+const (
+	zaggSum = iota
+	zaggMin
+	zaggMax
+)
+
+const (
+	zsetOpUnion = iota
+	zsetOpInter
+)
+
+// zunionInterAggregate combine the score of an element found in many sets
+func zunionInterAggregate(target *float64, val float64, aggregate int) {
+	switch aggregate {
+	case zaggSum:
+		*target = *target + val
+		// the result of adding two doubles is NaN when one variable is
+		// +inf and the other is -inf. When these numbers are added, we
+		// maintain the convention of the result being 0.0
+		if math.IsNaN(*target) {
+			*target = 0.0
+		}
+	case zaggMin:
+		if val < *target {
+			*target = val
+		}
+	case zaggMax:
+		if val > *target {
+			*target = val
+		}
+	}
+}
+
+// zuiLength cardinality of a set or sorted set source, 0 when missing
+func zuiLength(o *RedisObject) int {
+	if o == nil {
+		return 0
+	}
+	if o.Type == constant.REDIS_SET {
+		return setTypeSize(o)
+	}
+	return zsetLength(o)
+}
+
+// zuiEntries the elements of a set or sorted set source, set members
+// have score 1
+func zuiEntries(o *RedisObject) []zsetEntry {
+	if o.Type == constant.REDIS_ZSET {
+		return zsetEntries(o)
+	}
+	members := setTypeMembers(o)
+	entries := make([]zsetEntry, len(members))
+	for i, member := range members {
+		entries[i] = zsetEntry{ele: member, score: 1.0}
+	}
+	return entries
+}
+
+// zuiFind the score of ele in a set or sorted set source
+func zuiFind(o *RedisObject, ele []byte) (float64, bool) {
+	if o.Type == constant.REDIS_ZSET {
+		return zsetScore(o, ele)
+	}
+	return 1.0, setTypeIsMember(o, ele)
+}
+
+// zunionInterGenericCommand ZUNIONSTORE/ZINTERSTORE destination numkeys
+// key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM|MIN|MAX]
+func zunionInterGenericCommand(client *RedisClient, dstkey []byte, numkeysIndex int, op int) {
+	argv := client.argv
+	numkeys, ok := client.getLongLongOrReply(argv[numkeysIndex], "")
+	if !ok {
+		return
+	}
+	if numkeys < 1 {
+		client.addReplyErrorFormat("at least 1 input key is needed for '%s' command", strings.ToLower(string(argv[0])))
+		return
+	}
+	// test if the expected number of keys would overflow
+	if numkeys > int64(len(argv)-numkeysIndex-1) {
+		client.addReplyError(shared.syntaxerr)
+		return
+	}
+
+	// read keys to be used for input
+	keys := argv[numkeysIndex+1 : numkeysIndex+1+int(numkeys)]
+	srcs := make([]*RedisObject, len(keys))
+	weights := make([]float64, len(keys))
+	for i, key := range keys {
+		o := client.db.lookupKeyWrite(key)
+		if o != nil && o.Type != constant.REDIS_ZSET && o.Type != constant.REDIS_SET {
+			client.addReplyError(shared.wrongtypeerr)
+			return
+		}
+		srcs[i] = o
+		weights[i] = 1
+	}
+
+	// parse optional extra arguments
+	aggregate := zaggSum
+	for j := numkeysIndex + 1 + int(numkeys); j < len(argv); j++ {
+		remaining := len(argv) - j
+		opt := strings.ToLower(string(argv[j]))
+		if remaining >= int(numkeys)+1 && opt == "weights" {
+			for i := range weights {
+				j++
+				if weights[i], ok = client.getDoubleOrReply(argv[j], "weight value is not a float"); !ok {
+					return
+				}
+			}
+		} else if remaining >= 2 && opt == "aggregate" {
+			j++
+			switch strings.ToLower(string(argv[j])) {
+			case "sum":
+				aggregate = zaggSum
+			case "min":
+				aggregate = zaggMin
+			case "max":
+				aggregate = zaggMax
+			default:
+				client.addReplyError(shared.syntaxerr)
+				return
+			}
+		} else {
+			client.addReplyError(shared.syntaxerr)
+			return
+		}
+	}
+
+	// sort sets from the smallest to largest, this will improve our
+	// algorithm's performance
+	order := make([]int, len(srcs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return zuiLength(srcs[order[a]]) < zuiLength(srcs[order[b]])
+	})
+
+	var result []zsetEntry
+	if op == zsetOpInter {
+		// skip everything if the smallest input is empty
+		if first := srcs[order[0]]; first != nil {
+			// precondition: as srcs are sorted by size, the first
+			// source has the fewest elements
+			for _, entry := range zuiEntries(first) {
+				score := weightedScore(entry.score, weights[order[0]])
+				found := true
+				for _, idx := range order[1:] {
+					other := srcs[idx]
+					if other == nil {
+						found = false
+						break
+					}
+					// the same key may be passed more than once
+					value, ok := zuiFind(other, entry.ele)
+					if !ok {
+						found = false
+						break
+					}
+					zunionInterAggregate(&score, weightedScore(value, weights[idx]), aggregate)
+				}
+				if found {
+					result = append(result, zsetEntry{ele: entry.ele, score: score})
+				}
+			}
+		}
+	} else {
+		index := map[string]int{}
+		for _, idx := range order {
+			if srcs[idx] == nil {
+				continue
+			}
+			for _, entry := range zuiEntries(srcs[idx]) {
+				score := weightedScore(entry.score, weights[idx])
+				if i, ok := index[string(entry.ele)]; ok {
+					zunionInterAggregate(&result[i].score, score, aggregate)
+					continue
+				}
+				index[string(entry.ele)] = len(result)
+				result = append(result, zsetEntry{ele: entry.ele, score: score})
+			}
+		}
+	}
+	storeZsetResult(client, dstkey, result)
+}
+
+// weightedScore score times weight, with 0 * inf counted as 0
+func weightedScore(score, weight float64) float64 {
+	value := score * weight
+	if math.IsNaN(value) {
+		value = 0
+	}
+	return value
+}
+
+func zunionstoreCommand(client *RedisClient) {
+	zunionInterGenericCommand(client, client.argv[1], 2, zsetOpUnion)
+}
+
+func zinterstoreCommand(client *RedisClient) {
+	zunionInterGenericCommand(client, client.argv[1], 2, zsetOpInter)
+}
+
+// zscanCommand ZSCAN key cursor [MATCH pattern] [COUNT count]
+func zscanCommand(client *RedisClient) {
+	cursor, ok := parseScanCursorOrReply(client, client.argv[2])
+	if !ok {
+		return
+	}
+	zobj := client.db.lookupKeyRead(client.argv[1])
+	if zobj == nil {
+		client.addReply(shared.emptyscan)
+		return
+	}
+	if !client.checkType(zobj, constant.REDIS_ZSET) {
+		return
+	}
+	scanGenericCommand(client, zobj, cursor)
+}